@@ -0,0 +1,532 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	severityWarning  = "warning"
+	severityCritical = "critical"
+)
+
+// exitWarning and exitCritical are the exit statuses when apps breach their
+// thresholds, as for Nagios plugins
+const (
+	exitWarning  = 1
+	exitCritical = 2
+)
+
+// thresholdLevels are the percentages of memory quota at which an app is
+// worth warning about, or is critical. Either may be left unset.
+type thresholdLevels struct {
+	WarnPercent percentFlag `json:"warn_percent"`
+	CritPercent percentFlag `json:"crit_percent"`
+}
+
+// thresholdConfig is when apps using a lot of their memory quota are
+// alerted on, from the "thresholds" section of a config file
+type thresholdConfig struct {
+	thresholdLevels
+
+	// Orgs overrides the levels for apps in particular orgs, by name, ie
+	// so that prod orgs can run hotter than dev. Levels not set for an org
+	// are taken from the defaults.
+	Orgs map[string]*thresholdLevels `json:"orgs"`
+
+	// Notify, if set, is a webhook to POST breaches to, ie a Slack incoming
+	// webhook. Breaches are always logged.
+	Notify string `json:"notify"`
+
+	// Maintenance windows suppress notifications for some or all orgs, ie
+	// during planned load tests. Usage is still collected and reported.
+	Maintenance []*maintenanceWindow `json:"maintenance"`
+
+	// For is how many crawls in a row an app must breach a threshold before
+	// it is notified, and ClearAfter how many it must be back under before
+	// it is resolved. Both default to 1.
+	For        int `json:"for"`
+	ClearAfter int `json:"clear_after"`
+
+	// Cooldown, if set, is the least time between an app's alert firing and
+	// firing again, ie "1h"
+	Cooldown duration `json:"cooldown"`
+
+	// Forecast, if set, also alerts on orgs projected to reach their memory
+	// quota soon, so that quotas can be raised before apps fail to scale
+	Forecast *forecastConfig `json:"forecast"`
+
+	// Annotations, if set, is a file of who owns orgs and apps and what to
+	// do when they breach, included in their alerts
+	Annotations string `json:"annotations"`
+	annotations map[string]*alertAnnotation
+
+	// states is the alert for each app breaching, or recently breaching,
+	// its thresholds, keyed by app
+	states map[string]*alertState
+}
+
+// alertAnnotation is who to contact about alerts for an org or app, and the
+// runbook to follow
+type alertAnnotation struct {
+	Owner      string `json:"owner"`
+	RunbookURL string `json:"runbook_url"`
+}
+
+// maintenanceWindow is a recurring or one-off period during which breaches
+// are not notified
+type maintenanceWindow struct {
+	// Orgs the window applies to, by name, or every org if empty
+	Orgs []string `json:"orgs"`
+
+	// Window, if set, is a recurring window as for --compare-window, ie
+	// "sat 02:00-06:00", evaluated in Timezone, which defaults to local time
+	Window   string `json:"window"`
+	Timezone string `json:"timezone"`
+
+	// From and Until, if set, are a one-off window, ie "2018-06-01T20:00:00+10:00"
+	From  time.Time `json:"from"`
+	Until time.Time `json:"until"`
+
+	window *timeWindow
+	loc    *time.Location
+}
+
+// validate parses the window
+func (mw *maintenanceWindow) validate() error {
+	if mw.Window == "" && mw.From.IsZero() && mw.Until.IsZero() {
+		return errors.New("maintenance needs a window, or from and until")
+	}
+	if mw.From.IsZero() != mw.Until.IsZero() {
+		return errors.New("maintenance needs both from and until")
+	}
+	if !mw.From.IsZero() && !mw.Until.After(mw.From) {
+		return errors.New("maintenance until must be after from")
+	}
+	if mw.Window != "" {
+		var err error
+		mw.window, err = parseWindow(mw.Window)
+		if err != nil {
+			return err
+		}
+		if mw.Timezone == "" {
+			mw.Timezone = "Local"
+		}
+		mw.loc, err = time.LoadLocation(mw.Timezone)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// active returns true if the window applies to org at t. A window with
+// both a recurring window and from and until is only active when both are.
+func (mw *maintenanceWindow) active(org string, t time.Time) bool {
+	if len(mw.Orgs) != 0 {
+		found := false
+		for _, o := range mw.Orgs {
+			if o == org {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if !mw.From.IsZero() && (t.Before(mw.From) || !t.Before(mw.Until)) {
+		return false
+	}
+	if mw.window != nil && !mw.window.Contains(t.In(mw.loc)) {
+		return false
+	}
+	return true
+}
+
+const (
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+// alertState is what is known about the alert for an app across crawls
+type alertState struct {
+	// breaches and clears count the crawls in a row the app has been over,
+	// or under, its thresholds
+	breaches, clears int
+
+	// firing is the breach last notified, or nil if the alert isn't firing
+	firing  *breach
+	firedAt time.Time
+}
+
+// alertEvent is an alert that started firing, changed severity, or resolved
+type alertEvent struct {
+	Status string
+	*breach
+}
+
+func (ae *alertEvent) String() string {
+	var s string
+	switch {
+	case ae.Status == alertResolved && ae.Limit != 0:
+		s = fmt.Sprintf("resolved: /%s is no longer projected to reach its %s memory quota", ae.Key, toHumanSize(ae.Limit))
+	case ae.Status == alertResolved:
+		s = fmt.Sprintf("resolved: /%s is back under its %g%% %s threshold", ae.Key, ae.Threshold, ae.Severity)
+	default:
+		s = ae.breach.String()
+	}
+	var notes []string
+	if ae.Owner != "" {
+		notes = append(notes, "owner: "+ae.Owner)
+	}
+	if ae.RunbookURL != "" {
+		notes = append(notes, "runbook: "+ae.RunbookURL)
+	}
+	if len(notes) != 0 {
+		s += " (" + strings.Join(notes, ", ") + ")"
+	}
+	return s
+}
+
+// breach is an app over one of its thresholds, or an org at or projected
+// to reach its quota, in which case Limit is the quota and Percent the
+// share of it allocated
+type breach struct {
+	Key       string
+	Severity  string
+	Percent   float64
+	Threshold float64
+
+	Limit     int        `json:",omitempty"`
+	ReachesAt *time.Time `json:",omitempty"`
+
+	// Owner and RunbookURL are from the annotations file, if any
+	Owner      string `json:",omitempty"`
+	RunbookURL string `json:",omitempty"`
+}
+
+// org returns the name of the org the app is in, or "" for the installation
+func (b *breach) org() string {
+	if idx := strings.Index(b.Key, "/"); idx != -1 {
+		return b.Key[:idx]
+	}
+	return b.Key
+}
+
+func (b *breach) String() string {
+	if b.Limit != 0 && b.Severity == severityCritical {
+		return fmt.Sprintf("%s: /%s has allocated %.0f%% of its %s memory quota, so apps can't be scaled up", b.Severity, b.Key, b.Percent, toHumanSize(b.Limit))
+	}
+	if b.Limit != 0 {
+		return fmt.Sprintf("%s: /%s has allocated %.0f%% of its %s memory quota, and is projected to reach it by %s", b.Severity, b.Key, b.Percent, toHumanSize(b.Limit), b.ReachesAt.Format("2006-01-02 15:04"))
+	}
+	return fmt.Sprintf("%s: /%s is using %.0f%% of its memory quota, over the %g%% threshold", b.Severity, b.Key, b.Percent, b.Threshold)
+}
+
+// validate checks that no warning level is above its critical level,
+// parses the maintenance windows and reads the annotations file
+func (tc *thresholdConfig) validate() error {
+	var orgs []string
+	for org := range tc.Orgs {
+		orgs = append(orgs, org)
+	}
+	sort.Strings(orgs)
+	for _, org := range append([]string{""}, orgs...) {
+		l := tc.levels(org)
+		if l.WarnPercent.Given && l.CritPercent.Given && l.WarnPercent.Value > l.CritPercent.Value {
+			if org == "" {
+				return errors.New("warn_percent must not be above crit_percent")
+			}
+			return fmt.Errorf("org %s: warn_percent must not be above crit_percent", org)
+		}
+	}
+	if tc.For < 0 || tc.ClearAfter < 0 || tc.Cooldown < 0 {
+		return errors.New("for, clear_after and cooldown must not be negative")
+	}
+	for i, mw := range tc.Maintenance {
+		err := mw.validate()
+		if err != nil {
+			return fmt.Errorf("maintenance %d: %s", i, err)
+		}
+	}
+	if tc.Forecast != nil {
+		err := tc.Forecast.validate()
+		if err != nil {
+			return fmt.Errorf("forecast: %s", err)
+		}
+	}
+	if tc.Annotations != "" {
+		tc.annotations = nil
+		err := readJSONFile(tc.Annotations, &tc.annotations)
+		if err != nil {
+			return fmt.Errorf("annotations: %s", err)
+		}
+	}
+	return nil
+}
+
+// annotation returns the annotation for the most specific of key and the
+// org, space and app it is in that has one, or else the "*" annotation, or
+// nil if there is none
+func (tc *thresholdConfig) annotation(key string) *alertAnnotation {
+	for k := key; k != ""; {
+		if a, ok := tc.annotations[k]; ok {
+			return a
+		}
+		idx := strings.LastIndex(k, "/")
+		if idx == -1 {
+			break
+		}
+		k = k[:idx]
+	}
+	return tc.annotations["*"]
+}
+
+// inMaintenance returns true if any maintenance window applies to org at t
+func (tc *thresholdConfig) inMaintenance(org string, t time.Time) bool {
+	for _, mw := range tc.Maintenance {
+		if mw.active(org, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// levels returns the thresholds that apply to apps in org
+func (tc *thresholdConfig) levels(org string) thresholdLevels {
+	l := tc.thresholdLevels
+	if override, ok := tc.Orgs[org]; ok {
+		if override.WarnPercent.Given {
+			l.WarnPercent = override.WarnPercent
+		}
+		if override.CritPercent.Given {
+			l.CritPercent = override.CritPercent
+		}
+	}
+	return l
+}
+
+// check returns the apps in the report over their thresholds, and the
+// installation total if over the default thresholds, in key order
+func (tc *thresholdConfig) check(rep *usageReport) []*breach {
+	var rv []*breach
+	for _, row := range rep.Rows {
+		if (row.Level() != 3 && row.Key != "") || row.MemoryQuota == 0 {
+			continue
+		}
+		l := tc.levels((&breach{Key: row.Key}).org())
+		percent := float64(row.MemoryUsage) * 100 / float64(row.MemoryQuota)
+		switch {
+		case l.CritPercent.Given && percent >= l.CritPercent.Value:
+			rv = append(rv, &breach{Key: row.Key, Severity: severityCritical, Percent: percent, Threshold: l.CritPercent.Value})
+		case l.WarnPercent.Given && percent >= l.WarnPercent.Value:
+			rv = append(rv, &breach{Key: row.Key, Severity: severityWarning, Percent: percent, Threshold: l.WarnPercent.Value})
+		}
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		return rv[i].Key < rv[j].Key
+	})
+	return rv
+}
+
+// evaluate returns the breaches of check, and if forecasting, the orgs at
+// or projected to reach their quota, in key order, with their annotations
+func (tc *thresholdConfig) evaluate(rep *usageReport, now time.Time) ([]*breach, error) {
+	rv := tc.check(rep)
+	if tc.Forecast != nil {
+		orgs, err := tc.Forecast.check(rep, now)
+		if err != nil {
+			return nil, fmt.Errorf("forecasting quotas: %s", err)
+		}
+		rv = append(rv, orgs...)
+		sort.SliceStable(rv, func(i, j int) bool {
+			return rv[i].Key < rv[j].Key
+		})
+	}
+	for _, b := range rv {
+		if a := tc.annotation(b.Key); a != nil {
+			b.Owner, b.RunbookURL = a.Owner, a.RunbookURL
+		}
+	}
+	return rv, nil
+}
+
+// track updates the state of each app's alert with this crawl's breaches,
+// returning the alerts to notify. An app starts firing once it has breached
+// For crawls in a row, and resolves once it has been under its thresholds
+// ClearAfter crawls in a row. A firing alert is notified again only if its
+// severity changes, and an app's alert can't fire again within Cooldown of
+// last firing. Maintenance windows stop alerts firing, but not resolving.
+func (tc *thresholdConfig) track(breaches []*breach, now time.Time) []*alertEvent {
+	if tc.states == nil {
+		tc.states = make(map[string]*alertState)
+	}
+	need := func(n int) int {
+		if n < 1 {
+			return 1
+		}
+		return n
+	}
+
+	var rv []*alertEvent
+	breached := make(map[string]bool)
+	for _, b := range breaches {
+		breached[b.Key] = true
+		st, ok := tc.states[b.Key]
+		if !ok {
+			st = &alertState{}
+			tc.states[b.Key] = st
+		}
+		st.breaches++
+		st.clears = 0
+		switch {
+		case st.breaches < need(tc.For):
+		case st.firing != nil && st.firing.Severity == b.Severity:
+		case tc.inMaintenance(b.org(), now):
+		case st.firing == nil && !st.firedAt.IsZero() && now.Sub(st.firedAt) < time.Duration(tc.Cooldown):
+		default:
+			rv = append(rv, &alertEvent{Status: alertFiring, breach: b})
+			st.firing, st.firedAt = b, now
+		}
+	}
+
+	var keys []string
+	for key := range tc.states {
+		if !breached[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		st := tc.states[key]
+		st.breaches = 0
+		st.clears++
+		if st.firing != nil {
+			if st.clears < need(tc.ClearAfter) {
+				continue
+			}
+			// resolved even in maintenance, as the firing alert was notified
+			// and only new pages are suppressed
+			rv = append(rv, &alertEvent{Status: alertResolved, breach: st.firing})
+			st.firing = nil
+		}
+		// kept while cooling down, so that a flapping app doesn't fire again
+		if st.firedAt.IsZero() || now.Sub(st.firedAt) >= time.Duration(tc.Cooldown) {
+			delete(tc.states, key)
+		}
+	}
+
+	sort.SliceStable(rv, func(i, j int) bool {
+		return rv[i].Key < rv[j].Key
+	})
+	return rv
+}
+
+// notify logs each breach, and sends alerts that started firing or were
+// resolved to the Notify webhook, if set
+func (tc *thresholdConfig) notify(rep *usageReport, breaches []*breach, now time.Time) error {
+	for _, b := range breaches {
+		if tc.inMaintenance(b.org(), now) {
+			log.Printf("%s (not notified, in maintenance)", b)
+			continue
+		}
+		log.Print(b)
+	}
+	events := tc.track(breaches, now)
+	var lines []string
+	for _, e := range events {
+		if e.Status == alertResolved {
+			log.Print(e)
+		}
+		lines = append(lines, e.String())
+	}
+	if len(events) == 0 || tc.Notify == "" {
+		return nil
+	}
+
+	// "text" is what Slack and compatible webhooks display
+	body := &bytes.Buffer{}
+	err := json.NewEncoder(body).Encode(struct {
+		Text   string        `json:"text"`
+		RunID  string        `json:"run_id"`
+		Tag    string        `json:"tag,omitempty"`
+		Alerts []*alertEvent `json:"alerts"`
+	}{
+		Text:   strings.Join(lines, "\n"),
+		RunID:  rep.RunID,
+		Tag:    rep.Tag,
+		Alerts: events,
+	})
+	if err != nil {
+		return err
+	}
+	err = doSinkRequest(http.DefaultClient, http.MethodPost, tc.Notify, "application/json", "", rep.RunID, body)
+	if err != nil {
+		return fmt.Errorf("notifying %s: %s", tc.Notify, err)
+	}
+	return nil
+}
+
+// alertSink checks each report against thresholds, so that alerts are
+// raised wherever reports are written, ie with --watch or --listen
+type alertSink struct {
+	Thresholds *thresholdConfig
+
+	// worst is the highest severity breached in the last report, outside
+	// of maintenance windows
+	worst string
+}
+
+func (as *alertSink) Write(rep *usageReport) error {
+	now := time.Now()
+	breaches, err := as.Thresholds.evaluate(rep, now)
+	if err != nil {
+		return err
+	}
+	as.worst = ""
+	for _, b := range breaches {
+		if !as.Thresholds.inMaintenance(b.org(), now) && as.worst != severityCritical {
+			as.worst = b.Severity
+		}
+	}
+	return as.Thresholds.notify(rep, breaches, now)
+}
+
+// exitStatus returns exitCritical or exitWarning if the last report
+// breached a threshold, or 0 if not
+func (as *alertSink) exitStatus() int {
+	switch as.worst {
+	case severityCritical:
+		return exitCritical
+	case severityWarning:
+		return exitWarning
+	default:
+		return 0
+	}
+}
+
+func (as *alertSink) String() string {
+	return "thresholds"
+}
+
+// loadThresholds reads a file with the same form as the thresholds section
+// of a config file
+func loadThresholds(path string) (*thresholdConfig, error) {
+	tc := &thresholdConfig{}
+	err := readJSONFile(path, tc)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	err = tc.validate()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return tc, nil
+}
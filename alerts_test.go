@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrackResolvesDuringMaintenance(t *testing.T) {
+	start := time.Date(2018, 6, 1, 20, 0, 0, 0, time.UTC)
+	tc := &thresholdConfig{Maintenance: []*maintenanceWindow{{Orgs: []string{"o"}, From: start, Until: start.Add(3 * time.Hour)}}}
+	b := &breach{Key: "o/s/a", Severity: severityCritical, Percent: 99, Threshold: 95}
+
+	events := tc.track([]*breach{b}, start.Add(-time.Hour))
+	if len(events) != 1 || events[0].Status != alertFiring {
+		t.Fatalf("got %+v before the window, want the alert firing", events)
+	}
+	// breaching again in the window isn't notified, but clearing in it is
+	events = tc.track([]*breach{b}, start.Add(time.Hour))
+	if len(events) != 0 {
+		t.Errorf("got %+v, want nothing notified while still firing", events)
+	}
+	events = tc.track(nil, start.Add(2*time.Hour))
+	if len(events) != 1 || events[0].Status != alertResolved || events[0].Key != "o/s/a" {
+		t.Errorf("got %+v in the window, want the alert resolved", events)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/govau/cf-report-memory-usage/internal/cfclient"
+)
+
+const (
+	apiVersionAuto = "auto"
+	apiVersionV2   = "v2"
+	apiVersionV3   = "v3"
+)
+
+// cfAPI is what a report needs from the cloud controller. There is an
+// implementation for each API version, as /v2 is removed from newer versions
+// of CAPI, while older installations lack parts of /v3.
+type cfAPI interface {
+	// Orgs calls f for each org in scope
+	Orgs(scope reportScope, f func(*cfOrg) error) error
+
+	// Spaces calls f for each space in scope within org
+	Spaces(scope reportScope, org *cfOrg, f func(*cfSpace) error) error
+
+	// Apps calls f for each app in space
+	Apps(space *cfSpace, f func(*cfApp) error) error
+
+	// InstanceStats returns stats for each instance of a started app, keyed
+	// by instance. Web instances are keyed by index, as in the v2 API, and
+	// other process types by "type-index".
+	InstanceStats(app *cfApp) (map[string]*instanceStats, error)
+
+	// ServiceInstances calls f for each service instance in space
+	ServiceInstances(space *cfSpace, f func(*cfServiceInstance) error) error
+
+	// DetectedBuildpack returns the buildpack an app was staged with, for
+	// apps whose Buildpack wasn't known from listing them, or "" if it has
+	// never been staged
+	DetectedBuildpack(app *cfApp) (string, error)
+
+	// QuotaMemoryLimits returns the total memory that each org quota and
+	// space quota allows apps to be allocated, keyed by quota GUID, in
+	// bytes, or -1 if unlimited
+	QuotaMemoryLimits() (orgQuotas, spaceQuotas map[string]int, err error)
+
+	// Version returns the API version, ie "v3"
+	Version() string
+}
+
+// cfOrg is an organization
+type cfOrg struct {
+	GUID string
+	Name string
+
+	// spacesURL is used by the v2 API
+	spacesURL string
+
+	// quotaGUID is the org's quota, or quota definition in v2 terms
+	quotaGUID string
+
+	// Labels are the org's metadata labels, with the v3 API only
+	Labels map[string]string
+}
+
+// cfSpace is a space
+type cfSpace struct {
+	GUID string
+	Name string
+
+	// appsURL is used by the v2 API
+	appsURL string
+
+	// quotaGUID is the space's quota, or "" if it has none of its own
+	quotaGUID string
+
+	// Labels are the space's metadata labels, with the v3 API only
+	Labels map[string]string
+}
+
+// cfApp is an app, and in v2 terms its web process
+type cfApp struct {
+	GUID  string
+	Name  string
+	State string
+
+	// Buildpack is the buildpack the app was staged with, several joined
+	// with "+", or "docker" for docker images. It is "" if not known from
+	// listing the app, in which case DetectedBuildpack returns it.
+	Buildpack string
+
+	// Stack is the name of the stack the app runs on, or "" for docker
+	// images
+	Stack string
+
+	// Labels are the app's metadata labels, with the v3 API only
+	Labels map[string]string
+
+	// url is used by the v2 API
+	url string
+}
+
+// cfServiceInstance is a service instance, with any annotations set on it
+// by its broker or an operator
+type cfServiceInstance struct {
+	GUID        string
+	Name        string
+	Annotations map[string]string
+}
+
+// instanceStats are the stats of a single app instance, in bytes
+type instanceStats struct {
+	State       string
+	MemoryUsage int
+	MemoryQuota int
+	DiskUsage   int
+	DiskQuota   int
+
+	// Host is the address of the Diego cell the instance runs on, if placed
+	Host string
+}
+
+// newCFAPI returns the API implementation to use. If version is "auto", v3
+// is used if the cloud controller advertises it, otherwise v2.
+func newCFAPI(client cfclient.API, version string) (cfAPI, error) {
+	switch version {
+	case apiVersionV2:
+		return &cfAPIv2{client: client}, nil
+	case apiVersionV3:
+		return &cfAPIv3{client: client}, nil
+	case apiVersionAuto:
+		var root struct {
+			Links struct {
+				V3 *struct {
+					Href string `json:"href"`
+				} `json:"cloud_controller_v3"`
+			} `json:"links"`
+		}
+		err := client.Get("/", &root)
+		if err != nil {
+			return nil, err
+		}
+		if root.Links.V3 != nil && root.Links.V3.Href != "" {
+			return &cfAPIv3{client: client}, nil
+		}
+		return &cfAPIv2{client: client}, nil
+	default:
+		return nil, fmt.Errorf("unknown API version: %s", version)
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"github.com/govau/cf-report-memory-usage/internal/cfclient"
+	"github.com/govau/cf-report-memory-usage/report"
+)
+
+// reportError describes err, which left key out of the report, for the
+// report's errors section
+func reportError(key string, err error) *report.Error {
+	ae, ok := err.(*cfclient.APIError)
+	if !ok {
+		return &report.Error{Key: key, Description: err.Error()}
+	}
+	return &report.Error{
+		Key:         key,
+		URL:         ae.URL,
+		StatusCode:  ae.StatusCode,
+		Code:        ae.Code,
+		Description: ae.Description,
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"log"
+
+	"github.com/govau/cf-report-memory-usage/internal/cfclient"
+)
+
+// cfAPIv2 implements cfAPI using the /v2 endpoints
+type cfAPIv2 struct {
+	client cfclient.API
+
+	// stacks are the names of stacks by GUID, listed with the first apps,
+	// as v2 apps only have their stack's GUID
+	stacks map[string]string
+}
+
+type appStats map[string]*struct {
+	State string `json:"state"`
+	Stats struct {
+		Host      string `json:"host"`
+		DiskQuota int    `json:"disk_quota"`
+		MemQuota  int    `json:"mem_quota"`
+		Usage     struct {
+			Disk int `json:"disk"`
+			Mem  int `json:"mem"`
+		} `json:"usage"`
+	} `json:"stats"`
+}
+
+func (api *cfAPIv2) Version() string {
+	return apiVersionV2
+}
+
+func (api *cfAPIv2) Orgs(scope reportScope, f func(*cfOrg) error) error {
+	cb := func(org *resource) error {
+		return f(&cfOrg{
+			GUID:      org.Metadata.GUID,
+			Name:      org.Entity.Name,
+			spacesURL: org.Entity.SpacesURL,
+			quotaGUID: org.Entity.QuotaGUID,
+		})
+	}
+	if scope.OrgGUID == "" {
+		return api.client.List("/v2/organizations", cb)
+	}
+	var org resource
+	err := api.client.Get("/v2/organizations/"+scope.OrgGUID, &org)
+	if err != nil {
+		return err
+	}
+	return cb(&org)
+}
+
+func (api *cfAPIv2) Spaces(scope reportScope, org *cfOrg, f func(*cfSpace) error) error {
+	cb := func(space *resource) error {
+		return f(&cfSpace{
+			GUID:      space.Metadata.GUID,
+			Name:      space.Entity.Name,
+			appsURL:   space.Entity.AppsURL,
+			quotaGUID: space.Entity.SpaceQuotaGUID,
+		})
+	}
+	if scope.SpaceGUID == "" {
+		return api.client.List(org.spacesURL, cb)
+	}
+	var space resource
+	err := api.client.Get("/v2/spaces/"+scope.SpaceGUID, &space)
+	if err != nil {
+		return err
+	}
+	return cb(&space)
+}
+
+func (api *cfAPIv2) Apps(space *cfSpace, f func(*cfApp) error) error {
+	if api.stacks == nil {
+		api.stacks = make(map[string]string)
+		err := api.client.List("/v2/stacks", func(stack *resource) error {
+			api.stacks[stack.Metadata.GUID] = stack.Entity.Name
+			return nil
+		})
+		if err != nil {
+			// only needed to total by stack, which lists it as unknown
+			log.Printf("warning: unable to list stacks: %s", err)
+		}
+	}
+	return api.client.List(space.appsURL, func(app *resource) error {
+		buildpack, stack := app.Entity.Buildpack, api.stacks[app.Entity.StackGUID]
+		switch {
+		case app.Entity.DockerImage != "":
+			// as in v3, docker images have no stack
+			buildpack, stack = "docker", ""
+		case buildpack == "":
+			buildpack = app.Entity.DetectedBuildpack
+		}
+		return f(&cfApp{
+			GUID:      app.Metadata.GUID,
+			Name:      app.Entity.Name,
+			State:     app.Entity.State,
+			Buildpack: buildpack,
+			Stack:     stack,
+			url:       app.Metadata.URL,
+		})
+	})
+}
+
+// DetectedBuildpack returns "", as v2 apps are listed with their detected
+// buildpack
+func (api *cfAPIv2) DetectedBuildpack(app *cfApp) (string, error) {
+	return "", nil
+}
+
+func (api *cfAPIv2) ServiceInstances(space *cfSpace, f func(*cfServiceInstance) error) error {
+	return errServicesNeedV3
+}
+
+func (api *cfAPIv2) QuotaMemoryLimits() (map[string]int, map[string]int, error) {
+	limits := func(r string) (map[string]int, error) {
+		rv := make(map[string]int)
+		err := api.client.List(r, func(quota *resource) error {
+			rv[quota.Metadata.GUID] = -1
+			if quota.Entity.MemoryLimit >= 0 {
+				rv[quota.Metadata.GUID] = quota.Entity.MemoryLimit * 1024 * 1024
+			}
+			return nil
+		})
+		return rv, err
+	}
+	orgQuotas, err := limits("/v2/quota_definitions")
+	if err != nil {
+		return nil, nil, err
+	}
+	spaceQuotas, err := limits("/v2/space_quota_definitions")
+	if err != nil {
+		return nil, nil, err
+	}
+	return orgQuotas, spaceQuotas, nil
+}
+
+func (api *cfAPIv2) InstanceStats(app *cfApp) (map[string]*instanceStats, error) {
+	var stats appStats
+	err := api.client.Get(app.url+"/stats", &stats)
+	if err != nil {
+		return nil, err
+	}
+	rv := make(map[string]*instanceStats)
+	for instanceIdx, instanceStat := range stats {
+		rv[instanceIdx] = &instanceStats{
+			State:       instanceStat.State,
+			MemoryUsage: instanceStat.Stats.Usage.Mem,
+			MemoryQuota: instanceStat.Stats.MemQuota,
+			DiskUsage:   instanceStat.Stats.Usage.Disk,
+			DiskQuota:   instanceStat.Stats.DiskQuota,
+			Host:        instanceStat.Stats.Host,
+		}
+	}
+	return rv, nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/govau/cf-report-memory-usage/internal/cfclient"
+)
+
+// cfAPIv3 implements cfAPI using the /v3 endpoints
+type cfAPIv3 struct {
+	client cfclient.API
+}
+
+// v3Resource captures the fields we care about from /v3 resources
+type v3Resource struct {
+	GUID  string `json:"guid"`
+	Name  string `json:"name"`  // org, space, app
+	State string `json:"state"` // app
+	Type  string `json:"type"`  // process
+
+	Instances int `json:"instances"` // process
+
+	Lifecycle struct {
+		Type string `json:"type"`
+		Data struct {
+			Buildpacks []string `json:"buildpacks"`
+			Stack      string   `json:"stack"`
+		} `json:"data"`
+	} `json:"lifecycle"` // app
+
+	Metadata struct {
+		Labels      map[string]string `json:"labels"`      // org, space, app
+		Annotations map[string]string `json:"annotations"` // service instance
+	} `json:"metadata"`
+
+	Apps struct {
+		TotalMemory *int `json:"total_memory_in_mb"` // null if unlimited
+	} `json:"apps"` // quota
+
+	Relationships struct {
+		Quota struct {
+			Data struct {
+				GUID string `json:"guid"`
+			} `json:"data"`
+		} `json:"quota"`
+	} `json:"relationships"` // org, space
+}
+
+// list calls f with each resource of a paginated list
+func (api *cfAPIv3) list(r string, f func(*v3Resource) error) error {
+	return api.client.ListV3(r, func(raw json.RawMessage) error {
+		var rr v3Resource
+		err := json.Unmarshal(raw, &rr)
+		if err != nil {
+			return err
+		}
+		return f(&rr)
+	})
+}
+
+func (api *cfAPIv3) Version() string {
+	return apiVersionV3
+}
+
+func (api *cfAPIv3) Orgs(scope reportScope, f func(*cfOrg) error) error {
+	cb := func(org *v3Resource) error {
+		return f(&cfOrg{GUID: org.GUID, Name: org.Name, quotaGUID: org.Relationships.Quota.Data.GUID, Labels: org.Metadata.Labels})
+	}
+	if scope.OrgGUID == "" {
+		return api.list("/v3/organizations", cb)
+	}
+	var org v3Resource
+	err := api.client.Get("/v3/organizations/"+url.PathEscape(scope.OrgGUID), &org)
+	if err != nil {
+		return err
+	}
+	return cb(&org)
+}
+
+func (api *cfAPIv3) Spaces(scope reportScope, org *cfOrg, f func(*cfSpace) error) error {
+	cb := func(space *v3Resource) error {
+		return f(&cfSpace{GUID: space.GUID, Name: space.Name, quotaGUID: space.Relationships.Quota.Data.GUID, Labels: space.Metadata.Labels})
+	}
+	if scope.SpaceGUID == "" {
+		return api.list("/v3/spaces?organization_guids="+url.QueryEscape(org.GUID), cb)
+	}
+	var space v3Resource
+	err := api.client.Get("/v3/spaces/"+url.PathEscape(scope.SpaceGUID), &space)
+	if err != nil {
+		return err
+	}
+	return cb(&space)
+}
+
+func (api *cfAPIv3) Apps(space *cfSpace, f func(*cfApp) error) error {
+	return api.list("/v3/apps?space_guids="+url.QueryEscape(space.GUID), func(app *v3Resource) error {
+		buildpack := strings.Join(app.Lifecycle.Data.Buildpacks, "+")
+		if app.Lifecycle.Type == "docker" {
+			buildpack = "docker"
+		}
+		return f(&cfApp{GUID: app.GUID, Name: app.Name, State: app.State, Buildpack: buildpack, Stack: app.Lifecycle.Data.Stack, Labels: app.Metadata.Labels})
+	})
+}
+
+// DetectedBuildpack reads the buildpacks of the app's current droplet, as
+// apps only list their buildpacks if they were given when pushed
+func (api *cfAPIv3) DetectedBuildpack(app *cfApp) (string, error) {
+	var droplet struct {
+		Buildpacks []struct {
+			Name          string `json:"name"`
+			BuildpackName string `json:"buildpack_name"`
+		} `json:"buildpacks"`
+	}
+	err := api.client.Get("/v3/apps/"+url.PathEscape(app.GUID)+"/droplets/current", &droplet)
+	if cfclient.IsStatus(err, http.StatusNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var names []string
+	for _, bp := range droplet.Buildpacks {
+		name := bp.Name
+		if name == "" {
+			name = bp.BuildpackName
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, "+"), nil
+}
+
+func (api *cfAPIv3) ServiceInstances(space *cfSpace, f func(*cfServiceInstance) error) error {
+	return api.list("/v3/service_instances?space_guids="+url.QueryEscape(space.GUID), func(si *v3Resource) error {
+		return f(&cfServiceInstance{GUID: si.GUID, Name: si.Name, Annotations: si.Metadata.Annotations})
+	})
+}
+
+func (api *cfAPIv3) QuotaMemoryLimits() (map[string]int, map[string]int, error) {
+	limits := func(r string) (map[string]int, error) {
+		rv := make(map[string]int)
+		err := api.list(r, func(quota *v3Resource) error {
+			rv[quota.GUID] = -1
+			if quota.Apps.TotalMemory != nil {
+				rv[quota.GUID] = *quota.Apps.TotalMemory * 1024 * 1024
+			}
+			return nil
+		})
+		return rv, err
+	}
+	orgQuotas, err := limits("/v3/organization_quotas")
+	if err != nil {
+		return nil, nil, err
+	}
+	spaceQuotas, err := limits("/v3/space_quotas")
+	if err != nil {
+		return nil, nil, err
+	}
+	return orgQuotas, spaceQuotas, nil
+}
+
+func (api *cfAPIv3) InstanceStats(app *cfApp) (map[string]*instanceStats, error) {
+	rv := make(map[string]*instanceStats)
+	err := api.list("/v3/apps/"+url.PathEscape(app.GUID)+"/processes", func(process *v3Resource) error {
+		if process.Instances == 0 {
+			return nil
+		}
+
+		var stats struct {
+			Resources []struct {
+				Type      string `json:"type"`
+				Index     int    `json:"index"`
+				State     string `json:"state"`
+				Host      string `json:"host"`
+				MemQuota  int    `json:"mem_quota"`
+				DiskQuota int    `json:"disk_quota"`
+				Usage     struct {
+					Mem  int `json:"mem"`
+					Disk int `json:"disk"`
+				} `json:"usage"`
+			} `json:"resources"`
+		}
+		err := api.client.Get("/v3/processes/"+url.PathEscape(process.GUID)+"/stats", &stats)
+		if err != nil {
+			return err
+		}
+		for _, s := range stats.Resources {
+			typ := s.Type
+			if typ == "" {
+				typ = process.Type
+			}
+			key := fmt.Sprintf("%d", s.Index)
+			if typ != "web" {
+				key = fmt.Sprintf("%s-%d", typ, s.Index)
+			}
+			rv[key] = &instanceStats{
+				State:       s.State,
+				MemoryUsage: s.Usage.Mem,
+				MemoryQuota: s.MemQuota,
+				DiskUsage:   s.Usage.Disk,
+				DiskQuota:   s.DiskQuota,
+				Host:        s.Host,
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/govau/cf-report-memory-usage/report"
+)
+
+// auditLine is a line of an audit object: an instance row, with when the
+// run it is from started
+type auditLine struct {
+	*report.Row
+	RunTime time.Time
+}
+
+// auditSink PUTs the instance rows of each report, one JSON object per line,
+// to their own object in an S3-compatible bucket, partitioned by the date of
+// the run, ie https://s3.ap-southeast-2.amazonaws.com/bucket/prefix/2024/01/01/
+// 20240101T020000Z-RUNID.jsonl. It is a raw, append-only record of every
+// sample, for processing independently of our aggregates, so objects are
+// only created, never replaced: a retried delivery of a run that was
+// already written is left as it is.
+type auditSink struct {
+	URL        string
+	Client     *http.Client
+	Encrypter  *reportEncrypter
+	Compressor *reportCompressor
+}
+
+// auditObjectPath returns the path within the bucket of the audit object
+// for rep, relative to the sink's URL
+func auditObjectPath(rep *usageReport) string {
+	t := rep.Time.UTC()
+	return t.Format("2006/01/02/") + t.Format(sampleTimeFormat) + "-" + rep.RunID + ".jsonl"
+}
+
+func (as *auditSink) Write(rep *usageReport) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, row := range rep.Rows {
+		if row.Level() != 4 {
+			continue
+		}
+		err := enc.Encode(&auditLine{Row: row, RunTime: rep.Time})
+		if err != nil {
+			return err
+		}
+	}
+	up, err := encodeUpload(buf.Bytes(), "application/x-ndjson", as.Compressor, as.Encrypter)
+	if err != nil {
+		return err
+	}
+
+	name := auditObjectPath(rep) + up.Suffix
+	req, err := newSinkRequest(http.MethodPut, strings.TrimSuffix(as.URL, "/")+"/"+name, up.ContentType, up.Encoding, rep.RunID, bytes.NewReader(up.Data))
+	if err != nil {
+		return err
+	}
+	// only create the object, so that the record can't be rewritten
+	req.Header.Set("If-None-Match", "*")
+	err = signS3Request(req, up.Data, time.Now())
+	if err != nil {
+		return err
+	}
+
+	resp, err := as.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusPreconditionFailed:
+		// already written by an earlier delivery of the same run
+		return nil
+	default:
+		return fmt.Errorf("bad status code: %d", resp.StatusCode)
+	}
+}
+
+func (as *auditSink) String() string {
+	return "audit:" + as.URL
+}
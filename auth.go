@@ -0,0 +1,439 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/cli/plugin"
+
+	"github.com/govau/cf-report-memory-usage/internal/cfclient"
+)
+
+const (
+	authCF                = "cf"
+	authPassword          = "password"
+	authClientCredentials = "client-credentials"
+	authToken             = "token"
+	authTokenFile         = "token-file"
+	authOIDC              = "oidc"
+)
+
+// environment variables that secrets are read from, so that they don't
+// appear in process listings or shell history
+const (
+	envUsername     = "CF_USERNAME"
+	envPassword     = "CF_PASSWORD"
+	envClientSecret = "CF_CLIENT_SECRET"
+	envAccessToken  = "CF_ACCESS_TOKEN"
+)
+
+// environment variables that the connection flags default to, so that a
+// container can be configured without a command line
+const (
+	envAuth              = "CF_AUTH"
+	envAPI               = "CF_API"
+	envUAA               = "CF_UAA"
+	envClientID          = "CF_CLIENT_ID"
+	envTokenFile         = "CF_TOKEN_FILE"
+	envSkipSSLValidation = "CF_SKIP_SSL_VALIDATION"
+)
+
+// tokenEarlyRefresh is how long before it expires a cached token is replaced
+const tokenEarlyRefresh = time.Minute
+
+// tokenProvider supplies the access tokens that requests are made with
+type tokenProvider interface {
+	// Token returns an Authorization header value, ie "bearer eyXXXXX". If
+	// renew is set the last token was rejected, so a cached token mustn't
+	// be returned.
+	Token(renew bool) (string, error)
+
+	// String describes the provider for progress messages
+	String() string
+}
+
+// cliTokens are the tokens of the user logged in to the cf CLI, which the
+// CLI refreshes as needed
+type cliTokens struct {
+	conn plugin.CliConnection
+}
+
+func (ct *cliTokens) Token(renew bool) (string, error) {
+	return ct.conn.AccessToken()
+}
+
+func (ct *cliTokens) String() string {
+	return "cf CLI login"
+}
+
+// fileTokens reads the token from a file on every request for one, so that
+// the file can be rotated underneath a long running server, ie by a sidecar
+type fileTokens struct {
+	Path string
+}
+
+func (ft *fileTokens) Token(renew bool) (string, error) {
+	b, err := ioutil.ReadFile(ft.Path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", fmt.Errorf("%s is empty", ft.Path)
+	}
+	if !strings.HasPrefix(strings.ToLower(token), "bearer ") {
+		token = "bearer " + token
+	}
+	return token, nil
+}
+
+func (ft *fileTokens) String() string {
+	return "token file " + ft.Path
+}
+
+// envTokens is a fixed token from the environment. It can't be renewed, so
+// crawls fail once it expires.
+type envTokens struct{}
+
+func (et *envTokens) Token(renew bool) (string, error) {
+	token := strings.TrimSpace(os.Getenv(envAccessToken))
+	if token == "" {
+		return "", fmt.Errorf("%s is empty", envAccessToken)
+	}
+	if renew {
+		return "", fmt.Errorf("%s was rejected, and can't be refreshed", envAccessToken)
+	}
+	if !strings.HasPrefix(strings.ToLower(token), "bearer ") {
+		token = "bearer " + token
+	}
+	return token, nil
+}
+
+func (et *envTokens) String() string {
+	return envAccessToken
+}
+
+// uaaTokens fetches tokens from UAA with an OAuth grant, caching each until
+// shortly before it expires
+type uaaTokens struct {
+	// TokenURL is UAA's token endpoint, ie "https://uaa.system.example.com/oauth/token"
+	TokenURL string
+
+	ClientID     string
+	ClientSecret string
+
+	// Grant returns the grant specific form values, ie the grant_type and
+	// credentials. It is called for every token, so that assertions read
+	// from files can be rotated.
+	Grant func() (url.Values, error)
+
+	// Description is what String returns
+	Description string
+
+	Client *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (ut *uaaTokens) Token(renew bool) (string, error) {
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+	if !renew && ut.token != "" && time.Now().Before(ut.expires.Add(-tokenEarlyRefresh)) {
+		return ut.token, nil
+	}
+
+	form, err := ut.Grant()
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodPost, ut.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(ut.ClientID), url.QueryEscape(ut.ClientSecret))
+	resp, err := ut.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unable to get a token: %s", cfclient.ParseAPIError(resp))
+	}
+
+	var res struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return "", err
+	}
+	if res.AccessToken == "" {
+		return "", fmt.Errorf("unable to get a token from %s: no access token in response", ut.TokenURL)
+	}
+	if res.TokenType == "" {
+		res.TokenType = "bearer"
+	}
+	ut.token = res.TokenType + " " + res.AccessToken
+	ut.expires = time.Now().Add(time.Duration(res.ExpiresIn) * time.Second)
+	return ut.token, nil
+}
+
+func (ut *uaaTokens) String() string {
+	return ut.Description
+}
+
+// defaultRequestTimeout is how long a request may take by default, long
+// enough for the slowest cloud controller listings
+const defaultRequestTimeout = time.Minute
+
+// authOptions are how to find the API and authenticate to it
+type authOptions struct {
+	// Provider is "cf" (the default as a plugin), "password",
+	// "client-credentials", "token", "token-file" or "oidc"
+	Provider string
+
+	// API is the cloud controller URL. It defaults to the cf CLI's target.
+	API string
+
+	// UAA, if set, is the UAA URL, otherwise it is discovered from the API
+	UAA string
+
+	// ClientID is the UAA client for password, client credentials and OIDC
+	// grants. Password grants default to the cf CLI's own client.
+	ClientID string
+
+	// TokenFile is the access token for "token-file", or the OIDC ID token
+	// exchanged for an access token for "oidc"
+	TokenFile string
+
+	// SkipSSLValidation disables TLS validation, as the cf CLI's setting
+	// does when authenticating with the cf CLI
+	SkipSSLValidation bool
+
+	// RequestTimeout is how long each request, including for tokens, may
+	// take before it is abandoned, and retried as a network error would be
+	RequestTimeout time.Duration
+}
+
+// defaultAuthOptions returns the options from the environment, which flags
+// then override. Run standalone, without the cf CLI, the provider defaults
+// to whichever credentials are in the environment.
+func defaultAuthOptions(standalone bool) authOptions {
+	ao := authOptions{
+		Provider:  os.Getenv(envAuth),
+		API:       os.Getenv(envAPI),
+		UAA:       os.Getenv(envUAA),
+		ClientID:  os.Getenv(envClientID),
+		TokenFile: os.Getenv(envTokenFile),
+	}
+	ao.SkipSSLValidation, _ = strconv.ParseBool(os.Getenv(envSkipSSLValidation))
+	if ao.Provider != "" {
+		return ao
+	}
+	switch {
+	case !standalone:
+		ao.Provider = authCF
+	case os.Getenv(envAccessToken) != "":
+		ao.Provider = authToken
+	case ao.TokenFile != "":
+		ao.Provider = authTokenFile
+	case ao.ClientID != "" && os.Getenv(envClientSecret) != "":
+		ao.Provider = authClientCredentials
+	case os.Getenv(envUsername) != "":
+		ao.Provider = authPassword
+	}
+	return ao
+}
+
+// connect returns a client for the API, authenticated as per ao. If
+// cliConnection is nil, it is being run standalone rather than as a plugin.
+func (ao *authOptions) connect(cliConnection plugin.CliConnection, quiet bool) (*simpleClient, error) {
+	if ao.Provider == "" {
+		return nil, fmt.Errorf("not run by the cf CLI, so set %s and either %s, %s and %s, or %s and %s, or use --auth", envAPI, envAccessToken, envClientID, envClientSecret, envUsername, envPassword)
+	}
+	if ao.Provider == authCF && cliConnection == nil {
+		return nil, errors.New("not run by the cf CLI, so can't use its login, use another --auth")
+	}
+	api, skipSSL := ao.API, ao.SkipSSLValidation
+	if ao.Provider == authCF {
+		var err error
+		if api == "" {
+			api, err = cliConnection.ApiEndpoint()
+			if err != nil {
+				return nil, err
+			}
+		}
+		disabled, err := cliConnection.IsSSLDisabled()
+		if err != nil {
+			return nil, err
+		}
+		skipSSL = skipSSL || disabled
+	}
+	if api == "" {
+		return nil, fmt.Errorf("--api is needed with --auth %s", ao.Provider)
+	}
+	api = strings.TrimSuffix(api, "/")
+
+	httpClient := &http.Client{Timeout: ao.RequestTimeout}
+	if skipSSL {
+		if !quiet {
+			log.Println("warning: skipping TLS validation...")
+		}
+
+		httpClient.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+		}
+	}
+
+	tokens, err := ao.tokens(cliConnection, api, httpClient)
+	if err != nil {
+		return nil, err
+	}
+	at, err := tokens.Token(false)
+	if err != nil {
+		return nil, err
+	}
+	if !quiet && ao.Provider != authCF {
+		log.Printf("authenticated with %s", tokens)
+	}
+
+	return &simpleClient{
+		API:           api,
+		Authorization: at,
+		Refresh: func() (string, error) {
+			return tokens.Token(true)
+		},
+		Quiet:  quiet,
+		Client: httpClient,
+	}, nil
+}
+
+// tokens returns the token provider for ao
+func (ao *authOptions) tokens(cliConnection plugin.CliConnection, api string, httpClient *http.Client) (tokenProvider, error) {
+	switch ao.Provider {
+	case authCF:
+		return &cliTokens{conn: cliConnection}, nil
+	case authToken:
+		if os.Getenv(envAccessToken) == "" {
+			return nil, fmt.Errorf("%s is needed with --auth token", envAccessToken)
+		}
+		return &envTokens{}, nil
+	case authTokenFile:
+		if ao.TokenFile == "" {
+			return nil, errors.New("--token-file is needed with --auth token-file")
+		}
+		return &fileTokens{Path: ao.TokenFile}, nil
+	case authPassword, authClientCredentials, authOIDC:
+		// handled below
+	default:
+		return nil, fmt.Errorf("unknown auth provider, expected cf, password, client-credentials, token, token-file or oidc: %s", ao.Provider)
+	}
+
+	uaa := ao.UAA
+	if uaa == "" {
+		var err error
+		uaa, err = discoverUAA(httpClient, api)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ut := &uaaTokens{
+		TokenURL:     strings.TrimSuffix(uaa, "/") + "/oauth/token",
+		ClientID:     ao.ClientID,
+		ClientSecret: os.Getenv(envClientSecret),
+		Client:       httpClient,
+	}
+
+	switch ao.Provider {
+	case authPassword:
+		username, password := os.Getenv(envUsername), os.Getenv(envPassword)
+		if username == "" || password == "" {
+			return nil, fmt.Errorf("%s and %s are needed with --auth password", envUsername, envPassword)
+		}
+		if ut.ClientID == "" {
+			// the cf CLI's own client, which has no secret
+			ut.ClientID = "cf"
+		}
+		ut.Description = "password grant for " + username
+		ut.Grant = func() (url.Values, error) {
+			return url.Values{
+				"grant_type": {"password"},
+				"username":   {username},
+				"password":   {password},
+			}, nil
+		}
+	case authClientCredentials:
+		if ut.ClientID == "" || ut.ClientSecret == "" {
+			return nil, fmt.Errorf("--client-id and %s are needed with --auth client-credentials", envClientSecret)
+		}
+		ut.Description = "client credentials for " + ut.ClientID
+		ut.Grant = func() (url.Values, error) {
+			return url.Values{"grant_type": {"client_credentials"}}, nil
+		}
+	case authOIDC:
+		if ut.ClientID == "" || ao.TokenFile == "" {
+			return nil, errors.New("--client-id and --token-file are needed with --auth oidc")
+		}
+		ut.Description = "OIDC token from " + ao.TokenFile
+		// the ID token is read each time, as CI systems and Kubernetes
+		// rotate them well within a long running server's lifetime
+		tf := &fileTokens{Path: ao.TokenFile}
+		ut.Grant = func() (url.Values, error) {
+			idToken, err := tf.Token(false)
+			if err != nil {
+				return nil, err
+			}
+			return url.Values{
+				"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+				"assertion":  {strings.TrimSpace(idToken[len("bearer "):])},
+			}, nil
+		}
+	}
+	return ut, nil
+}
+
+// discoverUAA returns the UAA URL advertised by the API
+func discoverUAA(httpClient *http.Client, api string) (string, error) {
+	resp, err := httpClient.Get(api + "/")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unable to discover UAA: %s", cfclient.ParseAPIError(resp))
+	}
+	var root struct {
+		Links struct {
+			UAA *struct {
+				Href string `json:"href"`
+			} `json:"uaa"`
+		} `json:"links"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&root)
+	if err != nil {
+		return "", err
+	}
+	if root.Links.UAA == nil || root.Links.UAA.Href == "" {
+		return "", fmt.Errorf("%s doesn't advertise a UAA, use --uaa", api)
+	}
+	return root.Links.UAA.Href, nil
+}
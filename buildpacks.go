@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// unknownBuildpack is what instances whose buildpack isn't known are
+// grouped under
+const unknownBuildpack = "(unknown)"
+
+// buildpackOverhead is how much of their memory quota the instances of a
+// buildpack's apps leave unused, on average
+type buildpackOverhead struct {
+	Buildpack string
+	Apps      int
+
+	// Samples is how many instances were considered, summed across reports
+	Samples int
+
+	// AverageUsage and AverageQuota are per instance, in bytes, and
+	// AverageGap is the difference between them
+	AverageUsage int
+	AverageQuota int
+	AverageGap   int
+
+	// GapPercent is AverageGap as a percentage of AverageQuota
+	GapPercent float64
+}
+
+// buildpackAnalysis is the overhead of every buildpack across several reports
+type buildpackAnalysis struct {
+	Reports    int
+	Buildpacks []*buildpackOverhead
+}
+
+// analyseBuildpacks groups the running instances in reps by their app's
+// buildpack, finding the average gap between usage and quota of each, most
+// over-provisioned first. Instances that aren't running are left out, as
+// they use nothing whatever their quota, as are service instances.
+func analyseBuildpacks(reps []*usageReport) (*buildpackAnalysis, error) {
+	if len(reps) == 0 {
+		return nil, errors.New("no reports to analyse")
+	}
+
+	type totals struct {
+		apps         map[string]bool
+		samples      int
+		usage, quota int
+	}
+	byBuildpack := make(map[string]*totals)
+	for _, rep := range reps {
+		for _, row := range rep.Rows {
+			if row.Level() != 4 || !row.Running() || row.MemoryQuota == 0 {
+				continue
+			}
+			app := row.Key[:strings.LastIndex(row.Key, "/")]
+			if strings.HasPrefix(app[strings.LastIndex(app, "/")+1:], servicePrefix) {
+				continue
+			}
+			buildpack := row.Buildpack
+			if buildpack == "" {
+				buildpack = unknownBuildpack
+			}
+			t, ok := byBuildpack[buildpack]
+			if !ok {
+				t = &totals{apps: make(map[string]bool)}
+				byBuildpack[buildpack] = t
+			}
+			t.apps[app] = true
+			t.samples++
+			t.usage += row.MemoryUsage
+			t.quota += row.MemoryQuota
+		}
+	}
+
+	ba := &buildpackAnalysis{Reports: len(reps)}
+	for buildpack, t := range byBuildpack {
+		bo := &buildpackOverhead{
+			Buildpack:    buildpack,
+			Apps:         len(t.apps),
+			Samples:      t.samples,
+			AverageUsage: t.usage / t.samples,
+			AverageQuota: t.quota / t.samples,
+			GapPercent:   float64(t.quota-t.usage) * 100 / float64(t.quota),
+		}
+		bo.AverageGap = bo.AverageQuota - bo.AverageUsage
+		ba.Buildpacks = append(ba.Buildpacks, bo)
+	}
+	sort.Slice(ba.Buildpacks, func(i, j int) bool {
+		if ba.Buildpacks[i].GapPercent != ba.Buildpacks[j].GapPercent {
+			return ba.Buildpacks[i].GapPercent > ba.Buildpacks[j].GapPercent
+		}
+		return ba.Buildpacks[i].Buildpack < ba.Buildpacks[j].Buildpack
+	})
+	return ba, nil
+}
+
+// renderBuildpacks writes the analysis as a table or JSON
+func renderBuildpacks(out io.Writer, ba *buildpackAnalysis, format string) error {
+	switch format {
+	case formatJSON:
+		return json.NewEncoder(out).Encode(ba)
+	case formatTable:
+		// handled below
+	default:
+		return fmt.Errorf("unknown format: %s", format)
+	}
+
+	table := tablewriter.NewWriter(out)
+	table.SetHeader([]string{"Buildpack", "Apps", "Samples", "Average Usage", "Average Quota", "Average Gap", "Gap Percent"})
+	for _, bo := range ba.Buildpacks {
+		table.Append([]string{
+			bo.Buildpack,
+			strconv.Itoa(bo.Apps),
+			strconv.Itoa(bo.Samples),
+			toHumanSize(bo.AverageUsage),
+			toHumanSize(bo.AverageQuota),
+			toHumanSize(bo.AverageGap),
+			fmt.Sprintf("%.0f%%", bo.GapPercent),
+		})
+	}
+	table.Render()
+
+	_, err := fmt.Fprintf(out, "Based on %d report(s), per running instance\n", ba.Reports)
+	return err
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// defaultCacheTTL is how long cached metadata is used for by default
+const defaultCacheTTL = time.Hour
+
+// cachedAPI wraps a cfAPI, keeping the orgs, spaces and quotas it lists in
+// files in Dir for TTL, so that repeated runs only fetch apps and their
+// stats. Listings are only cached once complete, so a crawl that stopped
+// part way through is fetched afresh next time.
+type cachedAPI struct {
+	cfAPI
+
+	// Dir is where entries are kept. It is shared by installations, as
+	// entries are keyed by the API URL.
+	Dir string
+	TTL time.Duration
+
+	// API is the cloud controller URL, ie "https://api.system.example.com"
+	API string
+
+	// mu guards the warning being logged only once
+	mu     sync.Mutex
+	warned bool
+}
+
+// cacheEntry is a file in the cache
+type cacheEntry struct {
+	Fetched time.Time
+
+	Orgs   []*cachedOrg   `json:",omitempty"`
+	Spaces []*cachedSpace `json:",omitempty"`
+
+	OrgQuotas   map[string]int `json:",omitempty"`
+	SpaceQuotas map[string]int `json:",omitempty"`
+}
+
+// cachedOrg and cachedSpace are cfOrg and cfSpace with their unexported
+// fields, which the v2 API needs, exported
+type cachedOrg struct {
+	GUID, Name, SpacesURL, QuotaGUID string
+	Labels                           map[string]string `json:",omitempty"`
+}
+
+type cachedSpace struct {
+	GUID, Name, AppsURL, QuotaGUID string
+	Labels                         map[string]string `json:",omitempty"`
+}
+
+// path returns the file for key. Keys are hashed with the API and its
+// version, as GUIDs are only unique within an installation.
+func (ca *cachedAPI) path(key string) string {
+	return filepath.Join(ca.Dir, fmt.Sprintf("%x.json", sha256.Sum256([]byte(ca.API+" "+ca.Version()+" "+key))))
+}
+
+// load returns the entry for key, or nil if there isn't a fresh one
+func (ca *cachedAPI) load(key string) *cacheEntry {
+	var ce cacheEntry
+	err := readJSONFile(ca.path(key), &ce)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			ca.warn(err)
+		}
+		return nil
+	}
+	if time.Since(ce.Fetched) > ca.TTL {
+		return nil
+	}
+	return &ce
+}
+
+// save stores the entry for key. Failing to is only a warning, as the
+// report doesn't need the cache.
+func (ca *cachedAPI) save(key string, ce *cacheEntry) {
+	ce.Fetched = time.Now()
+	err := os.MkdirAll(ca.Dir, 0700)
+	if err == nil {
+		err = writeJSONFile(ca.path(key), ce)
+	}
+	if err != nil {
+		ca.warn(err)
+	}
+}
+
+// warn logs the first problem with the cache, rather than one per entry
+func (ca *cachedAPI) warn(err error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if !ca.warned {
+		ca.warned = true
+		log.Printf("warning: metadata cache: %s", err)
+	}
+}
+
+func (ca *cachedAPI) Orgs(scope reportScope, f func(*cfOrg) error) error {
+	key := "orgs " + scope.OrgGUID
+	if ce := ca.load(key); ce != nil {
+		for _, o := range ce.Orgs {
+			err := f(&cfOrg{GUID: o.GUID, Name: o.Name, spacesURL: o.SpacesURL, quotaGUID: o.QuotaGUID, Labels: o.Labels})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var orgs []*cachedOrg
+	err := ca.cfAPI.Orgs(scope, func(org *cfOrg) error {
+		orgs = append(orgs, &cachedOrg{GUID: org.GUID, Name: org.Name, SpacesURL: org.spacesURL, QuotaGUID: org.quotaGUID, Labels: org.Labels})
+		return f(org)
+	})
+	if err != nil {
+		return err
+	}
+	ca.save(key, &cacheEntry{Orgs: orgs})
+	return nil
+}
+
+func (ca *cachedAPI) Spaces(scope reportScope, org *cfOrg, f func(*cfSpace) error) error {
+	key := "spaces " + org.GUID + " " + scope.SpaceGUID
+	if ce := ca.load(key); ce != nil {
+		for _, s := range ce.Spaces {
+			err := f(&cfSpace{GUID: s.GUID, Name: s.Name, appsURL: s.AppsURL, quotaGUID: s.QuotaGUID, Labels: s.Labels})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var spaces []*cachedSpace
+	err := ca.cfAPI.Spaces(scope, org, func(space *cfSpace) error {
+		spaces = append(spaces, &cachedSpace{GUID: space.GUID, Name: space.Name, AppsURL: space.appsURL, QuotaGUID: space.quotaGUID, Labels: space.Labels})
+		return f(space)
+	})
+	if err != nil {
+		return err
+	}
+	ca.save(key, &cacheEntry{Spaces: spaces})
+	return nil
+}
+
+func (ca *cachedAPI) QuotaMemoryLimits() (orgQuotas, spaceQuotas map[string]int, err error) {
+	key := "quotas"
+	if ce := ca.load(key); ce != nil {
+		return ce.OrgQuotas, ce.SpaceQuotas, nil
+	}
+	orgQuotas, spaceQuotas, err = ca.cfAPI.QuotaMemoryLimits()
+	if err != nil {
+		return nil, nil, err
+	}
+	ca.save(key, &cacheEntry{OrgQuotas: orgQuotas, SpaceQuotas: spaceQuotas})
+	return orgQuotas, spaceQuotas, nil
+}
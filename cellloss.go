@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// errCellLossNeedsCapacity is returned when simulating losing cells
+// without knowing how much each can hold
+var errCellLossNeedsCapacity = errors.New("--lose-cells needs --cell-memory, the memory of each cell")
+
+// orgCellLoss is how an org's instances fare when cells are lost
+type orgCellLoss struct {
+	Org string
+
+	// Evicted is how many of the org's instances were on the lost cells,
+	// and Failed how many of them couldn't be placed on the others
+	Evicted int
+	Failed  int
+
+	// FailedQuota is the memory allocated to the instances that failed
+	FailedQuota int
+
+	// FailedInstances are the keys of the instances that failed
+	FailedInstances []string `json:",omitempty"`
+}
+
+// cellLoss is the outcome of losing some cells, with their instances
+// rescheduled onto the rest
+type cellLoss struct {
+	// Capacity is the memory of each cell, in bytes
+	Capacity int
+
+	// Lost are the cells lost, of Cells in total
+	Lost  []string
+	Cells int
+
+	// Evicted and Failed are how many instances were on the lost cells, and
+	// how many of those couldn't be rescheduled
+	Evicted int
+	Failed  int
+
+	// AllocatedBefore and AllocatedAfter are the memory allocated on the
+	// remaining cells before and after rescheduling, of RemainingCapacity
+	AllocatedBefore   int
+	AllocatedAfter    int
+	RemainingCapacity int
+
+	// Orgs are those with instances on the lost cells, most failing first
+	Orgs []*orgCellLoss
+}
+
+// lostCells returns the cells of cp that spec names: either a number of
+// cells, taking those with the most memory allocated as the worst case, or
+// comma separated cell addresses, ie those of an availability zone
+func lostCells(cp *cellPlacement, spec string) ([]*cellUsage, error) {
+	byAllocation := append([]*cellUsage(nil), cp.Cells...)
+	sort.SliceStable(byAllocation, func(i, j int) bool {
+		return byAllocation[i].MemoryQuota > byAllocation[j].MemoryQuota
+	})
+	if n, err := strconv.Atoi(spec); err == nil {
+		if n < 1 || n >= len(cp.Cells) {
+			return nil, fmt.Errorf("can't lose %d of %d cells, expected at least 1 and fewer than all", n, len(cp.Cells))
+		}
+		return byAllocation[:n], nil
+	}
+
+	byName := make(map[string]*cellUsage)
+	for _, cu := range cp.Cells {
+		byName[cu.Cell] = cu
+	}
+	var rv []*cellUsage
+	for _, cell := range strings.Split(spec, ",") {
+		cu, ok := byName[cell]
+		if !ok {
+			return nil, fmt.Errorf("no instances are running on cell %s", cell)
+		}
+		rv = append(rv, cu)
+	}
+	if len(rv) == len(cp.Cells) {
+		return nil, errors.New("can't lose every cell")
+	}
+	return rv, nil
+}
+
+// simulateCellLoss reschedules the instances on the lost cells of cp, which
+// must have every cell's instances listed, onto the remaining cells. As
+// Diego places by allocated memory, each instance, largest allocation
+// first, goes on the remaining cell with the most unallocated memory, and
+// fails if it fits on none.
+func simulateCellLoss(cp *cellPlacement, lost []*cellUsage) *cellLoss {
+	cl := &cellLoss{Capacity: cp.Capacity, Cells: len(cp.Cells)}
+	isLost := make(map[string]bool)
+	var evicted []*cellInstance
+	for _, cu := range lost {
+		isLost[cu.Cell] = true
+		cl.Lost = append(cl.Lost, cu.Cell)
+		evicted = append(evicted, cu.Placed...)
+	}
+	// free is the unallocated memory of each remaining cell
+	var free []int
+	for _, cu := range cp.Cells {
+		if isLost[cu.Cell] {
+			continue
+		}
+		free = append(free, cp.Capacity-cu.MemoryQuota)
+		cl.AllocatedBefore += cu.MemoryQuota
+		cl.RemainingCapacity += cp.Capacity
+	}
+	cl.AllocatedAfter = cl.AllocatedBefore
+
+	sort.SliceStable(evicted, func(i, j int) bool {
+		if evicted[i].MemoryQuota != evicted[j].MemoryQuota {
+			return evicted[i].MemoryQuota > evicted[j].MemoryQuota
+		}
+		return evicted[i].Key < evicted[j].Key
+	})
+	byOrg := make(map[string]*orgCellLoss)
+	for _, ci := range evicted {
+		org := ci.Key[:strings.Index(ci.Key, "/")]
+		ol, ok := byOrg[org]
+		if !ok {
+			ol = &orgCellLoss{Org: org}
+			byOrg[org] = ol
+			cl.Orgs = append(cl.Orgs, ol)
+		}
+		ol.Evicted++
+		cl.Evicted++
+
+		most := 0
+		for i := range free {
+			if free[i] > free[most] {
+				most = i
+			}
+		}
+		if free[most] < ci.MemoryQuota {
+			ol.Failed++
+			ol.FailedQuota += ci.MemoryQuota
+			ol.FailedInstances = append(ol.FailedInstances, ci.Key)
+			cl.Failed++
+			continue
+		}
+		free[most] -= ci.MemoryQuota
+		cl.AllocatedAfter += ci.MemoryQuota
+	}
+	for _, ol := range cl.Orgs {
+		sort.Strings(ol.FailedInstances)
+	}
+	sort.SliceStable(cl.Orgs, func(i, j int) bool {
+		if cl.Orgs[i].FailedQuota != cl.Orgs[j].FailedQuota {
+			return cl.Orgs[i].FailedQuota > cl.Orgs[j].FailedQuota
+		}
+		return cl.Orgs[i].Org < cl.Orgs[j].Org
+	})
+	return cl
+}
+
+// renderCellLoss writes the outcome of losing cells as a table or JSON.
+// Tables follow the unit, alignment and plainness of opts, and list the
+// instances that failed to reschedule after the table.
+func renderCellLoss(out io.Writer, rep *usageReport, cl *cellLoss, opts renderOptions) error {
+	switch opts.Format {
+	case formatJSON:
+		return json.NewEncoder(out).Encode(cl)
+	case formatTable:
+		// handled below
+	default:
+		return fmt.Errorf("cell loss can't be shown in the %s format", opts.Format)
+	}
+
+	var buf bytes.Buffer
+	table := newTable(&buf, []string{"Org", "Evicted", "Rescheduled", "Failed", "Failed Allocation"}, opts)
+	for _, ol := range cl.Orgs {
+		table.Append([]string{
+			ol.Org,
+			strconv.Itoa(ol.Evicted),
+			strconv.Itoa(ol.Evicted - ol.Failed),
+			strconv.Itoa(ol.Failed),
+			toSize(ol.FailedQuota, opts.Unit),
+		})
+	}
+	table.Render()
+	rendered := buf.String()
+	if opts.Plain {
+		rendered = trimLines(rendered)
+	}
+
+	_, err := fmt.Fprintf(out, "%slosing %d of %d cells of %s (%s): %d of %d instances couldn't be rescheduled, leaving the other cells %s allocated, run ID: %s\n",
+		rendered, len(cl.Lost), cl.Cells, toSize(cl.Capacity, opts.Unit), strings.Join(cl.Lost, ", "),
+		cl.Failed, cl.Evicted, toPercent(cl.AllocatedAfter, cl.RemainingCapacity), describeRun(rep))
+	if err != nil {
+		return err
+	}
+	for _, ol := range cl.Orgs {
+		if ol.Failed == 0 {
+			continue
+		}
+		_, err = fmt.Fprintf(out, "\nInstances of %s that couldn't be rescheduled:\n  /%s\n", ol.Org, strings.Join(ol.FailedInstances, "\n  /"))
+		if err != nil {
+			return err
+		}
+	}
+	return writeErrors(out, rep.Errors)
+}
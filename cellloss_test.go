@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/govau/cf-report-memory-usage/report"
+)
+
+func TestSimulateCellLoss(t *testing.T) {
+	const gb = 1 << 30
+	instance := func(key, cell string, quota int) *appUsageInfo {
+		return &appUsageInfo{RunID: "run", Key: key, MemoryUsage: quota / 2, MemoryQuota: quota, Cell: cell, State: "RUNNING"}
+	}
+	rep := &usageReport{RunID: "run", Rows: report.AddTotals("run", []*appUsageInfo{
+		instance("o1/s/a/0", "c1", 4*gb),
+		instance("o1/s/a/1", "c1", 4*gb),
+		instance("o2/s/b/0", "c1", 2*gb),
+		instance("o2/s/b/1", "c2", 2*gb),
+		instance("o2/s/c/0", "c2", 1*gb),
+		instance("o3/s/d/0", "c3", 3*gb),
+	})}
+	cp := cellTotals(rep, 8*gb, []string{allCells})
+
+	// losing the most allocated cell, c1, leaves 5 GB free on each of c2
+	// and c3: one of o1's 4 GB instances fits on each, then o2's 2 GB doesn't
+	lost, err := lostCells(cp, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := simulateCellLoss(cp, lost)
+	if strings.Join(cl.Lost, ",") != "c1" || cl.Evicted != 3 || cl.Failed != 1 {
+		t.Errorf("lost %v, evicting %d and failing %d, want c1, 3 and 1", cl.Lost, cl.Evicted, cl.Failed)
+	}
+	if len(cl.Orgs) != 2 || cl.Orgs[0].Org != "o2" || cl.Orgs[0].FailedQuota != 2*gb || strings.Join(cl.Orgs[0].FailedInstances, ",") != "o2/s/b/0" {
+		t.Errorf("got orgs %+v, want o2 failing o2/s/b/0 first", cl.Orgs[0])
+	}
+	if cl.Orgs[1].Org != "o1" || cl.Orgs[1].Evicted != 2 || cl.Orgs[1].Failed != 0 {
+		t.Errorf("got %+v, want o1 fully rescheduled", cl.Orgs[1])
+	}
+	if cl.AllocatedBefore != 6*gb || cl.AllocatedAfter != 14*gb || cl.RemainingCapacity != 16*gb {
+		t.Errorf("got %d to %d of %d allocated", cl.AllocatedBefore, cl.AllocatedAfter, cl.RemainingCapacity)
+	}
+
+	// losing a cell by name that can absorb its instances
+	lost, err = lostCells(cp, "c3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cl := simulateCellLoss(cp, lost); cl.Failed != 0 || cl.Evicted != 1 {
+		t.Errorf("losing c3 failed %d of %d, want 0 of 1", cl.Failed, cl.Evicted)
+	}
+
+	for _, spec := range []string{"0", "3", "c1,c2,c3", "c9"} {
+		if _, err := lostCells(cp, spec); err == nil {
+			t.Errorf("%s: lost cells, want an error", spec)
+		}
+	}
+}
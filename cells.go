@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// hotCellFactor is how many times the average cell's memory usage a cell
+// must use to be hot, as instances are then unevenly placed
+const hotCellFactor = 1.5
+
+// allCells in the cells to list instances on lists them on every cell
+const allCells = "*"
+
+// cellUsage is the memory used and allocated to the instances running on a
+// Diego cell, in bytes
+type cellUsage struct {
+	Cell      string
+	Apps      int
+	Instances int
+
+	MemoryUsage int
+	MemoryQuota int
+
+	// Hot is set if the cell uses more than hotCellFactor times the average
+	Hot bool
+
+	// Placed, if listed, are the app instances on the cell, largest quota
+	// first, as would need placing elsewhere if the cell were drained
+	Placed []*cellInstance `json:",omitempty"`
+}
+
+// cellInstance is an app instance on a cell
+type cellInstance struct {
+	Key         string
+	MemoryUsage int
+	MemoryQuota int
+	State       string `json:",omitempty"`
+}
+
+// cellPlacement is the usage of every cell that instances in a report were
+// placed on
+type cellPlacement struct {
+	// Capacity, if given, is the memory of each cell, in bytes
+	Capacity int `json:",omitempty"`
+
+	// AverageUsage is the mean memory usage of the cells
+	AverageUsage int
+
+	Cells []*cellUsage
+
+	// Unplaced is how many instances have no cell, ie are down
+	Unplaced int
+}
+
+// cellTotals totals the instances in rep by the cell they run on, most used
+// first. Service instances aren't on cells, so aren't counted. The instances
+// on each cell in listed are kept too, on every cell if it has allCells.
+func cellTotals(rep *usageReport, capacity int, listed []string) *cellPlacement {
+	list := make(map[string]bool)
+	for _, cell := range listed {
+		list[cell] = true
+	}
+	cp := &cellPlacement{Capacity: capacity}
+	byCell := make(map[string]*cellUsage)
+	apps := make(map[string]map[string]bool)
+	for _, row := range rep.Rows {
+		if row.Level() != 4 {
+			continue
+		}
+		app := row.Key[:strings.LastIndex(row.Key, "/")]
+		if strings.HasPrefix(app[strings.LastIndex(app, "/")+1:], servicePrefix) {
+			continue
+		}
+		if row.Cell == "" {
+			cp.Unplaced++
+			continue
+		}
+		cu, ok := byCell[row.Cell]
+		if !ok {
+			cu = &cellUsage{Cell: row.Cell}
+			byCell[row.Cell] = cu
+			apps[row.Cell] = make(map[string]bool)
+		}
+		apps[row.Cell][app] = true
+		cu.Instances++
+		cu.MemoryUsage += row.MemoryUsage
+		cu.MemoryQuota += row.MemoryQuota
+		if list[row.Cell] || list[allCells] {
+			cu.Placed = append(cu.Placed, &cellInstance{Key: row.Key, MemoryUsage: row.MemoryUsage, MemoryQuota: row.MemoryQuota, State: row.State})
+		}
+	}
+
+	total := 0
+	for cell, cu := range byCell {
+		cu.Apps = len(apps[cell])
+		total += cu.MemoryUsage
+		cp.Cells = append(cp.Cells, cu)
+	}
+	if len(cp.Cells) != 0 {
+		cp.AverageUsage = total / len(cp.Cells)
+	}
+	for _, cu := range cp.Cells {
+		cu.Hot = float64(cu.MemoryUsage) > hotCellFactor*float64(cp.AverageUsage)
+		sort.Slice(cu.Placed, func(i, j int) bool {
+			if cu.Placed[i].MemoryQuota != cu.Placed[j].MemoryQuota {
+				return cu.Placed[i].MemoryQuota > cu.Placed[j].MemoryQuota
+			}
+			return cu.Placed[i].Key < cu.Placed[j].Key
+		})
+	}
+	sort.Slice(cp.Cells, func(i, j int) bool {
+		if cp.Cells[i].MemoryUsage != cp.Cells[j].MemoryUsage {
+			return cp.Cells[i].MemoryUsage > cp.Cells[j].MemoryUsage
+		}
+		return cp.Cells[i].Cell < cp.Cells[j].Cell
+	})
+	return cp
+}
+
+// unknown returns the cells of listed that no instances are on
+func (cp *cellPlacement) unknown(listed []string) []string {
+	known := make(map[string]bool)
+	for _, cu := range cp.Cells {
+		known[cu.Cell] = true
+	}
+	var rv []string
+	for _, cell := range listed {
+		if cell != allCells && !known[cell] {
+			rv = append(rv, cell)
+		}
+	}
+	return rv
+}
+
+// renderCells writes the placement as a table or JSON. Tables follow the
+// unit, alignment and plainness of opts.
+func renderCells(out io.Writer, rep *usageReport, cp *cellPlacement, opts renderOptions) error {
+	switch opts.Format {
+	case formatJSON:
+		return json.NewEncoder(out).Encode(cp)
+	case formatTable:
+		// handled below
+	default:
+		return fmt.Errorf("cells can't be shown in the %s format", opts.Format)
+	}
+
+	header := []string{"Cell", "Apps", "Instances", "Used", "Allocated", "Used Percent"}
+	if cp.Capacity != 0 {
+		header = append(header, "Used of Cell", "Allocated of Cell")
+	}
+	header = append(header, "Hot")
+	var buf bytes.Buffer
+	table := newTable(&buf, header, opts)
+	var hot []string
+	for _, cu := range cp.Cells {
+		cells := []string{
+			cu.Cell,
+			strconv.Itoa(cu.Apps),
+			strconv.Itoa(cu.Instances),
+			toSize(cu.MemoryUsage, opts.Unit),
+			toSize(cu.MemoryQuota, opts.Unit),
+			toPercent(cu.MemoryUsage, cu.MemoryQuota),
+		}
+		if cp.Capacity != 0 {
+			cells = append(cells, toPercent(cu.MemoryUsage, cp.Capacity), toPercent(cu.MemoryQuota, cp.Capacity))
+		}
+		mark := ""
+		if cu.Hot {
+			mark = "!"
+			hot = append(hot, cu.Cell)
+		}
+		table.Append(append(cells, mark))
+	}
+	table.Render()
+	rendered := buf.String()
+	if opts.Plain {
+		rendered = trimLines(rendered)
+	}
+
+	_, err := fmt.Fprintf(out, "%s%d cells, using %s each on average, run ID: %s\n", rendered, len(cp.Cells), toSize(cp.AverageUsage, opts.Unit), describeRun(rep))
+	if err != nil {
+		return err
+	}
+	if cp.Unplaced != 0 {
+		_, err = fmt.Fprintf(out, "%d instances aren't running on a cell\n", cp.Unplaced)
+		if err != nil {
+			return err
+		}
+	}
+	if len(hot) != 0 {
+		_, err = fmt.Fprintf(out, "\nHot cells, using over %.1f times the average:\n  %s\n", hotCellFactor, strings.Join(hot, "\n  "))
+		if err != nil {
+			return err
+		}
+	}
+	err = renderCellInstances(out, cp, opts)
+	if err != nil {
+		return err
+	}
+	return writeErrors(out, rep.Errors)
+}
+
+// renderCellInstances writes a table of the instances listed on each cell,
+// if any were, in the order of the cells
+func renderCellInstances(out io.Writer, cp *cellPlacement, opts renderOptions) error {
+	var buf bytes.Buffer
+	table := newTable(&buf, []string{"Cell", "Instance", "Used", "Allocated", "State"}, opts)
+	listed := 0
+	for _, cu := range cp.Cells {
+		for _, ci := range cu.Placed {
+			table.Append([]string{cu.Cell, "/" + ci.Key, toSize(ci.MemoryUsage, opts.Unit), toSize(ci.MemoryQuota, opts.Unit), ci.State})
+			listed++
+		}
+	}
+	if listed == 0 {
+		return nil
+	}
+	table.Render()
+	rendered := buf.String()
+	if opts.Plain {
+		rendered = trimLines(rendered)
+	}
+	_, err := fmt.Fprintf(out, "\nInstances by cell, largest allocation first:\n%s", rendered)
+	return err
+}
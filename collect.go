@@ -0,0 +1,696 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/govau/cf-report-memory-usage/internal/cfclient"
+	"github.com/govau/cf-report-memory-usage/report"
+)
+
+const (
+	errorPolicyFail     = "fail"
+	errorPolicyContinue = "continue"
+)
+
+// exitPartialData is the exit status when a report was produced, but some
+// orgs, spaces or apps were left out due to errors
+const exitPartialData = 3
+
+// errPartialData is returned once an incomplete report has been written
+var errPartialData = errors.New("report is incomplete, as some orgs, spaces or apps could not be fetched")
+
+// collector crawls the installation to produce usage reports
+type collector struct {
+	client   *simpleClient
+	api      cfAPI
+	logCache *logCache
+	opts     collectorOptions
+
+	// summary, if set, records each report collected
+	summary *runSummary
+}
+
+// collectorOptions control how the installation is crawled
+type collectorOptions struct {
+	// APIVersion is "auto", "v2" or "v3"
+	APIVersion string
+
+	// Scope limits the crawl to an org or space
+	Scope reportScope
+
+	// Concurrency is how many apps to fetch stats for at once
+	Concurrency int
+
+	// Consistent, if set, lists every app before fetching any stats, so
+	// that they are fetched in a burst, close together in time
+	Consistent bool
+
+	// Shard, if set, limits the crawl to a share of the orgs
+	Shard reportShard
+
+	// Exclude are orgs and spaces left out of the crawl, and so its totals,
+	// ie the system org
+	Exclude exclusions
+
+	// ErrorPolicy is what to do when an org's spaces, a space's apps or
+	// services, or an app's stats can't be fetched: "continue" without them
+	// (the default), listing them in the report's errors, or "fail" the crawl
+	ErrorPolicy string
+
+	// IncludeServices, if set, also reports the memory of service instances
+	// annotated with their usage, as if they were apps
+	IncludeServices bool
+
+	// Quotas, if set, also fetches the memory limit of each org and space
+	// quota, to show headroom or forecast when orgs will run out
+	Quotas bool
+
+	// Progress, if set, shows how many apps have had their stats fetched
+	// on stderr while crawling
+	Progress bool
+
+	// Buildpacks, if set, also fetches the detected buildpack of apps that
+	// weren't pushed with one, at the cost of a request per app with v3
+	Buildpacks bool
+
+	// Labels, if set, are the label keys to record on each instance, from
+	// its app, or failing that its space or org. Labels need the v3 API.
+	Labels []string
+
+	// Timeout, if set, stops the crawl after this long, reporting what has
+	// been collected so far as an incomplete report
+	Timeout time.Duration
+
+	// CacheDir, if set, is where orgs, spaces and quotas are cached between
+	// crawls, for CacheTTL (defaulting to an hour)
+	CacheDir string
+	CacheTTL time.Duration
+
+	// Tag, if set, is recorded on the report and each of its rows, ie to
+	// mark runs during load tests
+	Tag string
+
+	// FreshOrg, if set, is the org Scope is limited to, which is combined
+	// with every other org as it was in the latest run in HistoryDir
+	FreshOrg   string
+	HistoryDir string
+}
+
+// errCrawlStopped is returned from callbacks to stop listing once a worker has failed
+var errCrawlStopped = errors.New("crawl stopped")
+
+// deletedWhileCrawling returns true if err is that something listed earlier
+// in the crawl is no longer there, as it has since been deleted
+func deletedWhileCrawling(err error) bool {
+	return cfclient.IsStatus(err, http.StatusNotFound)
+}
+
+// warnDeleted warns that key was left out as it was deleted mid-crawl
+func (col *collector) warnDeleted(key string, err error) {
+	if !col.client.Quiet {
+		log.Printf("warning: leaving out /%s, which was deleted while crawling: %s", key, err)
+	}
+}
+
+// listedGUIDs are the orgs, spaces and started apps listed by a crawl, by
+// GUID, and the orgs and spaces whose spaces and apps were fully listed
+type listedGUIDs struct {
+	Orgs, Spaces, Apps map[string]bool
+	SpacesOf, AppsOf   map[string]bool
+}
+
+// appeared lists the installation again, as the crawl would, returning the
+// keys of orgs, spaces and started apps that seen doesn't have, in key
+// order. On a long crawl these were created after the list they would be in
+// was read. What is within new orgs and spaces isn't listed, as they are new
+// too, nor what is within those that couldn't be listed the first time.
+func (col *collector) appeared(seen *listedGUIDs) ([]string, error) {
+	var keys []string
+	err := col.api.Orgs(col.opts.Scope, func(org *cfOrg) error {
+		if !col.opts.Shard.contains(org) || col.opts.Exclude.org(org) {
+			return nil
+		}
+		orgKey := noSlash(org.Name)
+		if !seen.Orgs[org.GUID] {
+			keys = append(keys, orgKey)
+			return nil
+		}
+		if !seen.SpacesOf[org.GUID] {
+			return nil
+		}
+		err := col.api.Spaces(col.opts.Scope, org, func(space *cfSpace) error {
+			if col.opts.Exclude.space(org, space) {
+				return nil
+			}
+			spaceKey := orgKey + "/" + noSlash(space.Name)
+			if !seen.Spaces[space.GUID] {
+				keys = append(keys, spaceKey)
+				return nil
+			}
+			if !seen.AppsOf[space.GUID] {
+				return nil
+			}
+			err := col.api.Apps(space, func(app *cfApp) error {
+				if app.State != "STOPPED" && !seen.Apps[app.GUID] {
+					keys = append(keys, spaceKey+"/"+noSlash(app.Name))
+				}
+				return nil
+			})
+			if deletedWhileCrawling(err) {
+				return nil
+			}
+			return err
+		})
+		if deletedWhileCrawling(err) {
+			return nil
+		}
+		return err
+	})
+	sort.Strings(keys)
+	return keys, err
+}
+
+// newCollector returns a collector for the installation client is connected to
+func newCollector(client *simpleClient, opts collectorOptions) (*collector, error) {
+	if opts.Concurrency < 1 {
+		return nil, errors.New("concurrency must be at least 1")
+	}
+	if opts.ErrorPolicy == "" {
+		opts.ErrorPolicy = errorPolicyContinue
+	}
+	switch opts.ErrorPolicy {
+	case errorPolicyFail, errorPolicyContinue:
+	default:
+		return nil, fmt.Errorf("unknown error policy, expected fail or continue: %s", opts.ErrorPolicy)
+	}
+	api, err := newCFAPI(client, opts.APIVersion)
+	if err != nil {
+		return nil, err
+	}
+	if !client.Quiet {
+		log.Printf("using %s API", api.Version())
+	}
+	if opts.IncludeServices && api.Version() != apiVersionV3 {
+		return nil, errServicesNeedV3
+	}
+	if len(opts.Labels) != 0 && api.Version() != apiVersionV3 {
+		return nil, errLabelsNeedV3
+	}
+	if opts.CacheDir != "" {
+		if opts.CacheTTL <= 0 {
+			opts.CacheTTL = defaultCacheTTL
+		}
+		api = &cachedAPI{cfAPI: api, Dir: opts.CacheDir, TTL: opts.CacheTTL, API: client.API}
+		if !client.Quiet {
+			log.Printf("caching orgs, spaces and quotas in %s for %s", opts.CacheDir, opts.CacheTTL)
+		}
+	}
+	return &collector{
+		client:   client,
+		api:      api,
+		logCache: &logCache{client: client},
+		opts:     opts,
+	}, nil
+}
+
+func (c *reportMemoryUsage) reportMemoryUsage(col *collector, sinks []sink) error {
+	rep, err := col.collect()
+	if err != nil {
+		return err
+	}
+	err = writeSinks(sinks, rep)
+	if err != nil {
+		return err
+	}
+	if rep.Incomplete() {
+		return errPartialData
+	}
+	return nil
+}
+
+// watchMemoryUsage reports every interval until killed. Failures are logged
+// rather than fatal, so that a live view survives a cloud controller blip.
+func (c *reportMemoryUsage) watchMemoryUsage(col *collector, sinks []sink, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("interval must be positive: %s", interval)
+	}
+	for {
+		next := time.Now().Add(interval)
+		err := c.reportMemoryUsage(col, sinks)
+		if err != nil && err != errPartialData {
+			log.Printf("error: %s, retrying in %s", err, time.Until(next).Round(time.Second))
+		}
+		time.Sleep(time.Until(next))
+	}
+}
+
+// appJob is a started app to fetch instance stats for. seq is the order
+// it was listed in, so that results are reported in a stable order.
+type appJob struct {
+	seq   int
+	org   *cfOrg
+	space *cfSpace
+	app   *cfApp
+}
+
+// appResult is the outcome of an appJob
+type appResult struct {
+	seq  int
+	key  string
+	rows []*appUsageInfo
+	err  error
+}
+
+// collect walks every org, space and started app in scope, and returns a
+// row per app instance plus an aggregated row for each level of the hierarchy.
+// Orgs, spaces and apps are listed serially, while instance stats are
+// fetched by a pool of opts.Concurrency workers, as apps are listed, or
+// once they all have been if opts.Consistent is set.
+func (col *collector) collect() (*usageReport, error) {
+	started := time.Now()
+	runID, err := newRunID()
+	if err != nil {
+		return nil, err
+	}
+
+	// requests made once ctx is done fail, so the crawl winds down, and
+	// what was collected before then is reported
+	base := col.client.Context()
+	ctx, cancel := base, context.CancelFunc(func() {})
+	if col.opts.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(base, col.opts.Timeout)
+	}
+	defer cancel()
+	col.client.SetContext(ctx)
+	defer col.client.SetContext(base)
+
+	var orgQuotas, spaceQuotas, orgLimits, spaceLimits map[string]int
+	if col.opts.Quotas {
+		orgQuotas, spaceQuotas, err = col.api.QuotaMemoryLimits()
+		if err != nil {
+			return nil, fmt.Errorf("listing quotas: %s", err)
+		}
+		orgLimits, spaceLimits = make(map[string]int), make(map[string]int)
+	}
+
+	var progress *crawlProgress
+	if col.opts.Progress {
+		progress = newCrawlProgress()
+		progress.start()
+	}
+
+	jobs := make(chan *appJob)
+	results := make(chan *appResult)
+	var workers sync.WaitGroup
+	for i := 0; i < col.opts.Concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for job := range jobs {
+				rows, err := col.appRows(runID, job.org, job.space, job.app)
+				results <- &appResult{
+					seq:  job.seq,
+					key:  noSlash(job.org.Name) + "/" + noSlash(job.space.Name) + "/" + noSlash(job.app.Name),
+					rows: rows,
+					err:  err,
+				}
+			}
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	byApp := make(map[int][]*appUsageInfo)
+	skipped := make(map[int]*report.Error)
+	deletedApps := make(map[int]string)
+	var workerErr error
+	var failed int32
+	gathered := make(chan struct{})
+	go func() {
+		for res := range results {
+			if progress != nil {
+				progress.doneApp()
+			}
+			if res.err != nil && ctx.Err() != nil {
+				// failed because the crawl was stopped, not the app
+				continue
+			}
+			if res.err != nil && deletedWhileCrawling(res.err) {
+				col.warnDeleted(res.key, res.err)
+				deletedApps[res.seq] = res.key
+				continue
+			}
+			if res.err != nil && col.opts.ErrorPolicy == errorPolicyContinue {
+				if !col.client.Quiet {
+					log.Printf("warning: skipping app %s: %s", res.key, res.err)
+				}
+				skipped[res.seq] = reportError(res.key, res.err)
+				continue
+			}
+			if res.err != nil {
+				if workerErr == nil {
+					workerErr = res.err
+				}
+				atomic.StoreInt32(&failed, 1)
+				continue
+			}
+			byApp[res.seq] = res.rows
+		}
+		close(gathered)
+	}()
+
+	seq := 0
+	var pending []*appJob
+	var services []*appUsageInfo
+	// crawlErrs are orgs and spaces left out, or incomplete, with the
+	// continue policy. It is only used by this goroutine.
+	var crawlErrs []*report.Error
+	// vanished are orgs, spaces and apps deleted since they were listed, and
+	// seen those listed so far, which may be listed twice if others are
+	// created or deleted between requests for pages of a list. They are only
+	// used by this goroutine too.
+	var vanished []string
+	seen := &listedGUIDs{
+		Orgs:     make(map[string]bool),
+		Spaces:   make(map[string]bool),
+		Apps:     make(map[string]bool),
+		SpacesOf: make(map[string]bool),
+		AppsOf:   make(map[string]bool),
+	}
+	listedTwice := func(listed map[string]bool, guid, key string) bool {
+		if !listed[guid] {
+			listed[guid] = true
+			return false
+		}
+		if !col.client.Quiet {
+			log.Printf("warning: /%s was listed twice, as others were created or deleted while listing, counting it once", key)
+		}
+		return true
+	}
+	skip := func(key, what string, err error) error {
+		if deletedWhileCrawling(err) && ctx.Err() == nil {
+			col.warnDeleted(key, err)
+			vanished = append(vanished, key)
+			return nil
+		}
+		if col.opts.ErrorPolicy != errorPolicyContinue || err == errCrawlStopped || ctx.Err() != nil {
+			return err
+		}
+		if !col.client.Quiet {
+			log.Printf("warning: skipping %s %s: %s", what, key, err)
+		}
+		crawlErrs = append(crawlErrs, reportError(key, err))
+		return nil
+	}
+	var excludedOrgs, excludedSpaces int
+	err = col.api.Orgs(col.opts.Scope, func(org *cfOrg) error {
+		if !col.opts.Shard.contains(org) {
+			return nil
+		}
+		if col.opts.Exclude.org(org) {
+			excludedOrgs++
+			return nil
+		}
+		orgKey := noSlash(org.Name)
+		if listedTwice(seen.Orgs, org.GUID, orgKey) {
+			return nil
+		}
+		if limit, ok := orgQuotas[org.quotaGUID]; ok {
+			orgLimits[orgKey] = limit
+		}
+		err := col.api.Spaces(col.opts.Scope, org, func(space *cfSpace) error {
+			if col.opts.Exclude.space(org, space) {
+				excludedSpaces++
+				return nil
+			}
+			spaceKey := orgKey + "/" + noSlash(space.Name)
+			if listedTwice(seen.Spaces, space.GUID, spaceKey) {
+				return nil
+			}
+			if limit, ok := spaceQuotas[space.quotaGUID]; ok {
+				spaceLimits[spaceKey] = limit
+			}
+			err := col.api.Apps(space, func(app *cfApp) error {
+				if atomic.LoadInt32(&failed) != 0 || ctx.Err() != nil {
+					return errCrawlStopped
+				}
+				if app.State == "STOPPED" || listedTwice(seen.Apps, app.GUID, spaceKey+"/"+noSlash(app.Name)) {
+					return nil
+				}
+				job := &appJob{seq: seq, org: org, space: space, app: app}
+				seq++
+				if progress != nil {
+					progress.listedApp()
+				}
+				if col.opts.Consistent {
+					pending = append(pending, job)
+				} else {
+					jobs <- job
+				}
+				return nil
+			})
+			if err != nil {
+				return skip(spaceKey, "apps of space", err)
+			}
+			seen.AppsOf[space.GUID] = true
+			if !col.opts.IncludeServices {
+				return nil
+			}
+			rows, err := col.serviceRows(runID, org, space)
+			if err != nil {
+				return skip(spaceKey, "service instances of space", err)
+			}
+			services = append(services, rows...)
+			return nil
+		})
+		if err != nil {
+			return skip(orgKey, "spaces of org", err)
+		}
+		seen.SpacesOf[org.GUID] = true
+		return nil
+	})
+	if progress != nil {
+		progress.doneListing()
+	}
+	var burst time.Time
+	if err == nil && len(pending) != 0 {
+		col.warnRateLimit(len(pending))
+		burst = time.Now()
+		for _, job := range pending {
+			if atomic.LoadInt32(&failed) != 0 || ctx.Err() != nil {
+				break
+			}
+			jobs <- job
+		}
+	}
+	close(jobs)
+	<-gathered
+	if progress != nil {
+		progress.finish()
+	}
+	var stoppedErr *report.Error
+	if ctx.Err() != nil {
+		// the errors are only that requests were abandoned
+		err, workerErr = nil, nil
+		stopped := "interrupted, so only part of the installation was crawled"
+		if base.Err() == nil {
+			stopped = fmt.Sprintf("stopped after the --timeout of %s, so only part of the installation was crawled", col.opts.Timeout)
+		}
+		stoppedErr = &report.Error{Description: stopped}
+		// always shown, even with --quiet, as the report is incomplete
+		log.Printf("warning: crawl %s", stopped)
+	}
+	if workerErr != nil {
+		return nil, workerErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	var appeared []string
+	if ctx.Err() == nil {
+		appeared, err = col.appeared(seen)
+		if err != nil {
+			log.Printf("warning: couldn't check for orgs, spaces and apps created while crawling: %s", err)
+		}
+		for _, key := range appeared {
+			if !col.client.Quiet {
+				log.Printf("warning: /%s was created while crawling, after the list it is in was read, so is left out until the next run", key)
+			}
+		}
+	}
+	if col.opts.Exclude.active() && !col.client.Quiet {
+		log.Printf("excluded %d orgs and %d spaces", excludedOrgs, excludedSpaces)
+	}
+	if !burst.IsZero() && !col.client.Quiet {
+		log.Printf("fetched the stats of %d apps in %s", len(pending), time.Since(burst).Round(time.Millisecond))
+	}
+
+	var allInfo []*appUsageInfo
+	var skippedKeys []string
+	errs := crawlErrs
+	if stoppedErr != nil {
+		errs = append(errs, stoppedErr)
+	}
+	for i := 0; i < seq; i++ {
+		allInfo = append(allInfo, byApp[i]...)
+		if re, ok := skipped[i]; ok {
+			skippedKeys = append(skippedKeys, re.Key)
+			errs = append(errs, re)
+		}
+		if key, ok := deletedApps[i]; ok {
+			vanished = append(vanished, key)
+		}
+	}
+	sort.Strings(vanished)
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errs[i].Key < errs[j].Key
+	})
+	allInfo = append(allInfo, services...)
+	if col.opts.IncludeServices && !col.client.Quiet {
+		log.Printf("attributed the memory of %d service instances", len(services))
+	}
+	if len(skippedKeys) != 0 {
+		// always shown, even with --quiet, as the report is incomplete
+		log.Printf("warning: skipped %d of %d apps as their stats could not be fetched, report is incomplete", len(skippedKeys), seq)
+	}
+	if len(crawlErrs) != 0 {
+		log.Printf("warning: %d orgs or spaces could not be fully listed, report is incomplete", len(crawlErrs))
+	}
+	if len(vanished) != 0 && !col.client.Quiet {
+		log.Printf("warning: left out %d orgs, spaces or apps deleted while crawling", len(vanished))
+	}
+
+	for _, info := range allInfo {
+		info.Tag = col.opts.Tag
+	}
+	rep := &usageReport{
+		RunID:    runID,
+		Tag:      col.opts.Tag,
+		Time:     started,
+		Skipped:  skippedKeys,
+		Errors:   errs,
+		Vanished: vanished,
+		Appeared: appeared,
+		Partial:  col.opts.Scope != (reportScope{}) || col.opts.Exclude.active(),
+		Shard:    col.opts.Shard.String(),
+
+		OrgMemoryLimits:   orgLimits,
+		SpaceMemoryLimits: spaceLimits,
+
+		Rows: report.AddTotals(runID, allInfo),
+	}
+	if col.opts.FreshOrg != "" {
+		rep, err = col.withCached(rep)
+		if err != nil {
+			return nil, err
+		}
+	}
+	col.summary.record(rep)
+	return rep, nil
+}
+
+// warnRateLimit warns if fetching the stats of apps at once will run into
+// the cloud controller's rate limit, which spreads the burst out again as
+// rate limited requests are retried
+func (col *collector) warnRateLimit(apps int) {
+	remaining, ok := col.client.RateLimit()
+	if ok && remaining < apps {
+		log.Printf("warning: fetching the stats of %d apps, but only %d more requests are allowed before rate limiting, so samples will be further apart", apps, remaining)
+	}
+}
+
+// appRows fetches the stats of each instance of a started app, returning
+// a row per instance, in instance order
+func (col *collector) appRows(runID string, org *cfOrg, space *cfSpace, app *cfApp) ([]*appUsageInfo, error) {
+	stats, err := col.api.InstanceStats(app)
+	if err != nil {
+		return nil, err
+	}
+	sampled := time.Now()
+
+	if col.opts.Buildpacks && app.Buildpack == "" {
+		app.Buildpack, err = col.api.DetectedBuildpack(app)
+		if err != nil {
+			// only needed for the buildpack analysis, which lists it as unknown
+			log.Printf("warning: unable to read the buildpack of %s: %s", app.Name, err)
+		}
+	}
+
+	var instances, unhealthy []string
+	for instanceIdx, instanceStat := range stats {
+		instances = append(instances, instanceIdx)
+		if instanceStat.State == "CRASHED" || instanceStat.State == "DOWN" {
+			unhealthy = append(unhealthy, instanceIdx)
+		}
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instanceLess(instances[i], instances[j])
+	})
+
+	var last map[string]*lastMemory
+	if len(unhealthy) != 0 {
+		last, err = col.logCache.LastMemory(app.GUID, unhealthy)
+		if err != nil {
+			// best effort only, as log-cache may not be deployed
+			log.Printf("warning: unable to read last memory usage of %s from log-cache: %s", app.Name, err)
+		}
+	}
+
+	var rows []*appUsageInfo
+	for _, instanceIdx := range instances {
+		instanceStat := stats[instanceIdx]
+		info := &appUsageInfo{
+			RunID: runID,
+			Key: fmt.Sprintf("%s/%s/%s/%s",
+				noSlash(org.Name),
+				noSlash(space.Name),
+				noSlash(app.Name),
+				noSlash(instanceIdx),
+			),
+			MemoryUsage: instanceStat.MemoryUsage,
+			MemoryQuota: instanceStat.MemoryQuota,
+			DiskUsage:   instanceStat.DiskUsage,
+			DiskQuota:   instanceStat.DiskQuota,
+			SampledAt:   &sampled,
+			State:       instanceStat.State,
+			Buildpack:   app.Buildpack,
+			Stack:       app.Stack,
+			Cell:        instanceStat.Host,
+			Labels:      inheritedLabels(col.opts.Labels, org, space, app),
+		}
+		if lm, ok := last[instanceIdx]; ok {
+			info.LastMemoryUsage = lm.Usage
+			info.LastReportedAt = &lm.At
+		}
+		rows = append(rows, info)
+	}
+	return rows, nil
+}
+
+// instanceLess orders instance keys numerically where they are indexes
+// ("2" before "10"), and otherwise as strings ("worker-0")
+func instanceLess(a, b string) bool {
+	ai, aErr := strconv.Atoi(a)
+	bi, bErr := strconv.Atoi(b)
+	switch {
+	case aErr == nil && bErr == nil:
+		return ai < bi
+	case aErr == nil:
+		return true
+	case bErr == nil:
+		return false
+	default:
+		return a < b
+	}
+}
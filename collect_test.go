@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/govau/cf-report-memory-usage/internal/cfclient"
+	"github.com/govau/cf-report-memory-usage/report"
+)
+
+// fakeCC serves a v3 installation of two orgs, where the stats of one app
+// can't be fetched, and any extra responses, by request URI
+func fakeCC(extra map[string]string) *httptest.Server {
+	// next links are absolute, so are written with the server's URL as BASE
+	page := func(next string, resources ...string) string {
+		href := "null"
+		if next != "" {
+			href = fmt.Sprintf(`{"href": "BASE%s"}`, next)
+		}
+		return fmt.Sprintf(`{"pagination": {"next": %s}, "resources": [%s]}`, href, strings.Join(resources, ","))
+	}
+	stats := func(typ string, index int, state string, mem, memQuota int) string {
+		return fmt.Sprintf(`{"type": "%s", "index": %d, "state": "%s", "host": "10.0.0.%d", "mem_quota": %d, "disk_quota": 1024, "usage": {"mem": %d, "disk": 512}}`, typ, index, state, index+1, memQuota, mem)
+	}
+	responses := map[string]string{
+		"/v3/organizations":                  page("", `{"guid": "org1", "name": "o1"}`, `{"guid": "org2", "name": "o2"}`),
+		"/v3/spaces?organization_guids=org1": page("", `{"guid": "space1", "name": "s1"}`),
+		"/v3/spaces?organization_guids=org2": page("", `{"guid": "space2", "name": "s2"}`),
+		"/v3/apps?space_guids=space1":        page("/v3/apps?space_guids=space1&page=2", `{"guid": "a", "name": "a", "state": "STARTED"}`, `{"guid": "b", "name": "b", "state": "STARTED"}`),
+		"/v3/apps?space_guids=space1&page=2": page("", `{"guid": "c", "name": "c", "state": "STOPPED"}`),
+		"/v3/apps?space_guids=space2":        page("", `{"guid": "d", "name": "d", "state": "STARTED"}`),
+		"/v3/apps/a/processes":               page("", `{"guid": "a-web", "type": "web", "instances": 2}`),
+		"/v3/apps/b/processes":               page("", `{"guid": "b-web", "type": "web", "instances": 1}`),
+		"/v3/apps/d/processes":               page("", `{"guid": "d-web", "type": "web", "instances": 2}`, `{"guid": "d-worker", "type": "worker", "instances": 1}`, `{"guid": "d-task", "type": "task", "instances": 0}`),
+		"/v3/processes/a-web/stats":          page("", stats("web", 0, "RUNNING", 100, 256), stats("web", 1, "CRASHED", 0, 256)),
+		"/v3/processes/d-web/stats":          page("", stats("web", 0, "RUNNING", 300, 512), stats("web", 1, "RUNNING", 200, 512)),
+		"/v3/processes/d-worker/stats":       page("", stats("worker", 0, "RUNNING", 1000, 2048)),
+		"/":                                  `{"links": {}}`,
+	}
+	for uri, body := range extra {
+		responses[uri] = body
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v3/processes/b-web/stats":
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{"errors": [{"code": 10001, "title": "CF-StatsError", "detail": "Stats server temporarily unavailable."}]}`)
+			return
+		case strings.HasPrefix(r.URL.Path, "/api/v1/read/"):
+			// log-cache has no metrics for the crashed instance
+			fmt.Fprint(w, `{"envelopes": {"batch": []}}`)
+			return
+		}
+		body, ok := responses[r.URL.RequestURI()]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, strings.Replace(body, "BASE", "http://"+r.Host, -1))
+	}))
+}
+
+// newTestCollector returns a collector for srv using the v3 API
+func newTestCollector(t *testing.T, srv *httptest.Server, opts collectorOptions) *collector {
+	client := &cfclient.Client{API: srv.URL, Authorization: "bearer test", Quiet: true, Client: srv.Client()}
+	opts.APIVersion = apiVersionV3
+	opts.Concurrency = 2
+	col, err := newCollector(client, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return col
+}
+
+func TestCollectTotals(t *testing.T) {
+	srv := fakeCC(nil)
+	defer srv.Close()
+	rep, err := newTestCollector(t, srv, collectorOptions{}).collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		Key                      string
+		MemoryUsage, MemoryQuota int
+		DiskUsage                int
+		NotRunning               int
+	}{
+		{"o1/s1/a/0", 100, 256, 512, 0},
+		{"o1/s1/a/1", 0, 256, 512, 0},
+		{"o2/s2/d/0", 300, 512, 512, 0},
+		{"o2/s2/d/1", 200, 512, 512, 0},
+		{"o2/s2/d/worker-0", 1000, 2048, 512, 0},
+		{"", 1600, 3584, 2560, 1},
+		{"o1", 100, 512, 1024, 1},
+		{"o1/s1", 100, 512, 1024, 1},
+		{"o1/s1/a", 100, 512, 1024, 1},
+		{"o2", 1500, 3072, 1536, 0},
+		{"o2/s2", 1500, 3072, 1536, 0},
+		{"o2/s2/d", 1500, 3072, 1536, 0},
+	}
+	if len(rep.Rows) != len(want) {
+		var keys []string
+		for _, row := range rep.Rows {
+			keys = append(keys, "/"+row.Key)
+		}
+		t.Fatalf("got rows %s, want %d rows", strings.Join(keys, " "), len(want))
+	}
+	for i, w := range want {
+		row := rep.Rows[i]
+		if row.Key != w.Key || row.MemoryUsage != w.MemoryUsage || row.MemoryQuota != w.MemoryQuota || row.DiskUsage != w.DiskUsage || row.NotRunning != w.NotRunning {
+			t.Errorf("row %d: got /%s %d/%d disk %d not running %d, want /%s %d/%d disk %d not running %d", i,
+				row.Key, row.MemoryUsage, row.MemoryQuota, row.DiskUsage, row.NotRunning,
+				w.Key, w.MemoryUsage, w.MemoryQuota, w.DiskUsage, w.NotRunning)
+		}
+		if row.RunID != rep.RunID {
+			t.Errorf("row %d: run ID %s, want %s", i, row.RunID, rep.RunID)
+		}
+	}
+	if rep.Row("o1/s1/a/1").State != "CRASHED" || rep.Row("o2/s2/d/worker-0").Cell != "10.0.0.1" {
+		t.Errorf("instance state and cell not recorded")
+	}
+
+	if strings.Join(rep.Skipped, ",") != "o1/s1/b" {
+		t.Errorf("skipped %v, want o1/s1/b", rep.Skipped)
+	}
+	if len(rep.Errors) != 1 || rep.Errors[0].Key != "o1/s1/b" || rep.Errors[0].StatusCode != http.StatusInternalServerError || rep.Errors[0].Code != "CF-StatsError" {
+		t.Errorf("got errors %+v, want the stats of o1/s1/b failing", rep.Errors)
+	}
+}
+
+func TestCollectFailsWithErrorPolicyFail(t *testing.T) {
+	srv := fakeCC(nil)
+	defer srv.Close()
+	_, err := newTestCollector(t, srv, collectorOptions{ErrorPolicy: errorPolicyFail}).collect()
+	if err == nil || !strings.Contains(err.Error(), "CF-StatsError") {
+		t.Errorf("got %v, want the stats error", err)
+	}
+}
+
+func TestCollectVanished(t *testing.T) {
+	// o3 and app e are deleted after being listed, so their spaces and
+	// processes aren't found, and d is listed again on the next page
+	srv := fakeCC(map[string]string{
+		"/v3/organizations":                  `{"pagination": {"next": null}, "resources": [{"guid": "org1", "name": "o1"}, {"guid": "org2", "name": "o2"}, {"guid": "org3", "name": "o3"}]}`,
+		"/v3/apps?space_guids=space2":        `{"pagination": {"next": {"href": "BASE/v3/apps?space_guids=space2&page=2"}}, "resources": [{"guid": "d", "name": "d", "state": "STARTED"}, {"guid": "e", "name": "e", "state": "STARTED"}]}`,
+		"/v3/apps?space_guids=space2&page=2": `{"pagination": {"next": null}, "resources": [{"guid": "d", "name": "d", "state": "STARTED"}]}`,
+	})
+	defer srv.Close()
+	rep, err := newTestCollector(t, srv, collectorOptions{ErrorPolicy: errorPolicyFail}).collect()
+	if err == nil || !strings.Contains(err.Error(), "CF-StatsError") {
+		t.Fatalf("got %v, want only the stats error to fail the crawl", err)
+	}
+
+	rep, err = newTestCollector(t, srv, collectorOptions{}).collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(rep.Vanished, ",") != "o2/s2/e,o3" {
+		t.Errorf("vanished %v, want o2/s2/e,o3", rep.Vanished)
+	}
+	if strings.Join(rep.Skipped, ",") != "o1/s1/b" || len(rep.Errors) != 1 {
+		t.Errorf("got errors %+v, want only the stats of o1/s1/b failing", rep.Errors)
+	}
+	if total := rep.Row("o2/s2/d"); total == nil || total.MemoryUsage != 1500 || total.MemoryQuota != 3072 {
+		t.Errorf("got o2/s2/d of %+v, want 1500/3072, counted once", total)
+	}
+}
+
+func TestCollectAppeared(t *testing.T) {
+	// o3, o2/s3 and app f are created after the lists they are in are
+	// first read, so are only there when listed again
+	created := map[string]string{
+		"/v3/organizations":                  `{"pagination": {"next": null}, "resources": [{"guid": "org1", "name": "o1"}, {"guid": "org2", "name": "o2"}, {"guid": "org3", "name": "o3"}]}`,
+		"/v3/spaces?organization_guids=org2": `{"pagination": {"next": null}, "resources": [{"guid": "space2", "name": "s2"}, {"guid": "space3", "name": "s3"}]}`,
+		"/v3/apps?space_guids=space1&page=2": `{"pagination": {"next": null}, "resources": [{"guid": "c", "name": "c", "state": "STOPPED"}, {"guid": "f", "name": "f", "state": "STARTED"}]}`,
+	}
+	cc := fakeCC(nil)
+	defer cc.Close()
+	requested := make(map[string]bool)
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		again := requested[r.URL.RequestURI()]
+		requested[r.URL.RequestURI()] = true
+		mu.Unlock()
+		if body, ok := created[r.URL.RequestURI()]; ok && again {
+			fmt.Fprint(w, body)
+			return
+		}
+		cc.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	rep, err := newTestCollector(t, srv, collectorOptions{}).collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(rep.Appeared, ","); got != "o1/s1/f,o2/s3,o3" {
+		t.Errorf("appeared %s, want o1/s1/f,o2/s3,o3", got)
+	}
+	if rep.Row("o3") != nil || rep.Row("o1/s1/f") != nil || len(rep.Errors) != 1 {
+		t.Errorf("got what appeared in the report, or errors %+v, want them left out and only the stats of o1/s1/b failing", rep.Errors)
+	}
+}
+
+func TestCollectScope(t *testing.T) {
+	// the org is fetched by GUID rather than listed
+	srv := fakeCC(map[string]string{"/v3/organizations/org2": `{"guid": "org2", "name": "o2"}`})
+	defer srv.Close()
+	scope := reportScope{OrgGUID: "org2", OrgName: "o2"}
+	rep, err := newTestCollector(t, srv, collectorOptions{Scope: scope}).collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total := rep.Total(); total.MemoryUsage != 1500 || total.MemoryQuota != 3072 {
+		t.Errorf("got a total of %d/%d, want 1500/3072, o2 only", total.MemoryUsage, total.MemoryQuota)
+	}
+	if rep.Incomplete() {
+		t.Errorf("got errors %+v, want none", rep.Errors)
+	}
+}
+
+func TestCollectExcludes(t *testing.T) {
+	srv := fakeCC(nil)
+	defer srv.Close()
+	for _, tc := range []struct {
+		Orgs, Spaces []string
+		Want         int
+	}{
+		{[]string{"regex:^o1$"}, nil, 1500},
+		{[]string{"system", "p-*"}, []string{"s2"}, 100},
+		{nil, []string{"o2/s*"}, 100},
+		{[]string{"o*"}, nil, 0},
+	} {
+		var exclude exclusions
+		for _, spec := range tc.Orgs {
+			if err := exclude.Orgs.Set(spec); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, spec := range tc.Spaces {
+			if err := exclude.Spaces.Set(spec); err != nil {
+				t.Fatal(err)
+			}
+		}
+		rep, err := newTestCollector(t, srv, collectorOptions{Exclude: exclude}).collect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a report of nothing has no total
+		got := 0
+		if total := rep.Total(); total != nil {
+			got = total.MemoryUsage
+		}
+		if got != tc.Want {
+			t.Errorf("excluding orgs %s and spaces %s: got a total of %d, want %d", exclude.Orgs.String(), exclude.Spaces.String(), got, tc.Want)
+		}
+	}
+
+	var invalid namePatterns
+	if invalid.Set("[") == nil || invalid.Set("regex:(") == nil {
+		t.Error("invalid patterns accepted")
+	}
+}
+
+func TestCollectFreshOrg(t *testing.T) {
+	srv := fakeCC(map[string]string{"/v3/organizations/org2": `{"guid": "org2", "name": "o2"}`})
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "fresh-org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := collectorOptions{Scope: reportScope{OrgGUID: "org2", OrgName: "o2"}, FreshOrg: "o2", HistoryDir: dir}
+	_, err = newTestCollector(t, srv, opts).collect()
+	if err != errNoCachedRun {
+		t.Errorf("got %v without a cached run, want errNoCachedRun", err)
+	}
+
+	// the cached run has o2 using far less, and an o3 since deleted
+	cached := &usageReport{RunID: "cached", Time: time.Now().Add(-time.Hour), Rows: report.AddTotals("cached", []*appUsageInfo{
+		{RunID: "cached", Key: "o1/s1/a/0", MemoryUsage: 10, MemoryQuota: 256},
+		{RunID: "cached", Key: "o2/s2/d/0", MemoryUsage: 1, MemoryQuota: 512},
+		{RunID: "cached", Key: "o3/s3/e/0", MemoryUsage: 5, MemoryQuota: 128},
+	})}
+	err = (&historyStore{Dir: dir, Quiet: true}).Write(cached)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Exclude.Orgs.Set("o3")
+	rep, err := newTestCollector(t, srv, opts).collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total := rep.Total(); total.MemoryUsage != 1510 || total.MemoryQuota != 3328 {
+		t.Errorf("got a total of %d/%d, want 1510/3328, o1 cached and o2 fresh", total.MemoryUsage, total.MemoryQuota)
+	}
+	if rep.FreshOrg != "o2" || rep.CachedRunID != "cached" || rep.Row("o1/s1/a/0").RunID != rep.RunID {
+		t.Errorf("got fresh %s from %s, want o2 from the cached run, relabelled", rep.FreshOrg, rep.CachedRunID)
+	}
+	if !strings.Contains(describeRun(rep), "only o2 crawled, the rest is from run cached") {
+		t.Errorf("got %q", describeRun(rep))
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// namedWindows are shorthands accepted by --compare-window
+var namedWindows = map[string]string{
+	"business-hours": "mon-fri 09:00-17:00",
+	"after-hours":    "mon-fri 17:00-09:00",
+	"overnight":      "00:00-06:00",
+	"weekend":        "sat-sun 00:00-24:00",
+}
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// timeWindow is a recurring period of the day on some days of the week
+type timeWindow struct {
+	Name string
+
+	// Days the window starts on, indexed by time.Weekday
+	Days [7]bool
+
+	// Start and End are minutes since midnight. If End is before Start the
+	// window runs past midnight.
+	Start, End int
+}
+
+// parseWindow parses a window of the form "[DAYS ]HH:MM-HH:MM", where DAYS
+// is a range ("mon-fri") or list ("sat,sun"), or one of the namedWindows
+func parseWindow(s string) (*timeWindow, error) {
+	w := &timeWindow{Name: s}
+	spec, ok := namedWindows[s]
+	if !ok {
+		spec = s
+	}
+
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 1:
+		for i := range w.Days {
+			w.Days[i] = true
+		}
+	case 2:
+		err := parseWeekdays(fields[0], &w.Days)
+		if err != nil {
+			return nil, fmt.Errorf("invalid window %q: %s", s, err)
+		}
+		fields = fields[1:]
+	default:
+		return nil, fmt.Errorf("invalid window %q, expected [DAYS ]HH:MM-HH:MM", s)
+	}
+
+	times := strings.Split(fields[0], "-")
+	if len(times) != 2 {
+		return nil, fmt.Errorf("invalid window %q, expected [DAYS ]HH:MM-HH:MM", s)
+	}
+	var err error
+	w.Start, err = parseClock(times[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid window %q: %s", s, err)
+	}
+	w.End, err = parseClock(times[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid window %q: %s", s, err)
+	}
+	return w, nil
+}
+
+// parseWeekdays sets days from "mon-fri" or "sat,sun" style specs
+func parseWeekdays(s string, days *[7]bool) error {
+	idx := func(name string) (int, error) {
+		for i, n := range weekdayNames {
+			if n == name {
+				return i, nil
+			}
+		}
+		return 0, fmt.Errorf("unknown day: %s", name)
+	}
+	for _, part := range strings.Split(strings.ToLower(s), ",") {
+		bits := strings.Split(part, "-")
+		from, err := idx(bits[0])
+		if err != nil {
+			return err
+		}
+		to := from
+		if len(bits) == 2 {
+			to, err = idx(bits[1])
+			if err != nil {
+				return err
+			}
+		} else if len(bits) > 2 {
+			return fmt.Errorf("invalid days: %s", part)
+		}
+		for i := from; ; i = (i + 1) % 7 {
+			days[i] = true
+			if i == to {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseClock parses HH:MM into minutes since midnight, allowing 24:00
+func parseClock(s string) (int, error) {
+	bits := strings.Split(s, ":")
+	if len(bits) != 2 {
+		return 0, fmt.Errorf("invalid time: %s", s)
+	}
+	h, err := strconv.Atoi(bits[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid time: %s", s)
+	}
+	m, err := strconv.Atoi(bits[1])
+	if err != nil {
+		return 0, fmt.Errorf("invalid time: %s", s)
+	}
+	rv := h*60 + m
+	if h < 0 || m < 0 || m > 59 || rv > 24*60 {
+		return 0, fmt.Errorf("invalid time: %s", s)
+	}
+	return rv, nil
+}
+
+// Contains returns true if t falls in the window
+func (w *timeWindow) Contains(t time.Time) bool {
+	mins := t.Hour()*60 + t.Minute()
+	day := int(t.Weekday())
+	if w.Start <= w.End {
+		return w.Days[day] && mins >= w.Start && mins < w.End
+	}
+	// past midnight, so either in the evening of a start day, or the morning after one
+	return (w.Days[day] && mins >= w.Start) || (w.Days[(day+6)%7] && mins < w.End)
+}
+
+// parseCompareWindows parses "WINDOW vs WINDOW"
+func parseCompareWindows(s string) ([]*timeWindow, error) {
+	bits := strings.Split(s, " vs ")
+	if len(bits) != 2 {
+		return nil, fmt.Errorf("invalid comparison %q, expected \"WINDOW vs WINDOW\"", s)
+	}
+	var rv []*timeWindow
+	for _, b := range bits {
+		w, err := parseWindow(strings.TrimSpace(b))
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, w)
+	}
+	return rv, nil
+}
+
+// windowUsage is the mean usage of an org during a window
+type windowUsage struct {
+	Window      string
+	Samples     int
+	MemoryUsage int
+	MemoryQuota int
+}
+
+// windowComparison compares an org's usage across two windows. Org is ""
+// for the whole installation.
+type windowComparison struct {
+	Org     string
+	Windows []*windowUsage
+
+	// IdleMemory is how much less memory is used on average in the second
+	// window than in the first
+	IdleMemory int
+}
+
+// compareWindows averages each org's usage in the history over the two
+// windows, evaluated in loc
+func compareWindows(hs *historyStore, windows []*timeWindow, loc *time.Location) ([]*windowComparison, error) {
+	type sums struct {
+		samples, usage, quota int
+	}
+	byOrg := make(map[string][]*sums)
+	err := hs.forEachOrgSample(func(t time.Time, org string, usage, quota, weight int) error {
+		s, ok := byOrg[org]
+		if !ok {
+			s = make([]*sums, len(windows))
+			for i := range s {
+				s[i] = &sums{}
+			}
+			byOrg[org] = s
+		}
+		for i, w := range windows {
+			if w.Contains(t.In(loc)) {
+				s[i].samples += weight
+				s[i].usage += usage * weight
+				s[i].quota += quota * weight
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var rv []*windowComparison
+	for org, s := range byOrg {
+		wc := &windowComparison{Org: org}
+		for i, w := range windows {
+			wu := &windowUsage{Window: w.Name, Samples: s[i].samples}
+			if wu.Samples != 0 {
+				wu.MemoryUsage = s[i].usage / wu.Samples
+				wu.MemoryQuota = s[i].quota / wu.Samples
+			}
+			wc.Windows = append(wc.Windows, wu)
+		}
+		wc.IdleMemory = wc.Windows[0].MemoryUsage - wc.Windows[1].MemoryUsage
+		rv = append(rv, wc)
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		if rv[i].IdleMemory != rv[j].IdleMemory {
+			return rv[i].IdleMemory > rv[j].IdleMemory
+		}
+		return rv[i].Org < rv[j].Org
+	})
+	return rv, nil
+}
+
+// renderComparison writes the comparison as a table or JSON
+func renderComparison(out io.Writer, comparisons []*windowComparison, windows []*timeWindow, format string) error {
+	switch format {
+	case formatJSON:
+		return json.NewEncoder(out).Encode(comparisons)
+	case formatTable:
+		// handled below
+	default:
+		return fmt.Errorf("unknown format: %s", format)
+	}
+
+	table := tablewriter.NewWriter(out)
+	table.SetHeader([]string{"Org", windows[0].Name, windows[1].Name, "Idle", "Percent"})
+	for _, wc := range comparisons {
+		table.Append([]string{
+			fmt.Sprintf("/%s", wc.Org),
+			toHumanSize(wc.Windows[0].MemoryUsage),
+			toHumanSize(wc.Windows[1].MemoryUsage),
+			toHumanSize(wc.IdleMemory),
+			toPercent(wc.IdleMemory, wc.Windows[0].MemoryUsage),
+		})
+	}
+	table.Render()
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+)
+
+const (
+	compressGzip = "gzip"
+	compressZstd = "zstd"
+)
+
+// reportCompressor compresses files and uploads, with gzip, or with zstd
+// using the zstd command, as there is no zstd in the standard library
+type reportCompressor struct {
+	Algorithm string
+}
+
+// newCompressor checks the algorithm, and that zstd is installed if needed
+func newCompressor(algorithm string) (*reportCompressor, error) {
+	switch algorithm {
+	case compressGzip:
+	case compressZstd:
+		_, err := exec.LookPath("zstd")
+		if err != nil {
+			return nil, fmt.Errorf("zstd is needed to compress with zstd: %s", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown compression, expected gzip or zstd: %s", algorithm)
+	}
+	return &reportCompressor{Algorithm: algorithm}, nil
+}
+
+// suffix is the extension for files compressed by rc
+func (rc *reportCompressor) suffix() string {
+	return compressionSuffixes[rc.Algorithm]
+}
+
+// compressionSuffixes are the extensions of compressed files, by algorithm
+var compressionSuffixes = map[string]string{
+	compressGzip: ".gz",
+	compressZstd: ".zst",
+}
+
+// compress returns data compressed
+func (rc *reportCompressor) compress(data []byte) ([]byte, error) {
+	if rc.Algorithm == compressZstd {
+		return runFilter(bytes.NewReader(data), "zstd", "-q", "-c")
+	}
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	_, err := zw.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// gzipMagic and zstdMagic start every gzip and zstd file
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// readMaybeCompressed returns the contents of path, decompressed if it is
+// compressed, so that compressed snapshots and files can be compared as
+// uncompressed ones are. Files are recognised by their contents rather than
+// their names, as file sinks don't change the path they are given.
+func readMaybeCompressed(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(data, gzipMagic):
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		defer zr.Close()
+		data, err = ioutil.ReadAll(zr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		return data, nil
+	case bytes.HasPrefix(data, zstdMagic):
+		data, err = runFilter(bytes.NewReader(data), "zstd", "-q", "-d", "-c")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		return data, nil
+	default:
+		return data, nil
+	}
+}
+
+// runFilter runs a command with in as its stdin, returning its stdout
+func runFilter(in io.Reader, command string, args ...string) ([]byte, error) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd := exec.Command(command, args...)
+	cmd.Stdin = in
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %s: %s", command, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reportsConfig is the top level of the file passed via --config
+type reportsConfig struct {
+	// Reports to produce, each from the same crawl of the installation
+	Reports []*reportConfig `json:"reports"`
+
+	// Digests summarise trends from a history sink, and need no crawl
+	Digests []*digestConfig `json:"digests"`
+
+	// Thresholds, if set, alert on apps using too much of their quota,
+	// checked after each crawl
+	Thresholds *thresholdConfig `json:"thresholds"`
+}
+
+// reportConfig defines a single named report
+type reportConfig struct {
+	// Name identifies the report in progress messages and errors
+	Name string `json:"name"`
+
+	// Org and Space, if set, limit the report to an org, or a space within
+	// it, by name, as for --org and --space. The crawl still covers every
+	// report, so each is cut from the same crawl.
+	Org   string `json:"org"`
+	Space string `json:"space"`
+
+	// Format is one of "table", "json", "csv", "prometheus" or "html", defaulting to "table"
+	Format string `json:"format"`
+
+	// Metric is which usage to show in tables: "memory" (the default), "disk" or "both"
+	Metric string `json:"metric"`
+
+	// MaxKeyWidth and WrapKeys are as for --max-key-width and --wrap-keys
+	MaxKeyWidth int  `json:"max_key_width"`
+	WrapKeys    bool `json:"wrap_keys"`
+
+	// Align and Plain are as for --align and --plain
+	Align string `json:"align"`
+	Plain bool   `json:"plain"`
+
+	// Unit is as for --unit, ie "GB"
+	Unit string `json:"unit"`
+
+	// Quotas is as for --quotas
+	Quotas bool `json:"quotas"`
+
+	// ShowUnhealthy is as for --show-unhealthy
+	ShowUnhealthy bool `json:"show_unhealthy"`
+
+	// MinPercent, MaxPercent and Top are as for --min-percent, --max-percent and --top
+	MinPercent percentFlag `json:"min_percent"`
+	MaxPercent percentFlag `json:"max_percent"`
+	Top        int         `json:"top"`
+
+	// GroupBy is as for --group-by
+	GroupBy string `json:"group_by"`
+
+	// Sort is as for --sort, ie "percent:asc"
+	Sort rowSort `json:"sort"`
+
+	// Output is the file to write to, or "-" for stdout. Defaults to stdout
+	// if no other sinks are given.
+	Output string `json:"output"`
+
+	// Sinks are additional destinations, in the same form as --sink,
+	// ie "webhook:https://example.com/hook"
+	Sinks []string `json:"sinks"`
+
+	// Every, if set, is how often to re-run the report, ie "1h" or "24h".
+	// If no reports have it set, each report is run once and we exit.
+	Every duration `json:"every"`
+
+	sinks []sink
+}
+
+// scope returns the part of rep the report is limited to, or rep if it
+// isn't. The org's own quota and errors are kept for a space.
+func (rc *reportConfig) scope(rep *usageReport) *usageReport {
+	if rc.Org == "" {
+		return rep
+	}
+	prefix := noSlash(rc.Org)
+	if rc.Space != "" {
+		prefix += "/" + noSlash(rc.Space)
+	}
+	return within(rep, func(key string) bool {
+		return key == prefix || strings.HasPrefix(key, prefix+"/") ||
+			(rc.Space != "" && key == noSlash(rc.Org))
+	})
+}
+
+// needsQuotas returns true if org and space quotas must be collected, for
+// a report that shows them or to forecast quota breaches
+func (conf *reportsConfig) needsQuotas() bool {
+	for _, rc := range conf.Reports {
+		if rc.Quotas {
+			return true
+		}
+	}
+	return conf.Thresholds != nil && conf.Thresholds.Forecast != nil
+}
+
+// duration is a time.Duration that is parsed from strings such as "1h30m" or
+// "90d", both as a flag and in JSON config
+type duration time.Duration
+
+// UnmarshalJSON parses a duration string
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+	return d.Set(s)
+}
+
+// Set parses a duration string, implementing flag.Value
+func (d *duration) Set(s string) error {
+	dd, err := parseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(dd)
+	return nil
+}
+
+func (d *duration) String() string {
+	return time.Duration(*d).String()
+}
+
+// parseDuration is time.ParseDuration but also accepts a whole number of
+// days ("90d") or weeks ("2w"), which are more natural for retention periods
+func parseDuration(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+	} {
+		if strings.HasSuffix(s, suffix) {
+			n, err := strconv.Atoi(strings.TrimSuffix(s, suffix))
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration: %s", s)
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+	return time.ParseDuration(s)
+}
+
+// loadConfig reads and validates a reports config file
+// opts provides settings shared by all sinks, with the format taken from each report.
+func loadConfig(path string, opts sinkOptions) (*reportsConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var conf reportsConfig
+	err = json.NewDecoder(f).Decode(&conf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	if len(conf.Reports) == 0 && len(conf.Digests) == 0 {
+		return nil, fmt.Errorf("%s: no reports defined", path)
+	}
+	seen := make(map[string]bool)
+	for i, rc := range conf.Reports {
+		if rc.Name == "" {
+			return nil, fmt.Errorf("%s: report %d has no name", path, i)
+		}
+		if seen[rc.Name] {
+			return nil, fmt.Errorf("%s: duplicate report name: %s", path, rc.Name)
+		}
+		seen[rc.Name] = true
+		if rc.Space != "" && rc.Org == "" {
+			return nil, fmt.Errorf("%s: report %s: space needs an org", path, rc.Name)
+		}
+
+		render := renderOptions{
+			Format:        rc.Format,
+			Metric:        rc.Metric,
+			MaxKeyWidth:   rc.MaxKeyWidth,
+			WrapKeys:      rc.WrapKeys,
+			Align:         rc.Align,
+			Plain:         rc.Plain,
+			Unit:          rc.Unit,
+			Quotas:        rc.Quotas,
+			ShowUnhealthy: rc.ShowUnhealthy,
+			Filter: rowFilter{
+				MinPercent: rc.MinPercent,
+				MaxPercent: rc.MaxPercent,
+				Top:        rc.Top,
+			},
+			GroupBy: rc.GroupBy,
+			Sort:    rc.Sort,
+		}
+		err = render.validate()
+		if err != nil {
+			return nil, fmt.Errorf("%s: report %s: %s", path, rc.Name, err)
+		}
+		if rc.Output == "" && len(rc.Sinks) == 0 {
+			rc.Output = "-"
+		}
+		specs := rc.Sinks
+		if rc.Output != "" {
+			if rc.Output != "-" {
+				specs = append([]string{"file:" + rc.Output}, specs...)
+			} else {
+				specs = append([]string{"-"}, specs...)
+			}
+		}
+		for _, spec := range specs {
+			opts.Render = render
+			s, err := parseSink(spec, opts)
+			if err != nil {
+				return nil, fmt.Errorf("%s: report %s: %s", path, rc.Name, err)
+			}
+			rc.sinks = append(rc.sinks, s)
+		}
+		if rc.Every < 0 {
+			return nil, fmt.Errorf("%s: report %s: every must not be negative", path, rc.Name)
+		}
+	}
+
+	if conf.Thresholds != nil {
+		if len(conf.Reports) == 0 {
+			return nil, fmt.Errorf("%s: thresholds need a report, to crawl the installation", path)
+		}
+		err = conf.Thresholds.validate()
+		if err != nil {
+			return nil, fmt.Errorf("%s: thresholds: %s", path, err)
+		}
+	}
+
+	seen = make(map[string]bool)
+	for i, dc := range conf.Digests {
+		if dc.Name == "" {
+			return nil, fmt.Errorf("%s: digest %d has no name", path, i)
+		}
+		if seen[dc.Name] {
+			return nil, fmt.Errorf("%s: duplicate digest name: %s", path, dc.Name)
+		}
+		seen[dc.Name] = true
+
+		err = dc.validate()
+		if err != nil {
+			return nil, fmt.Errorf("%s: digest %s: %s", path, dc.Name, err)
+		}
+		dc.encrypter = opts.Encrypter
+	}
+
+	return &conf, nil
+}
+
+// runPipelines crawls the installation and writes each configured report,
+// then sends each digest. If any report or digest is scheduled, it keeps
+// running, crawling once each time one or more reports are due, and logs
+// failures rather than returning them, as with --listen, so that one failed
+// crawl or sink doesn't stop every later run. Otherwise it returns the
+// first failure, or errPartialData if a report was incomplete.
+func runPipelines(col *collector, conf *reportsConfig) error {
+	reportsDue := make(map[*reportConfig]time.Time)
+	digestsDue := make(map[*digestConfig]time.Time)
+	now := time.Now()
+	for _, rc := range conf.Reports {
+		reportsDue[rc] = now
+	}
+	for _, dc := range conf.Digests {
+		// scheduled digests need history to build up first, so wait a period
+		digestsDue[dc] = now.Add(time.Duration(dc.Every))
+	}
+
+	scheduled := false
+	for _, rc := range conf.Reports {
+		scheduled = scheduled || rc.Every != 0
+	}
+	for _, dc := range conf.Digests {
+		scheduled = scheduled || dc.Every != 0
+	}
+	// fail returns err if nothing is scheduled, or logs it and returns nil
+	fail := func(err error) error {
+		if !scheduled {
+			return err
+		}
+		log.Printf("error: %s", err)
+		return nil
+	}
+
+	partial := false
+	for len(reportsDue)+len(digestsDue) != 0 {
+		var next time.Time
+		for _, t := range reportsDue {
+			if next.IsZero() || t.Before(next) {
+				next = t
+			}
+		}
+		for _, t := range digestsDue {
+			if next.IsZero() || t.Before(next) {
+				next = t
+			}
+		}
+		time.Sleep(time.Until(next))
+
+		now := time.Now()
+		var due []*reportConfig
+		for _, rc := range conf.Reports {
+			if t, ok := reportsDue[rc]; ok && !t.After(now) {
+				due = append(due, rc)
+			}
+		}
+		var rep *usageReport
+		if len(due) != 0 {
+			var err error
+			rep, err = col.collect()
+			if err != nil {
+				rep = nil
+				err = fail(fmt.Errorf("crawl failed: %s", err))
+				if err != nil {
+					return err
+				}
+			}
+			if rep != nil && rep.Incomplete() {
+				partial = true
+			}
+			if rep != nil && conf.Thresholds != nil {
+				breaches, err := conf.Thresholds.evaluate(rep, now)
+				if err == nil {
+					err = conf.Thresholds.notify(rep, breaches, now)
+				}
+				if err != nil {
+					err = fail(fmt.Errorf("thresholds: %s", err))
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+		for _, rc := range due {
+			// if the crawl failed, the report is retried when next due
+			if rep != nil {
+				err := writeSinks(rc.sinks, rc.scope(rep))
+				if err != nil {
+					err = fail(fmt.Errorf("report %s: %s", rc.Name, err))
+					if err != nil {
+						return err
+					}
+				}
+			}
+			if rc.Every == 0 {
+				delete(reportsDue, rc)
+			} else {
+				reportsDue[rc] = now.Add(time.Duration(rc.Every))
+			}
+		}
+
+		for _, dc := range conf.Digests {
+			t, ok := digestsDue[dc]
+			if !ok || t.After(now) {
+				continue
+			}
+			err := dc.send(time.Now())
+			if err != nil {
+				err = fail(fmt.Errorf("digest %s: %s", dc.Name, err))
+				if err != nil {
+					return err
+				}
+			}
+			if dc.Every == 0 {
+				delete(digestsDue, dc)
+			} else {
+				digestsDue[dc] = now.Add(time.Duration(dc.Every))
+			}
+		}
+	}
+
+	if partial {
+		return errPartialData
+	}
+	return nil
+}
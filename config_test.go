@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/govau/cf-report-memory-usage/report"
+)
+
+func TestReportConfigScope(t *testing.T) {
+	rep := &usageReport{
+		RunID:           "run",
+		OrgMemoryLimits: map[string]int{"o1": 1000, "o2": 1000},
+		Errors:          []*report.Error{{Key: "o1"}, {Key: "o1/s2"}, {Key: "o2/s"}},
+		Rows: report.AddTotals("run", []*appUsageInfo{
+			{Key: "o1/s1/a/0", MemoryUsage: 100, MemoryQuota: 200},
+			{Key: "o1/s2/b/0", MemoryUsage: 300, MemoryQuota: 400},
+			{Key: "o2/s/c/0", MemoryUsage: 500, MemoryQuota: 600},
+		}),
+	}
+
+	for _, test := range []struct {
+		rc     reportConfig
+		quota  int
+		errors int
+	}{
+		{reportConfig{}, 1200, 3},
+		{reportConfig{Org: "o1"}, 600, 2},
+		// the org's own errors and quota still apply to the space
+		{reportConfig{Org: "o1", Space: "s1"}, 200, 1},
+	} {
+		scoped := test.rc.scope(rep)
+		if total := scoped.Total(); total == nil || total.MemoryQuota != test.quota || len(scoped.Errors) != test.errors {
+			t.Errorf("%+v: got %+v with %d errors, want a quota of %d and %d errors", test.rc, total, len(scoped.Errors), test.quota, test.errors)
+		}
+		if test.rc.Org != "" && (!scoped.Partial || scoped.OrgMemoryLimits["o1"] != 1000 || len(scoped.OrgMemoryLimits) != 1) {
+			t.Errorf("%+v: got limits %v, partial %t, want only o1's, and partial", test.rc, scoped.OrgMemoryLimits, scoped.Partial)
+		}
+	}
+}
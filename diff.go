@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/govau/cf-report-memory-usage/report"
+	"github.com/olekukonko/tablewriter"
+)
+
+// loadSnapshot reads a run saved by a history sink, or the output of
+// --output-json, which has rows only
+func loadSnapshot(path string) (*usageReport, error) {
+	data, err := readMaybeCompressed(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rep, err := report.Read(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return rep, nil
+}
+
+// latestSnapshots returns the two most recent of paths, which are sorted
+// oldest first, and are in dir
+func latestSnapshots(dir string, paths []string) (before, after *usageReport, err error) {
+	if len(paths) < 2 {
+		return nil, nil, fmt.Errorf("need at least two runs in %s to compare", dir)
+	}
+	before, err = loadSample(paths[len(paths)-2])
+	if err != nil {
+		return nil, nil, err
+	}
+	after, err = loadSample(paths[len(paths)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+	return before, after, nil
+}
+
+// loadDiffInputs returns the runs to compare: the two files given, or if
+// none are, the latest two runs in snapshotDir or historyDir
+func loadDiffInputs(paths []string, historyDir, snapshotDir string) (before, after *usageReport, err error) {
+	switch len(paths) {
+	case 0:
+		var stored []string
+		switch {
+		case snapshotDir != "":
+			stored, err = (&snapshotSink{Dir: snapshotDir}).paths()
+			historyDir = snapshotDir
+		case historyDir != "":
+			stored, err = (&historyStore{Dir: historyDir}).samplePaths()
+		default:
+			return nil, nil, errors.New("--diff needs two snapshot files, --snapshot-dir or --history-dir")
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return latestSnapshots(historyDir, stored)
+	case 2:
+		before, err = loadSnapshot(paths[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		after, err = loadSnapshot(paths[1])
+		if err != nil {
+			return nil, nil, err
+		}
+		return before, after, nil
+	default:
+		return nil, nil, errors.New("--diff needs two snapshot files, ie --diff old.json new.json")
+	}
+}
+
+const (
+	deltaNew     = "new"
+	deltaDeleted = "deleted"
+	deltaChanged = "changed"
+)
+
+// usageDiff describes what changed between two runs
+type usageDiff struct {
+	BeforeRunID string
+	AfterRunID  string
+
+	// NewApps appeared since the earlier run, and DeletedApps disappeared
+	NewApps     []*appDelta
+	DeletedApps []*appDelta
+
+	// Changes has an entry for each org, space and app that was created,
+	// deleted or whose memory usage or quota changed, in key order
+	Changes []*keyDelta
+
+	// Net is the change for the installation as a whole
+	Net *appDelta
+
+	// beforeTime and afterTime are when the runs started, for HTML, and
+	// are zero if read from --output-json
+	beforeTime, afterTime time.Time
+}
+
+// keyDelta is the change in memory usage and quota of an org, space or app
+type keyDelta struct {
+	appDelta
+
+	// Status is "new", "deleted" or "changed"
+	Status string
+}
+
+// diffReports compares two runs
+func diffReports(before, after *usageReport) *usageDiff {
+	d := &usageDiff{
+		BeforeRunID: before.RunID,
+		AfterRunID:  after.RunID,
+		Net:         &appDelta{},
+		beforeTime:  before.Time,
+		afterTime:   after.Time,
+	}
+	_, d.NewApps, d.DeletedApps = diffApps(before, after)
+
+	aggregates := func(rep *usageReport) map[string]*appUsageInfo {
+		rv := make(map[string]*appUsageInfo)
+		for _, row := range rep.Rows {
+			if row.Level() >= 1 && row.Level() <= 3 {
+				rv[row.Key] = row
+			}
+		}
+		return rv
+	}
+	prev, cur := aggregates(before), aggregates(after)
+	var keys []string
+	for key := range cur {
+		keys = append(keys, key)
+	}
+	for key := range prev {
+		if _, ok := cur[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		kd := &keyDelta{appDelta: appDelta{Key: key}, Status: deltaChanged}
+		b, inBefore := prev[key]
+		a, inAfter := cur[key]
+		if inBefore {
+			kd.Before, kd.BeforeQuota = b.MemoryUsage, b.MemoryQuota
+		} else {
+			kd.Status = deltaNew
+		}
+		if inAfter {
+			kd.After, kd.AfterQuota = a.MemoryUsage, a.MemoryQuota
+		} else {
+			kd.Status = deltaDeleted
+		}
+		if kd.Status == deltaChanged && kd.Before == kd.After && kd.BeforeQuota == kd.AfterQuota {
+			continue
+		}
+		d.Changes = append(d.Changes, kd)
+	}
+
+	if total := before.Total(); total != nil {
+		d.Net.Before, d.Net.BeforeQuota = total.MemoryUsage, total.MemoryQuota
+	}
+	if total := after.Total(); total != nil {
+		d.Net.After, d.Net.AfterQuota = total.MemoryUsage, total.MemoryQuota
+	}
+	return d
+}
+
+// renderDiff writes the diff as a table, JSON or an HTML page
+func renderDiff(out io.Writer, d *usageDiff, format string) error {
+	switch format {
+	case formatJSON:
+		return json.NewEncoder(out).Encode(d)
+	case formatHTML:
+		return renderDiffHTML(out, d)
+	case formatTable:
+		// handled below
+	default:
+		return fmt.Errorf("unknown format: %s", format)
+	}
+
+	table := tablewriter.NewWriter(out)
+	table.SetHeader([]string{"Change", "Key", "Before", "After", "Usage", "Quota"})
+	row := func(change, key string, ad *appDelta) []string {
+		return []string{
+			change,
+			key,
+			toHumanSize(ad.Before),
+			toHumanSize(ad.After),
+			signedHumanSize(ad.Change()),
+			signedHumanSize(ad.AfterQuota - ad.BeforeQuota),
+		}
+	}
+	for _, kd := range d.Changes {
+		table.Append(row(kd.Status, "/"+kd.Key, &kd.appDelta))
+	}
+	table.Append(row("net", "", d.Net))
+	table.Render()
+	return nil
+}
+
+// signedHumanSize is toHumanSize, with a + for positive values
+func signedHumanSize(b int) string {
+	if b > 0 {
+		return "+" + toHumanSize(b)
+	}
+	return toHumanSize(b)
+}
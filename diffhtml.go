@@ -0,0 +1,161 @@
+package main
+
+import (
+	"html/template"
+	"io"
+	"time"
+)
+
+// htmlDiffPage is everything the HTML diff template needs
+type htmlDiffPage struct {
+	BeforeRunID string
+	AfterRunID  string
+	BeforeTime  string
+	AfterTime   string
+
+	Net *htmlDelta
+
+	// Levels are the changes to orgs and spaces, in key order, and Apps
+	// those of apps in both runs
+	Levels []*htmlDelta
+	Apps   []*htmlDelta
+
+	NewApps     []*htmlDelta
+	DeletedApps []*htmlDelta
+}
+
+// htmlDelta is a changed row of the HTML diff
+type htmlDelta struct {
+	Key    string
+	Level  int
+	Status string
+
+	Before      string
+	After       string
+	Change      string
+	QuotaChange string
+
+	// Quota is, for new and deleted apps, their quota
+	Quota string
+
+	// Class is "grow" or "shrink" as memory usage went up or down, "new" or
+	// "deleted", or "" if only the quota changed
+	Class string
+}
+
+// newHTMLDelta returns the row for a change to key
+func newHTMLDelta(key, status string, ad *appDelta) *htmlDelta {
+	hd := &htmlDelta{
+		Key:         "/" + key,
+		Level:       (&appUsageInfo{Key: key}).Level(),
+		Status:      status,
+		Before:      toHumanSize(ad.Before),
+		After:       toHumanSize(ad.After),
+		Change:      signedHumanSize(ad.Change()),
+		QuotaChange: signedHumanSize(ad.AfterQuota - ad.BeforeQuota),
+	}
+	switch {
+	case status == deltaNew:
+		hd.Class, hd.Quota = status, toHumanSize(ad.AfterQuota)
+	case status == deltaDeleted:
+		hd.Class, hd.Quota = status, toHumanSize(ad.BeforeQuota)
+	case ad.Change() > 0:
+		hd.Class = "grow"
+	case ad.Change() < 0:
+		hd.Class = "shrink"
+	}
+	return hd
+}
+
+// renderDiffHTML writes the diff as a self-contained page for reviewing
+// what changed, ie at a monthly governance review: orgs and spaces coloured
+// by whether they grew or shrank, then the apps that were created, deleted
+// and changed
+func renderDiffHTML(out io.Writer, d *usageDiff) error {
+	page := htmlDiffPage{
+		BeforeRunID: d.BeforeRunID,
+		AfterRunID:  d.AfterRunID,
+		Net:         newHTMLDelta("", deltaChanged, d.Net),
+	}
+	if !d.beforeTime.IsZero() {
+		page.BeforeTime = d.beforeTime.UTC().Format(time.RFC1123)
+	}
+	if !d.afterTime.IsZero() {
+		page.AfterTime = d.afterTime.UTC().Format(time.RFC1123)
+	}
+	for _, kd := range d.Changes {
+		hd := newHTMLDelta(kd.Key, kd.Status, &kd.appDelta)
+		switch {
+		case hd.Level < 3:
+			page.Levels = append(page.Levels, hd)
+		case kd.Status == deltaChanged:
+			page.Apps = append(page.Apps, hd)
+		}
+	}
+	for _, ad := range d.NewApps {
+		page.NewApps = append(page.NewApps, newHTMLDelta(ad.Key, deltaNew, ad))
+	}
+	for _, ad := range d.DeletedApps {
+		page.DeletedApps = append(page.DeletedApps, newHTMLDelta(ad.Key, deltaDeleted, ad))
+	}
+	return htmlDiffTemplate.Execute(out, page)
+}
+
+var htmlDiffTemplate = template.Must(template.New("diff").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Memory usage changes</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; font-size: 14px; color: #222; margin: 2em; }
+h1 { font-size: 20px; }
+h2 { font-size: 16px; margin-top: 1.5em; }
+.meta { color: #666; }
+table { border-collapse: collapse; }
+th, td { padding: 3px 10px; text-align: right; white-space: nowrap; }
+th { border-bottom: 1px solid #ccc; }
+th.key, td.key { text-align: left; }
+td.level2 { padding-left: 2em; }
+.grow td.change { color: #b71c1c; font-weight: bold; }
+.shrink td.change { color: #1b5e20; font-weight: bold; }
+tr.grow { background: #ffebee; }
+tr.shrink { background: #e8f5e9; }
+tr.new { background: #e3f2fd; }
+tr.deleted { background: #f5f5f5; color: #666; }
+.none { color: #666; }
+</style>
+</head>
+<body>
+<h1>Memory usage changes</h1>
+<p class="meta">From run {{.BeforeRunID}}{{if .BeforeTime}} at {{.BeforeTime}}{{end}} to run {{.AfterRunID}}{{if .AfterTime}} at {{.AfterTime}}{{end}}</p>
+<p class="{{.Net.Class}}">Installation: {{.Net.Before}} to {{.Net.After}}, <strong>{{.Net.Change}}</strong>, quota {{.Net.QuotaChange}}</p>
+<h2>Orgs and spaces</h2>
+{{if .Levels}}<table>
+<tr><th class="key">Org / space</th><th>Status</th><th>Before</th><th>After</th><th>Usage</th><th>Quota</th></tr>
+{{range .Levels}}{{template "delta" .}}{{end}}</table>
+{{else}}<p class="none">No orgs or spaces changed.</p>
+{{end}}
+<h2>New apps ({{len .NewApps}})</h2>
+{{if .NewApps}}<table>
+<tr><th class="key">App</th><th>Usage</th><th>Quota</th></tr>
+{{range .NewApps}}<tr class="new"><td class="key">{{.Key}}</td><td>{{.After}}</td><td>{{.Quota}}</td></tr>
+{{end}}</table>
+{{end}}
+<h2>Deleted apps ({{len .DeletedApps}})</h2>
+{{if .DeletedApps}}<table>
+<tr><th class="key">App</th><th>Usage</th><th>Quota</th></tr>
+{{range .DeletedApps}}<tr class="deleted"><td class="key">{{.Key}}</td><td>{{.Before}}</td><td>{{.Quota}}</td></tr>
+{{end}}</table>
+{{end}}
+<h2>Changed apps ({{len .Apps}})</h2>
+{{if .Apps}}<details>
+<summary>Show every app whose usage or quota changed</summary>
+<table>
+<tr><th class="key">App</th><th>Status</th><th>Before</th><th>After</th><th>Usage</th><th>Quota</th></tr>
+{{range .Apps}}{{template "delta" .}}{{end}}</table>
+</details>
+{{end}}
+</body>
+</html>
+{{define "delta"}}<tr class="{{.Class}}"><td class="key level{{.Level}}">{{.Key}}</td><td>{{.Status}}</td><td>{{.Before}}</td><td>{{.After}}</td><td class="change">{{.Change}}</td><td>{{.QuotaChange}}</td></tr>
+{{end}}`))
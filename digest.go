@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/smtp"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/govau/cf-report-memory-usage/report"
+)
+
+const (
+	defaultDigestPeriod = 7 * 24 * time.Hour
+	defaultDigestTop    = 10
+
+	// digestChartWidth is the width in characters of the longest bar in the totals chart
+	digestChartWidth = 40
+)
+
+// digestConfig defines a trend digest built from a history sink directory
+type digestConfig struct {
+	// Name identifies the digest in progress messages and errors
+	Name string `json:"name"`
+
+	// History is the directory of a history sink
+	History string `json:"history"`
+
+	// Period is how far back the digest looks, defaulting to 7d
+	Period duration `json:"period"`
+
+	// Top is how many growers and shrinkers to list, defaulting to 10
+	Top int `json:"top"`
+
+	// Every, if set, is how often to send the digest, ie "7d"
+	Every duration `json:"every"`
+
+	// Output is the file to write to, or "-" for stdout. Defaults to stdout
+	// if no email is configured.
+	Output string `json:"output"`
+
+	// Email, if set, sends the digest by email
+	Email *emailConfig `json:"email"`
+
+	// encrypter, if set, encrypts the digest written to Output or emailed
+	encrypter *reportEncrypter
+}
+
+// emailConfig is how to send an email
+type emailConfig struct {
+	// SMTP is the server, as host:port
+	SMTP string `json:"smtp"`
+
+	From string   `json:"from"`
+	To   []string `json:"to"`
+
+	// Username, if set, is used for PLAIN auth, with the password read from
+	// the environment variable named by PasswordEnv
+	Username    string `json:"username"`
+	PasswordEnv string `json:"password_env"`
+}
+
+// validate checks the config and fills in defaults
+func (dc *digestConfig) validate() error {
+	if dc.History == "" {
+		return errors.New("history must be set")
+	}
+	if dc.Period == 0 {
+		dc.Period = duration(defaultDigestPeriod)
+	}
+	if dc.Period < 0 || dc.Every < 0 {
+		return errors.New("period and every must not be negative")
+	}
+	if dc.Top == 0 {
+		dc.Top = defaultDigestTop
+	}
+	if dc.Output == "" && dc.Email == nil {
+		dc.Output = "-"
+	}
+	if dc.Email != nil {
+		if dc.Email.SMTP == "" || dc.Email.From == "" || len(dc.Email.To) == 0 {
+			return errors.New("email needs smtp, from and to")
+		}
+	}
+	return nil
+}
+
+// send builds the digest for the period leading up to now, and delivers it
+func (dc *digestConfig) send(now time.Time) error {
+	d, err := buildDigest(&historyStore{Dir: dc.History}, time.Duration(dc.Period), dc.Top, now)
+	if err != nil {
+		return err
+	}
+	body := &bytes.Buffer{}
+	err = renderDigest(body, d)
+	if err != nil {
+		return err
+	}
+	// stdout is left readable, but anything leaving the terminal is encrypted
+	stored := body.Bytes()
+	if dc.encrypter != nil {
+		stored, err = dc.encrypter.encrypt(stored, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch dc.Output {
+	case "":
+	case "-":
+		_, err = io.Copy(os.Stdout, body)
+	default:
+		err = writeFile(dc.Output, stored)
+	}
+	if err != nil {
+		return err
+	}
+
+	if dc.Email != nil {
+		return dc.Email.send(fmt.Sprintf("Memory usage digest for %s to %s", d.From.Format("2006-01-02"), d.To.Format("2006-01-02")), stored)
+	}
+	return nil
+}
+
+// send emails a plain text message
+func (ec *emailConfig) send(subject string, body []byte) error {
+	var auth smtp.Auth
+	if ec.Username != "" {
+		host := ec.SMTP
+		if idx := strings.LastIndex(host, ":"); idx != -1 {
+			host = host[:idx]
+		}
+		auth = smtp.PlainAuth("", ec.Username, os.Getenv(ec.PasswordEnv), host)
+	}
+
+	msg := &bytes.Buffer{}
+	fmt.Fprintf(msg, "From: %s\r\n", ec.From)
+	fmt.Fprintf(msg, "To: %s\r\n", strings.Join(ec.To, ", "))
+	fmt.Fprintf(msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.Write(bytes.Replace(body, []byte("\n"), []byte("\r\n"), -1))
+
+	return smtp.SendMail(ec.SMTP, auth, ec.From, ec.To, msg.Bytes())
+}
+
+// writeFile writes data to path, replacing any previous contents
+func writeFile(path string, data []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// appDelta is the change in an app's memory usage (and quota) between two runs
+type appDelta struct {
+	Key         string
+	Before      int
+	After       int
+	BeforeQuota int
+	AfterQuota  int
+}
+
+// Change is how much more memory is used after than before
+func (ad *appDelta) Change() int {
+	return ad.After - ad.Before
+}
+
+// diffApps compares the app level rows of two runs, returning apps in both
+// and those that were added or removed
+func diffApps(before, after *usageReport) (changed, added, removed []*appDelta) {
+	deltas := func(acs []*report.AppChange) []*appDelta {
+		var rv []*appDelta
+		for _, ac := range acs {
+			ad := &appDelta{Key: ac.Key}
+			if ac.Before != nil {
+				ad.Before, ad.BeforeQuota = ac.Before.MemoryUsage, ac.Before.MemoryQuota
+			}
+			if ac.After != nil {
+				ad.After, ad.AfterQuota = ac.After.MemoryUsage, ac.After.MemoryQuota
+			}
+			rv = append(rv, ad)
+		}
+		return rv
+	}
+	d := after.Diff(before)
+	return deltas(d.Changed), deltas(d.Added), deltas(d.Removed)
+}
+
+// dailyTotal is the mean installation memory usage for a day
+type dailyTotal struct {
+	Day         time.Time
+	MemoryUsage int
+}
+
+// usageDigest summarises how usage changed over a period
+type usageDigest struct {
+	From, To     time.Time
+	TopGrowers   []*appDelta
+	TopShrinkers []*appDelta
+	NewApps      []*appDelta
+	DeletedApps  []*appDelta
+	Totals       []*dailyTotal
+}
+
+// buildDigest compares the first and last runs in the history within period
+// of now, and charts the daily totals in between
+func buildDigest(hs *historyStore, period time.Duration, top int, now time.Time) (*usageDigest, error) {
+	from := now.Add(-period)
+	paths, err := hs.samplePaths()
+	if err != nil {
+		return nil, err
+	}
+	var inPeriod []string
+	for _, path := range paths {
+		t, err := sampleTime(path)
+		if err != nil {
+			return nil, err
+		}
+		if !t.Before(from) && !t.After(now) {
+			inPeriod = append(inPeriod, path)
+		}
+	}
+	if len(inPeriod) == 0 {
+		return nil, fmt.Errorf("no runs in %s since %s", hs.Dir, from.Format(time.RFC3339))
+	}
+
+	first, err := loadSample(inPeriod[0])
+	if err != nil {
+		return nil, err
+	}
+	last, err := loadSample(inPeriod[len(inPeriod)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	d := &usageDigest{From: from, To: now}
+	var changed []*appDelta
+	changed, d.NewApps, d.DeletedApps = diffApps(first, last)
+
+	sort.SliceStable(changed, func(i, j int) bool {
+		return changed[i].Change() > changed[j].Change()
+	})
+	for _, ad := range changed {
+		if len(d.TopGrowers) == top || ad.Change() <= 0 {
+			break
+		}
+		d.TopGrowers = append(d.TopGrowers, ad)
+	}
+	for i := len(changed) - 1; i >= 0; i-- {
+		ad := changed[i]
+		if len(d.TopShrinkers) == top || ad.Change() >= 0 {
+			break
+		}
+		d.TopShrinkers = append(d.TopShrinkers, ad)
+	}
+
+	type sums struct{ usage, samples int }
+	byDay := make(map[time.Time]*sums)
+	err = hs.forEachOrgSample(func(t time.Time, org string, usage, quota, weight int) error {
+		if org != "" || t.Before(from) || t.After(now) {
+			return nil
+		}
+		t = t.In(now.Location())
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+		s, ok := byDay[day]
+		if !ok {
+			s = &sums{}
+			byDay[day] = s
+		}
+		s.usage += usage * weight
+		s.samples += weight
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for day, s := range byDay {
+		d.Totals = append(d.Totals, &dailyTotal{Day: day, MemoryUsage: s.usage / s.samples})
+	}
+	sort.Slice(d.Totals, func(i, j int) bool {
+		return d.Totals[i].Day.Before(d.Totals[j].Day)
+	})
+
+	return d, nil
+}
+
+// renderDigest writes the digest as plain text, suitable for an email body
+func renderDigest(out io.Writer, d *usageDigest) error {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "Memory usage digest for %s to %s\n", d.From.Format("2006-01-02"), d.To.Format("2006-01-02"))
+
+	fmt.Fprintf(buf, "\nTotal memory usage by day\n\n")
+	max := 0
+	for _, t := range d.Totals {
+		if t.MemoryUsage > max {
+			max = t.MemoryUsage
+		}
+	}
+	for _, t := range d.Totals {
+		width := 0
+		if max != 0 {
+			width = t.MemoryUsage * digestChartWidth / max
+		}
+		fmt.Fprintf(buf, "  %s  %-*s  %s\n", t.Day.Format("Mon 2006-01-02"), digestChartWidth, strings.Repeat("#", width), toHumanSize(t.MemoryUsage))
+	}
+
+	for _, section := range []struct {
+		Title string
+		Apps  []*appDelta
+	}{
+		{"Top growers", d.TopGrowers},
+		{"Top shrinkers", d.TopShrinkers},
+		{"New apps", d.NewApps},
+		{"Deleted apps", d.DeletedApps},
+	} {
+		fmt.Fprintf(buf, "\n%s\n\n", section.Title)
+		if len(section.Apps) == 0 {
+			fmt.Fprintf(buf, "  none\n")
+		}
+		for _, ad := range section.Apps {
+			fmt.Fprintf(buf, "  %10s  /%s (%s -> %s)\n", signedHumanSize(ad.Change()), ad.Key, toHumanSize(ad.Before), toHumanSize(ad.After))
+		}
+	}
+
+	_, err := io.Copy(out, buf)
+	return err
+}
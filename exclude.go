@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// regexPrefix marks a name pattern as a regular expression rather than a glob
+const regexPrefix = "regex:"
+
+// systemOrgs are the orgs --tenants-only leaves out: the system org that
+// platform components such as smoke tests, the autoscaler and healthwatch
+// are pushed to, and the p- orgs that marketplace tiles create
+var systemOrgs = []string{"system", "p-*"}
+
+// namePattern is a glob, ie "system*", or a regular expression after
+// regexPrefix, ie "regex:^(dev|test)-"
+type namePattern struct {
+	spec string
+	re   *regexp.Regexp
+}
+
+// match returns true if name matches the pattern. Globs must match the
+// whole name, as regular expressions need not.
+func (np *namePattern) match(name string) bool {
+	if np.re != nil {
+		return np.re.MatchString(name)
+	}
+	ok, _ := path.Match(np.spec, name)
+	return ok
+}
+
+// namePatterns are the orgs or spaces to exclude, given by a repeatable flag
+type namePatterns []*namePattern
+
+func (nps *namePatterns) String() string {
+	var specs []string
+	for _, np := range *nps {
+		specs = append(specs, np.spec)
+	}
+	return strings.Join(specs, ",")
+}
+
+func (nps *namePatterns) Set(s string) error {
+	np := &namePattern{spec: s}
+	if strings.HasPrefix(s, regexPrefix) {
+		var err error
+		np.re, err = regexp.Compile(strings.TrimPrefix(s, regexPrefix))
+		if err != nil {
+			return fmt.Errorf("invalid regex: %s", err)
+		}
+	} else if _, err := path.Match(s, ""); err != nil {
+		return fmt.Errorf("invalid glob: %s", s)
+	}
+	*nps = append(*nps, np)
+	return nil
+}
+
+// match returns true if any of the patterns match any of names
+func (nps namePatterns) match(names ...string) bool {
+	for _, np := range nps {
+		for _, name := range names {
+			if np.match(name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// exclusions are the orgs and spaces left out of a crawl, so that totals
+// only include what is wanted, ie tenant workloads. Spaces are matched by
+// their name, or as "org/space".
+type exclusions struct {
+	Orgs   namePatterns
+	Spaces namePatterns
+}
+
+// org returns true if the org is excluded
+func (ex *exclusions) org(org *cfOrg) bool {
+	return ex.Orgs.match(org.Name)
+}
+
+// space returns true if the space in org is excluded
+func (ex *exclusions) space(org *cfOrg, space *cfSpace) bool {
+	return ex.Spaces.match(space.Name, org.Name+"/"+space.Name)
+}
+
+// active returns true if anything is excluded
+func (ex *exclusions) active() bool {
+	return len(ex.Orgs) != 0 || len(ex.Spaces) != 0
+}
+
+// row returns true if the org or space of the row is excluded, for rows
+// that weren't just crawled, ie from a history sample
+func (ex *exclusions) row(row *appUsageInfo) bool {
+	bits := strings.SplitN(row.Key, "/", 3)
+	if ex.Orgs.match(bits[0]) {
+		return true
+	}
+	return len(bits) > 1 && ex.Spaces.match(bits[1], bits[0]+"/"+bits[1])
+}
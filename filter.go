@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// percentFlag is a percentage that may or may not have been given
+type percentFlag struct {
+	Given bool
+	Value float64
+}
+
+func (pf *percentFlag) String() string {
+	if !pf.Given {
+		return ""
+	}
+	return strconv.FormatFloat(pf.Value, 'f', -1, 64)
+}
+
+func (pf *percentFlag) Set(s string) error {
+	v, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil {
+		return fmt.Errorf("invalid percentage: %s", s)
+	}
+	pf.Given, pf.Value = true, v
+	return nil
+}
+
+// UnmarshalJSON parses a percentage as a number
+func (pf *percentFlag) UnmarshalJSON(b []byte) error {
+	return pf.Set(string(b))
+}
+
+// rowFilter picks out apps by how much of their quota they use, ie to find
+// those that are over or under-sized. The zero value keeps every row.
+type rowFilter struct {
+	// MinPercent and MaxPercent keep apps using at least, or at most, this
+	// percentage of their quota
+	MinPercent percentFlag
+	MaxPercent percentFlag
+
+	// Top, if set, keeps only this many of the matching apps, with the
+	// largest quotas
+	Top int
+}
+
+// active returns true if the filter would remove anything
+func (rf *rowFilter) active() bool {
+	return rf.MinPercent.Given || rf.MaxPercent.Given || rf.Top > 0
+}
+
+// apply returns the rows to show. Apps are matched using memory, or disk if
+// metric is "disk". The instances of matching apps are kept, as are the
+// totals for the spaces and orgs they are in and the installation. Totals
+// are unchanged, so still include apps that were filtered out.
+func (rf *rowFilter) apply(rows []*appUsageInfo, metric string) []*appUsageInfo {
+	if !rf.active() {
+		return rows
+	}
+
+	usage := func(row *appUsageInfo) (int, int) {
+		if metric == metricDisk {
+			return row.DiskUsage, row.DiskQuota
+		}
+		return row.MemoryUsage, row.MemoryQuota
+	}
+
+	var apps []*appUsageInfo
+	for _, row := range rows {
+		if strings.Count(row.Key, "/") != 2 {
+			continue
+		}
+		used, quota := usage(row)
+		if rf.MinPercent.Given || rf.MaxPercent.Given {
+			if quota == 0 {
+				continue
+			}
+			percent := float64(used) * 100 / float64(quota)
+			if rf.MinPercent.Given && percent < rf.MinPercent.Value {
+				continue
+			}
+			if rf.MaxPercent.Given && percent > rf.MaxPercent.Value {
+				continue
+			}
+		}
+		apps = append(apps, row)
+	}
+	if rf.Top > 0 && len(apps) > rf.Top {
+		sort.SliceStable(apps, func(i, j int) bool {
+			_, qi := usage(apps[i])
+			_, qj := usage(apps[j])
+			return qi > qj
+		})
+		apps = apps[:rf.Top]
+	}
+
+	keep := map[string]bool{"": true}
+	for _, app := range apps {
+		bits := strings.Split(app.Key, "/")
+		for i := range bits {
+			keep[strings.Join(bits[:i+1], "/")] = true
+		}
+	}
+	var filtered []*appUsageInfo
+	for _, row := range rows {
+		key := row.Key
+		if strings.Count(key, "/") == 3 {
+			key = key[:strings.LastIndex(key, "/")]
+		}
+		if !keep[key] {
+			continue
+		}
+		filtered = append(filtered, row)
+	}
+	return filtered
+}
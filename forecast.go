@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+const (
+	defaultForecastLookback = 7 * 24 * time.Hour
+	defaultForecastHorizon  = 14 * 24 * time.Hour
+)
+
+// forecastConfig is when orgs are alerted on for being on track to run out
+// of memory quota, from the "forecast" part of the thresholds section
+type forecastConfig struct {
+	// History is the directory of a history sink, which past runs are read
+	// from to find each org's trend
+	History string `json:"history"`
+
+	// Lookback is how far back the trend is fitted over, defaulting to 7d
+	Lookback duration `json:"lookback"`
+
+	// Horizon is how far ahead to warn of an org reaching its quota,
+	// defaulting to 14d
+	Horizon duration `json:"horizon"`
+}
+
+// validate checks the config and fills in defaults
+func (fc *forecastConfig) validate() error {
+	if fc.History == "" {
+		return errors.New("history must be set, to the directory of a history sink")
+	}
+	if fc.Lookback == 0 {
+		fc.Lookback = duration(defaultForecastLookback)
+	}
+	if fc.Horizon == 0 {
+		fc.Horizon = duration(defaultForecastHorizon)
+	}
+	if fc.Lookback < 0 || fc.Horizon < 0 {
+		return errors.New("lookback and horizon must not be negative")
+	}
+	return nil
+}
+
+// trendPoint is an org's allocated memory at a point in time, weighted by
+// how many runs it is a mean of
+type trendPoint struct {
+	t      time.Time
+	value  float64
+	weight float64
+}
+
+// fitTrend returns the slope, in bytes per second, of the weighted least
+// squares line through points. ok is false if there aren't points at two
+// different times to fit a line through.
+func fitTrend(points []*trendPoint) (slope float64, ok bool) {
+	if len(points) < 2 {
+		return 0, false
+	}
+	// times are relative to the first point, to keep the sums small
+	origin := points[0].t
+	var sw, sx, sy float64
+	for _, p := range points {
+		x := p.t.Sub(origin).Seconds()
+		sw += p.weight
+		sx += p.weight * x
+		sy += p.weight * p.value
+	}
+	mx, my := sx/sw, sy/sw
+	var sxx, sxy float64
+	for _, p := range points {
+		dx := p.t.Sub(origin).Seconds() - mx
+		sxx += p.weight * dx * dx
+		sxy += p.weight * dx * (p.value - my)
+	}
+	if sxx == 0 {
+		return 0, false
+	}
+	return sxy / sxx, true
+}
+
+// check returns the orgs in the report that are already at their quota,
+// as critical, and those projected to reach it within Horizon, as warnings.
+// CF checks org quotas against the memory allocated to started apps rather
+// than what they use, so it is the trend in allocation that is projected.
+func (fc *forecastConfig) check(rep *usageReport, now time.Time) ([]*breach, error) {
+	if len(rep.OrgMemoryLimits) == 0 {
+		return nil, nil
+	}
+
+	from := now.Add(-time.Duration(fc.Lookback))
+	points := make(map[string][]*trendPoint)
+	err := (&historyStore{Dir: fc.History}).forEachOrgSample(func(t time.Time, org string, usage, quota, weight int) error {
+		// the report being checked may already be in the history
+		if org == "" || t.Before(from) || !t.Before(rep.Time) {
+			return nil
+		}
+		points[org] = append(points[org], &trendPoint{t: t, value: float64(quota), weight: float64(weight)})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var rv []*breach
+	for _, row := range rep.Rows {
+		limit, ok := rep.OrgMemoryLimits[row.Key]
+		if row.Level() != 1 || !ok || limit <= 0 {
+			continue
+		}
+		b := &breach{
+			Key:     row.Key,
+			Percent: float64(row.MemoryQuota) * 100 / float64(limit),
+			Limit:   limit,
+		}
+		if row.MemoryQuota >= limit {
+			b.Severity = severityCritical
+			b.ReachesAt = &now
+			rv = append(rv, b)
+			continue
+		}
+
+		orgPoints := append(points[row.Key], &trendPoint{t: rep.Time, value: float64(row.MemoryQuota), weight: 1})
+		sort.SliceStable(orgPoints, func(i, j int) bool {
+			return orgPoints[i].t.Before(orgPoints[j].t)
+		})
+		slope, ok := fitTrend(orgPoints)
+		if !ok || slope <= 0 {
+			continue
+		}
+		secs := float64(limit-row.MemoryQuota) / slope
+		if secs > time.Duration(fc.Horizon).Seconds() {
+			continue
+		}
+		reaches := now.Add(time.Duration(secs * float64(time.Second)))
+		b.Severity = severityWarning
+		b.ReachesAt = &reaches
+		rv = append(rv, b)
+	}
+	return rv, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/govau/cf-report-memory-usage/report"
+)
+
+// errNoCachedRun is returned with --fresh-org if there is no run to take
+// the rest of the installation from
+var errNoCachedRun = errors.New("--fresh-org needs a previous run of the whole installation in --history-dir")
+
+// inOrg returns true if key is orgKey, or within it
+func inOrg(key, orgKey string) bool {
+	return key == orgKey || strings.HasPrefix(key, orgKey+"/")
+}
+
+// withCached returns fresh, a crawl of the FreshOrg only, combined with
+// every other org as it was in the latest run in HistoryDir, so that the
+// org that matters right now is current without crawling everything
+func (col *collector) withCached(fresh *usageReport) (*usageReport, error) {
+	cached, err := (&historyStore{Dir: col.opts.HistoryDir}).latest()
+	if err != nil {
+		return nil, err
+	}
+	if cached == nil {
+		return nil, errNoCachedRun
+	}
+	rep := spliceFreshOrg(cached, fresh, col.opts.FreshOrg, col.opts.Exclude)
+	if !col.client.Quiet {
+		log.Printf("crawled %s only, the rest is from run %s, %s old", col.opts.FreshOrg, rep.CachedRunID, time.Since(*rep.CachedTime).Round(time.Second))
+	}
+	return rep, nil
+}
+
+// spliceFreshOrg returns a report of org as it is in fresh, and every other
+// org, less any excluded, as it was in cached. The result takes the run ID
+// and time of fresh, with totals recalculated.
+func spliceFreshOrg(cached, fresh *usageReport, org string, exclude exclusions) *usageReport {
+	orgKey := noSlash(org)
+	rep := &usageReport{
+		RunID:       fresh.RunID,
+		Tag:         fresh.Tag,
+		Time:        fresh.Time,
+		FreshOrg:    org,
+		CachedRunID: cached.RunID,
+		CachedTime:  &cached.Time,
+		Partial:     cached.Partial,
+		Shard:       cached.Shard,
+	}
+	// if the cached run was itself mostly cached, the rest is that old
+	if cached.CachedTime != nil {
+		rep.CachedRunID, rep.CachedTime = cached.CachedRunID, cached.CachedTime
+	}
+
+	for _, key := range cached.Skipped {
+		if !inOrg(key, orgKey) {
+			rep.Skipped = append(rep.Skipped, key)
+		}
+	}
+	rep.Skipped = append(rep.Skipped, fresh.Skipped...)
+	for _, key := range cached.Vanished {
+		if !inOrg(key, orgKey) {
+			rep.Vanished = append(rep.Vanished, key)
+		}
+	}
+	rep.Vanished = append(rep.Vanished, fresh.Vanished...)
+	for _, key := range cached.Appeared {
+		if !inOrg(key, orgKey) {
+			rep.Appeared = append(rep.Appeared, key)
+		}
+	}
+	rep.Appeared = append(rep.Appeared, fresh.Appeared...)
+	for _, re := range cached.Errors {
+		if !inOrg(re.Key, orgKey) {
+			rep.Errors = append(rep.Errors, re)
+		}
+	}
+	rep.Errors = append(rep.Errors, fresh.Errors...)
+	sort.SliceStable(rep.Errors, func(i, j int) bool {
+		return rep.Errors[i].Key < rep.Errors[j].Key
+	})
+
+	limits := func(cached, fresh map[string]int) map[string]int {
+		if cached == nil && fresh == nil {
+			return nil
+		}
+		rv := make(map[string]int)
+		for key, limit := range cached {
+			if !inOrg(key, orgKey) {
+				rv[key] = limit
+			}
+		}
+		for key, limit := range fresh {
+			rv[key] = limit
+		}
+		return rv
+	}
+	rep.OrgMemoryLimits = limits(cached.OrgMemoryLimits, fresh.OrgMemoryLimits)
+	rep.SpaceMemoryLimits = limits(cached.SpaceMemoryLimits, fresh.SpaceMemoryLimits)
+
+	var instances []*appUsageInfo
+	for _, row := range cached.Rows {
+		if row.Level() != 4 || inOrg(row.Key, orgKey) || exclude.row(row) {
+			continue
+		}
+		instance := *row
+		instance.RunID, instance.Tag = fresh.RunID, fresh.Tag
+		instances = append(instances, &instance)
+	}
+	for _, row := range fresh.Rows {
+		if row.Level() == 4 {
+			instances = append(instances, row)
+		}
+	}
+	sort.SliceStable(instances, func(i, j int) bool {
+		return instances[i].Key < instances[j].Key
+	})
+	rep.Rows = report.AddTotals(fresh.RunID, instances)
+	return rep
+}
+
+// describeFreshOrg returns, for a report with a FreshOrg, which org is
+// current and how old the rest is, or "" otherwise
+func describeFreshOrg(rep *usageReport) string {
+	if rep.FreshOrg == "" || rep.CachedTime == nil {
+		return ""
+	}
+	return fmt.Sprintf("only %s crawled, the rest is from run %s at %s", rep.FreshOrg, rep.CachedRunID, rep.CachedTime.Format(time.RFC3339))
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	groupByOrg      = "org"
+	groupBySpace    = "space"
+	groupByApp      = "app"
+	groupByInstance = "instance"
+)
+
+// groupByBuildpack and groupByStack total instances by their app's
+// buildpack or stack, as --group-by-label does by label, rather than
+// showing a level of rows
+const (
+	groupByBuildpack = "buildpack"
+	groupByStack     = "stack"
+)
+
+// groupLevels is the depth of the rows shown for each --group-by
+var groupLevels = map[string]int{
+	groupByOrg:      1,
+	groupBySpace:    2,
+	groupByApp:      3,
+	groupByInstance: 4,
+}
+
+// groupedRow is a row as rendered, with how many instances it has and
+// their average usage if grouping, and its quota's headroom if showing
+// quotas. Either is nil otherwise, so is left out of JSON.
+type groupedRow struct {
+	*appUsageInfo
+	*groupStats
+	*quotaHeadroom
+}
+
+// groupStats are how many instances an org, space, app or instance has,
+// and their average usage
+type groupStats struct {
+	Instances          int
+	AverageMemoryUsage int
+	AverageDiskUsage   int
+}
+
+// countInstances returns how many instances are within each key
+func countInstances(rows []*appUsageInfo) map[string]int {
+	counts := make(map[string]int)
+	for _, row := range rows {
+		if row.Level() != 4 {
+			continue
+		}
+		bits := strings.Split(row.Key, "/")
+		for i := range bits {
+			counts[strings.Join(bits[:i+1], "/")]++
+		}
+		counts[""]++
+	}
+	return counts
+}
+
+// groupRows returns the rows at the level given by groupBy, and the
+// installation total, with instance counts taken from counts
+func groupRows(rows []*appUsageInfo, groupBy string, counts map[string]int) ([]*groupedRow, error) {
+	level, ok := groupLevels[groupBy]
+	if !ok {
+		return nil, fmt.Errorf("unknown grouping, expected org, space, app or instance: %s", groupBy)
+	}
+	var rv []*groupedRow
+	for _, row := range rows {
+		if row.Level() != level && row.Key != "" {
+			continue
+		}
+		gs := &groupStats{Instances: counts[row.Key]}
+		if gs.Instances != 0 {
+			gs.AverageMemoryUsage = row.MemoryUsage / gs.Instances
+			gs.AverageDiskUsage = row.DiskUsage / gs.Instances
+		}
+		rv = append(rv, &groupedRow{appUsageInfo: row, groupStats: gs})
+	}
+	return rv, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// helpTopic is a subtopic of "cf report-memory-usage help TOPIC"
+type helpTopic struct {
+	Name    string
+	Summary string
+	write   func(out io.Writer, fs *flag.FlagSet)
+}
+
+// helpTopics are every subtopic, in the order they are listed
+var helpTopics = []*helpTopic{
+	{Name: "FORMATS", Summary: "what the report can be rendered as, and how tables are laid out", write: writeFormatsHelp},
+	{Name: "FILTERS", Summary: "limiting, grouping and ordering the rows shown", write: writeFiltersHelp},
+	{Name: "SINKS", Summary: "where the report can be sent, with --sink", write: writeSinksHelp},
+}
+
+// writeHelp writes the help for topic, matched regardless of case, or the
+// list of topics if topic is empty. Flags are described as in fs.
+func writeHelp(out io.Writer, fs *flag.FlagSet, topic string) error {
+	if topic == "" {
+		tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(tw, "Help topics, shown with cf report-memory-usage help TOPIC:\n\n")
+		for _, ht := range helpTopics {
+			fmt.Fprintf(tw, "   %s\t%s\n", ht.Name, ht.Summary)
+		}
+		return tw.Flush()
+	}
+
+	var names []string
+	for _, ht := range helpTopics {
+		if strings.EqualFold(ht.Name, topic) {
+			tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+			ht.write(tw, fs)
+			return tw.Flush()
+		}
+		names = append(names, ht.Name)
+	}
+	return fmt.Errorf("unknown help topic, expected %s: %s", strings.Join(names, ", "), topic)
+}
+
+// writeFlagsHelp lists the named flags with their usage
+func writeFlagsHelp(out io.Writer, fs *flag.FlagSet, names ...string) {
+	for _, name := range names {
+		if f := fs.Lookup(name); f != nil {
+			fmt.Fprintf(out, "   --%s\t%s\n", f.Name, f.Usage)
+		}
+	}
+}
+
+func writeFormatsHelp(out io.Writer, fs *flag.FlagSet) {
+	fmt.Fprintf(out, "FORMATS:\n")
+	for _, of := range outputFormats {
+		fmt.Fprintf(out, "   %s\t%s\n", of.Name, of.Help)
+	}
+	for _, of := range outputFormats {
+		if of.Flag != "" {
+			fmt.Fprintf(out, "\nUse --%s for %s on stdout and file sinks", of.Flag, of.Name)
+		}
+	}
+	fmt.Fprintf(out, "\nIn a config file, set \"format\" on a report, and on the server, /report?format=.\n")
+
+	fmt.Fprintf(out, "\nTABLE OPTIONS:\n")
+	writeFlagsHelp(out, fs, "metric", "unit", "max-key-width", "wrap-keys", "align", "plain")
+
+	fmt.Fprintf(out, "\nEXAMPLES:\n")
+	fmt.Fprintf(out, "   cf report-memory-usage --metric both --unit GB\n")
+	fmt.Fprintf(out, "   cf report-memory-usage --quiet --output-csv > memory.csv\n")
+	fmt.Fprintf(out, "   cf report-memory-usage --quiet --output-prometheus > /var/lib/node_exporter/cf_memory.prom\n")
+}
+
+func writeFiltersHelp(out io.Writer, fs *flag.FlagSet) {
+	fmt.Fprintf(out, "FILTERS:\n")
+	writeFlagsHelp(out, fs, "org", "space", "min-percent", "max-percent", "top", "group-by", "sort")
+	fmt.Fprintf(out, "\nTotals for orgs, spaces and the installation always include apps that were filtered out.\n")
+	fmt.Fprintf(out, "Apps are matched on memory, or on disk with --metric disk.\n")
+
+	fmt.Fprintf(out, "\nEXAMPLES:\n")
+	fmt.Fprintf(out, "   cf report-memory-usage --org my-org --space prod\n")
+	fmt.Fprintf(out, "   cf report-memory-usage --max-percent 10 --top 20\n")
+	fmt.Fprintf(out, "   cf report-memory-usage --group-by org --sort percent\n")
+}
+
+func writeSinksHelp(out io.Writer, fs *flag.FlagSet) {
+	fmt.Fprintf(out, "SINKS:\n")
+	for _, sk := range sinkKinds {
+		name := sk.Name
+		if sk.Target != "" {
+			name += ":" + sk.Target
+		}
+		fmt.Fprintf(out, "   %s\t%s\n", name, sk.Help)
+	}
+
+	fmt.Fprintf(out, "\nSINK OPTIONS:\n")
+	writeFlagsHelp(out, fs, "sink", "retain", "compact-after", "snapshot-dir", "sign-key", "encrypt-recipient", "compress")
+
+	fmt.Fprintf(out, "\nEXAMPLES:\n")
+	fmt.Fprintf(out, "   cf report-memory-usage --output-json --sink file:/var/reports/memory.json --sink webhook:https://example.com/hook\n")
+	fmt.Fprintf(out, "   cf report-memory-usage --sink stdout --sink history:/var/lib/memory-history --retain 90d\n")
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// histogramBuckets are the upper bounds, in bytes, instances are counted
+// against, doubling from 64 MB to 16 GB, with larger instances counted only
+// in the total, as a Prometheus +Inf bucket would
+var histogramBuckets = func() []int {
+	var rv []int
+	for b := 64 << 20; b <= 16<<30; b *= 2 {
+		rv = append(rv, b)
+	}
+	return rv
+}()
+
+// memoryHistogram counts instances by memory usage and by memory quota. As
+// in Prometheus, buckets are cumulative, each counting the instances of at
+// most its bound.
+type memoryHistogram struct {
+	// Org is the org counted, or "" for the whole installation
+	Org string
+
+	Count int
+
+	UsageBuckets []int
+	UsageSum     int
+	QuotaBuckets []int
+	QuotaSum     int
+}
+
+// observe counts an instance
+func (mh *memoryHistogram) observe(row *appUsageInfo) {
+	mh.Count++
+	mh.UsageSum += row.MemoryUsage
+	mh.QuotaSum += row.MemoryQuota
+	for i, bound := range histogramBuckets {
+		if row.MemoryUsage <= bound {
+			mh.UsageBuckets[i]++
+		}
+		if row.MemoryQuota <= bound {
+			mh.QuotaBuckets[i]++
+		}
+	}
+}
+
+// memoryHistograms counts the instances in rep, for the installation and
+// then for each org, in name order
+func memoryHistograms(rep *usageReport) []*memoryHistogram {
+	newHistogram := func(org string) *memoryHistogram {
+		return &memoryHistogram{
+			Org:          org,
+			UsageBuckets: make([]int, len(histogramBuckets)),
+			QuotaBuckets: make([]int, len(histogramBuckets)),
+		}
+	}
+	total := newHistogram("")
+	byOrg := make(map[string]*memoryHistogram)
+	for _, row := range rep.Rows {
+		if row.Level() != 4 {
+			continue
+		}
+		org := row.Key[:strings.Index(row.Key, "/")]
+		mh, ok := byOrg[org]
+		if !ok {
+			mh = newHistogram(org)
+			byOrg[org] = mh
+		}
+		mh.observe(row)
+		total.observe(row)
+	}
+
+	var orgs []*memoryHistogram
+	for _, mh := range byOrg {
+		orgs = append(orgs, mh)
+	}
+	sort.Slice(orgs, func(i, j int) bool {
+		return orgs[i].Org < orgs[j].Org
+	})
+	return append([]*memoryHistogram{total}, orgs...)
+}
+
+// renderHistograms writes the histograms as a table, JSON or Prometheus
+// histograms
+func renderHistograms(out io.Writer, rep *usageReport, histograms []*memoryHistogram, format string) error {
+	switch format {
+	case formatJSON:
+		return json.NewEncoder(out).Encode(struct {
+			Buckets    []int
+			Histograms []*memoryHistogram
+		}{histogramBuckets, histograms})
+	case formatPrometheus:
+		return writeHistogramMetrics(out, histograms)
+	case formatTable:
+		// handled below
+	default:
+		return fmt.Errorf("histograms can't be used with the %s format", format)
+	}
+
+	header := []string{"Key", "Of"}
+	for _, bound := range histogramBuckets {
+		header = append(header, "<= "+strings.Replace(toHumanSize(bound), ".0 ", " ", 1))
+	}
+	header = append(header, "Instances")
+	table := tablewriter.NewWriter(out)
+	table.SetHeader(header)
+	for _, mh := range histograms {
+		for _, of := range []struct {
+			Name    string
+			Buckets []int
+		}{{"Usage", mh.UsageBuckets}, {"Quota", mh.QuotaBuckets}} {
+			cells := []string{"/" + mh.Org, of.Name}
+			for _, n := range of.Buckets {
+				cells = append(cells, strconv.Itoa(n))
+			}
+			table.Append(append(cells, strconv.Itoa(mh.Count)))
+		}
+	}
+	table.Render()
+	_, err := fmt.Fprintf(out, "Instances of at most each size, run ID: %s\n", describeRun(rep))
+	if err != nil {
+		return err
+	}
+	return writeErrors(out, rep.Errors)
+}
+
+// writeHistogramMetrics writes the histograms in the Prometheus text
+// format. Orgs and the installation are separate metrics, so that summing
+// either doesn't count instances twice.
+func writeHistogramMetrics(out io.Writer, histograms []*memoryHistogram) error {
+	for _, m := range []struct {
+		Name, Help string
+		Buckets    func(*memoryHistogram) []int
+		Sum        func(*memoryHistogram) int
+	}{
+		{"instance_memory_usage_bytes", "Instances by memory used", func(mh *memoryHistogram) []int { return mh.UsageBuckets }, func(mh *memoryHistogram) int { return mh.UsageSum }},
+		{"instance_memory_quota_bytes", "Instances by memory quota", func(mh *memoryHistogram) []int { return mh.QuotaBuckets }, func(mh *memoryHistogram) int { return mh.QuotaSum }},
+	} {
+		for _, perOrg := range []bool{false, true} {
+			name, help, labels := "cf_report_memory_usage_"+m.Name, m.Help+" across the installation", ""
+			if perOrg {
+				name, help = "cf_report_memory_usage_org_"+m.Name, m.Help+" in each org"
+			}
+			_, err := fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+			if err != nil {
+				return err
+			}
+			for _, mh := range histograms {
+				if (mh.Org != "") != perOrg {
+					continue
+				}
+				if perOrg {
+					labels = "org=\"" + promLabelEscaper.Replace(mh.Org) + "\","
+				}
+				for i, n := range m.Buckets(mh) {
+					_, err = fmt.Fprintf(out, "%s_bucket{%sle=\"%d\"} %d\n", name, labels, histogramBuckets[i], n)
+					if err != nil {
+						return err
+					}
+				}
+				series := ""
+				if perOrg {
+					series = "{" + strings.TrimSuffix(labels, ",") + "}"
+				}
+				_, err = fmt.Fprintf(out, "%s_bucket{%sle=\"+Inf\"} %d\n%s_sum%s %d\n%s_count%s %d\n",
+					name, labels, mh.Count,
+					name, series, m.Sum(mh),
+					name, series, mh.Count)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
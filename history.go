@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	historySamplesDir = "samples"
+	historyHourlyDir  = "hourly"
+
+	// sampleTimeFormat is used to name sample files so that they sort by time
+	sampleTimeFormat = "20060102T150405Z"
+
+	// hourTimeFormat is used to name hourly aggregate files
+	hourTimeFormat = "20060102T15Z"
+)
+
+// historyStore is a sink that keeps every run in a directory, so that
+// usage can be compared over time. Layout is:
+//
+//	DIR/samples/<time>-<run id>.json  full report for a run
+//	DIR/hourly/<hour>.json            org totals averaged over the hour
+//	DIR/ledger.json                   when each org and space was first and last seen
+//	DIR/lease.json                    which server instance is crawling, if electing a leader
+//
+// After each write, samples older than CompactAfter are downsampled into
+// the hourly files, and anything older than Retain is deleted.
+type historyStore struct {
+	Dir          string
+	Retain       time.Duration
+	CompactAfter time.Duration
+	Quiet        bool
+}
+
+// hourlyAggregate is the mean usage of an org (or the whole installation,
+// if Org is "") across all samples taken within an hour
+type hourlyAggregate struct {
+	Hour        time.Time
+	Org         string
+	Samples     int
+	MemoryUsage int
+	MemoryQuota int
+}
+
+func (hs *historyStore) String() string {
+	return "history:" + hs.Dir
+}
+
+// Write saves the report, then compacts and expires old data
+func (hs *historyStore) Write(rep *usageReport) error {
+	dir := filepath.Join(hs.Dir, historySamplesDir)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	// named by run ID so that a retried write replaces rather than duplicates
+	err = writeJSONFile(filepath.Join(dir, rep.Time.UTC().Format(sampleTimeFormat)+"-"+rep.RunID+".json"), rep)
+	if err != nil {
+		return err
+	}
+
+	err = hs.updateLedger(rep)
+	if err != nil {
+		return err
+	}
+
+	return hs.compact(time.Now())
+}
+
+// samplePaths returns the paths of all stored samples, oldest first
+func (hs *historyStore) samplePaths() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(hs.Dir, historySamplesDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// sampleTime returns the time a sample was taken, based on its file name
+func sampleTime(path string) (time.Time, error) {
+	name := filepath.Base(path)
+	idx := strings.Index(name, "-")
+	if idx == -1 {
+		return time.Time{}, fmt.Errorf("unexpected file in history: %s", path)
+	}
+	return time.Parse(sampleTimeFormat, name[:idx])
+}
+
+// loadSample reads a stored report
+func loadSample(path string) (*usageReport, error) {
+	data, err := readMaybeCompressed(path)
+	if err != nil {
+		return nil, err
+	}
+	var rep usageReport
+	err = json.Unmarshal(data, &rep)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return &rep, nil
+}
+
+// latest returns the most recent stored report, or nil if there are none
+func (hs *historyStore) latest() (*usageReport, error) {
+	paths, err := hs.samplePaths()
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	return loadSample(paths[len(paths)-1])
+}
+
+// samples returns every stored report that hasn't been compacted, oldest first
+func (hs *historyStore) samples() ([]*usageReport, error) {
+	paths, err := hs.samplePaths()
+	if err != nil {
+		return nil, err
+	}
+	var rv []*usageReport
+	for _, path := range paths {
+		rep, err := loadSample(path)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, rep)
+	}
+	return rv, nil
+}
+
+// compact downsamples samples older than CompactAfter into hourly org
+// aggregates, then deletes anything older than Retain
+func (hs *historyStore) compact(now time.Time) error {
+	paths, err := hs.samplePaths()
+	if err != nil {
+		return err
+	}
+
+	byHour := make(map[time.Time][]string)
+	for _, path := range paths {
+		t, err := sampleTime(path)
+		if err != nil {
+			return err
+		}
+		if hs.Retain != 0 && now.Sub(t) > hs.Retain {
+			err = os.Remove(path)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if hs.CompactAfter != 0 && now.Sub(t) > hs.CompactAfter {
+			hour := t.Truncate(time.Hour)
+			byHour[hour] = append(byHour[hour], path)
+		}
+	}
+
+	for hour, paths := range byHour {
+		err = hs.compactHour(hour, paths)
+		if err != nil {
+			return err
+		}
+		if !hs.Quiet {
+			log.Printf("history: compacted %d samples for %s", len(paths), hour.Format(time.RFC3339))
+		}
+	}
+
+	if hs.Retain == 0 {
+		return nil
+	}
+	hourly, err := filepath.Glob(filepath.Join(hs.Dir, historyHourlyDir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range hourly {
+		hour, err := time.Parse(hourTimeFormat, strings.TrimSuffix(filepath.Base(path), ".json"))
+		if err != nil {
+			return fmt.Errorf("unexpected file in history: %s", path)
+		}
+		if now.Sub(hour.Add(time.Hour)) > hs.Retain {
+			err = os.Remove(path)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// compactHour merges the samples into the aggregate file for the hour, and
+// removes the samples once that is safely written
+func (hs *historyStore) compactHour(hour time.Time, paths []string) error {
+	dir := filepath.Join(hs.Dir, historyHourlyDir)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	aggPath := filepath.Join(dir, hour.Format(hourTimeFormat)+".json")
+
+	aggs, err := loadHourly(aggPath)
+	if err != nil {
+		return err
+	}
+	byOrg := make(map[string]*hourlyAggregate)
+	for _, agg := range aggs {
+		byOrg[agg.Org] = agg
+	}
+
+	for _, path := range paths {
+		rep, err := loadSample(path)
+		if err != nil {
+			return err
+		}
+		for _, row := range rep.Rows {
+			if strings.Contains(row.Key, "/") {
+				continue
+			}
+			agg, ok := byOrg[row.Key]
+			if !ok {
+				agg = &hourlyAggregate{Hour: hour, Org: row.Key}
+				byOrg[row.Key] = agg
+				aggs = append(aggs, agg)
+			}
+			agg.MemoryUsage = (agg.MemoryUsage*agg.Samples + row.MemoryUsage) / (agg.Samples + 1)
+			agg.MemoryQuota = (agg.MemoryQuota*agg.Samples + row.MemoryQuota) / (agg.Samples + 1)
+			agg.Samples++
+		}
+	}
+
+	sort.Slice(aggs, func(i, j int) bool {
+		return aggs[i].Org < aggs[j].Org
+	})
+	err = writeJSONFile(aggPath, aggs)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadHourly reads an hourly aggregate file, returning nothing if it doesn't exist yet
+func loadHourly(path string) ([]*hourlyAggregate, error) {
+	var aggs []*hourlyAggregate
+	err := readJSONFile(path, &aggs)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return aggs, err
+}
+
+// writeJSONFile writes v to path, via a temporary file so that readers never
+// see a partial write
+func writeJSONFile(path string, v interface{}) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(f).Encode(v)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// readJSONFile decodes the file at path into v
+func readJSONFile(path string, v interface{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = json.NewDecoder(f).Decode(v)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	return nil
+}
+
+// forEachOrgSample calls f with the org totals (and installation total, where
+// org is "") of every run in the history, including those that have been
+// compacted, oldest first. weight is the number of runs the values are a mean of.
+func (hs *historyStore) forEachOrgSample(f func(t time.Time, org string, usage, quota, weight int) error) error {
+	hourly, err := filepath.Glob(filepath.Join(hs.Dir, historyHourlyDir, "*.json"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(hourly)
+	for _, path := range hourly {
+		aggs, err := loadHourly(path)
+		if err != nil {
+			return err
+		}
+		for _, agg := range aggs {
+			// the middle of the hour is the best guess at when the samples were taken
+			err = f(agg.Hour.Add(time.Hour/2), agg.Org, agg.MemoryUsage, agg.MemoryQuota, agg.Samples)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	paths, err := hs.samplePaths()
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		rep, err := loadSample(path)
+		if err != nil {
+			return err
+		}
+		for _, row := range rep.Rows {
+			if strings.Contains(row.Key, "/") {
+				continue
+			}
+			err = f(rep.Time, row.Key, row.MemoryUsage, row.MemoryQuota, 1)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"html/template"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/govau/cf-report-memory-usage/report"
+)
+
+// htmlNode is a row of an HTML report, with the rows below it
+type htmlNode struct {
+	Name  string
+	Key   string
+	Level int
+
+	// Bars are memory and/or disk, as per the metric
+	Bars []htmlBar
+
+	// Limit is the memory limit and headroom of an org, space or app's
+	// quota, and what limits it, with --quotas
+	Limit string
+
+	// Note marks instances whose stats are from their last report
+	Note string
+
+	// State is, with --show-unhealthy, the state of an instance, or how
+	// many instances within aren't running, and Unhealthy is set if the
+	// node isn't running
+	State     string
+	Unhealthy bool
+
+	Children []*htmlNode
+}
+
+// htmlBar is usage against quota, for one metric
+type htmlBar struct {
+	Label   string
+	Usage   string
+	Quota   string
+	Percent string
+
+	// Width is the percent used, capped at 100, for drawing the bar, and
+	// Level is "ok", "warn" or "high"
+	Width int
+	Level string
+}
+
+// htmlPage is everything the HTML template needs
+type htmlPage struct {
+	RunID  string
+	Tag    string
+	Fresh  string
+	Time   string
+	Root   *htmlNode
+	Errors []htmlError
+}
+
+type htmlError struct {
+	Key, Text string
+}
+
+// writeHTML writes the rows as a self-contained page, with a collapsible
+// tree of orgs, spaces, apps and instances, for emailing or publishing
+// where a table would go unread. rows are in the order each node's
+// children are shown. Rows whose parent was filtered out hang off the
+// nearest row above them that is included.
+func writeHTML(out io.Writer, rep *usageReport, rows []*groupedRow, errs []*report.Error, opts renderOptions) error {
+	nodes := map[string]*htmlNode{}
+	for _, row := range rows {
+		nodes[row.Key] = newHTMLNode(row, opts)
+	}
+	root, ok := nodes[""]
+	if !ok {
+		root = &htmlNode{Name: "Total"}
+	}
+	for _, row := range rows {
+		if row.Key == "" {
+			continue
+		}
+		parent := root
+		bits := strings.Split(row.Key, "/")
+		for i := len(bits) - 1; i > 0; i-- {
+			if n, ok := nodes[strings.Join(bits[:i], "/")]; ok {
+				parent = n
+				break
+			}
+		}
+		parent.Children = append(parent.Children, nodes[row.Key])
+	}
+
+	page := htmlPage{RunID: rep.RunID, Tag: rep.Tag, Fresh: describeFreshOrg(rep), Root: root}
+	if !rep.Time.IsZero() {
+		page.Time = rep.Time.UTC().Format(time.RFC1123)
+	}
+	for _, e := range errs {
+		page.Errors = append(page.Errors, htmlError{Key: "/" + e.Key, Text: errorText(e)})
+	}
+	return htmlTemplate.Execute(out, page)
+}
+
+// newHTMLNode returns the node for row, without its children
+func newHTMLNode(row *groupedRow, opts renderOptions) *htmlNode {
+	n := &htmlNode{Name: "Total", Key: "/" + row.Key, Level: row.Level()}
+	if row.Key != "" {
+		n.Name = row.Key[strings.LastIndex(row.Key, "/")+1:]
+	}
+	if opts.Metric != metricDisk {
+		n.Bars = append(n.Bars, newHTMLBar("Memory", row.MemoryUsage, row.MemoryQuota, opts.Unit))
+	}
+	if opts.Metric != metricMemory {
+		n.Bars = append(n.Bars, newHTMLBar("Disk", row.DiskUsage, row.DiskQuota, opts.Unit))
+	}
+	if opts.Quotas && row.quotaHeadroom != nil {
+		limit, headroom := row.quotaHeadroom.limitCells(opts.Unit)
+		n.Limit = "limit " + limit + ", headroom " + headroom
+		if by := row.quotaHeadroom.limitedBy(); by != "" {
+			n.Limit += ", limited by " + by
+		}
+		if row.ExceedsOrg {
+			n.Limit += ", exceeds the org's quota"
+		}
+	}
+	if row.LastReportedAt != nil {
+		n.Note = "last reported " + row.LastReportedAt.UTC().Format(time.RFC3339) + ", using " + toSize(row.LastMemoryUsage, opts.Unit)
+	}
+	if opts.ShowUnhealthy {
+		n.State = stateCell(row.appUsageInfo)
+		n.Unhealthy = !row.Running()
+	}
+	return n
+}
+
+// newHTMLBar returns the bar for used of quota bytes. Bars turn amber at
+// 75% and red at 90%, as usage that high leaves little room for spikes.
+func newHTMLBar(label string, used, quota int, unit string) htmlBar {
+	hb := htmlBar{
+		Label:   label,
+		Usage:   toSize(used, unit),
+		Quota:   toSize(quota, unit),
+		Percent: toPercent(used, quota),
+		Level:   "ok",
+	}
+	if quota > 0 {
+		percent := used * 100 / quota
+		switch {
+		case percent >= 90:
+			hb.Level = "high"
+		case percent >= 75:
+			hb.Level = "warn"
+		}
+		if percent > 100 {
+			percent = 100
+		}
+		hb.Width = percent
+	}
+	return hb
+}
+
+var htmlTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Memory usage report</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; font-size: 14px; color: #222; margin: 2em; }
+h1 { font-size: 20px; }
+.meta { color: #666; }
+details { margin-left: 1.5em; }
+details.level0 { margin-left: 0; }
+summary, .leaf { display: flex; align-items: center; padding: 2px 0; cursor: pointer; }
+.leaf { margin-left: 1.5em; cursor: default; }
+.name { flex: 0 0 24em; overflow: hidden; text-overflow: ellipsis; white-space: nowrap; }
+.bar { flex: 0 0 22em; display: flex; align-items: center; margin-right: 1em; }
+.label { flex: 0 0 4em; color: #666; }
+.track { flex: 0 0 8em; height: 10px; background: #eee; margin-right: 0.5em; }
+.fill { display: block; height: 100%; }
+.ok { background: #4caf50; }
+.warn { background: #ff9800; }
+.high { background: #f44336; }
+.figures { white-space: nowrap; }
+.note { color: #666; font-size: 12px; }
+.errors { color: #b71c1c; }
+.unhealthy .name, .unhealthy .state { color: #b71c1c; font-weight: bold; }
+.state { margin-right: 1em; white-space: nowrap; }
+</style>
+</head>
+<body>
+<h1>Memory usage report</h1>
+<p class="meta">{{if .Time}}{{.Time}}, r{{else}}R{{end}}un ID {{.RunID}}{{if .Tag}}, tag {{.Tag}}{{end}}{{if .Fresh}}, {{.Fresh}}{{end}}</p>
+{{template "node" .Root}}
+{{if .Errors}}
+<h2 class="errors">Errors, so totals are incomplete</h2>
+<ul class="errors">
+{{range .Errors}}<li>{{.Key}}: {{.Text}}</li>
+{{end}}</ul>
+{{end}}
+</body>
+</html>
+{{define "row"}}<span class="name" title="{{.Key}}">{{.Name}}</span>{{if .State}}<span class="state">{{.State}}</span>{{end}}{{range .Bars}}<span class="bar"><span class="label">{{.Label}}</span><span class="track"><span class="fill {{.Level}}" style="width: {{.Width}}%"></span></span><span class="figures">{{.Usage}} / {{.Quota}} ({{.Percent}})</span></span>{{end}}{{if .Limit}}<span class="note">{{.Limit}}</span>{{end}}{{if .Note}}<span class="note">{{.Note}}</span>{{end}}{{end}}
+{{define "node"}}{{if .Children}}<details class="level{{.Level}}{{if .Unhealthy}} unhealthy{{end}}"{{if eq .Level 0}} open{{end}}>
+<summary>{{template "row" .}}</summary>
+{{range .Children}}{{template "node" .}}{{end}}</details>
+{{else}}<div class="leaf{{if .Unhealthy}} unhealthy{{end}}">{{template "row" .}}</div>
+{{end}}{{end}}`))
@@ -0,0 +1,328 @@
+// Package cfclient is the HTTP client report-memory-usage crawls the cloud
+// controller with. It retries transient failures, refreshes expired tokens
+// and follows the pagination of the v2 and v3 APIs. What the rest of the
+// plugin needs of it is the API interface, so that it can be faked.
+package cfclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// API is what is needed to read resources from the cloud controller
+type API interface {
+	// Get makes a GET request, where r is the relative path, and rv is
+	// json.Unmarshalled to
+	Get(r string, rv interface{}) error
+
+	// GetURL is as Get, but for an absolute URL
+	GetURL(u string, rv interface{}) error
+
+	// List calls f with each resource of a v2 list, following next_url
+	List(r string, f func(*Resource) error) error
+
+	// ListV3 calls f with each resource of a v3 list, following
+	// pagination.next
+	ListV3(r string, f func(json.RawMessage) error) error
+}
+
+// Client is a simple CloudFoundry client
+type Client struct {
+	// API url, ie "https://api.system.example.com"
+	API string
+
+	// Authorization header, ie "bearer eyXXXXX". Once requests are being
+	// made, use AuthorizationHeader() as it may be refreshed.
+	Authorization string
+
+	// Refresh, if set, returns a new Authorization header value, and is
+	// called when a request is rejected as the token has expired
+	Refresh func() (string, error)
+
+	// Quiet - if set don't print progress to stderr
+	Quiet bool
+
+	// Verbose, if set, logs every request made to stderr
+	Verbose bool
+
+	// Client - http.Client to use
+	Client *http.Client
+
+	// Retries is how many times to retry a request that fails with a
+	// network error, a 429 or a 5xx gateway error
+	Retries int
+
+	// RetryBackoff is how long to wait before the first retry, doubling for
+	// each subsequent retry. A Retry-After header takes precedence.
+	RetryBackoff time.Duration
+
+	// requests and failures count the requests made, for server mode
+	// telemetry. Accessed atomically.
+	requests, failures uint64
+
+	// rateLimitRemaining is the X-RateLimit-Remaining of the latest
+	// response that had one, if rateLimitSeen
+	rateLimitRemaining int
+	rateLimitSeen      bool
+
+	// ctx, if set, cancels requests once done, ie when interrupted or when
+	// a crawl reaches its timeout
+	ctx context.Context
+
+	// mu guards Authorization, which may be refreshed by any request,
+	// the rate limit and ctx
+	mu sync.Mutex
+}
+
+// Context returns the context requests are made with
+func (c *Client) Context() context.Context {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// SetContext replaces the context requests are made with
+func (c *Client) SetContext(ctx context.Context) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ctx = ctx
+}
+
+// RateLimit returns how many more requests the cloud controller said it
+// would allow before rate limiting, or false if it hasn't said
+func (c *Client) RateLimit() (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rateLimitRemaining, c.rateLimitSeen
+}
+
+// Requests returns how many requests have been made, including retries
+func (c *Client) Requests() uint64 {
+	return atomic.LoadUint64(&c.requests)
+}
+
+// Failures returns how many requests failed or had a bad status code
+func (c *Client) Failures() uint64 {
+	return atomic.LoadUint64(&c.failures)
+}
+
+// AuthorizationHeader returns the current Authorization header value
+func (c *Client) AuthorizationHeader() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Authorization
+}
+
+// refresh replaces the Authorization header value, unless another request
+// already has since stale was rejected
+func (c *Client) refresh(stale string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Authorization != stale {
+		return nil
+	}
+	if !c.Quiet {
+		log.Println("access token rejected, refreshing")
+	}
+	auth, err := c.Refresh()
+	if err != nil {
+		return fmt.Errorf("unable to refresh access token: %s", err)
+	}
+	c.Authorization = auth
+	return nil
+}
+
+// Get makes a GET request, where r is the relative path, and rv is json.Unmarshalled to
+func (c *Client) Get(r string, rv interface{}) error {
+	return c.GetURL(c.API+r, rv)
+}
+
+// GetURL is as Get, but for an absolute URL, for use with other CloudFoundry
+// components that accept the same token, such as log-cache. Transient
+// failures are retried as per Retries and RetryBackoff.
+func (c *Client) GetURL(u string, rv interface{}) error {
+	ctx := c.Context()
+	backoff := c.RetryBackoff
+	if backoff < 0 {
+		backoff = 0
+	}
+	refreshed := false
+	for attempt := 0; ; attempt++ {
+		auth := c.AuthorizationHeader()
+		retryAfter, err := c.getOnce(ctx, u, auth, rv)
+		// the token has likely expired part way through a long crawl, so
+		// refresh it and try again, once, without counting it as a retry
+		if IsStatus(err, http.StatusUnauthorized) && c.Refresh != nil && !refreshed {
+			refreshed = true
+			err = c.refresh(auth)
+			if err != nil {
+				return err
+			}
+			attempt--
+			continue
+		}
+		if err == nil || retryAfter < 0 || attempt >= c.Retries {
+			return err
+		}
+		wait := backoff + time.Duration(mathrand.Int63n(int64(backoff)/2+1))
+		if retryAfter > 0 {
+			wait = retryAfter
+		}
+		log.Printf("warning: %s, retrying in %s", err, wait.Round(time.Millisecond))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		// doubling stops at maxRetryBackoff, but a longer backoff given is kept
+		if backoff < maxRetryBackoff {
+			backoff *= 2
+			if backoff > maxRetryBackoff {
+				backoff = maxRetryBackoff
+			}
+		}
+	}
+}
+
+// maxRetryAfter caps how long a Retry-After header can make us wait, and
+// maxRetryBackoff how long backing off can, however many retries there are
+const (
+	maxRetryAfter   = 5 * time.Minute
+	maxRetryBackoff = 5 * time.Minute
+)
+
+// getOnce makes a single GET request. On failure it returns how long the
+// server asked us to wait before retrying (0 if it didn't say), or -1 if
+// the request shouldn't be retried.
+func (c *Client) getOnce(ctx context.Context, u, auth string, rv interface{}) (time.Duration, error) {
+	if ctx.Err() != nil {
+		return -1, ctx.Err()
+	}
+	if c.Verbose {
+		log.Printf("GET %s", u)
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return -1, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", auth)
+	atomic.AddUint64(&c.requests, 1)
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		atomic.AddUint64(&c.failures, 1)
+		if ctx.Err() != nil {
+			return -1, err
+		}
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining")); err == nil {
+		c.mu.Lock()
+		c.rateLimitRemaining, c.rateLimitSeen = remaining, true
+		c.mu.Unlock()
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// handled below
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		atomic.AddUint64(&c.failures, 1)
+		return parseRetryAfter(resp.Header.Get("Retry-After")), ParseAPIError(resp)
+	default:
+		atomic.AddUint64(&c.failures, 1)
+		return -1, ParseAPIError(resp)
+	}
+
+	return -1, json.NewDecoder(resp.Body).Decode(rv)
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of
+// seconds or a date, returning 0 if it is missing or invalid
+func parseRetryAfter(h string) time.Duration {
+	if h == "" {
+		return 0
+	}
+	var d time.Duration
+	if secs, err := strconv.Atoi(h); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(h); err == nil {
+		d = time.Until(t)
+	}
+	if d < 0 {
+		return 0
+	}
+	if d > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return d
+}
+
+// List makes a GET request, to list resources, where we will follow the "next_url"
+// to page results, and calls "f" as a callback to process each resource found
+func (c *Client) List(r string, f func(*Resource) error) error {
+	for r != "" {
+		var res struct {
+			NextURL   string `json:"next_url"`
+			Resources []*Resource
+		}
+		err := c.Get(r, &res)
+		if err != nil {
+			return err
+		}
+
+		for _, rr := range res.Resources {
+			err = f(rr)
+			if err != nil {
+				return err
+			}
+		}
+
+		r = res.NextURL
+	}
+	return nil
+}
+
+// ListV3 makes GET requests following pagination.next, which is an absolute
+// URL, calling f with each resource, for the caller to decode
+func (c *Client) ListV3(r string, f func(json.RawMessage) error) error {
+	u := c.API + r
+	for u != "" {
+		var res struct {
+			Pagination struct {
+				Next *struct {
+					Href string `json:"href"`
+				} `json:"next"`
+			} `json:"pagination"`
+			Resources []json.RawMessage `json:"resources"`
+		}
+		err := c.GetURL(u, &res)
+		if err != nil {
+			return err
+		}
+
+		for _, rr := range res.Resources {
+			err = f(rr)
+			if err != nil {
+				return err
+			}
+		}
+
+		u = ""
+		if res.Pagination.Next != nil {
+			u = res.Pagination.Next.Href
+		}
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+package cfclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestClient returns a client for a test server with handler, that
+// retries quickly
+func newTestClient(handler http.HandlerFunc) (*Client, *httptest.Server) {
+	srv := httptest.NewServer(handler)
+	return &Client{
+		API:           srv.URL,
+		Authorization: "bearer test",
+		Quiet:         true,
+		Client:        srv.Client(),
+		Retries:       2,
+		RetryBackoff:  time.Millisecond,
+	}, srv
+}
+
+func TestListFollowsNextURL(t *testing.T) {
+	pages := map[string]string{
+		"/v2/organizations":        `{"next_url": "/v2/organizations?page=2", "resources": [{"entity": {"name": "a"}}, {"entity": {"name": "b"}}]}`,
+		"/v2/organizations?page=2": `{"next_url": "/v2/organizations?page=3", "resources": [{"entity": {"name": "c"}}]}`,
+		"/v2/organizations?page=3": `{"next_url": null, "resources": []}`,
+	}
+	client, srv := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := pages[r.URL.RequestURI()]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, body)
+	})
+	defer srv.Close()
+
+	var names []string
+	err := client.List("/v2/organizations", func(r *Resource) error {
+		names = append(names, r.Entity.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(names, ","); got != "a,b,c" {
+		t.Errorf("listed %s, want a,b,c", got)
+	}
+	if client.Requests() != 3 {
+		t.Errorf("made %d requests, want 3", client.Requests())
+	}
+}
+
+func TestListStopsOnCallbackError(t *testing.T) {
+	client, srv := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"next_url": "/v2/apps?page=2", "resources": [{"entity": {"name": "a"}}, {"entity": {"name": "b"}}]}`)
+	})
+	defer srv.Close()
+	stop := fmt.Errorf("stop")
+	calls := 0
+	err := client.List("/v2/apps", func(r *Resource) error {
+		calls++
+		return stop
+	})
+	if err != stop {
+		t.Errorf("got %v, want the callback's error", err)
+	}
+	if calls != 1 || client.Requests() != 1 {
+		t.Errorf("got %d calls and %d requests, want 1 of each", calls, client.Requests())
+	}
+}
+
+func TestListV3FollowsPaginationNext(t *testing.T) {
+	var srvURL string
+	client, srv := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("page") {
+		case "":
+			fmt.Fprintf(w, `{"pagination": {"next": {"href": "%s/v3/apps?page=2"}}, "resources": [{"guid": "1"}, {"guid": "2"}]}`, srvURL)
+		case "2":
+			fmt.Fprint(w, `{"pagination": {"next": null}, "resources": [{"guid": "3"}]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	defer srv.Close()
+	srvURL = client.API
+
+	var guids []string
+	err := client.ListV3("/v3/apps", func(raw json.RawMessage) error {
+		var app struct {
+			GUID string `json:"guid"`
+		}
+		err := json.Unmarshal(raw, &app)
+		guids = append(guids, app.GUID)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(guids, ","); got != "1,2,3" {
+		t.Errorf("listed %s, want 1,2,3", got)
+	}
+}
+
+func TestGetRetriesTransientFailures(t *testing.T) {
+	for _, status := range []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout} {
+		attempts := 0
+		client, srv := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			if attempts <= 2 {
+				w.WriteHeader(status)
+				return
+			}
+			fmt.Fprint(w, `{"name": "ok"}`)
+		})
+		defer srv.Close()
+		var rv struct {
+			Name string `json:"name"`
+		}
+		err := client.Get("/v2/info", &rv)
+		if err != nil {
+			t.Errorf("%d: %s", status, err)
+			continue
+		}
+		if rv.Name != "ok" || client.Requests() != 3 || client.Failures() != 2 {
+			t.Errorf("%d: got %q after %d requests and %d failures, want ok after 3 and 2", status, rv.Name, client.Requests(), client.Failures())
+		}
+	}
+}
+
+func TestGetRetriesWithNegativeBackoff(t *testing.T) {
+	attempts := 0
+	client, srv := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		fmt.Fprint(w, `{"name": "ok"}`)
+	})
+	defer srv.Close()
+	// retried straight away, rather than panicking on the jitter
+	client.RetryBackoff = -time.Second
+	var rv struct {
+		Name string `json:"name"`
+	}
+	err := client.Get("/v2/info", &rv)
+	if err != nil || rv.Name != "ok" || client.Requests() != 2 {
+		t.Errorf("got %q, %v after %d requests, want ok after 2", rv.Name, err, client.Requests())
+	}
+}
+
+func TestGetGivesUpAfterRetries(t *testing.T) {
+	client, srv := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	defer srv.Close()
+	err := client.Get("/v2/info", &struct{}{})
+	if !IsStatus(err, http.StatusBadGateway) {
+		t.Errorf("got %v, want a 502", err)
+	}
+	if client.Requests() != 3 {
+		t.Errorf("made %d requests, want 3", client.Requests())
+	}
+}
+
+func TestGetDoesNotRetryClientErrors(t *testing.T) {
+	client, srv := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"errors": [{"code": 10010, "title": "CF-ResourceNotFound", "detail": "App not found"}]}`)
+	})
+	defer srv.Close()
+	err := client.Get("/v3/apps/missing", &struct{}{})
+	ae, ok := err.(*APIError)
+	if !ok {
+		t.Fatalf("got %v, want an APIError", err)
+	}
+	if ae.StatusCode != http.StatusNotFound || ae.Code != "CF-ResourceNotFound" || ae.Description != "App not found" {
+		t.Errorf("got %+v", ae)
+	}
+	if want := "GET " + client.API + "/v3/apps/missing: 404 Not Found: CF-ResourceNotFound: App not found"; ae.Error() != want {
+		t.Errorf("got %q, want %q", ae.Error(), want)
+	}
+	if client.Requests() != 1 {
+		t.Errorf("made %d requests, want 1", client.Requests())
+	}
+}
+
+func TestGetRefreshesRejectedToken(t *testing.T) {
+	client, srv := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "bearer fresh" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error": "invalid_token", "error_description": "expired"}`)
+			return
+		}
+		fmt.Fprint(w, `{}`)
+	})
+	defer srv.Close()
+	refreshes := 0
+	client.Refresh = func() (string, error) {
+		refreshes++
+		return "bearer fresh", nil
+	}
+	err := client.Get("/v2/info", &struct{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refreshes != 1 || client.AuthorizationHeader() != "bearer fresh" {
+		t.Errorf("refreshed %d times, to %q", refreshes, client.AuthorizationHeader())
+	}
+
+	// a token that is rejected again isn't refreshed in a loop
+	client.Refresh = func() (string, error) {
+		refreshes++
+		return "bearer stale", nil
+	}
+	client.Authorization = "bearer stale"
+	err = client.Get("/v2/info", &struct{}{})
+	if !IsStatus(err, http.StatusUnauthorized) || refreshes != 2 {
+		t.Errorf("got %v after %d refreshes, want a 401 after 2", err, refreshes)
+	}
+}
+
+func TestGetRecordsRateLimit(t *testing.T) {
+	client, srv := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/limited" {
+			w.Header().Set("X-RateLimit-Remaining", "42")
+		}
+		fmt.Fprint(w, `{}`)
+	})
+	defer srv.Close()
+	if _, ok := client.RateLimit(); ok {
+		t.Error("rate limit known before any requests")
+	}
+	client.Get("/unlimited", &struct{}{})
+	if _, ok := client.RateLimit(); ok {
+		t.Error("rate limit known without a header")
+	}
+	client.Get("/limited", &struct{}{})
+	if remaining, ok := client.RateLimit(); !ok || remaining != 42 {
+		t.Errorf("got %d, %t, want 42, true", remaining, ok)
+	}
+}
+
+func TestGetStopsWhenContextDone(t *testing.T) {
+	client, srv := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	client.SetContext(ctx)
+	err := client.Get("/v2/info", &struct{}{})
+	if err != context.Canceled {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+	if client.Requests() != 0 {
+		t.Errorf("made %d requests, want none", client.Requests())
+	}
+}
+
+func TestParseAPIError(t *testing.T) {
+	for _, tc := range []struct {
+		Body              string
+		Code, Description string
+	}{
+		{`{"code": 10003, "description": "You are not authorized", "error_code": "CF-NotAuthorized"}`, "CF-NotAuthorized", "You are not authorized"},
+		{`{"code": 10003, "description": "You are not authorized"}`, "10003", "You are not authorized"},
+		{`{"errors": [{"code": 10003, "title": "CF-NotAuthorized", "detail": "You are not authorized"}]}`, "CF-NotAuthorized", "You are not authorized"},
+		{`{"errors": [{"code": 10003}]}`, "10003", ""},
+		{`{"error": "invalid_token", "error_description": "expired"}`, "invalid_token", "expired"},
+		{`<html>Forbidden</html>`, "", ""},
+		{``, "", ""},
+	} {
+		client, srv := newTestClient(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, tc.Body)
+		})
+		defer srv.Close()
+		err := client.Get("/v2/info", &struct{}{})
+		ae, ok := err.(*APIError)
+		if !ok {
+			t.Errorf("%s: got %v, want an APIError", tc.Body, err)
+			continue
+		}
+		if ae.StatusCode != http.StatusForbidden || ae.Code != tc.Code || ae.Description != tc.Description {
+			t.Errorf("%s: got %d %q %q, want 403 %q %q", tc.Body, ae.StatusCode, ae.Code, ae.Description, tc.Code, tc.Description)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	for _, tc := range []struct {
+		Header string
+		Want   time.Duration
+	}{
+		{"", 0},
+		{"3", 3 * time.Second},
+		{"-3", 0},
+		{"soon", 0},
+		{"86400", maxRetryAfter},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0},
+	} {
+		if got := parseRetryAfter(tc.Header); got != tc.Want {
+			t.Errorf("%q: got %s, want %s", tc.Header, got, tc.Want)
+		}
+	}
+}
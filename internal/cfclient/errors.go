@@ -0,0 +1,96 @@
+package cfclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// maxErrorBody caps how much of an error response is read
+const maxErrorBody = 64 * 1024
+
+// APIError is a non-200 response from the cloud controller, or another
+// component such as UAA or log-cache, with the error it described if any
+type APIError struct {
+	// Method and URL are the request that failed, included in Error as
+	// they are in network errors
+	Method string
+	URL    string
+
+	StatusCode int
+
+	// Code is the CF error code, ie "CF-NotAuthorized", or UAA's error,
+	// ie "invalid_token"
+	Code string
+
+	// Description is the human readable explanation, if there was one
+	Description string
+}
+
+func (ae *APIError) Error() string {
+	msg := fmt.Sprintf("%s %s: %d %s", ae.Method, ae.URL, ae.StatusCode, http.StatusText(ae.StatusCode))
+	if ae.Code != "" {
+		msg += ": " + ae.Code
+	}
+	if ae.Description != "" {
+		msg += ": " + ae.Description
+	}
+	return msg
+}
+
+// ParseAPIError reads the error from a non-200 response. Bodies that
+// aren't a recognised error are ignored, leaving just the status code.
+func ParseAPIError(resp *http.Response) *APIError {
+	ae := &APIError{
+		Method:     resp.Request.Method,
+		URL:        resp.Request.URL.String(),
+		StatusCode: resp.StatusCode,
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	if err != nil {
+		return ae
+	}
+	var body struct {
+		// v2
+		Code        json.Number `json:"code"`
+		Description string      `json:"description"`
+		ErrorCode   string      `json:"error_code"`
+
+		// v3
+		Errors []struct {
+			Code   json.Number `json:"code"`
+			Title  string      `json:"title"`
+			Detail string      `json:"detail"`
+		} `json:"errors"`
+
+		// UAA
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if json.Unmarshal(b, &body) != nil {
+		return ae
+	}
+	switch {
+	case len(body.Errors) != 0:
+		ae.Code, ae.Description = body.Errors[0].Title, body.Errors[0].Detail
+		if ae.Code == "" {
+			ae.Code = body.Errors[0].Code.String()
+		}
+	case body.ErrorCode != "" || body.Description != "":
+		ae.Code, ae.Description = body.ErrorCode, body.Description
+		if ae.Code == "" {
+			ae.Code = body.Code.String()
+		}
+	case body.Error != "":
+		ae.Code, ae.Description = body.Error, body.ErrorDescription
+	}
+	return ae
+}
+
+// IsStatus returns true if err is an APIError with the status code
+func IsStatus(err error, code int) bool {
+	ae, ok := err.(*APIError)
+	return ok && ae.StatusCode == code
+}
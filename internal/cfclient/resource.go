@@ -0,0 +1,40 @@
+package cfclient
+
+import "time"
+
+// Resource captures fields that we care about when
+// retrieving data from CloudFoundry with the v2 API
+type Resource struct {
+	Metadata struct {
+		GUID      string    `json:"guid"`       // app
+		UpdatedAt time.Time `json:"updated_at"` // buildpack
+		URL       string    `json:"url"`        // app
+	} `json:"metadata"`
+	Entity struct {
+		Name               string    // org, space
+		SpacesURL          string    `json:"spaces_url"`                  // org
+		UsersURL           string    `json:"users_url"`                   // org
+		QuotaGUID          string    `json:"quota_definition_guid"`       // org
+		SpaceQuotaGUID     string    `json:"space_quota_definition_guid"` // space
+		MemoryLimit        int       `json:"memory_limit"`                // quota definition, in MB
+		ManagersURL        string    `json:"managers_url"`                // org, space
+		BillingManagersURL string    `json:"billing_managers_url"`        // org
+		AuditorsURL        string    `json:"auditors_url"`                // org, space
+		DevelopersURL      string    `json:"developers_url"`              // space
+		AppsURL            string    `json:"apps_url"`                    // space
+		BuildpackGUID      string    `json:"detected_buildpack_guid"`     // app
+		Buildpack          string    `json:"buildpack"`                   // app
+		DetectedBuildpack  string    `json:"detected_buildpack"`          // app
+		DockerImage        string    `json:"docker_image"`                // app
+		StackGUID          string    `json:"stack_guid"`                  // app
+		Admin              bool      // user
+		Username           string    // user
+		Filename           string    `json:"filename"`           // buildpack
+		Enabled            bool      `json:"enabled"`            // buildpack
+		PackageUpdatedAt   time.Time `json:"package_updated_at"` // app
+		Memory             int       `json:"memory"`             // app in gb?
+		Instances          int       `json:"instances"`          // app
+		DiskQuota          int       `json:"disk_quota"`         // app in gb?
+		State              string    `json:"state"`
+	} `json:"entity"`
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// unlabelled is what instances without the label are grouped under
+const unlabelled = "(none)"
+
+// errLabelsNeedV3 is returned if labels are asked for with the v2 API
+var errLabelsNeedV3 = errors.New("grouping by label needs the v3 API, as v2 has no labels")
+
+// inheritedLabels returns the value of each of keys, from the app's labels,
+// or failing that its space's or org's, so that a cost center can be set
+// once on a space rather than on every app within it
+func inheritedLabels(keys []string, org *cfOrg, space *cfSpace, app *cfApp) map[string]string {
+	if len(keys) == 0 {
+		return nil
+	}
+	labels := make(map[string]string)
+	for _, key := range keys {
+		for _, l := range []map[string]string{app.Labels, space.Labels, org.Labels} {
+			if v, ok := l[key]; ok {
+				labels[key] = v
+				break
+			}
+		}
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+	return labels
+}
+
+// labelGroup is the total usage of the instances with a label value, or
+// buildpack or stack, in bytes
+type labelGroup struct {
+	Value     string
+	Apps      int
+	Instances int
+
+	MemoryUsage int
+	MemoryQuota int
+	DiskUsage   int
+	DiskQuota   int
+}
+
+// labelTotals totals the instances in rep by their value of the label key,
+// largest memory quota first, as chargeback is for what is allocated
+func labelTotals(rep *usageReport, key string) []*labelGroup {
+	return totalsBy(rep, func(row *appUsageInfo) (string, bool) {
+		value, ok := row.Labels[key]
+		return value, ok
+	})
+}
+
+// dimensionTotals totals the instances in rep by their app's buildpack or
+// stack, as per --group-by, largest memory quota first
+func dimensionTotals(rep *usageReport, dimension string) []*labelGroup {
+	return totalsBy(rep, func(row *appUsageInfo) (string, bool) {
+		if dimension == groupByStack {
+			return row.Stack, row.Stack != ""
+		}
+		return row.Buildpack, row.Buildpack != ""
+	})
+}
+
+// totalsBy totals the instances in rep by the value returned for each,
+// which is totalled as (none) if there is no value
+func totalsBy(rep *usageReport, valueOf func(*appUsageInfo) (string, bool)) []*labelGroup {
+	groups := make(map[string]*labelGroup)
+	apps := make(map[string]map[string]bool)
+	for _, row := range rep.Rows {
+		if row.Level() != 4 {
+			continue
+		}
+		value, ok := valueOf(row)
+		if !ok {
+			value = unlabelled
+		}
+		lg, ok := groups[value]
+		if !ok {
+			lg = &labelGroup{Value: value}
+			groups[value] = lg
+			apps[value] = make(map[string]bool)
+		}
+		apps[value][row.Key[:strings.LastIndex(row.Key, "/")]] = true
+		lg.Instances++
+		lg.MemoryUsage += row.MemoryUsage
+		lg.MemoryQuota += row.MemoryQuota
+		lg.DiskUsage += row.DiskUsage
+		lg.DiskQuota += row.DiskQuota
+	}
+
+	var rv []*labelGroup
+	for value, lg := range groups {
+		lg.Apps = len(apps[value])
+		rv = append(rv, lg)
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		if rv[i].MemoryQuota != rv[j].MemoryQuota {
+			return rv[i].MemoryQuota > rv[j].MemoryQuota
+		}
+		return rv[i].Value < rv[j].Value
+	})
+	return rv
+}
+
+// renderLabelGroups writes the groups as a table, JSON or CSV, where key is
+// the label, or "buildpack" or "stack". Tables follow the metric, unit,
+// alignment and plainness of opts.
+func renderLabelGroups(out io.Writer, rep *usageReport, key string, groups []*labelGroup, opts renderOptions) error {
+	switch opts.Format {
+	case formatJSON:
+		return json.NewEncoder(out).Encode(groups)
+	case formatCSV:
+		w := csv.NewWriter(out)
+		err := w.Write([]string{"RunID", "Label", "Value", "Apps", "Instances", "MemoryUsage", "MemoryQuota", "DiskUsage", "DiskQuota"})
+		if err != nil {
+			return err
+		}
+		for _, lg := range groups {
+			err = w.Write([]string{
+				rep.RunID, key, lg.Value,
+				strconv.Itoa(lg.Apps),
+				strconv.Itoa(lg.Instances),
+				strconv.Itoa(lg.MemoryUsage),
+				strconv.Itoa(lg.MemoryQuota),
+				strconv.Itoa(lg.DiskUsage),
+				strconv.Itoa(lg.DiskQuota),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		w.Flush()
+		return w.Error()
+	case formatTable:
+		// handled below
+	default:
+		return fmt.Errorf("grouping by label can't be used with the %s format", opts.Format)
+	}
+
+	header := []string{key, "Apps", "Instances"}
+	switch opts.Metric {
+	case metricDisk:
+		header = append(header, "Disk Usage", "Disk Quota", "Disk Percent")
+	case metricBoth:
+		header = append(header, "Memory Usage", "Memory Quota", "Memory Percent", "Disk Usage", "Disk Quota", "Disk Percent")
+	default:
+		header = append(header, "Usage", "Quota", "Percent")
+	}
+	var buf bytes.Buffer
+	table := newTable(&buf, header, opts)
+	for _, lg := range groups {
+		cells := []string{lg.Value, strconv.Itoa(lg.Apps), strconv.Itoa(lg.Instances)}
+		if opts.Metric != metricDisk {
+			cells = append(cells,
+				toSize(lg.MemoryUsage, opts.Unit),
+				toSize(lg.MemoryQuota, opts.Unit),
+				toPercent(lg.MemoryUsage, lg.MemoryQuota),
+			)
+		}
+		if opts.Metric != metricMemory {
+			cells = append(cells,
+				toSize(lg.DiskUsage, opts.Unit),
+				toSize(lg.DiskQuota, opts.Unit),
+				toPercent(lg.DiskUsage, lg.DiskQuota),
+			)
+		}
+		table.Append(cells)
+	}
+	table.Render()
+	rendered := buf.String()
+	if opts.Plain {
+		rendered = trimLines(rendered)
+	}
+
+	_, err := fmt.Fprintf(out, "%sRun ID: %s\n", rendered, describeRun(rep))
+	if err != nil {
+		return err
+	}
+	return writeErrors(out, rep.Errors)
+}
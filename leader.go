@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// historyLeaseFile holds the leader lease within a history directory
+const historyLeaseFile = "lease.json"
+
+// leaderLease elects a single server instance to crawl, when several share a
+// history directory, ie on a volume service. The leader holds a lease in the
+// directory that it renews while running. Others wait for it to expire.
+//
+// This relies only on renames being atomic, so two instances may both
+// believe they are leader for a short time if they race for an expired
+// lease. As crawls are read only and history writes are idempotent, the
+// cost of that is only some extra load on the cloud controller.
+type leaderLease struct {
+	// Dir is the shared history directory
+	Dir string
+
+	// ID identifies this instance
+	ID string
+
+	// TTL is how long the lease lasts without being renewed
+	TTL time.Duration
+
+	mu     sync.Mutex
+	leader bool
+}
+
+// leaseFile is the contents of the lease file
+type leaseFile struct {
+	Holder  string
+	Expires time.Time
+}
+
+// newInstanceID returns an ID for this instance, preferring the one
+// assigned by CloudFoundry if running as an app
+func newInstanceID() (string, error) {
+	if guid := os.Getenv("CF_INSTANCE_GUID"); guid != "" {
+		return guid, nil
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid()), nil
+}
+
+// acquire takes or renews the lease, returning true if we hold it
+func (ll *leaderLease) acquire(now time.Time) (bool, error) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+
+	path := filepath.Join(ll.Dir, historyLeaseFile)
+	var lf leaseFile
+	err := readJSONFile(path, &lf)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if lf.Holder != ll.ID && now.Before(lf.Expires) {
+		ll.setLeader(false, lf.Holder)
+		return false, nil
+	}
+
+	err = os.MkdirAll(ll.Dir, 0755)
+	if err != nil {
+		return false, err
+	}
+	err = writeJSONFile(path, &leaseFile{Holder: ll.ID, Expires: now.Add(ll.TTL)})
+	if err != nil {
+		return false, err
+	}
+
+	// read it back, in case another instance wrote at the same time
+	err = readJSONFile(path, &lf)
+	if err != nil {
+		return false, err
+	}
+	ll.setLeader(lf.Holder == ll.ID, lf.Holder)
+	return ll.leader, nil
+}
+
+// setLeader records whether we are leader, logging changes
+func (ll *leaderLease) setLeader(leader bool, holder string) {
+	if leader != ll.leader {
+		if leader {
+			log.Printf("instance %s is now leader", ll.ID)
+		} else {
+			log.Printf("instance %s is no longer leader, %s is", ll.ID, holder)
+		}
+	}
+	ll.leader = leader
+}
+
+// isLeader returns true if we held the lease when last checked
+func (ll *leaderLease) isLeader() bool {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	return ll.leader
+}
+
+// hold renews the lease every third of its TTL until stop is closed, so
+// that it isn't lost during a long crawl
+func (ll *leaderLease) hold(stop <-chan struct{}) {
+	ticker := time.NewTicker(ll.TTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			_, err := ll.acquire(now)
+			if err != nil {
+				log.Printf("warning: unable to renew leader lease: %s", err)
+			}
+		}
+	}
+}
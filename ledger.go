@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// historyLedgerFile holds the capacity ledger within a history directory. It
+// is never compacted or expired, so covers the lifetime of the history.
+const historyLedgerFile = "ledger.json"
+
+// ledgerEntry records the lifetime of an org or space ("org/space")
+type ledgerEntry struct {
+	Key       string
+	FirstSeen time.Time
+	LastSeen  time.Time
+
+	PeakMemoryUsage int
+	PeakUsageAt     time.Time
+	PeakMemoryQuota int
+	PeakQuotaAt     time.Time
+}
+
+// capacityLedger tracks when each org and space was first and last seen
+// with running apps, and their peak memory
+type capacityLedger struct {
+	// LastRun is the time of the most recent run recorded that covered the
+	// whole installation, so that anything it didn't see was gone
+	LastRun time.Time
+	Entries []*ledgerEntry
+}
+
+// Active returns true if the entry was seen in the most recent run of the
+// whole installation, or since
+func (cl *capacityLedger) Active(e *ledgerEntry) bool {
+	return !e.LastSeen.Before(cl.LastRun)
+}
+
+// loadLedger reads the ledger from a history directory, returning an empty
+// ledger if there isn't one yet
+func loadLedger(dir string) (*capacityLedger, error) {
+	cl := &capacityLedger{}
+	err := readJSONFile(filepath.Join(dir, historyLedgerFile), cl)
+	if os.IsNotExist(err) {
+		return cl, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cl, nil
+}
+
+// coversInstallation returns true if rep is of every org and space, so
+// that those missing from it are gone, rather than outside its scope, shard
+// or exclusions, left out by --fresh-org or failed to be listed
+func coversInstallation(rep *usageReport) bool {
+	return !rep.Partial && rep.Shard == "" && rep.FreshOrg == "" && !rep.Incomplete()
+}
+
+// updateLedger records the orgs and spaces in rep in the history's ledger.
+// Runs of part of the installation update those they saw, but only those
+// that covered all of it decide what is gone.
+func (hs *historyStore) updateLedger(rep *usageReport) error {
+	cl, err := loadLedger(hs.Dir)
+	if err != nil {
+		return err
+	}
+
+	byKey := make(map[string]*ledgerEntry)
+	for _, e := range cl.Entries {
+		byKey[e.Key] = e
+	}
+	for _, row := range rep.Rows {
+		if row.Key == "" || strings.Count(row.Key, "/") > 1 {
+			continue
+		}
+		e, ok := byKey[row.Key]
+		if !ok {
+			e = &ledgerEntry{Key: row.Key, FirstSeen: rep.Time}
+			byKey[row.Key] = e
+			cl.Entries = append(cl.Entries, e)
+		}
+		if rep.Time.Before(e.FirstSeen) {
+			e.FirstSeen = rep.Time
+		}
+		if rep.Time.After(e.LastSeen) {
+			e.LastSeen = rep.Time
+		}
+		if row.MemoryUsage > e.PeakMemoryUsage || e.PeakUsageAt.IsZero() {
+			e.PeakMemoryUsage, e.PeakUsageAt = row.MemoryUsage, rep.Time
+		}
+		if row.MemoryQuota > e.PeakMemoryQuota || e.PeakQuotaAt.IsZero() {
+			e.PeakMemoryQuota, e.PeakQuotaAt = row.MemoryQuota, rep.Time
+		}
+	}
+	if coversInstallation(rep) && rep.Time.After(cl.LastRun) {
+		cl.LastRun = rep.Time
+	}
+
+	sort.Slice(cl.Entries, func(i, j int) bool {
+		return cl.Entries[i].Key < cl.Entries[j].Key
+	})
+	return writeJSONFile(filepath.Join(hs.Dir, historyLedgerFile), cl)
+}
+
+// renderLedger writes the ledger as a table or JSON
+func renderLedger(out io.Writer, cl *capacityLedger, format string) error {
+	switch format {
+	case formatJSON:
+		return json.NewEncoder(out).Encode(cl)
+	case formatTable:
+		// handled below
+	default:
+		return fmt.Errorf("unknown format: %s", format)
+	}
+
+	table := tablewriter.NewWriter(out)
+	table.SetHeader([]string{"Key", "First Seen", "Last Seen", "Status", "Peak Usage", "Peak Quota"})
+	for _, e := range cl.Entries {
+		status := "gone"
+		if cl.Active(e) {
+			status = "active"
+		}
+		table.Append([]string{
+			"/" + e.Key,
+			e.FirstSeen.Format("2006-01-02"),
+			e.LastSeen.Format("2006-01-02"),
+			status,
+			fmt.Sprintf("%s (%s)", toHumanSize(e.PeakMemoryUsage), e.PeakUsageAt.Format("2006-01-02")),
+			fmt.Sprintf("%s (%s)", toHumanSize(e.PeakMemoryQuota), e.PeakQuotaAt.Format("2006-01-02")),
+		})
+	}
+	table.Render()
+	return nil
+}
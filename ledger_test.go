@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/govau/cf-report-memory-usage/report"
+)
+
+func TestLedgerIgnoresMissingOrgsOfPartialRuns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hs := &historyStore{Dir: dir, Quiet: true}
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	run := func(hours int, partial bool, orgs ...string) {
+		var instances []*appUsageInfo
+		for _, org := range orgs {
+			instances = append(instances, &appUsageInfo{Key: org + "/s/a/0", MemoryUsage: 100, MemoryQuota: 200})
+		}
+		rep := &usageReport{RunID: "run", Time: start.Add(time.Duration(hours) * time.Hour), Partial: partial, Rows: report.AddTotals("run", instances)}
+		err := hs.updateLedger(rep)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	active := func(key string) bool {
+		cl, err := loadLedger(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range cl.Entries {
+			if e.Key == key {
+				return cl.Active(e)
+			}
+		}
+		t.Fatalf("/%s isn't in the ledger", key)
+		return false
+	}
+
+	run(0, false, "o1", "o2")
+	// ie --org o1
+	run(1, true, "o1")
+	if !active("o2") || !active("o2/s") {
+		t.Errorf("got o2 gone after a run limited to o1, want it active")
+	}
+	run(2, false, "o1", "o2")
+	if !active("o1") || !active("o2") {
+		t.Errorf("got an org gone after a full run of both, want both active")
+	}
+	run(3, false, "o1")
+	if active("o2") || !active("o1") {
+		t.Errorf("got o2 active after a full run without it, want it gone")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logCacheLookback is how far back to search for an instance's last metrics
+const logCacheLookback = 24 * time.Hour
+
+// logCache reads container metrics from log-cache, which keeps recent
+// metrics even for app instances that have since crashed
+type logCache struct {
+	client *simpleClient
+
+	once sync.Once
+	url  string
+	err  error
+}
+
+// lastMemory is the most recent memory metric seen for an instance
+type lastMemory struct {
+	Usage int
+	At    time.Time
+}
+
+// endpoint returns the log-cache URL advertised by the cloud controller, or
+// guesses it from the API URL for older versions that don't advertise it
+func (lc *logCache) endpoint() (string, error) {
+	lc.once.Do(func() {
+		var root struct {
+			Links struct {
+				LogCache struct {
+					Href string `json:"href"`
+				} `json:"log_cache"`
+			} `json:"links"`
+		}
+		lc.err = lc.client.Get("/", &root)
+		if lc.err != nil {
+			return
+		}
+		lc.url = root.Links.LogCache.Href
+		if lc.url == "" {
+			lc.url = strings.Replace(lc.client.API, "://api.", "://log-cache.", 1)
+		}
+	})
+	return lc.url, lc.err
+}
+
+// LastMemory returns the last reported memory usage for each of the given
+// instance indexes of an app. Instances with no metrics in the lookback
+// period are missing from the result.
+func (lc *logCache) LastMemory(appGUID string, instances []string) (map[string]*lastMemory, error) {
+	base, err := lc.endpoint()
+	if err != nil {
+		return nil, err
+	}
+
+	q := url.Values{}
+	q.Set("envelope_types", "GAUGE")
+	q.Set("descending", "true")
+	q.Set("limit", "1000")
+	q.Set("start_time", fmt.Sprintf("%d", time.Now().Add(-logCacheLookback).UnixNano()))
+
+	var res struct {
+		Envelopes struct {
+			Batch []struct {
+				Timestamp  string `json:"timestamp"`
+				InstanceID string `json:"instance_id"`
+				Gauge      struct {
+					Metrics map[string]struct {
+						Value float64 `json:"value"`
+					} `json:"metrics"`
+				} `json:"gauge"`
+			} `json:"batch"`
+		} `json:"envelopes"`
+	}
+	err = lc.client.GetURL(base+"/api/v1/read/"+url.PathEscape(appGUID)+"?"+q.Encode(), &res)
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := make(map[string]bool)
+	for _, i := range instances {
+		wanted[i] = true
+	}
+	rv := make(map[string]*lastMemory)
+	for _, e := range res.Envelopes.Batch {
+		if !wanted[e.InstanceID] || rv[e.InstanceID] != nil {
+			continue
+		}
+		mem, ok := e.Gauge.Metrics["memory"]
+		if !ok {
+			continue
+		}
+		var ns int64
+		_, err = fmt.Sscan(e.Timestamp, &ns)
+		if err != nil {
+			return nil, fmt.Errorf("bad envelope timestamp: %s", e.Timestamp)
+		}
+		rv[e.InstanceID] = &lastMemory{
+			Usage: int(mem.Value),
+			At:    time.Unix(0, ns),
+		}
+	}
+	return rv, nil
+}
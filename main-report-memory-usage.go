@@ -1,316 +1,891 @@
 package main
 
 import (
-	"crypto/tls"
-	"encoding/json"
-	"errors"
+	"context"
+	"crypto/rand"
 	"flag"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
 	"os"
-	"sort"
+	"os/signal"
+	"strconv"
 	"strings"
 	"time"
 
 	"code.cloudfoundry.org/cli/plugin"
-	"github.com/olekukonko/tablewriter"
-)
-
-// simpleClient is a simple CloudFoundry client
-type simpleClient struct {
-	// API url, ie "https://api.system.example.com"
-	API string
 
-	// Authorization header, ie "bearer eyXXXXX"
-	Authorization string
+	"github.com/govau/cf-report-memory-usage/internal/cfclient"
+	"github.com/govau/cf-report-memory-usage/report"
+)
 
-	// Quiet - if set don't print progress to stderr
-	Quiet bool
+type reportMemoryUsage struct{}
 
-	// Client - http.Client to use
-	Client *http.Client
-}
+func (c *reportMemoryUsage) Run(cliConnection plugin.CliConnection, args []string) {
+	summary := newRunSummary()
+	outputJSON := false
+	outputCSV := false
+	outputPrometheus := false
+	outputHTML := false
+	quiet := false
+	verbose := false
+	configPath := ""
+	var sinkSpecs sinkFlags
+	pushURL := ""
+	pushFormat := ""
+	retain := duration(0)
+	compactAfter := duration(7 * 24 * time.Hour)
+	historyDir := ""
+	snapshotDir := ""
+	signKey := ""
+	verifyKey := ""
+	thresholdsPath := ""
+	var warnPercent, critPercent percentFlag
+	var encryptRecipients recipientFlags
+	compress := ""
+	compareWindow := ""
+	timezone := "Local"
+	diffMode := false
+	ledgerMode := false
+	recommend := false
+	buildpacks := false
+	shadow := false
+	includeServices := false
+	headroom := 25.0
+	apiVersion := apiVersionAuto
+	auth := defaultAuthOptions(cliConnection == nil)
+	metric := metricMemory
+	concurrency := 1
+	consistent := false
+	errorPolicy := errorPolicyContinue
+	failFast := false
+	cacheDir := ""
+	cacheTTL := duration(defaultCacheTTL)
+	leaderElection := false
+	var shard reportShard
+	var exclude exclusions
+	freshOrg := ""
+	tenantsOnly := false
+	mergeMode := false
+	tag := ""
+	watch := false
+	var filter rowFilter
+	retries := 3
+	retryBackoff := duration(time.Second)
+	timeout := duration(0)
+	requestTimeout := duration(defaultRequestTimeout)
+	listen := ""
+	tenantKeysPath := ""
+	issueKeyOrgs := ""
+	tenantName := ""
+	printOpenAPI := false
+	interval := duration(5 * time.Minute)
+	orgName := ""
+	spaceName := ""
+	maxKeyWidth := 0
+	wrapKeys := false
+	align := alignAuto
+	plain := false
+	unit := unitAuto
+	quotas := false
+	showUnhealthy := false
+	groupBy := ""
+	groupByLabel := ""
+	histogram := false
+	cells := false
+	cellMemory := ""
+	cellInstances := ""
+	loseCells := ""
+	score := false
+	var weights scoreWeights
+	var staleBuildpacks namePatterns
+	var order rowSort
 
-// Get makes a GET request, where r is the relative path, and rv is json.Unmarshalled to
-func (sc *simpleClient) Get(r string, rv interface{}) error {
-	if !sc.Quiet {
-		log.Printf("GET %s%s", sc.API, r)
-	}
-	req, err := http.NewRequest(http.MethodGet, sc.API+r, nil)
+	fs := flag.NewFlagSet("report-memory-usage", flag.ExitOnError)
+	fs.BoolVar(&outputJSON, "output-json", false, "if set sends JSON to stdout instead of a rendered table")
+	fs.BoolVar(&outputCSV, "output-csv", false, "if set sends CSV to stdout instead of a rendered table")
+	fs.BoolVar(&outputPrometheus, "output-prometheus", false, "if set sends metrics in the Prometheus text format to stdout instead of a rendered table, ie for the node exporter textfile collector")
+	fs.BoolVar(&outputHTML, "output-html", false, "if set sends a self-contained HTML page, with a collapsible tree of orgs, spaces, apps and instances, to stdout instead of a rendered table")
+	fs.BoolVar(&quiet, "quiet", false, "if set suppressing printing of progress messages to stderr")
+	fs.BoolVar(&verbose, "verbose", false, "if set, log every request made to stderr instead of showing progress")
+	fs.StringVar(&configPath, "config", "", "if set, path to a JSON file defining the reports to run")
+	fs.StringVar(&pushURL, "push-url", "", "if set, push the report to this URL, as a --sink of the --push-format kind would")
+	fs.StringVar(&pushFormat, "push-format", "webhook", "how to push to --push-url: webhook (POST the JSON report), s3 (PUT it to an S3-compatible bucket) or influxdb (POST line protocol)")
+	fs.Var(&sinkSpecs, "sink", "destination for the report, may be repeated: stdout, file:PATH, webhook:URL, pushgateway:URL, s3:URL, influxdb:URL, history:DIR or snapshot:DIR")
+	fs.Var(&retain, "retain", "if set, how long history sinks keep data for, ie 90d")
+	fs.Var(&compactAfter, "compact-after", "age at which history sinks downsample per-instance samples to hourly org totals")
+	fs.StringVar(&historyDir, "history-dir", "", "history sink directory to read from when comparing past runs")
+	fs.StringVar(&snapshotDir, "snapshot-dir", "", "if set, also write each run to a timestamped JSON file in this directory, for --diff")
+	fs.StringVar(&signKey, "sign-key", "", "if set, path to a PEM private key used to write a SHA-256 checksum and detached signature next to each file and snapshot written")
+	fs.Var(&encryptRecipients, "encrypt-recipient", "if set, encrypt files, snapshots, webhook uploads, S3 and audit objects and emailed digests for this recipient, an age public key (age1...) or gpg key ID, may be repeated")
+	fs.StringVar(&compress, "compress", "", "if set, compress files, snapshots, webhook uploads and S3 objects with gzip or zstd (which needs the zstd command), before any encryption")
+	fs.Var(&warnPercent, "warn-percent", "if set, exit with status 1 if any app, or the installation, uses at least this percentage of its memory quota")
+	fs.Var(&critPercent, "crit-percent", "if set, exit with status 2 if any app, or the installation, uses at least this percentage of its memory quota")
+	fs.StringVar(&thresholdsPath, "thresholds", "", "if set, path to a JSON file of alerting thresholds, as for the thresholds section of --config, checked after each crawl")
+	fs.StringVar(&verifyKey, "verify-key", "", "if set, path to a PEM public key used to check the signatures of the report files given as arguments")
+	fs.StringVar(&compareWindow, "compare-window", "", "if set, compare average usage from --history-dir in two windows, ie \"business-hours vs overnight\"")
+	fs.StringVar(&timezone, "timezone", timezone, "time zone for --compare-window, ie Australia/Sydney")
+	fs.BoolVar(&diffMode, "diff", false, "if set, show the change in memory usage of each org, space and app between two snapshot files given as arguments, or the latest two runs in --snapshot-dir or --history-dir, as a table, JSON or, with --output-html, a page for reviewing changes")
+	fs.BoolVar(&ledgerMode, "ledger", false, "if set, show when each org and space in --history-dir was first and last seen, and its peak memory")
+	fs.BoolVar(&recommend, "recommend", false, "if set, suggest a memory limit for each app from its p95 instance usage plus --headroom, and how much memory could be reclaimed, using every run in --history-dir if given")
+	fs.Float64Var(&headroom, "headroom", headroom, "percentage to add to p95 usage for --recommend")
+	fs.BoolVar(&shadow, "shadow-compare", false, "if set, crawl with both the v2 and v3 APIs, and list the apps whose instances, quotas, states or buildpacks they disagree on, exiting with status 1 if any")
+	fs.BoolVar(&buildpacks, "buildpacks", false, "if set, show the average gap between memory usage and quota of the running instances of each buildpack, using every run in --history-dir if given")
+	fs.StringVar(&metric, "metric", metric, "which usage to show in tables: memory, disk or both")
+	fs.IntVar(&maxKeyWidth, "max-key-width", maxKeyWidth, "if set, shorten keys in tables to this many characters")
+	fs.BoolVar(&wrapKeys, "wrap-keys", false, "if set, wrap keys longer than --max-key-width over several lines rather than shortening them")
+	fs.StringVar(&align, "align", align, "how to align table columns: auto (numbers on the right), left or right")
+	fs.BoolVar(&plain, "plain", false, "if set, render tables without borders, for pasting into chat or diffing")
+	fs.BoolVar(&quotas, "quotas", false, "if set, fetch org and space quotas, and show the memory limit and remaining headroom of each org and space")
+	fs.BoolVar(&showUnhealthy, "show-unhealthy", false, "if set, show the state of each instance, and list the apps with instances that are not running, whose usage is understated")
+	fs.StringVar(&unit, "unit", unit, "unit to show sizes in tables in: auto (the largest unit for each size), B, KB, MB, GB or TB. JSON and CSV are always in bytes")
+	fs.Var(&order, "sort", "order of rows in every format: usage, quota, percent or key, optionally with :asc or :desc, ie percent:asc. Tables default to quota:desc")
+	fs.StringVar(&groupBy, "group-by", "", "if set, only show org, space, app or instance rows, with how many instances each has and their average usage, or total usage and quota by each app's buildpack or stack")
+	fs.BoolVar(&cells, "cells", false, "if set, total the memory used and allocated on each Diego cell, flagging hot cells using over 1.5 times the average")
+	fs.StringVar(&cellInstances, "cell-instances", "", "if set, also list the app instances on these comma separated cells, or * for every cell, with their memory, ie to plan draining cells for maintenance. Implies --cells")
+	fs.StringVar(&loseCells, "lose-cells", "", "if set with --cell-memory, simulate losing this many cells, those with the most memory allocated, or these comma separated cells, ie an availability zone, and show which orgs' instances couldn't be rescheduled on the rest")
+	fs.StringVar(&cellMemory, "cell-memory", "", "the memory of each cell with --cells, ie 64G, to show how much of it is used and allocated")
+	fs.BoolVar(&histogram, "histogram", false, "if set, count instances by memory usage and by quota, in buckets from 64 MB to 16 GB, for each org and the installation, as a table, JSON or Prometheus histograms")
+	fs.BoolVar(&score, "score", false, "if set, rank orgs by an efficiency score out of 100, combining how much of their quota they use, how little is in apps using under 25% of theirs, how many instances are running and how few are on --stale-buildpack")
+	fs.Var(&weights, "score-weights", "how much each part of --score counts, ie utilization=40,waste=30,crashes=20,stale=10, the defaults, for any not given")
+	fs.Var(&staleBuildpacks, "stale-buildpack", "if set, a glob, or regex:PATTERN, of buildpacks that are stale for --score, ie *-v3.*, fetching the buildpacks of apps as --buildpacks does. Can be repeated.")
+	fs.StringVar(&groupByLabel, "group-by-label", "", "if set, total usage and quota by the value of this label of each app, or of its space or org if the app has none, ie for chargeback by cost center. Needs the v3 API")
+	fs.Var(&filter.MinPercent, "min-percent", "if set, only show apps using at least this percentage of their quota, ie 90")
+	fs.Var(&filter.MaxPercent, "max-percent", "if set, only show apps using at most this percentage of their quota, ie 10 to find apps to right-size")
+	fs.IntVar(&filter.Top, "top", 0, "if set, only show this many apps, those with the largest quotas")
+	fs.StringVar(&orgName, "org", "", "if set, only report on this org")
+	fs.StringVar(&spaceName, "space", "", "if set, only report on this space, in --org or the targeted org")
+	fs.StringVar(&freshOrg, "fresh-org", "", "if set, only crawl this org, taking every other org from the latest run in --history-dir, so that an org's numbers are current without a full crawl")
+	fs.Var(&shard, "shard", "if set, only crawl a share of the orgs, ie 2/5 for the second of five, to be combined with --merge")
+	fs.Var(&exclude.Orgs, "exclude-org", "if set, leave orgs matching this glob out of the crawl and its totals, ie p-*, or regex:PATTERN for a regular expression. Can be repeated.")
+	fs.Var(&exclude.Spaces, "exclude-space", "if set, leave spaces matching this glob, by name or as org/space, out of the crawl and its totals, ie */sandbox, or regex:PATTERN. Can be repeated.")
+	fs.BoolVar(&tenantsOnly, "tenants-only", false, "if set, exclude the system org and the p-* orgs of marketplace tiles, so that totals only include tenant workloads")
+	fs.BoolVar(&mergeMode, "merge", false, "if set, combine the --output-json reports of each --shard given as arguments into one report")
+	fs.IntVar(&concurrency, "concurrency", concurrency, "how many apps to fetch instance stats for at once")
+	fs.BoolVar(&consistent, "consistent", false, "if set, list every app before fetching any stats, then fetch them in a burst of --concurrency requests, so that apps are sampled close together in time")
+	fs.StringVar(&errorPolicy, "error-policy", errorPolicy, "what to do when an org's spaces, a space's apps or an app's stats can't be fetched: continue without them, listing them in the report's errors and exiting with status 3, or fail")
+	fs.StringVar(&cacheDir, "cache-dir", "", "if set, cache orgs, spaces and quotas in this directory between runs, so that repeated runs only fetch apps and their stats")
+	fs.Var(&cacheTTL, "cache-ttl", "how long cached orgs, spaces and quotas are used for with --cache-dir, ie 30m or 1d")
+	fs.BoolVar(&failFast, "fail-fast", false, "if set, fail on the first org, space or app that can't be fetched, as --error-policy fail does")
+	fs.StringVar(&listen, "listen", "", "if set, run as a server on this address, ie :8080, serving the latest report on /report and metrics on /metrics")
+	fs.BoolVar(&watch, "watch", false, "if set, re-run the report every --interval, redrawing the table or writing a new JSON document each time")
+	fs.Var(&interval, "interval", "how often to re-crawl with --listen or --watch")
+	fs.BoolVar(&leaderElection, "leader-election", false, "if set with --listen, only crawl if elected leader of the instances sharing the --sink history:DIR, otherwise serve the leader's reports")
+	fs.StringVar(&tenantKeysPath, "tenant-keys", "", "if set with --listen, require a key from this file to read /report, each seeing only its own orgs. Keys are issued with --issue-tenant-key")
+	fs.StringVar(&issueKeyOrgs, "issue-tenant-key", "", "if set, issue a key to --tenant-keys FILE for reading these comma separated orgs, or * for all orgs and /metrics, print it and exit")
+	fs.BoolVar(&printOpenAPI, "openapi", false, "if set, print the OpenAPI document describing the --listen endpoints, also served on /openapi.json, and exit")
+	fs.StringVar(&tenantName, "tenant-name", "", "the name of the tenant issued a key with --issue-tenant-key, defaulting to its orgs")
+	fs.IntVar(&retries, "retries", retries, "how many times to retry requests that fail with a network error, 429 or gateway error")
+	fs.Var(&retryBackoff, "retry-backoff", "how long to wait before the first retry, doubling each time, unless the response has Retry-After")
+	fs.Var(&timeout, "timeout", "if set, stop crawling after this long, ie 10m, reporting what has been collected so far as incomplete")
+	fs.StringVar(&tag, "tag", "", "if set, tag the run, ie loadtest-2024-06, so that reports collected during load tests or game days can be told apart downstream, included in every row and sink")
+	fs.Var(&requestTimeout, "request-timeout", "how long each request to the cloud controller or UAA may take, after which it is retried as a network error would be")
+	fs.BoolVar(&includeServices, "include-services", false, "if set, also report the memory of service instances annotated with report-memory-usage/memory-usage, as if they were apps in their space, needs the v3 API")
+	fs.StringVar(&apiVersion, "api-version", apiVersion, "cloud controller API version to use: auto, v2 or v3")
+	fs.StringVar(&auth.Provider, "auth", auth.Provider, "how to authenticate: cf (the cf CLI login), password (CF_USERNAME and CF_PASSWORD), client-credentials (--client-id and CF_CLIENT_SECRET), token (CF_ACCESS_TOKEN), token-file or oidc, defaulting to CF_AUTH, or when run without the cf CLI, whichever is in the environment")
+	fs.StringVar(&auth.API, "api", auth.API, "cloud controller URL, ie https://api.system.example.com, defaulting to CF_API or the cf CLI target, needed unless --auth cf")
+	fs.StringVar(&auth.UAA, "uaa", auth.UAA, "UAA URL to get tokens from, defaulting to CF_UAA, or discovered from the API")
+	fs.StringVar(&auth.ClientID, "client-id", auth.ClientID, "UAA client for --auth password, client-credentials or oidc, defaulting to CF_CLIENT_ID, or the cf CLI client for password")
+	fs.StringVar(&auth.TokenFile, "token-file", auth.TokenFile, "file holding the access token for --auth token-file, or the OIDC ID token exchanged for one for --auth oidc, re-read for each token, defaulting to CF_TOKEN_FILE")
+	fs.BoolVar(&auth.SkipSSLValidation, "skip-ssl-validation", auth.SkipSSLValidation, "if set, don't validate the TLS certificates of the API and UAA, as the cf CLI setting does with --auth cf, defaulting to CF_SKIP_SSL_VALIDATION")
+	err := fs.Parse(args[1:])
 	if err != nil {
-		return err
+		summary.fatal(err)
 	}
-	req.Header.Set("Authorization", sc.Authorization)
-	resp, err := sc.Client.Do(req)
+	if failFast {
+		errorPolicy = errorPolicyFail
+	}
+	err = validRunTag(tag)
 	if err != nil {
-		return err
+		summary.fatal(err)
+	}
+	if tenantsOnly {
+		for _, org := range systemOrgs {
+			exclude.Orgs.Set(org)
+		}
+	}
+	// buildpacks and stacks aren't levels of rows, so are totalled as
+	// labels are
+	groupByDimension := ""
+	if groupBy == groupByBuildpack || groupBy == groupByStack {
+		groupByDimension, groupBy = groupBy, ""
+	}
+	if pushURL != "" {
+		spec, err := pushSinkSpec(pushFormat, pushURL)
+		if err != nil {
+			summary.fatal(err)
+		}
+		sinkSpecs = append(sinkSpecs, spec)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return errors.New("bad status code")
+	if fs.Arg(0) == "help" {
+		if fs.NArg() > 2 {
+			summary.fatal("help takes at most one topic")
+		}
+		err = writeHelp(os.Stdout, fs, fs.Arg(1))
+		if err != nil {
+			summary.fatal(err)
+		}
+		return
 	}
+	// every run that gets this far ends with a summary, including on failure
+	defer func() {
+		log.Print(summary.line(0))
+	}()
 
-	return json.NewDecoder(resp.Body).Decode(rv)
-}
+	render := renderOptions{
+		Format:        formatTable,
+		Metric:        metric,
+		MaxKeyWidth:   maxKeyWidth,
+		WrapKeys:      wrapKeys,
+		Align:         align,
+		Plain:         plain,
+		Unit:          unit,
+		Quotas:        quotas,
+		Filter:        filter,
+		ShowUnhealthy: showUnhealthy,
+		GroupBy:       groupBy,
+		Sort:          order,
+	}
+	outputs := 0
+	for _, o := range []struct {
+		set    bool
+		format string
+	}{
+		{outputJSON, formatJSON},
+		{outputCSV, formatCSV},
+		{outputPrometheus, formatPrometheus},
+		{outputHTML, formatHTML},
+	} {
+		if o.set {
+			render.Format = o.format
+			outputs++
+		}
+	}
+	if outputs > 1 {
+		summary.fatal("only one of --output-json, --output-csv, --output-prometheus and --output-html may be given")
+	}
+	err = render.validate()
+	if err != nil {
+		summary.fatal(err)
+	}
+	if quiet && verbose {
+		summary.fatal("--quiet and --verbose can't be used together")
+	}
+	if retries < 0 || retryBackoff < 0 {
+		summary.fatal("--retries and --retry-backoff can't be negative")
+	}
 
-// List makes a GET request, to list resources, where we will follow the "next_url"
-// to page results, and calls "f" as a callback to process each resource found
-func (sc *simpleClient) List(r string, f func(*resource) error) error {
-	for r != "" {
-		var res struct {
-			NextURL   string `json:"next_url"`
-			Resources []*resource
+	sinkOpts := sinkOptions{
+		Render:       render,
+		Quiet:        quiet,
+		Retain:       time.Duration(retain),
+		CompactAfter: time.Duration(compactAfter),
+	}
+	if signKey != "" {
+		sinkOpts.Signer, err = loadSigner(signKey)
+		if err != nil {
+			summary.fatal(err)
 		}
-		err := sc.Get(r, &res)
+		sinkOpts.Signer.Quiet = quiet
+	}
+	if len(encryptRecipients) != 0 {
+		sinkOpts.Encrypter, err = newEncrypter(encryptRecipients)
 		if err != nil {
-			return err
+			summary.fatal(err)
 		}
+	}
+	if compress != "" {
+		sinkOpts.Compressor, err = newCompressor(compress)
+		if err != nil {
+			summary.fatal(err)
+		}
+	}
 
-		for _, rr := range res.Resources {
-			err = f(rr)
+	// merges, diffs and comparisons only need the files given, not the API
+	if verifyKey != "" {
+		if len(fs.Args()) == 0 {
+			summary.fatal("--verify-key needs the report files to check as arguments")
+		}
+		key, err := loadPublicKey(verifyKey)
+		if err != nil {
+			summary.fatal(err)
+		}
+		failed := 0
+		for _, path := range fs.Args() {
+			err = verifyArtifact(path, key)
 			if err != nil {
-				return err
+				log.Printf("error: %s", err)
+				failed++
+				continue
 			}
+			fmt.Printf("%s: OK\n", path)
 		}
-
-		r = res.NextURL
+		if failed != 0 {
+			summary.fatalf("%d of %d files failed verification", failed, len(fs.Args()))
+		}
+		return
+	}
+	if mergeMode {
+		if len(fs.Args()) == 0 {
+			summary.fatal("--merge needs the JSON reports of each shard as arguments")
+		}
+		var reps []*usageReport
+		for _, path := range fs.Args() {
+			rep, err := loadSnapshot(path)
+			if err != nil {
+				summary.fatal(err)
+			}
+			reps = append(reps, rep)
+		}
+		merged, err := mergeReports(reps)
+		if err != nil {
+			summary.fatal(err)
+		}
+		if len(sinkSpecs) == 0 {
+			sinkSpecs = sinkFlags{"stdout"}
+		}
+		if snapshotDir != "" {
+			sinkSpecs = append(sinkSpecs, "snapshot:"+snapshotDir)
+		}
+		sinks, err := parseSinks(sinkSpecs, sinkOpts)
+		if err != nil {
+			summary.fatal(err)
+		}
+		err = writeSinks(sinks, merged)
+		if err != nil {
+			summary.fatal(err)
+		}
+		summary.record(merged)
+		if merged.Incomplete() {
+			log.Print("warning: some orgs, spaces or apps could not be fetched by the shards, report is incomplete")
+			summary.exit(exitPartialData)
+		}
+		return
+	}
+	if diffMode {
+		before, after, err := loadDiffInputs(fs.Args(), historyDir, snapshotDir)
+		if err != nil {
+			summary.fatal(err)
+		}
+		err = renderDiff(os.Stdout, diffReports(before, after), render.Format)
+		if err != nil {
+			summary.fatal(err)
+		}
+		return
+	}
+	if ledgerMode {
+		if historyDir == "" {
+			summary.fatal("--ledger requires --history-dir")
+		}
+		cl, err := loadLedger(historyDir)
+		if err != nil {
+			summary.fatal(err)
+		}
+		err = renderLedger(os.Stdout, cl, render.Format)
+		if err != nil {
+			summary.fatal(err)
+		}
+		return
+	}
+	if compareWindow != "" {
+		if historyDir == "" {
+			summary.fatal("--compare-window requires --history-dir")
+		}
+		windows, err := parseCompareWindows(compareWindow)
+		if err != nil {
+			summary.fatal(err)
+		}
+		loc, err := time.LoadLocation(timezone)
+		if err != nil {
+			summary.fatal(err)
+		}
+		comparisons, err := compareWindows(&historyStore{Dir: historyDir}, windows, loc)
+		if err != nil {
+			summary.fatal(err)
+		}
+		err = renderComparison(os.Stdout, comparisons, windows, render.Format)
+		if err != nil {
+			summary.fatal(err)
+		}
+		return
+	}
+	if printOpenAPI {
+		err := writeOpenAPI(os.Stdout)
+		if err != nil {
+			summary.fatal(err)
+		}
+		return
+	}
+	if issueKeyOrgs != "" {
+		if tenantKeysPath == "" {
+			summary.fatal("--issue-tenant-key needs --tenant-keys FILE to add the key to")
+		}
+		key, err := issueTenantKey(tenantKeysPath, tenantName, strings.Split(issueKeyOrgs, ","))
+		if err != nil {
+			summary.fatal(err)
+		}
+		log.Printf("issued a key for %s to %s, which is only shown once:", issueKeyOrgs, tenantKeysPath)
+		fmt.Println(key)
+		return
+	}
+	if buildpacks && historyDir != "" {
+		reps, err := (&historyStore{Dir: historyDir}).samples()
+		if err != nil {
+			summary.fatal(err)
+		}
+		ba, err := analyseBuildpacks(reps)
+		if err != nil {
+			summary.fatal(err)
+		}
+		err = renderBuildpacks(os.Stdout, ba, render.Format)
+		if err != nil {
+			summary.fatal(err)
+		}
+		return
+	}
+	if recommend && historyDir != "" {
+		reps, err := (&historyStore{Dir: historyDir}).samples()
+		if err != nil {
+			summary.fatal(err)
+		}
+		recs, err := recommendLimits(reps, headroom)
+		if err != nil {
+			summary.fatal(err)
+		}
+		err = renderRecommendations(os.Stdout, recs, render.Format)
+		if err != nil {
+			summary.fatal(err)
+		}
+		return
 	}
-	return nil
-}
-
-// resource captures fields that we care about when
-// retrieving data from CloudFoundry
-type resource struct {
-	Metadata struct {
-		GUID      string    `json:"guid"`       // app
-		UpdatedAt time.Time `json:"updated_at"` // buildpack
-		URL       string    `json:"url"`        // app
-	} `json:"metadata"`
-	Entity struct {
-		Name               string    // org, space
-		SpacesURL          string    `json:"spaces_url"`              // org
-		UsersURL           string    `json:"users_url"`               // org
-		ManagersURL        string    `json:"managers_url"`            // org, space
-		BillingManagersURL string    `json:"billing_managers_url"`    // org
-		AuditorsURL        string    `json:"auditors_url"`            // org, space
-		DevelopersURL      string    `json:"developers_url"`          // space
-		AppsURL            string    `json:"apps_url"`                // space
-		BuildpackGUID      string    `json:"detected_buildpack_guid"` // app
-		Buildpack          string    `json:"buildpack"`               // app
-		Admin              bool      // user
-		Username           string    // user
-		Filename           string    `json:"filename"`           // buildpack
-		Enabled            bool      `json:"enabled"`            // buildpack
-		PackageUpdatedAt   time.Time `json:"package_updated_at"` // app
-		Memory             int       `json:"memory"`             // app in gb?
-		Instances          int       `json:"instances"`          // app
-		DiskQuota          int       `json:"disk_quota"`         // app in gb?
-		State              string    `json:"state"`
-	} `json:"entity"`
-}
-
-type reportMemoryUsage struct{}
 
-func newSimpleClient(cliConnection plugin.CliConnection, quiet bool) (*simpleClient, error) {
-	at, err := cliConnection.AccessToken()
+	auth.RequestTimeout = time.Duration(requestTimeout)
+	client, err := auth.connect(cliConnection, quiet)
 	if err != nil {
-		return nil, err
+		summary.fatal(err)
+	}
+	client.Retries = retries
+	client.Verbose = verbose
+	client.RetryBackoff = time.Duration(retryBackoff)
+	if listen == "" && !watch && configPath == "" {
+		client.SetContext(interruptible())
 	}
 
-	api, err := cliConnection.ApiEndpoint()
-	if err != nil {
-		return nil, err
+	if freshOrg != "" {
+		if orgName != "" || spaceName != "" || shard.Count != 0 {
+			summary.fatal("--fresh-org can't be used with --org, --space or --shard")
+		}
+		if historyDir == "" {
+			summary.fatal(errNoCachedRun)
+		}
+		orgName = freshOrg
+	}
+	var scope reportScope
+	explicitScope := orgName != "" || spaceName != ""
+	if explicitScope {
+		if auth.Provider == authCF {
+			scope, err = namedScope(cliConnection, orgName, spaceName)
+		} else {
+			scope, err = apiScope(client, orgName, spaceName)
+		}
+		if err != nil {
+			summary.fatal(err)
+		}
 	}
 
-	skipSSL, err := cliConnection.IsSSLDisabled()
+	// check up front that the token can see enough, rather than failing part way through
+	scopes, err := tokenScopes(client.AuthorizationHeader())
 	if err != nil {
-		return nil, err
-	}
+		log.Printf("warning: unable to check access token permissions: %s", err)
+	} else {
+		warnings, err := checkPermissions(scopes)
+		if err != nil {
+			summary.fatal(err)
+		}
+		for _, w := range warnings {
+			log.Printf("warning: %s", w)
+		}
 
-	httpClient := http.DefaultClient
-	if skipSSL {
-		if !quiet {
-			log.Println("warning: skipping TLS validation...")
+		// users without admin read access can only usefully report on their own spaces
+		if !canSeeAllOrgs(scopes) && !explicitScope {
+			if auth.Provider != authCF {
+				summary.fatalf("not an admin or admin read-only user, and not logged in with the cf CLI, so use --org ORG [--space SPACE]")
+			}
+			scope, err = targetedScope(cliConnection)
+			if err != nil {
+				summary.fatal(err)
+			}
+			log.Printf("note: not an admin or admin read-only user, so reporting on the targeted %s only", scope)
 		}
+	}
 
-		httpClient = &http.Client{
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: true,
-				},
-			},
+	var labels []string
+	if groupByLabel != "" {
+		if groupBy != "" || groupByDimension != "" {
+			summary.fatal("--group-by and --group-by-label can't be used together")
 		}
+		labels = []string{groupByLabel}
 	}
+	colOpts := collectorOptions{
+		APIVersion:  apiVersion,
+		Scope:       scope,
+		Concurrency: concurrency,
+		Consistent:  consistent,
+		Progress:    !quiet && !verbose && listen == "",
+		Shard:       shard,
+		Exclude:     exclude,
+		ErrorPolicy: errorPolicy,
 
-	return &simpleClient{
-		API:           api,
-		Authorization: at,
-		Quiet:         quiet,
-		Client:        httpClient,
-	}, nil
-}
+		Quotas:          quotas,
+		Buildpacks:      buildpacks || groupByDimension == groupByBuildpack || len(staleBuildpacks) != 0,
+		Labels:          labels,
+		IncludeServices: includeServices,
 
-func (c *reportMemoryUsage) Run(cliConnection plugin.CliConnection, args []string) {
-	outputJSON := false
-	quiet := false
+		CacheDir: cacheDir,
+		CacheTTL: time.Duration(cacheTTL),
+		Timeout:  time.Duration(timeout),
+		Tag:      tag,
 
-	fs := flag.NewFlagSet("report-memory-usage", flag.ExitOnError)
-	fs.BoolVar(&outputJSON, "output-json", false, "if set sends JSON to stdout instead of a rendered table")
-	fs.BoolVar(&quiet, "quiet", false, "if set suppressing printing of progress messages to stderr")
-	err := fs.Parse(args[1:])
-	if err != nil {
-		log.Fatal(err)
+		FreshOrg:   freshOrg,
+		HistoryDir: historyDir,
 	}
-
-	client, err := newSimpleClient(cliConnection, quiet)
+	if shadow {
+		sc, err := shadowCompare(client, colOpts, summary)
+		if err != nil {
+			summary.fatal(err)
+		}
+		err = renderShadow(os.Stdout, sc, render.Format)
+		if err != nil {
+			summary.fatal(err)
+		}
+		if len(sc.Discrepancies) != 0 {
+			summary.exit(exitDiscrepancies)
+		}
+		return
+	}
+	col, err := newCollector(client, colOpts)
 	if err != nil {
-		log.Fatal(err)
+		summary.fatal(err)
+	}
+	col.summary = summary
+	if explicitScope && !quiet {
+		log.Printf("reporting on %s", scope)
 	}
 
 	switch args[0] {
 	case "report-memory-usage":
-		err := c.reportMemoryUsage(client, os.Stdout, outputJSON)
-		if err != nil {
-			log.Fatal(err)
+		if configPath != "" {
+			if listen != "" || watch {
+				summary.fatal("--listen and --watch can't be used with --config, use \"every\" instead")
+			}
+			if snapshotDir != "" {
+				summary.fatal("--snapshot-dir can't be used with --config, add a \"snapshot:DIR\" sink to a report instead")
+			}
+			if thresholdsPath != "" || warnPercent.Given || critPercent.Given {
+				summary.fatal("--thresholds, --warn-percent and --crit-percent can't be used with --config, add a \"thresholds\" section instead")
+			}
+			conf, err := loadConfig(configPath, sinkOptions{
+				Quiet:        quiet,
+				Retain:       time.Duration(retain),
+				CompactAfter: time.Duration(compactAfter),
+				Signer:       sinkOpts.Signer,
+				Encrypter:    sinkOpts.Encrypter,
+				Compressor:   sinkOpts.Compressor,
+			})
+			if err != nil {
+				summary.fatal(err)
+			}
+			col.opts.Quotas = conf.needsQuotas()
+			err = runPipelines(col, conf)
+			if err == errPartialData {
+				summary.exit(exitPartialData)
+			}
+			if err != nil {
+				summary.fatal(err)
+			}
+			return
 		}
-	}
-}
-
-type appUsageInfo struct {
-	Key         string
-	MemoryUsage int
-	MemoryQuota int
-}
-
-type appStats map[string]*struct {
-	Stats struct {
-		DiskQuota int `json:"disk_quota"`
-		MemQuota  int `json:"mem_quota"`
-		Usage     struct {
-			Disk int `json:"disk"`
-			Mem  int `json:"mem"`
-		} `json:"usage"`
-	} `json:"stats"`
-}
 
-func noSlash(s string) string {
-	return strings.Replace(s, "/", "-", -1)
-}
+		if groupByLabel != "" {
+			rep, err := col.collect()
+			if err != nil {
+				summary.fatal(err)
+			}
+			err = renderLabelGroups(os.Stdout, rep, groupByLabel, labelTotals(rep, groupByLabel), render)
+			if err != nil {
+				summary.fatal(err)
+			}
+			summary.exitIfIncomplete(rep)
+			return
+		}
 
-func (c *reportMemoryUsage) reportMemoryUsage(client *simpleClient, out io.Writer, outputJSON bool) error {
-	buildpacks := make(map[string]*resource)
-	err := client.List("/v2/buildpacks", func(bp *resource) error {
-		if bp.Entity.Enabled {
-			buildpacks[bp.Entity.Name] = bp
+		if groupByDimension != "" {
+			rep, err := col.collect()
+			if err != nil {
+				summary.fatal(err)
+			}
+			err = renderLabelGroups(os.Stdout, rep, groupByDimension, dimensionTotals(rep, groupByDimension), render)
+			if err != nil {
+				summary.fatal(err)
+			}
+			summary.exitIfIncomplete(rep)
+			return
 		}
-		return nil
-	})
-	if err != nil {
-		return err
-	}
 
-	var allInfo []*appUsageInfo
-	err = client.List("/v2/organizations", func(org *resource) error {
-		return client.List(org.Entity.SpacesURL, func(space *resource) error {
-			return client.List(space.Entity.AppsURL, func(app *resource) error {
-				if app.Entity.State == "STOPPED" {
-					return nil
+		if cells || cellInstances != "" || loseCells != "" {
+			capacity := 0
+			if cellMemory != "" {
+				capacity, err = parseByteSize(cellMemory)
+				if err != nil {
+					summary.fatalf("invalid --cell-memory: %s", err)
 				}
-				var stats appStats
-				err := client.Get(app.Metadata.URL+"/stats", &stats)
+			}
+			if loseCells != "" && capacity == 0 {
+				summary.fatal(errCellLossNeedsCapacity)
+			}
+			rep, err := col.collect()
+			if err != nil {
+				summary.fatal(err)
+			}
+			if loseCells != "" {
+				cp := cellTotals(rep, capacity, []string{allCells})
+				lost, err := lostCells(cp, loseCells)
 				if err != nil {
-					return err
+					summary.fatal(err)
 				}
-				for instanceIdx, instanceStat := range stats {
-					allInfo = append(allInfo, &appUsageInfo{
-						Key: fmt.Sprintf("%s/%s/%s/%s",
-							noSlash(org.Entity.Name),
-							noSlash(space.Entity.Name),
-							noSlash(app.Entity.Name),
-							noSlash(instanceIdx),
-						),
-						MemoryUsage: instanceStat.Stats.Usage.Mem,
-						MemoryQuota: instanceStat.Stats.MemQuota,
-					})
+				err = renderCellLoss(os.Stdout, rep, simulateCellLoss(cp, lost), render)
+				if err != nil {
+					summary.fatal(err)
 				}
-				return nil
-			})
-		})
-	})
-	if err != nil {
-		return err
-	}
+				summary.exitIfIncomplete(rep)
+				return
+			}
+			var listed []string
+			if cellInstances != "" {
+				listed = strings.Split(cellInstances, ",")
+			}
+			cp := cellTotals(rep, capacity, listed)
+			for _, cell := range cp.unknown(listed) {
+				log.Printf("warning: no instances are running on cell %s", cell)
+			}
+			err = renderCells(os.Stdout, rep, cp, render)
+			if err != nil {
+				summary.fatal(err)
+			}
+			summary.exitIfIncomplete(rep)
+			return
+		}
 
-	totalQuota, totalUsage := make(map[string]int), make(map[string]int)
-	for _, info := range allInfo {
-		bits := strings.Split(info.Key, "/")
-		for i := range bits {
-			key := strings.Join(bits[:i], "/")
-			totalQuota[key], totalUsage[key] = totalQuota[key]+info.MemoryQuota, totalUsage[key]+info.MemoryUsage
+		if score {
+			rep, err := col.collect()
+			if err != nil {
+				summary.fatal(err)
+			}
+			err = renderScores(os.Stdout, rep, scoreOrgs(rep, weights, staleBuildpacks), render)
+			if err != nil {
+				summary.fatal(err)
+			}
+			summary.exitIfIncomplete(rep)
+			return
 		}
-	}
-	for k, quota := range totalQuota {
-		allInfo = append(allInfo, &appUsageInfo{
-			Key:         k,
-			MemoryUsage: totalUsage[k],
-			MemoryQuota: quota,
-		})
-	}
 
-	if outputJSON {
-		return json.NewEncoder(out).Encode(allInfo)
-	}
+		if histogram {
+			rep, err := col.collect()
+			if err != nil {
+				summary.fatal(err)
+			}
+			err = renderHistograms(os.Stdout, rep, memoryHistograms(rep), render.Format)
+			if err != nil {
+				summary.fatal(err)
+			}
+			summary.exitIfIncomplete(rep)
+			return
+		}
+
+		if buildpacks {
+			rep, err := col.collect()
+			if err != nil {
+				summary.fatal(err)
+			}
+			ba, err := analyseBuildpacks([]*usageReport{rep})
+			if err != nil {
+				summary.fatal(err)
+			}
+			err = renderBuildpacks(os.Stdout, ba, render.Format)
+			if err != nil {
+				summary.fatal(err)
+			}
+			summary.exitIfIncomplete(rep)
+			return
+		}
 
-	sort.Sort(sort.Reverse(byTotalDisk(allInfo)))
+		if recommend {
+			rep, err := col.collect()
+			if err != nil {
+				summary.fatal(err)
+			}
+			recs, err := recommendLimits([]*usageReport{rep}, headroom)
+			if err != nil {
+				summary.fatal(err)
+			}
+			err = renderRecommendations(os.Stdout, recs, render.Format)
+			if err != nil {
+				summary.fatal(err)
+			}
+			summary.exitIfIncomplete(rep)
+			return
+		}
 
-	table := tablewriter.NewWriter(out)
-	table.SetHeader([]string{"Key", "Usage", "Quota", "Percent"})
-	for _, row := range allInfo {
-		table.Append([]string{
-			fmt.Sprintf("/%s", row.Key),
-			toHumanSize(row.MemoryUsage),
-			toHumanSize(row.MemoryQuota),
-			toPercent(row.MemoryUsage, row.MemoryQuota),
-		})
-	}
-	table.Render()
+		// in server mode the report is served, so only goes to sinks if asked
+		if len(sinkSpecs) == 0 && listen == "" {
+			sinkSpecs = sinkFlags{"stdout"}
+		}
+		if snapshotDir != "" {
+			sinkSpecs = append(sinkSpecs, "snapshot:"+snapshotDir)
+		}
+		sinks, err := parseSinks(sinkSpecs, sinkOpts)
+		if err != nil {
+			summary.fatal(err)
+		}
+		var alerts *alertSink
+		if thresholdsPath != "" || warnPercent.Given || critPercent.Given {
+			tc := &thresholdConfig{}
+			if thresholdsPath != "" {
+				tc, err = loadThresholds(thresholdsPath)
+				if err != nil {
+					summary.fatal(err)
+				}
+			}
+			// the flags override the file's defaults, but not its orgs
+			if warnPercent.Given {
+				tc.WarnPercent = warnPercent
+			}
+			if critPercent.Given {
+				tc.CritPercent = critPercent
+			}
+			err = tc.validate()
+			if err != nil {
+				summary.fatal(err)
+			}
+			if tc.Forecast != nil {
+				col.opts.Quotas = true
+			}
+			alerts = &alertSink{Thresholds: tc}
+			sinks = append(sinks, alerts)
+		}
 
-	return nil
-}
+		if listen != "" {
+			if watch {
+				summary.fatal("--watch can't be used with --listen")
+			}
+			rs := &reportServer{
+				Collector: col,
+				Interval:  time.Duration(interval),
+				Sinks:     sinks,
+			}
+			if tenantKeysPath != "" {
+				rs.TenantKeys = &tenantKeys{Path: tenantKeysPath}
+				_, err = rs.TenantKeys.load()
+				if err != nil {
+					summary.fatal(err)
+				}
+			}
+			if leaderElection {
+				for _, s := range sinks {
+					if hs, ok := s.(*historyStore); ok {
+						rs.History = hs
+					}
+				}
+				if rs.History == nil {
+					summary.fatal("--leader-election needs a --sink history:DIR shared by all instances")
+				}
+				id, err := newInstanceID()
+				if err != nil {
+					summary.fatal(err)
+				}
+				rs.Lease = &leaderLease{
+					Dir: rs.History.Dir,
+					ID:  id,
+					TTL: 2 * time.Duration(interval),
+				}
+			}
+			summary.fatal(rs.serve(listen))
+		}
+		if leaderElection {
+			summary.fatal("--leader-election can only be used with --listen")
+		}
+		if tenantKeysPath != "" {
+			summary.fatal("--tenant-keys can only be used with --listen")
+		}
 
-func toPercent(num, denom int) string {
-	if denom == 0 {
-		return "NaN"
-	}
-	return fmt.Sprintf("%d%%", (num*100.0)/denom)
-}
+		if watch {
+			// redraw tables in place, while JSON and CSV become a stream of documents
+			if render.Format == formatTable {
+				for _, s := range sinks {
+					if ws, ok := s.(*writerSink); ok {
+						ws.Clear = true
+					}
+				}
+			}
+			summary.fatal(c.watchMemoryUsage(col, sinks, time.Duration(interval)))
+		}
 
-func toHumanSize(b int) string {
-	units := []string{"B", "KB", "MB", "GB", "TB", "PB", "EB"}
-	for _, u := range units[:len(units)-1] {
-		if b < 1024 {
-			return fmt.Sprintf("%d %s", b, u)
+		err = c.reportMemoryUsage(col, sinks)
+		if alerts != nil {
+			// as a monitoring check, an error is UNKNOWN rather than WARNING,
+			// and breaches take priority over an incomplete report
+			if err != nil && err != errPartialData {
+				log.Print(err)
+				summary.exit(exitPartialData)
+			}
+			if status := alerts.exitStatus(); status != 0 {
+				summary.exit(status)
+			}
+		}
+		if err == errPartialData {
+			summary.exit(exitPartialData)
+		}
+		if err != nil {
+			summary.fatal(err)
 		}
-		b /= 1024
 	}
-	return fmt.Sprintf("%d %s", b, units[len(units)-1])
 }
 
-type byTotalDisk []*appUsageInfo
+// appUsageInfo and usageReport are defined in the report package, so that
+// other Go tooling can consume reports
+type appUsageInfo = report.Row
+type usageReport = report.Report
 
-func (b byTotalDisk) Len() int {
-	return len(b)
+// simpleClient and resource are defined in the cfclient package, so that
+// the client can be tested on its own
+type simpleClient = cfclient.Client
+type resource = cfclient.Resource
+
+// newRunID returns a random (version 4) UUID
+func newRunID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
 }
 
-func (b byTotalDisk) Less(i, j int) bool {
-	return (b[i].MemoryQuota) < (b[j].MemoryQuota)
+// validRunTag checks that tag, if set, is only letters, digits, ".", "-"
+// and "_", so that it can be used as is in labels and file names
+func validRunTag(tag string) error {
+	for _, r := range tag {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_') {
+			return fmt.Errorf("invalid --tag, expected letters, digits, ., - and _ only: %s", tag)
+		}
+	}
+	return nil
 }
 
-func (b byTotalDisk) Swap(i, j int) {
-	b[i], b[j] = b[j], b[i]
+func noSlash(s string) string {
+	return strings.Replace(s, "/", "-", -1)
 }
 
 func (c *reportMemoryUsage) GetMetadata() plugin.PluginMetadata {
@@ -329,12 +904,106 @@ func (c *reportMemoryUsage) GetMetadata() plugin.PluginMetadata {
 		Commands: []plugin.Command{
 			{
 				Name:     "report-memory-usage",
-				HelpText: "Report all buildpacks used in installation",
+				HelpText: "Report the memory usage of every app in the installation",
 				UsageDetails: plugin.Usage{
-					Usage: "cf report-memory-usage",
+					Usage: "cf report-memory-usage [--config reports.json] [--org ORG [--space SPACE]]\n" +
+						"   cf report-memory-usage --diff [OLD.json NEW.json]\n" +
+						"   cf report-memory-usage --merge SHARD.json...\n" +
+						"   cf report-memory-usage --verify-key PUBLIC.pem REPORT...\n" +
+						"   cf report-memory-usage help [FORMATS|FILTERS|SINKS]\n\n" +
+						"EXAMPLES:\n" +
+						"   cf report-memory-usage --org my-org --sort percent\n" +
+						"   cf report-memory-usage --max-percent 10 --top 20\n" +
+						"   cf report-memory-usage --quiet --output-json --sink history:/var/lib/memory-history\n" +
+						"   cf report-memory-usage --listen :8080 --interval 5m\n" +
+						"   cf report-memory-usage --diff --snapshot-dir /var/lib/memory-snapshots",
 					Options: map[string]string{
-						"output-json": "if set sends JSON to stdout instead of a rendered table",
-						"quiet":       "if set suppresses printing of progress messages to stderr",
+						"output-json":         "if set sends JSON to stdout instead of a rendered table",
+						"output-csv":          "if set sends CSV to stdout instead of a rendered table",
+						"output-prometheus":   "if set sends metrics in the Prometheus text format to stdout instead of a rendered table, ie for the node exporter textfile collector",
+						"output-html":         "if set sends a self-contained HTML page, with a collapsible tree of orgs, spaces, apps and instances, to stdout instead of a rendered table",
+						"config":              "if set, path to a JSON file defining the reports to run",
+						"sink":                "destination for the report, may be repeated: stdout, file:PATH, webhook:URL, pushgateway:URL, s3:URL, influxdb:URL, history:DIR or snapshot:DIR",
+						"push-url":            "if set, push the report to this URL, as a --sink of the --push-format kind would",
+						"push-format":         "how to push to --push-url: webhook (POST the JSON report), s3 (PUT it to an S3-compatible bucket) or influxdb (POST line protocol)",
+						"retain":              "if set, how long history sinks keep data for, ie 90d",
+						"compact-after":       "age at which history sinks downsample per-instance samples to hourly org totals",
+						"sign-key":            "if set, path to a PEM private key used to write a SHA-256 checksum and detached signature next to each file and snapshot written",
+						"encrypt-recipient":   "if set, encrypt files, snapshots, webhook uploads, S3 and audit objects and emailed digests for this recipient, an age public key (age1...) or gpg key ID, may be repeated",
+						"compress":            "if set, compress files, snapshots, webhook uploads and S3 objects with gzip or zstd (which needs the zstd command), before any encryption",
+						"warn-percent":        "if set, exit with status 1 if any app, or the installation, uses at least this percentage of its memory quota",
+						"crit-percent":        "if set, exit with status 2 if any app, or the installation, uses at least this percentage of its memory quota",
+						"thresholds":          "if set, path to a JSON file of alerting thresholds, as for the thresholds section of --config, checked after each crawl",
+						"verify-key":          "if set, path to a PEM public key used to check the signatures of the report files given as arguments",
+						"snapshot-dir":        "if set, also write each run to a timestamped JSON file in this directory, for --diff",
+						"history-dir":         "history sink directory to read from when comparing past runs",
+						"compare-window":      "if set, compare average usage from --history-dir in two windows, ie \"business-hours vs overnight\"",
+						"timezone":            "time zone for --compare-window, ie Australia/Sydney",
+						"ledger":              "if set, show when each org and space in --history-dir was first and last seen, and its peak memory",
+						"recommend":           "if set, suggest a memory limit for each app from its p95 instance usage plus --headroom, and how much memory could be reclaimed, using every run in --history-dir if given",
+						"headroom":            "percentage to add to p95 usage for --recommend",
+						"buildpacks":          "if set, show the average gap between memory usage and quota of the running instances of each buildpack, using every run in --history-dir if given",
+						"shadow-compare":      "if set, crawl with both the v2 and v3 APIs, and list the apps whose instances, quotas, states or buildpacks they disagree on, exiting with status 1 if any",
+						"metric":              "which usage to show in tables: memory, disk or both",
+						"max-key-width":       "if set, shorten keys in tables to this many characters",
+						"wrap-keys":           "if set, wrap keys longer than --max-key-width over several lines rather than shortening them",
+						"align":               "how to align table columns: auto (numbers on the right), left or right",
+						"plain":               "if set, render tables without borders, for pasting into chat or diffing",
+						"quotas":              "if set, fetch org and space quotas, and show the memory limit and remaining headroom of each org and space",
+						"show-unhealthy":      "if set, show the state of each instance, and list the apps with instances that are not running, whose usage is understated",
+						"unit":                "unit to show sizes in tables in: auto (the largest unit for each size), B, KB, MB, GB or TB. JSON and CSV are always in bytes",
+						"sort":                "order of rows in every format: usage, quota, percent or key, optionally with :asc or :desc, ie percent:asc. Tables default to quota:desc",
+						"group-by":            "if set, only show org, space, app or instance rows, with how many instances each has and their average usage, or total usage and quota by each app's buildpack or stack",
+						"score":               "if set, rank orgs by an efficiency score out of 100, combining how much of their quota they use, how little is in apps using under 25% of theirs, how many instances are running and how few are on --stale-buildpack",
+						"score-weights":       "how much each part of --score counts, ie utilization=40,waste=30,crashes=20,stale=10, the defaults, for any not given",
+						"stale-buildpack":     "if set, a glob, or regex:PATTERN, of buildpacks that are stale for --score, ie *-v3.*, fetching the buildpacks of apps as --buildpacks does. Can be repeated.",
+						"group-by-label":      "if set, total usage and quota by the value of this label of each app, or of its space or org if the app has none, ie for chargeback by cost center. Needs the v3 API",
+						"histogram":           "if set, count instances by memory usage and by quota, in buckets from 64 MB to 16 GB, for each org and the installation, as a table, JSON or Prometheus histograms",
+						"cells":               "if set, total the memory used and allocated on each Diego cell, flagging hot cells using over 1.5 times the average",
+						"cell-instances":      "if set, also list the app instances on these comma separated cells, or * for every cell, with their memory, ie to plan draining cells for maintenance. Implies --cells",
+						"lose-cells":          "if set with --cell-memory, simulate losing this many cells, those with the most memory allocated, or these comma separated cells, ie an availability zone, and show which orgs' instances couldn't be rescheduled on the rest",
+						"cell-memory":         "the memory of each cell with --cells, ie 64G, to show how much of it is used and allocated",
+						"min-percent":         "if set, only show apps using at least this percentage of their quota, ie 90",
+						"max-percent":         "if set, only show apps using at most this percentage of their quota, ie 10 to find apps to right-size",
+						"top":                 "if set, only show this many apps, those with the largest quotas",
+						"org":                 "if set, only report on this org",
+						"space":               "if set, only report on this space, in --org or the targeted org",
+						"fresh-org":           "if set, only crawl this org, taking every other org from the latest run in --history-dir, so that an org's numbers are current without a full crawl",
+						"shard":               "if set, only crawl a share of the orgs, ie 2/5 for the second of five, to be combined with --merge",
+						"exclude-org":         "if set, leave orgs matching this glob out of the crawl and its totals, ie p-*, or regex:PATTERN for a regular expression. Can be repeated.",
+						"exclude-space":       "if set, leave spaces matching this glob, by name or as org/space, out of the crawl and its totals, ie */sandbox, or regex:PATTERN. Can be repeated.",
+						"tenants-only":        "if set, exclude the system org and the p-* orgs of marketplace tiles, so that totals only include tenant workloads",
+						"merge":               "if set, combine the --output-json reports of each --shard given as arguments into one report",
+						"concurrency":         "how many apps to fetch instance stats for at once",
+						"consistent":          "if set, list every app before fetching any stats, then fetch them in a burst of --concurrency requests, so that apps are sampled close together in time",
+						"error-policy":        "what to do when an org's spaces, a space's apps or an app's stats can't be fetched: continue without them, listing them in the report's errors and exiting with status 3, or fail",
+						"fail-fast":           "if set, fail on the first org, space or app that can't be fetched, as --error-policy fail does",
+						"cache-dir":           "if set, cache orgs, spaces and quotas in this directory between runs, so that repeated runs only fetch apps and their stats",
+						"cache-ttl":           "how long cached orgs, spaces and quotas are used for with --cache-dir, ie 30m or 1d",
+						"listen":              "if set, run as a server on this address, ie :8080, serving the latest report on /report and metrics on /metrics",
+						"interval":            "how often to re-crawl with --listen or --watch",
+						"watch":               "if set, re-run the report every --interval, redrawing the table or writing a new JSON document each time",
+						"leader-election":     "if set with --listen, only crawl if elected leader of the instances sharing the --sink history:DIR, otherwise serve the leader's reports",
+						"tenant-keys":         "if set with --listen, require a key from this file to read /report, each seeing only its own orgs. Keys are issued with --issue-tenant-key",
+						"issue-tenant-key":    "if set, issue a key to --tenant-keys FILE for reading these comma separated orgs, or * for all orgs and /metrics, print it and exit",
+						"tenant-name":         "the name of the tenant issued a key with --issue-tenant-key, defaulting to its orgs",
+						"openapi":             "if set, print the OpenAPI document describing the --listen endpoints, also served on /openapi.json, and exit",
+						"retries":             "how many times to retry requests that fail with a network error, 429 or gateway error",
+						"retry-backoff":       "how long to wait before the first retry, doubling each time, unless the response has Retry-After",
+						"timeout":             "if set, stop crawling after this long, ie 10m, reporting what has been collected so far as incomplete",
+						"request-timeout":     "how long each request to the cloud controller or UAA may take, after which it is retried as a network error would be",
+						"tag":                 "if set, tag the run, ie loadtest-2024-06, so that reports collected during load tests or game days can be told apart downstream, included in every row and sink",
+						"include-services":    "if set, also report the memory of service instances annotated with report-memory-usage/memory-usage, as if they were apps in their space, needs the v3 API",
+						"api-version":         "cloud controller API version to use: auto, v2 or v3",
+						"auth":                "how to authenticate: cf (the cf CLI login), password (CF_USERNAME and CF_PASSWORD), client-credentials (--client-id and CF_CLIENT_SECRET), token (CF_ACCESS_TOKEN), token-file or oidc, defaulting to CF_AUTH, or when run without the cf CLI, whichever is in the environment",
+						"api":                 "cloud controller URL, ie https://api.system.example.com, defaulting to CF_API or the cf CLI target, needed unless --auth cf",
+						"uaa":                 "UAA URL to get tokens from, defaulting to CF_UAA, or discovered from the API",
+						"client-id":           "UAA client for --auth password, client-credentials or oidc, defaulting to CF_CLIENT_ID, or the cf CLI client for password",
+						"token-file":          "file holding the access token for --auth token-file, or the OIDC ID token exchanged for one for --auth oidc, re-read for each token, defaulting to CF_TOKEN_FILE",
+						"skip-ssl-validation": "if set, don't validate the TLS certificates of the API and UAA, as the cf CLI setting does with --auth cf, defaulting to CF_SKIP_SSL_VALIDATION",
+						"diff":                "if set, show the change in memory usage of each org, space and app between two snapshot files given as arguments, or the latest two runs in --snapshot-dir or --history-dir, as a table, JSON or, with --output-html, a page for reviewing changes",
+						"quiet":               "if set suppresses printing of progress messages to stderr",
+						"verbose":             "if set, log every request made to stderr instead of showing progress",
 					},
 				},
 			},
@@ -342,6 +1011,33 @@ func (c *reportMemoryUsage) GetMetadata() plugin.PluginMetadata {
 	}
 }
 
+// interruptible returns a context cancelled by the first Ctrl-C, so that a
+// single run can stop crawling and write what it has collected so far. A
+// second Ctrl-C exits straight away.
+func interruptible() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupts := make(chan os.Signal, 2)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		<-interrupts
+		log.Println("interrupted, writing what has been collected so far (Ctrl-C again to exit now)")
+		cancel()
+		<-interrupts
+		os.Exit(130)
+	}()
+	return ctx
+}
+
 func main() {
+	// the cf CLI runs plugins with the port to talk back to it, so anything
+	// else is running standalone, ie in a container without the cf CLI
+	if len(os.Args) < 2 {
+		(&reportMemoryUsage{}).Run(nil, []string{"report-memory-usage"})
+		return
+	}
+	if _, err := strconv.Atoi(os.Args[1]); err != nil {
+		(&reportMemoryUsage{}).Run(nil, append([]string{"report-memory-usage"}, os.Args[1:]...))
+		return
+	}
 	plugin.Start(&reportMemoryUsage{})
 }
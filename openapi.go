@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/govau/cf-report-memory-usage/report"
+)
+
+// openAPIPath is where server mode serves its OpenAPI document
+const openAPIPath = "/openapi.json"
+
+// openAPISchemas are the types described under components, by name. Their
+// schemas are derived from the types themselves, so that they can't drift
+// from what /report encodes.
+var openAPISchemas = map[string]reflect.Type{
+	"Row": reflect.TypeOf(report.Row{}),
+}
+
+// openAPIDocument describes server mode's endpoints, as OpenAPI 3.0, for
+// generating clients and contract testing
+func openAPIDocument() map[string]interface{} {
+	v := (&reportMemoryUsage{}).GetMetadata().Version
+	var formats []string
+	for _, f := range outputFormats {
+		formats = append(formats, f.Name)
+	}
+	query := func(name, description string, values ...string) map[string]interface{} {
+		schema := map[string]interface{}{"type": "string"}
+		if len(values) != 0 {
+			schema["enum"] = values
+		}
+		return map[string]interface{}{"name": name, "in": "query", "description": description, "schema": schema}
+	}
+	text := func(description string) map[string]interface{} {
+		return map[string]interface{}{
+			"description": description,
+			"content":     map[string]interface{}{"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}},
+		}
+	}
+
+	schemas := make(map[string]interface{})
+	for name, t := range openAPISchemas {
+		schemas[name] = openAPISchema(t)
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "cf-report-memory-usage",
+			"description": "The latest report of the memory and disk usage of every app instance, served by report-memory-usage --listen",
+			"version":     fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Build),
+		},
+		"paths": map[string]interface{}{
+			"/report": map[string]interface{}{
+				"get": map[string]interface{}{
+					"operationId": "getReport",
+					"summary":     "The latest report, with a row per instance and totals for each app, space, org and the installation",
+					"description": "With tenant keys, only the rows of the tenant's orgs are included, with totals recalculated.",
+					"parameters": []interface{}{
+						query("format", "how to render the report, defaulting to json", formats...),
+						query("metric", "which columns tables show", metricMemory, metricDisk, metricBoth),
+						query("unit", "the unit sizes are shown in in tables, json and csv are always in bytes", append([]string{unitAuto}, sizeUnits[:5]...)...),
+						query("sort", "the order of the rows, as FIELD[:asc|desc] where FIELD is usage, quota, percent or key"),
+					},
+					"responses": map[string]interface{}{
+						"200": map[string]interface{}{
+							"description": "The report. Sizes are in bytes.",
+							"content": map[string]interface{}{
+								"application/json": map[string]interface{}{
+									"schema": map[string]interface{}{
+										"type":  "array",
+										"items": map[string]interface{}{"$ref": "#/components/schemas/Row"},
+									},
+								},
+								"text/csv":   map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+								"text/html":  map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+								"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+							},
+						},
+						"400": text("The format, metric, unit or sort is unknown"),
+						"401": text("With tenant keys, the request has no key, or an unknown one"),
+						"503": text("There is no report yet, as the first crawl is in progress"),
+					},
+				},
+			},
+			openAPIPath: map[string]interface{}{
+				"get": map[string]interface{}{
+					"operationId": "getOpenAPI",
+					"summary":     "This document",
+					"security":    []interface{}{},
+					"responses": map[string]interface{}{
+						"200": map[string]interface{}{
+							"description": "The OpenAPI document",
+							"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": map[string]interface{}{"type": "object"}}},
+						},
+					},
+				},
+			},
+			"/metrics": map[string]interface{}{
+				"get": map[string]interface{}{
+					"operationId": "getMetrics",
+					"summary":     "Per-instance gauges from the latest report, and metrics about the crawls themselves, in the Prometheus text format",
+					"responses": map[string]interface{}{
+						"200": text("The metrics"),
+						"401": text("With tenant keys, the request has no key, or an unknown one"),
+						"403": text("With tenant keys, the key is not for every org"),
+					},
+				},
+			},
+		},
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"tenantKey": map[string]interface{}{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "Only needed if the server was started with --tenant-keys",
+				},
+			},
+		},
+		"security": []interface{}{
+			map[string]interface{}{},
+			map[string]interface{}{"tenantKey": []string{}},
+		},
+	}
+}
+
+// openAPISchema describes how t is encoded as JSON. Fields that are
+// omitted when empty aren't required.
+func openAPISchema(t reflect.Type) map[string]interface{} {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return openAPISchema(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Int:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float64, reflect.Float32:
+		return map[string]interface{}{"type": "number", "format": "double"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": openAPISchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": openAPISchema(t.Elem())}
+	case reflect.Struct:
+		// handled below
+	default:
+		panic("no OpenAPI schema for " + t.String())
+	}
+
+	properties := make(map[string]interface{})
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name, opts := f.Name, ""
+		if tag, ok := f.Tag.Lookup("json"); ok {
+			bits := strings.SplitN(tag, ",", 2)
+			if bits[0] == "-" {
+				continue
+			}
+			if bits[0] != "" {
+				name = bits[0]
+			}
+			if len(bits) == 2 {
+				opts = bits[1]
+			}
+		}
+		properties[name] = openAPISchema(f.Type)
+		if !strings.Contains(opts, "omitempty") {
+			required = append(required, name)
+		}
+	}
+	rv := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) != 0 {
+		rv["required"] = required
+	}
+	return rv
+}
+
+// writeOpenAPI writes the OpenAPI document as indented JSON
+func writeOpenAPI(out io.Writer) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(openAPIDocument())
+}
+
+// serveOpenAPI serves the OpenAPI document, which needs no key as it only
+// describes the API
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := writeOpenAPI(w)
+	if err != nil {
+		log.Printf("error: writing OpenAPI document: %s", err)
+	}
+}
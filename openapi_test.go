@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestWriteOpenAPI(t *testing.T) {
+	// every field of the documented types needs a schema
+	var buf bytes.Buffer
+	err := writeOpenAPI(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc struct {
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]struct {
+					Type                 string
+					AdditionalProperties struct {
+						Type   string
+						Format string
+					}
+				}
+			}
+		}
+	}
+	err = json.Unmarshal(buf.Bytes(), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := doc.Components.Schemas["Row"].Properties["Metrics"]
+	if metrics.Type != "object" || metrics.AdditionalProperties.Type != "number" || metrics.AdditionalProperties.Format != "double" {
+		t.Errorf("got Row.Metrics as %+v, want an object of doubles", metrics)
+	}
+}
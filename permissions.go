@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+const (
+	scopeRead          = "cloud_controller.read"
+	scopeAdmin         = "cloud_controller.admin"
+	scopeAdminReadOnly = "cloud_controller.admin_read_only"
+	scopeGlobalAuditor = "cloud_controller.global_auditor"
+)
+
+// tokenScopes returns the scopes granted to a UAA access token, given an
+// Authorization header value. The token signature isn't checked, as the
+// cloud controller will do that on every request.
+func tokenScopes(authorization string) ([]string, error) {
+	bits := strings.Fields(authorization)
+	if len(bits) == 0 {
+		return nil, errors.New("no access token")
+	}
+	parts := strings.Split(bits[len(bits)-1], ".")
+	if len(parts) != 3 {
+		return nil, errors.New("access token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, err
+	}
+
+	var claims struct {
+		Scope []string `json:"scope"`
+	}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return nil, err
+	}
+	return claims.Scope, nil
+}
+
+// hasScope returns true if scope is in scopes
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPermissions verifies that the scopes are enough to produce a report,
+// returning an error if nothing can be read, and otherwise warnings describing
+// what will be missing from the report
+func checkPermissions(scopes []string) ([]string, error) {
+	if !hasScope(scopes, scopeRead) && !hasScope(scopes, scopeAdmin) {
+		return nil, errors.New("access token lacks the " + scopeRead + " scope, so no data can be read; log in as a user or client with " + scopeRead + " (and ideally " + scopeAdminReadOnly + ")")
+	}
+
+	var warnings []string
+	if !hasScope(scopes, scopeAdmin) && !hasScope(scopes, scopeAdminReadOnly) {
+		if hasScope(scopes, scopeGlobalAuditor) {
+			warnings = append(warnings, "access token has "+scopeGlobalAuditor+" but not "+scopeAdminReadOnly+", so app instance stats will not be readable for apps outside your spaces")
+		} else {
+			warnings = append(warnings, "access token lacks "+scopeAdminReadOnly+", so the report is limited to the targeted org or space, and instance stats are only available for spaces where you are a developer")
+		}
+	}
+	return warnings, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// progressRedraw is how often an interactive progress bar is redrawn
+	progressRedraw = 200 * time.Millisecond
+
+	// progressLogEvery is how often progress is logged when stderr isn't
+	// a terminal, ie in CI, where a bar would fill the log with redraws
+	progressLogEvery = 15 * time.Second
+
+	progressBarWidth = 30
+)
+
+// crawlProgress shows how many apps have had their stats fetched, of those
+// listed so far, on stderr. Once every app has been listed it also shows an
+// ETA. On a terminal it is a bar redrawn in place, and otherwise a line is
+// logged every so often.
+type crawlProgress struct {
+	out         io.Writer
+	interactive bool
+
+	mu      sync.Mutex
+	started time.Time
+	listed  int
+	done    int
+	listing bool
+	drawn   bool
+	stop    chan struct{}
+	stopped chan struct{}
+
+	// prevLog is where the log package wrote before the crawl
+	prevLog io.Writer
+}
+
+// newCrawlProgress returns progress written to stderr
+func newCrawlProgress() *crawlProgress {
+	interactive := false
+	if fi, err := os.Stderr.Stat(); err == nil {
+		interactive = fi.Mode()&os.ModeCharDevice != 0
+	}
+	return &crawlProgress{out: os.Stderr, interactive: interactive}
+}
+
+// start begins showing progress. While the bar is shown, log output is
+// routed through it, so that warnings are printed above the bar rather
+// than over it.
+func (cp *crawlProgress) start() {
+	cp.mu.Lock()
+	cp.started = time.Now()
+	cp.listing = true
+	cp.stop = make(chan struct{})
+	cp.stopped = make(chan struct{})
+	cp.mu.Unlock()
+
+	every := progressLogEvery
+	if cp.interactive {
+		every = progressRedraw
+		cp.prevLog = log.Writer()
+		log.SetOutput(cp)
+	}
+	go func() {
+		defer close(cp.stopped)
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-cp.stop:
+				return
+			case <-ticker.C:
+				cp.draw()
+			}
+		}
+	}()
+}
+
+// listedApp counts an app whose stats are to be fetched
+func (cp *crawlProgress) listedApp() {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.listed++
+}
+
+// doneApp counts an app whose stats have been fetched, or failed to be
+func (cp *crawlProgress) doneApp() {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.done++
+}
+
+// doneListing marks every app as listed, so that an ETA can be given
+func (cp *crawlProgress) doneListing() {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.listing = false
+}
+
+// finish stops showing progress, clearing the bar
+func (cp *crawlProgress) finish() {
+	close(cp.stop)
+	<-cp.stopped
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if cp.interactive {
+		cp.clear()
+		log.SetOutput(cp.prevLog)
+	}
+}
+
+// Write prints a log line above the bar, then redraws it
+func (cp *crawlProgress) Write(p []byte) (int, error) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	drawn := cp.drawn
+	cp.clear()
+	n, err := cp.prevLog.Write(p)
+	if drawn {
+		fmt.Fprint(cp.out, cp.line()+"\x1b[K")
+		cp.drawn = true
+	}
+	return n, err
+}
+
+// draw shows the current progress
+func (cp *crawlProgress) draw() {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if !cp.interactive {
+		log.Print(cp.line())
+		return
+	}
+	// \r returns to the start of the line, and \x1b[K clears what is left
+	// of the last, longer, line
+	fmt.Fprint(cp.out, "\r"+cp.line()+"\x1b[K")
+	cp.drawn = true
+}
+
+// clear removes the bar, if it is shown, leaving the cursor at the start
+// of its line. cp.mu must be held.
+func (cp *crawlProgress) clear() {
+	if cp.drawn {
+		fmt.Fprint(cp.out, "\r\x1b[K")
+		cp.drawn = false
+	}
+}
+
+// line describes the progress, ie "[=====     ] 120/340 apps, 35%, ETA 18s".
+// cp.mu must be held.
+func (cp *crawlProgress) line() string {
+	elapsed := time.Since(cp.started)
+	if cp.listing {
+		return fmt.Sprintf("fetched the stats of %d of %d apps listed so far, %s elapsed", cp.done, cp.listed, elapsed.Round(time.Second))
+	}
+	fraction := 1.0
+	if cp.listed != 0 {
+		fraction = float64(cp.done) / float64(cp.listed)
+	}
+	eta := "?"
+	if cp.done != 0 {
+		remaining := time.Duration(float64(elapsed) * float64(cp.listed-cp.done) / float64(cp.done))
+		eta = remaining.Round(time.Second).String()
+	}
+	msg := fmt.Sprintf("%d/%d apps, %.0f%%, ETA %s", cp.done, cp.listed, fraction*100, eta)
+	if !cp.interactive {
+		return "fetched the stats of " + msg
+	}
+	filled := int(fraction * progressBarWidth)
+	return "[" + strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled) + "] " + msg
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	envAWSAccessKeyID     = "AWS_ACCESS_KEY_ID"
+	envAWSSecretAccessKey = "AWS_SECRET_ACCESS_KEY"
+	envAWSSessionToken    = "AWS_SESSION_TOKEN"
+	envAWSRegion          = "AWS_REGION"
+	envInfluxToken        = "INFLUX_TOKEN"
+)
+
+// pushFormats are the sink kinds --push-url can push to
+var pushFormats = []string{"webhook", "s3", "influxdb"}
+
+// pushSinkSpec returns the --sink spec that pushes to u in format, which
+// defaults to webhook
+func pushSinkSpec(format, u string) (string, error) {
+	if format == "" {
+		format = "webhook"
+	}
+	for _, f := range pushFormats {
+		if f == format {
+			return format + ":" + u, validPushURL(u)
+		}
+	}
+	return "", fmt.Errorf("unknown push format, expected %s: %s", strings.Join(pushFormats, ", "), format)
+}
+
+// s3Sink PUTs each report as its own object, named as snapshots are, to an
+// S3-compatible bucket given as a path-style URL, ie
+// https://s3.ap-southeast-2.amazonaws.com/bucket/prefix. Requests are signed
+// with AWS Signature Version 4, using the credentials in the environment.
+type s3Sink struct {
+	URL        string
+	Client     *http.Client
+	Encrypter  *reportEncrypter
+	Compressor *reportCompressor
+}
+
+func (ss *s3Sink) Write(rep *usageReport) error {
+	data, err := json.Marshal(rep)
+	if err != nil {
+		return err
+	}
+	up, err := encodeUpload(data, "application/json", ss.Compressor, ss.Encrypter)
+	if err != nil {
+		return err
+	}
+	name := rep.Time.UTC().Format(sampleTimeFormat) + "-" + rep.RunID + ".json" + up.Suffix
+	req, err := newSinkRequest(http.MethodPut, strings.TrimSuffix(ss.URL, "/")+"/"+name, up.ContentType, up.Encoding, rep.RunID, bytes.NewReader(up.Data))
+	if err != nil {
+		return err
+	}
+	err = signS3Request(req, up.Data, time.Now())
+	if err != nil {
+		return err
+	}
+	return sendSinkRequest(ss.Client, req)
+}
+
+func (ss *s3Sink) String() string {
+	return "s3:" + ss.URL
+}
+
+// signS3Request adds an AWS Signature Version 4 Authorization header to req,
+// whose body is payload, for the region in AWS_REGION, or us-east-1
+func signS3Request(req *http.Request, payload []byte, now time.Time) error {
+	keyID, secret := os.Getenv(envAWSAccessKeyID), os.Getenv(envAWSSecretAccessKey)
+	if keyID == "" || secret == "" {
+		return fmt.Errorf("%s and %s must be set to write to S3", envAWSAccessKeyID, envAWSSecretAccessKey)
+	}
+	region := os.Getenv(envAWSRegion)
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	sum := sha256.Sum256(payload)
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(sum[:]))
+	if token := os.Getenv(envAWSSessionToken); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") || k == "content-type" || k == "content-encoding" {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(sum[:]),
+	}, "\n")
+	scope := amzDate[:8] + "/" + region + "/s3/aws4_request"
+	requestSum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestSum[:])
+
+	key := []byte("AWS4" + secret)
+	for _, part := range []string{amzDate[:8], region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		keyID, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+	return nil
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data with key
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// influxSink POSTs per-instance usage in InfluxDB line protocol to a write
+// URL, ie http://influxdb:8086/api/v2/write?org=ORG&bucket=BUCKET, with the
+// token in INFLUX_TOKEN, if set. As points with the same tags and time
+// replace each other, retried deliveries aren't counted twice.
+type influxSink struct {
+	URL    string
+	Client *http.Client
+}
+
+func (is *influxSink) Write(rep *usageReport) error {
+	body := &bytes.Buffer{}
+	err := writeInfluxLines(body, rep)
+	if err != nil {
+		return err
+	}
+	req, err := newSinkRequest(http.MethodPost, is.URL, "text/plain; charset=utf-8", "", rep.RunID, body)
+	if err != nil {
+		return err
+	}
+	if token := os.Getenv(envInfluxToken); token != "" {
+		req.Header.Set("Authorization", "Token "+token)
+	}
+	return sendSinkRequest(is.Client, req)
+}
+
+func (is *influxSink) String() string {
+	return "influxdb:" + is.URL
+}
+
+// influxTagEscaper escapes tag values per the line protocol
+var influxTagEscaper = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `)
+
+// writeInfluxLines writes a point per instance, at the time it was sampled,
+// in nanoseconds. As with Prometheus, aggregates are left out as they can
+// be derived.
+func writeInfluxLines(out io.Writer, rep *usageReport) error {
+	for _, row := range rep.Rows {
+		if row.Level() != 4 {
+			continue
+		}
+		bits := strings.Split(row.Key, "/")
+		tags := fmt.Sprintf("org=%s,space=%s,app=%s,instance=%s",
+			influxTagEscaper.Replace(bits[0]), influxTagEscaper.Replace(bits[1]),
+			influxTagEscaper.Replace(bits[2]), influxTagEscaper.Replace(bits[3]))
+		if row.State != "" {
+			tags += ",state=" + influxTagEscaper.Replace(row.State)
+		}
+		if rep.Tag != "" {
+			tags += ",tag=" + influxTagEscaper.Replace(rep.Tag)
+		}
+		at := rep.Time
+		if row.SampledAt != nil {
+			at = *row.SampledAt
+		}
+		_, err := fmt.Fprintf(out, "cf_report_memory_usage,%s memory_usage=%di,memory_quota=%di,disk_usage=%di,disk_quota=%di,run_id=\"%s\" %d\n",
+			tags, row.MemoryUsage, row.MemoryQuota, row.DiskUsage, row.DiskQuota, rep.RunID, at.UnixNano())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validPushURL checks that u is an absolute http or https URL
+func validPushURL(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("invalid --push-url, expected an http or https URL: %s", u)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	limitedByOrg   = "org"
+	limitedBySpace = "space"
+)
+
+// quotaHeadroom is the memory limit of an org or space's own quota, and how
+// much more memory can be allocated to apps within it. A space's headroom
+// is limited by its org's quota as well as its own. Either is nil if there
+// is no limit. An app has the limit and headroom of whichever quota limits
+// its space.
+type quotaHeadroom struct {
+	MemoryLimit    *int `json:",omitempty"`
+	MemoryHeadroom *int `json:",omitempty"`
+
+	// LimitedBy is, for spaces and apps, "org" or "space": the quota with
+	// the least headroom, which will stop apps starting or scaling first.
+	// It is empty if neither quota is limited.
+	LimitedBy string `json:",omitempty"`
+
+	// ExceedsOrg is set on spaces whose own quota allows more memory than
+	// their org's does, so can never be reached. Such space quotas are
+	// usually a mistake, as the org quota silently applies instead.
+	ExceedsOrg bool `json:",omitempty"`
+}
+
+// quotaRows returns the org and space rows of rep, by key, for looking up
+// their quotas without scanning every row
+func quotaRows(rep *usageReport) map[string]*appUsageInfo {
+	rows := make(map[string]*appUsageInfo)
+	for _, row := range rep.Rows {
+		if level := row.Level(); level == 1 || level == 2 {
+			rows[row.Key] = row
+		}
+	}
+	return rows
+}
+
+// headroomFor returns the headroom of the org, space or app row with key, or
+// nil if the row is none of these or its org's quota wasn't collected. rows
+// are the org and space rows of rep, from quotaRows. CF checks quotas
+// against the memory allocated to started apps, so headroom is the limit
+// less the row's quota rather than its usage.
+func headroomFor(rep *usageReport, rows map[string]*appUsageInfo, key string) *quotaHeadroom {
+	bits := strings.Split(key, "/")
+	if key == "" || len(bits) > 3 {
+		return nil
+	}
+	if len(bits) == 3 {
+		space := headroomFor(rep, rows, strings.Join(bits[:2], "/"))
+		if space == nil {
+			return nil
+		}
+		app := &quotaHeadroom{MemoryHeadroom: space.MemoryHeadroom, LimitedBy: space.LimitedBy}
+		switch space.LimitedBy {
+		case limitedByOrg:
+			orgLimit := rep.OrgMemoryLimits[bits[0]]
+			app.MemoryLimit = &orgLimit
+		case limitedBySpace:
+			app.MemoryLimit = space.MemoryLimit
+		}
+		return app
+	}
+	orgLimit, ok := rep.OrgMemoryLimits[bits[0]]
+	if !ok {
+		return nil
+	}
+
+	// remaining returns the headroom under limit of the row with key
+	remaining := func(limit int, key string) *int {
+		if limit < 0 {
+			return nil
+		}
+		room := limit
+		if row, ok := rows[key]; ok {
+			room -= row.MemoryQuota
+		}
+		return &room
+	}
+
+	qh := &quotaHeadroom{}
+	if len(bits) == 1 {
+		if orgLimit >= 0 {
+			qh.MemoryLimit = &orgLimit
+		}
+		qh.MemoryHeadroom = remaining(orgLimit, key)
+		return qh
+	}
+
+	qh.MemoryHeadroom = remaining(orgLimit, bits[0])
+	if qh.MemoryHeadroom != nil {
+		qh.LimitedBy = limitedByOrg
+	}
+	if spaceLimit, ok := rep.SpaceMemoryLimits[key]; ok && spaceLimit >= 0 {
+		qh.MemoryLimit = &spaceLimit
+		qh.ExceedsOrg = orgLimit >= 0 && spaceLimit > orgLimit
+		spaceRoom := remaining(spaceLimit, key)
+		if qh.MemoryHeadroom == nil || *spaceRoom < *qh.MemoryHeadroom {
+			qh.MemoryHeadroom = spaceRoom
+			qh.LimitedBy = limitedBySpace
+		}
+	}
+	return qh
+}
+
+// quotasExceedingOrgs returns the spaces, in key order, whose own quota's
+// memory limit is more than their org's
+func quotasExceedingOrgs(rep *usageReport) []string {
+	var spaces []string
+	rows := quotaRows(rep)
+	for key := range rep.SpaceMemoryLimits {
+		if qh := headroomFor(rep, rows, key); qh != nil && qh.ExceedsOrg {
+			spaces = append(spaces, key)
+		}
+	}
+	sort.Strings(spaces)
+	return spaces
+}
+
+// limitCells returns the limit and headroom of a row for a table, with a
+// "-" where there is no limit, or blanks for rows without quotas. A space
+// whose quota exceeds its org's has its limit marked with "!".
+func (qh *quotaHeadroom) limitCells(unit string) (string, string) {
+	if qh == nil {
+		return "", ""
+	}
+	if qh.ExceedsOrg {
+		return toSize(*qh.MemoryLimit, unit) + " !", toSize(*qh.MemoryHeadroom, unit)
+	}
+	cell := func(v *int) string {
+		if v == nil {
+			return "-"
+		}
+		return toSize(*v, unit)
+	}
+	return cell(qh.MemoryLimit), cell(qh.MemoryHeadroom)
+}
+
+// limitedBy returns which quota limits a row, or "" for rows without quotas
+func (qh *quotaHeadroom) limitedBy() string {
+	if qh == nil {
+		return ""
+	}
+	return qh.LimitedBy
+}
+
+// limitRecord returns the limit and headroom of a row for CSV, in bytes,
+// with blanks where there is no limit
+func (qh *quotaHeadroom) limitRecord() (string, string) {
+	if qh == nil {
+		return "", ""
+	}
+	cell := func(v *int) string {
+		if v == nil {
+			return ""
+		}
+		return strconv.Itoa(*v)
+	}
+	return cell(qh.MemoryLimit), cell(qh.MemoryHeadroom)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+const (
+	// recommendPercentile of instance memory usage is what limits are sized for
+	recommendPercentile = 95
+
+	// recommendStep is what recommended limits are rounded up to a multiple of
+	recommendStep = 64 * 1024 * 1024
+)
+
+// appRecommendation suggests a new per-instance memory limit for an app
+type appRecommendation struct {
+	Key       string
+	Instances int
+
+	// Limit is the current per-instance memory limit
+	Limit int
+
+	// Usage is the 95th percentile of per-instance memory usage, across
+	// every instance in every report considered
+	Usage int
+
+	// Recommended is Usage plus headroom, rounded up to a multiple of 64 MB
+	Recommended int
+
+	// Reclaimable is how much memory would be freed across all instances by
+	// moving to the recommended limit. It is negative if the app needs more.
+	Reclaimable int
+}
+
+// recommendations for every app in the latest of several reports
+type recommendations struct {
+	HeadroomPercent float64
+	Reports         int
+	Apps            []*appRecommendation
+
+	// Reclaimable is the total that could be freed by shrinking oversized
+	// apps, and Needed the total that undersized apps should be given
+	Reclaimable int
+	Needed      int
+}
+
+// recommendLimits sizes each app in the last of reps, which are oldest
+// first, for the 95th percentile of its instances' usage across all of reps
+// plus headroomPercent
+func recommendLimits(reps []*usageReport, headroomPercent float64) (*recommendations, error) {
+	if len(reps) == 0 {
+		return nil, errors.New("no reports to base recommendations on")
+	}
+	if headroomPercent < 0 {
+		return nil, fmt.Errorf("headroom must not be negative: %g", headroomPercent)
+	}
+
+	usage := make(map[string][]int)
+	for _, rep := range reps {
+		for _, row := range rep.Rows {
+			if row.Level() == 4 {
+				app := row.Key[:strings.LastIndex(row.Key, "/")]
+				usage[app] = append(usage[app], row.MemoryUsage)
+			}
+		}
+	}
+
+	rv := &recommendations{HeadroomPercent: headroomPercent, Reports: len(reps)}
+	latest := reps[len(reps)-1]
+	counts := countInstances(latest.Rows)
+	for _, row := range latest.Rows {
+		if row.Level() != 3 || counts[row.Key] == 0 {
+			continue
+		}
+		ar := &appRecommendation{
+			Key:       row.Key,
+			Instances: counts[row.Key],
+			Limit:     row.MemoryQuota / counts[row.Key],
+			Usage:     percentile(usage[row.Key], recommendPercentile),
+		}
+		wanted := float64(ar.Usage) * (100 + headroomPercent) / 100
+		ar.Recommended = int(math.Ceil(wanted/recommendStep)) * recommendStep
+		if ar.Recommended == 0 {
+			ar.Recommended = recommendStep
+		}
+		ar.Reclaimable = (ar.Limit - ar.Recommended) * ar.Instances
+		if ar.Reclaimable > 0 {
+			rv.Reclaimable += ar.Reclaimable
+		} else {
+			rv.Needed -= ar.Reclaimable
+		}
+		rv.Apps = append(rv.Apps, ar)
+	}
+
+	sort.SliceStable(rv.Apps, func(i, j int) bool {
+		if rv.Apps[i].Reclaimable != rv.Apps[j].Reclaimable {
+			return rv.Apps[i].Reclaimable > rv.Apps[j].Reclaimable
+		}
+		return rv.Apps[i].Key < rv.Apps[j].Key
+	})
+	return rv, nil
+}
+
+// percentile returns the pth percentile of vals, by the nearest rank method
+func percentile(vals []int, p int) int {
+	if len(vals) == 0 {
+		return 0
+	}
+	sorted := make([]int, len(vals))
+	copy(sorted, vals)
+	sort.Ints(sorted)
+	rank := int(math.Ceil(float64(p) / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// renderRecommendations writes the recommendations as a table or JSON
+func renderRecommendations(out io.Writer, recs *recommendations, format string) error {
+	switch format {
+	case formatJSON:
+		return json.NewEncoder(out).Encode(recs)
+	case formatTable:
+		// handled below
+	default:
+		return fmt.Errorf("unknown format: %s", format)
+	}
+
+	table := tablewriter.NewWriter(out)
+	table.SetHeader([]string{"App", "Instances", "Limit", fmt.Sprintf("P%d Usage", recommendPercentile), "Recommended", "Reclaimable"})
+	for _, ar := range recs.Apps {
+		table.Append([]string{
+			"/" + ar.Key,
+			strconv.Itoa(ar.Instances),
+			toHumanSize(ar.Limit),
+			toHumanSize(ar.Usage),
+			toHumanSize(ar.Recommended),
+			signedHumanSize(ar.Reclaimable),
+		})
+	}
+	table.Render()
+
+	_, err := fmt.Fprintf(out, "Reclaimable from oversized apps: %s\nNeeded by undersized apps: %s\nBased on %d report(s), with %g%% headroom\n",
+		toHumanSize(recs.Reclaimable), toHumanSize(recs.Needed), recs.Reports, recs.HeadroomPercent)
+	return err
+}
@@ -0,0 +1,648 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/govau/cf-report-memory-usage/report"
+	"github.com/olekukonko/tablewriter"
+)
+
+const (
+	formatTable      = "table"
+	formatJSON       = "json"
+	formatCSV        = "csv"
+	formatPrometheus = "prometheus"
+	formatHTML       = "html"
+)
+
+// outputFormat is a format that reports can be rendered in
+type outputFormat struct {
+	Name string
+
+	// Flag, if set, is the flag that selects the format for stdout and file sinks
+	Flag string
+
+	// Help is a one line description, for "help FORMATS"
+	Help string
+}
+
+// outputFormats are every format, in the order they are listed in help
+var outputFormats = []*outputFormat{
+	{Name: formatTable, Help: "a table of every instance and total, sorted by quota (the default)"},
+	{Name: formatJSON, Flag: "output-json", Help: "an array of rows, with sizes in bytes"},
+	{Name: formatCSV, Flag: "output-csv", Help: "a row per key, including totals, split into Org, Space, App and Instance columns, with sizes in bytes"},
+	{Name: formatPrometheus, Flag: "output-prometheus", Help: "per-instance gauges in the Prometheus text format, ie for the node exporter textfile collector"},
+	{Name: formatHTML, Flag: "output-html", Help: "a self-contained page with a collapsible tree of orgs, spaces, apps and instances, and bars of usage against quota"},
+}
+
+const (
+	alignAuto  = "auto"
+	alignLeft  = "left"
+	alignRight = "right"
+)
+
+// unitAuto shows each size in the largest unit it is at least one of
+const unitAuto = "auto"
+
+const (
+	metricMemory = "memory"
+	metricDisk   = "disk"
+	metricBoth   = "both"
+)
+
+// renderOptions control how a report is rendered
+type renderOptions struct {
+	// Format is "table", "json", "csv", "prometheus" or "html"
+	Format string
+
+	// Metric is which columns to show in a table: "memory", "disk" or "both".
+	// JSON always has both.
+	Metric string
+
+	// MaxKeyWidth, if set, is the widest a key may be in a table. Longer
+	// keys are shortened with an ellipsis in the middle, or wrapped over
+	// several lines if WrapKeys is set. JSON always has the full key.
+	MaxKeyWidth int
+	WrapKeys    bool
+
+	// Align is how to align the numeric columns of a table: "auto" (the
+	// default) right aligns them, with the key on the left, while "left"
+	// and "right" align every column the same way
+	Align string
+
+	// Plain drops the borders and lines from tables, leaving columns
+	// separated by spaces, for pasting into chat or diffing
+	Plain bool
+
+	// Filter picks which apps to include
+	Filter rowFilter
+
+	// GroupBy, if set, shows only the "org", "space", "app" or "instance"
+	// rows, with how many instances each has and their average usage
+	GroupBy string
+
+	// Sort, if set, orders the rows in every format. Otherwise tables and
+	// HTML are sorted by quota, largest first, and other formats are in
+	// report order. HTML sorts each node's children.
+	Sort rowSort
+
+	// Unit is what sizes are shown in in tables: "auto" (the default) picks
+	// the largest unit for each size, while "B", "KB", "MB", "GB" or "TB"
+	// shows every size in that unit. JSON and CSV are always in bytes.
+	Unit string
+
+	// Quotas, if set, shows the memory limit of each org and space's quota,
+	// and its headroom, if they were collected, and for spaces and apps
+	// which quota limits them. Tables are followed by the spaces whose
+	// quota exceeds their org's.
+	Quotas bool
+
+	// ShowUnhealthy, if set, adds the state of each instance to tables, and
+	// how many instances within each total aren't running, and lists the
+	// apps with instances that aren't after the table. HTML highlights them.
+	ShowUnhealthy bool
+}
+
+// validate checks the options, filling in defaults
+func (ro *renderOptions) validate() error {
+	if ro.Format == "" {
+		ro.Format = formatTable
+	}
+	known := false
+	for _, of := range outputFormats {
+		known = known || of.Name == ro.Format
+	}
+	if !known {
+		return fmt.Errorf("unknown format: %s", ro.Format)
+	}
+
+	if ro.Metric == "" {
+		ro.Metric = metricMemory
+	}
+	switch ro.Metric {
+	case metricMemory, metricDisk, metricBoth:
+	default:
+		return fmt.Errorf("unknown metric, expected memory, disk or both: %s", ro.Metric)
+	}
+
+	if ro.Align == "" {
+		ro.Align = alignAuto
+	}
+	switch ro.Align {
+	case alignAuto, alignLeft, alignRight:
+	default:
+		return fmt.Errorf("unknown alignment, expected auto, left or right: %s", ro.Align)
+	}
+
+	if ro.Unit == "" {
+		ro.Unit = unitAuto
+	}
+	if ro.Unit != unitAuto {
+		ro.Unit = strings.ToUpper(ro.Unit)
+	}
+	switch ro.Unit {
+	case unitAuto, "B", "KB", "MB", "GB", "TB":
+	default:
+		return fmt.Errorf("unknown unit, expected auto, B, KB, MB, GB or TB: %s", ro.Unit)
+	}
+
+	if ro.MaxKeyWidth < 0 {
+		return fmt.Errorf("max key width must not be negative: %d", ro.MaxKeyWidth)
+	}
+	if ro.Filter.Top < 0 {
+		return fmt.Errorf("top must not be negative: %d", ro.Filter.Top)
+	}
+
+	if ro.WrapKeys && ro.MaxKeyWidth == 0 {
+		return errors.New("wrapping keys needs a max key width")
+	}
+
+	if ro.GroupBy != "" {
+		if _, ok := groupLevels[ro.GroupBy]; !ok {
+			return fmt.Errorf("unknown grouping, expected org, space, app or instance: %s", ro.GroupBy)
+		}
+		if ro.Format == formatPrometheus {
+			return errors.New("grouping can't be used with the prometheus format, which is always per instance")
+		}
+		if ro.Format == formatHTML {
+			return errors.New("grouping can't be used with the html format, which is always a tree")
+		}
+	}
+	return nil
+}
+
+// renderReport writes the rows to out as specified by opts
+func renderReport(out io.Writer, rep *usageReport, opts renderOptions) error {
+	// counted before filtering, as totals aren't recalculated either
+	counts := countInstances(rep.Rows)
+	full := rep
+	if opts.Filter.active() {
+		filtered := *rep
+		filtered.Rows = opts.Filter.apply(rep.Rows, opts.Metric)
+		rep = &filtered
+	}
+
+	var grouped []*groupedRow
+	if opts.GroupBy != "" {
+		var err error
+		grouped, err = groupRows(rep.Rows, opts.GroupBy, counts)
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, row := range rep.Rows {
+			grouped = append(grouped, &groupedRow{appUsageInfo: row})
+		}
+	}
+
+	if opts.Quotas {
+		rows := quotaRows(full)
+		for _, gr := range grouped {
+			gr.quotaHeadroom = headroomFor(full, rows, gr.Key)
+		}
+	}
+
+	order := opts.Sort
+	if order.Field == "" && (opts.Format == formatTable || opts.Format == formatHTML) {
+		order = rowSort{Field: sortQuota, Desc: true}
+	}
+	if order.Field != "" {
+		order.apply(grouped, opts.Metric)
+	}
+
+	switch opts.Format {
+	case formatJSON:
+		// without grouping or quotas, rows are encoded as in the report
+		return json.NewEncoder(out).Encode(grouped)
+	case formatCSV:
+		return writeCSV(out, rep.RunID, rep.Tag, grouped, opts.GroupBy != "", opts.Quotas)
+	case formatPrometheus:
+		return writePrometheus(out, rep)
+	case formatHTML:
+		return writeHTML(out, rep, grouped, full.Errors, opts)
+	case formatTable:
+		// handled below
+	default:
+		return fmt.Errorf("unknown format: %s", opts.Format)
+	}
+
+	var header []string
+	switch opts.Metric {
+	case metricDisk:
+		header = []string{"Key", "Disk Usage", "Disk Quota", "Disk Percent"}
+	case metricBoth:
+		header = []string{"Key", "Memory Usage", "Memory Quota", "Memory Percent", "Disk Usage", "Disk Quota", "Disk Percent"}
+	default:
+		header = []string{"Key", "Usage", "Quota", "Percent"}
+	}
+	if opts.GroupBy != "" {
+		header = append(header, "Instances")
+		switch opts.Metric {
+		case metricDisk:
+			header = append(header, "Disk Average")
+		case metricBoth:
+			header = append(header, "Memory Average", "Disk Average")
+		default:
+			header = append(header, "Average")
+		}
+	}
+	if opts.Quotas {
+		if opts.Metric == metricMemory {
+			header = append(header, "Limit", "Headroom")
+		} else {
+			header = append(header, "Memory Limit", "Memory Headroom")
+		}
+		header = append(header, "Limited By")
+	}
+	if opts.ShowUnhealthy {
+		header = append(header, "State")
+	}
+
+	var buf bytes.Buffer
+	table := newTable(&buf, header, opts)
+	for _, row := range grouped {
+		cells := []string{fitKey("/"+row.Key, opts)}
+		if opts.Metric != metricDisk {
+			usage := toSize(row.MemoryUsage, opts.Unit)
+			if row.LastReportedAt != nil {
+				usage = fmt.Sprintf("%s (last %s)", usage, toSize(row.LastMemoryUsage, opts.Unit))
+			}
+			cells = append(cells,
+				usage,
+				toSize(row.MemoryQuota, opts.Unit),
+				toPercent(row.MemoryUsage, row.MemoryQuota),
+			)
+		}
+		if opts.Metric != metricMemory {
+			cells = append(cells,
+				toSize(row.DiskUsage, opts.Unit),
+				toSize(row.DiskQuota, opts.Unit),
+				toPercent(row.DiskUsage, row.DiskQuota),
+			)
+		}
+		if opts.GroupBy != "" {
+			cells = append(cells, strconv.Itoa(row.Instances))
+			if opts.Metric != metricDisk {
+				cells = append(cells, toSize(row.AverageMemoryUsage, opts.Unit))
+			}
+			if opts.Metric != metricMemory {
+				cells = append(cells, toSize(row.AverageDiskUsage, opts.Unit))
+			}
+		}
+		if opts.Quotas {
+			limit, headroom := row.quotaHeadroom.limitCells(opts.Unit)
+			cells = append(cells, limit, headroom, row.quotaHeadroom.limitedBy())
+		}
+		if opts.ShowUnhealthy {
+			cells = append(cells, stateCell(row.appUsageInfo))
+		}
+		table.Append(cells)
+	}
+	table.Render()
+	rendered := buf.String()
+	if opts.Plain {
+		rendered = trimLines(rendered)
+	}
+
+	_, err := fmt.Fprintf(out, "%sRun ID: %s\n", rendered, describeRun(rep))
+	if err != nil {
+		return err
+	}
+	if opts.ShowUnhealthy {
+		err = writeUnhealthy(out, rep.Rows, counts)
+		if err != nil {
+			return err
+		}
+	}
+	if opts.Quotas {
+		err = writeQuotaProblems(out, full, opts.Unit)
+		if err != nil {
+			return err
+		}
+	}
+	return writeErrors(out, full.Errors)
+}
+
+// writeQuotaProblems lists the spaces whose own quota allows more memory
+// than their org's, after a table, as the org quota applies instead
+func writeQuotaProblems(out io.Writer, rep *usageReport, unit string) error {
+	spaces := quotasExceedingOrgs(rep)
+	if len(spaces) == 0 {
+		return nil
+	}
+	_, err := fmt.Fprintf(out, "\nSpace quotas exceeding their org's, which limits them instead:\n")
+	if err != nil {
+		return err
+	}
+	for _, key := range spaces {
+		org := strings.SplitN(key, "/", 2)[0]
+		_, err = fmt.Fprintf(out, "  /%s: %s, but org %s is limited to %s\n", key, toSize(rep.SpaceMemoryLimits[key], unit), org, toSize(rep.OrgMemoryLimits[org], unit))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stateCell is the state of an instance, or how many instances within an
+// aggregate aren't running, if any
+func stateCell(row *appUsageInfo) string {
+	if row.Level() == 4 {
+		return row.State
+	}
+	if row.NotRunning != 0 {
+		return fmt.Sprintf("%d not running", row.NotRunning)
+	}
+	return ""
+}
+
+// writeUnhealthy lists the apps with instances that aren't running, after
+// a table, as their usage is understated rather than low
+func writeUnhealthy(out io.Writer, rows []*appUsageInfo, counts map[string]int) error {
+	var unhealthy []*appUsageInfo
+	for _, row := range rows {
+		if row.Level() == 3 && !row.Running() {
+			unhealthy = append(unhealthy, row)
+		}
+	}
+	if len(unhealthy) == 0 {
+		return nil
+	}
+	_, err := fmt.Fprintf(out, "\nApps with instances not running:\n")
+	if err != nil {
+		return err
+	}
+	for _, row := range unhealthy {
+		_, err = fmt.Fprintf(out, "  /%s: %d of %d instances\n", row.Key, row.NotRunning, counts[row.Key])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeErrors lists what couldn't be fetched, after a table, so that an
+// incomplete report says why rather than just being short
+func writeErrors(out io.Writer, errs []*report.Error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	_, err := fmt.Fprintf(out, "\nErrors, so totals are incomplete:\n")
+	if err != nil {
+		return err
+	}
+	for _, e := range errs {
+		_, err = fmt.Fprintf(out, "  /%s: %s\n", e.Key, errorText(e))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errorText describes why e's key is missing, ie "403 Forbidden: CF-NotAuthorized"
+func errorText(e *report.Error) string {
+	var parts []string
+	if e.StatusCode != 0 {
+		parts = append(parts, strconv.Itoa(e.StatusCode)+" "+http.StatusText(e.StatusCode))
+	}
+	if e.Code != "" {
+		parts = append(parts, e.Code)
+	}
+	if e.Description != "" {
+		parts = append(parts, e.Description)
+	}
+	return strings.Join(parts, ": ")
+}
+
+// writeCSV writes every row, including totals, with the key split into its
+// parts so that it can be filtered in a spreadsheet. Sizes are in bytes,
+// instances have when they were sampled, to the nanosecond, and their
+// state, and totals how many instances within aren't running. If
+// grouped, instance counts and averages are included, and with quotas, the
+// memory limit and headroom of orgs, spaces and apps, and what limits them.
+// A Tag column is added last if the run is tagged.
+func writeCSV(out io.Writer, runID, tag string, rows []*groupedRow, grouped, quotas bool) error {
+	w := csv.NewWriter(out)
+	header := []string{"RunID", "Key", "Org", "Space", "App", "Instance", "MemoryUsage", "MemoryQuota", "DiskUsage", "DiskQuota", "LastMemoryUsage", "LastReportedAt", "SampledAt", "State", "NotRunning"}
+	if grouped {
+		header = append(header, "Instances", "AverageMemoryUsage", "AverageDiskUsage")
+	}
+	if quotas {
+		header = append(header, "MemoryLimit", "MemoryHeadroom", "LimitedBy")
+	}
+	if tag != "" {
+		header = append(header, "Tag")
+	}
+	err := w.Write(header)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		parts := make([]string, 4)
+		if row.Key != "" {
+			copy(parts, strings.Split(row.Key, "/"))
+		}
+		lastUsage, lastAt := "", ""
+		if row.LastReportedAt != nil {
+			lastUsage = strconv.Itoa(row.LastMemoryUsage)
+			lastAt = row.LastReportedAt.UTC().Format(time.RFC3339)
+		}
+		sampledAt := ""
+		if row.SampledAt != nil {
+			sampledAt = row.SampledAt.UTC().Format(time.RFC3339Nano)
+		}
+		record := append([]string{runID, "/" + row.Key}, parts...)
+		record = append(record,
+			strconv.Itoa(row.MemoryUsage),
+			strconv.Itoa(row.MemoryQuota),
+			strconv.Itoa(row.DiskUsage),
+			strconv.Itoa(row.DiskQuota),
+			lastUsage,
+			lastAt,
+			sampledAt,
+			row.State,
+			strconv.Itoa(row.NotRunning),
+		)
+		if grouped {
+			record = append(record,
+				strconv.Itoa(row.Instances),
+				strconv.Itoa(row.AverageMemoryUsage),
+				strconv.Itoa(row.AverageDiskUsage),
+			)
+		}
+		if quotas {
+			limit, headroom := row.quotaHeadroom.limitRecord()
+			record = append(record, limit, headroom, row.quotaHeadroom.limitedBy())
+		}
+		if tag != "" {
+			record = append(record, tag)
+		}
+		err = w.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// describeRun returns the run ID of rep, its tag if it has one, and which
+// org is current if the rest is cached
+func describeRun(rep *usageReport) string {
+	rv := rep.RunID
+	if rep.Tag != "" {
+		rv += ", tag: " + rep.Tag
+	}
+	if fresh := describeFreshOrg(rep); fresh != "" {
+		rv += ", " + fresh
+	}
+	return rv
+}
+
+// newTable returns a table styled as per opts, with the first column as
+// the key and the rest numeric
+func newTable(out io.Writer, header []string, opts renderOptions) *tablewriter.Table {
+	table := tablewriter.NewWriter(out)
+	table.SetHeader(header)
+	// we wrap keys ourselves, at slashes, rather than at spaces
+	table.SetAutoWrapText(false)
+
+	align := make([]int, len(header))
+	for i := range align {
+		switch {
+		case opts.Align == alignLeft || (opts.Align == alignAuto && i == 0):
+			align[i] = tablewriter.ALIGN_LEFT
+		default:
+			align[i] = tablewriter.ALIGN_RIGHT
+		}
+	}
+	table.SetColumnAlignment(align)
+
+	if opts.Plain {
+		table.SetBorder(false)
+		table.SetHeaderLine(false)
+		table.SetColumnSeparator("")
+		table.SetCenterSeparator("")
+		table.SetRowSeparator("")
+		table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	}
+	return table
+}
+
+// trimLines removes the padding tablewriter leaves at the end of each line
+func trimLines(s string) string {
+	lines := strings.SplitAfter(s, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \n")
+		if strings.HasSuffix(line, "\n") {
+			lines[i] += "\n"
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// fitKey shortens or wraps key to fit within opts.MaxKeyWidth
+func fitKey(key string, opts renderOptions) string {
+	runes := []rune(key)
+	if opts.MaxKeyWidth == 0 || len(runes) <= opts.MaxKeyWidth {
+		return key
+	}
+	if opts.WrapKeys {
+		return wrapKey(key, opts.MaxKeyWidth)
+	}
+	return middleEllipsis(runes, opts.MaxKeyWidth)
+}
+
+// middleEllipsis shortens runes to width by replacing the middle with "…",
+// keeping the start (the org) and the end (the app and instance) readable
+func middleEllipsis(runes []rune, width int) string {
+	if width < 3 {
+		return string(runes[:width])
+	}
+	tail := (width - 1) / 2
+	head := width - 1 - tail
+	return string(runes[:head]) + "…" + string(runes[len(runes)-tail:])
+}
+
+// wrapKey splits key into lines of up to width runes, breaking after a
+// slash where possible
+func wrapKey(key string, width int) string {
+	var lines []string
+	line := []rune{}
+	for _, part := range strings.SplitAfter(key, "/") {
+		p := []rune(part)
+		if len(line)+len(p) > width && len(p) <= width {
+			lines = append(lines, string(line))
+			line = []rune{}
+		}
+		// parts too long for a line of their own are split anywhere
+		for len(line)+len(p) > width {
+			n := width - len(line)
+			lines = append(lines, string(append(line, p[:n]...)))
+			line, p = []rune{}, p[n:]
+		}
+		line = append(line, p...)
+	}
+	if len(line) != 0 {
+		lines = append(lines, string(line))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func toPercent(num, denom int) string {
+	if denom == 0 {
+		return "NaN"
+	}
+	return fmt.Sprintf("%d%%", (num*100.0)/denom)
+}
+
+// sizeUnits are the binary units sizes are shown in, each 1024 times the last
+var sizeUnits = []string{"B", "KB", "MB", "GB", "TB", "PB", "EB"}
+
+// toHumanSize formats b bytes in the largest unit it is at least one of,
+// with one decimal place, ie "1.5 GB"
+func toHumanSize(b int) string {
+	if b < 0 {
+		return "-" + toHumanSize(-b)
+	}
+	if b < 1024 {
+		return fmt.Sprintf("%d B", b)
+	}
+	v := float64(b)
+	i := 0
+	for v >= 1024 && i < len(sizeUnits)-1 {
+		v /= 1024
+		i++
+	}
+	// rounding may carry into the next unit, ie 1023.96 KB is 1.0 MB
+	if v >= 1023.95 && i < len(sizeUnits)-1 {
+		v /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", v, sizeUnits[i])
+}
+
+// toSize formats b bytes in unit, or as per toHumanSize if unit is "auto"
+func toSize(b int, unit string) string {
+	for i, u := range sizeUnits {
+		if u != unit {
+			continue
+		}
+		if i == 0 {
+			return fmt.Sprintf("%d B", b)
+		}
+		return fmt.Sprintf("%.1f %s", float64(b)/math.Pow(1024, float64(i)), u)
+	}
+	return toHumanSize(b)
+}
@@ -0,0 +1,60 @@
+package report
+
+// Metric is a custom value of each instance, ie its cost under an internal
+// cost model, or its weight for an SLO, that is totalled up to each app,
+// space, org and the installation as memory usage is, so that it needn't
+// be rolled up separately. Totals are sums, so for an average, ie of a
+// weight per GB, add metrics for both sides of the ratio and divide them.
+type Metric interface {
+	// Name is what the metric is kept as in each row's Metrics
+	Name() string
+
+	// Value returns the metric for an instance row
+	Value(instance *Row) float64
+}
+
+// MetricFunc returns a Metric named name, whose value for each instance is
+// returned by value, ie:
+//
+//	cost := report.MetricFunc("cost", func(instance *report.Row) float64 {
+//		return float64(instance.MemoryQuota) / (1 << 30) * dollarsPerGB
+//	})
+func MetricFunc(name string, value func(instance *Row) float64) Metric {
+	return &metricFunc{name: name, value: value}
+}
+
+type metricFunc struct {
+	name  string
+	value func(instance *Row) float64
+}
+
+func (mf *metricFunc) Name() string {
+	return mf.name
+}
+
+func (mf *metricFunc) Value(instance *Row) float64 {
+	return mf.value(instance)
+}
+
+// WithMetrics returns a copy of the report with the value of each metric
+// added to the Metrics of every instance, and totalled for each app, space,
+// org and the installation. Metrics the instances already have, ie from an
+// earlier call, are kept unless replaced by one of the same name.
+func (r *Report) WithMetrics(metrics ...Metric) *Report {
+	var instances []*Row
+	for _, row := range r.Rows {
+		if row.Level() != 4 {
+			continue
+		}
+		instance := *row
+		instance.Metrics = make(map[string]float64, len(row.Metrics)+len(metrics))
+		for name, v := range row.Metrics {
+			instance.Metrics[name] = v
+		}
+		for _, m := range metrics {
+			instance.Metrics[m.Name()] = m.Value(row)
+		}
+		instances = append(instances, &instance)
+	}
+	return r.withInstances(instances)
+}
@@ -0,0 +1,451 @@
+// Package report is the data model of cf-report-memory-usage reports, for
+// Go tooling that consumes them, ie:
+//
+//	f, _ := os.Open("memory.json")
+//	rep, _ := report.Read(f)
+//	fmt.Println(rep.Org("my-org").Space("prod").Total().MemoryUsage)
+//
+// Reports are read from the output of --output-json, or from the samples of
+// a history sink. A row's Key is "org/space/app/instance", with aggregates
+// for each app, space, org and the installation (Key ""). Slashes within
+// names are replaced with "-".
+package report
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Row is the usage of an app instance, or the total for an app, space, org
+// or the installation, in bytes
+type Row struct {
+	RunID string
+
+	// Tag is the tag the run was given, if any, ie "loadtest-2024-06"
+	Tag string `json:",omitempty"`
+
+	Key         string
+	MemoryUsage int
+	MemoryQuota int
+	DiskUsage   int
+	DiskQuota   int
+
+	// LastMemoryUsage is, for crashed or down instances only, the last
+	// memory usage reported to log-cache, at LastReportedAt. It is not
+	// included in MemoryUsage or in aggregates.
+	LastMemoryUsage int        `json:",omitempty"`
+	LastReportedAt  *time.Time `json:",omitempty"`
+
+	// SampledAt is, for instances only, when their stats were fetched. On
+	// long crawls the first and last instances are sampled well apart.
+	SampledAt *time.Time `json:",omitempty"`
+
+	// State is, for app instances only, as reported with their stats, ie
+	// "RUNNING", "STARTING", "CRASHED" or "DOWN". It is empty in reports
+	// from before it was recorded, and for service instances.
+	State string `json:",omitempty"`
+
+	// Buildpack is, for app instances only, what the app was staged with,
+	// ie "java_buildpack", several joined with "+", or "docker". It is empty
+	// if not known, as with v3 unless detected buildpacks were fetched.
+	Buildpack string `json:",omitempty"`
+
+	// Stack is, for app instances only, the stack the app runs on, ie
+	// "cflinuxfs4". It is empty for docker images, and in reports from
+	// before it was recorded.
+	Stack string `json:",omitempty"`
+
+	// Cell is, for app instances only, the address of the Diego cell the
+	// instance runs on, as reported with its stats. It is empty if the
+	// instance isn't placed, ie is down.
+	Cell string `json:",omitempty"`
+
+	// Labels are, for app instances only, the values of the labels asked
+	// for when crawling, from the app, or failing that its space or org
+	Labels map[string]string `json:",omitempty"`
+
+	// Metrics are custom values, by name, set on instances with
+	// Report.WithMetrics, and totalled for aggregates as memory usage is
+	Metrics map[string]float64 `json:",omitempty"`
+
+	// NotRunning is, for aggregates only, how many of the instances within
+	// have a State other than "RUNNING". Those that are crashed or down
+	// use no memory, so otherwise look healthier than they are.
+	NotRunning int `json:",omitempty"`
+}
+
+// Running returns false if the row is an instance that isn't running, or
+// an aggregate with instances that aren't
+func (r *Row) Running() bool {
+	return r.NotRunning == 0 && (r.State == "" || r.State == "RUNNING")
+}
+
+// Level returns the depth of the row: 0 for the installation total, 1 for
+// an org, 2 a space, 3 an app and 4 an instance
+func (r *Row) Level() int {
+	if r.Key == "" {
+		return 0
+	}
+	return strings.Count(r.Key, "/") + 1
+}
+
+// Report is the result of a single crawl of the installation
+type Report struct {
+	// RunID uniquely identifies the crawl. It is included in every row so
+	// that (RunID, Key) can be used to de-duplicate retried deliveries.
+	RunID string
+
+	// Tag, if set, marks the run as unusual, ie "loadtest-2024-06" for one
+	// collected during a load test, so that it can be left out of baselines.
+	// It is also on every row.
+	Tag string `json:",omitempty"`
+
+	// Time is when the crawl started. It is zero if read from --output-json.
+	Time time.Time
+
+	// Skipped lists the apps ("org/space/app") left out because their stats
+	// could not be fetched
+	Skipped []string `json:",omitempty"`
+
+	// Errors describes each org, space or app that couldn't be fetched, in
+	// key order, including the skipped apps
+	Errors []*Error `json:",omitempty"`
+
+	// Vanished lists the orgs, spaces and apps ("org/space/app") that were
+	// deleted after being listed, while the crawl was under way, so are left
+	// out. Unlike those skipped, this doesn't make the report incomplete.
+	Vanished []string `json:",omitempty"`
+
+	// Appeared lists the orgs, spaces and apps that were created while the
+	// crawl was under way, after the list they would be in was read, so are
+	// left out until the next run. Nor does this make the report incomplete.
+	Appeared []string `json:",omitempty"`
+
+	// Partial is true if the crawl left out part of the installation on
+	// purpose, ie it was limited to an org or space, excluded some, or was
+	// merged from only some of the shards, so orgs and spaces missing from
+	// it may still exist. Shard is the share of orgs crawled, ie "2/5", if
+	// the report is of one shard.
+	Partial bool   `json:",omitempty"`
+	Shard   string `json:",omitempty"`
+
+	// OrgMemoryLimits is the memory limit of each org's quota, by name, and
+	// SpaceMemoryLimits that of each space with a space quota, by
+	// "org/space", in bytes, or -1 if unlimited. They are only collected
+	// when showing quotas, or forecasting quota breaches.
+	OrgMemoryLimits   map[string]int `json:",omitempty"`
+	SpaceMemoryLimits map[string]int `json:",omitempty"`
+
+	// FreshOrg, if set, is the only org that was crawled, with --fresh-org.
+	// Every other org is as it was in the run CachedRunID, at CachedTime.
+	FreshOrg    string     `json:",omitempty"`
+	CachedRunID string     `json:",omitempty"`
+	CachedTime  *time.Time `json:",omitempty"`
+
+	// Rows has one entry per app instance, plus aggregates for each level
+	Rows []*Row
+}
+
+// Error is an org, space or app left out of, or incomplete in, a report
+// because a request for it failed
+type Error struct {
+	// Key is what is affected, ie "org/space/app"
+	Key string
+
+	// URL is the request that failed, if the server responded
+	URL string `json:",omitempty"`
+
+	// StatusCode and Code are the HTTP status and CF error code, ie
+	// "CF-NotAuthorized", if the server responded
+	StatusCode int    `json:",omitempty"`
+	Code       string `json:",omitempty"`
+
+	Description string
+}
+
+// Incomplete returns true if anything was left out of the report due to
+// errors
+func (r *Report) Incomplete() bool {
+	return len(r.Skipped) != 0 || len(r.Errors) != 0
+}
+
+// Read decodes a report, either a history sample or --output-json, which
+// has rows only
+func Read(r io.Reader) (*Report, error) {
+	var raw json.RawMessage
+	err := json.NewDecoder(r).Decode(&raw)
+	if err != nil {
+		return nil, err
+	}
+
+	rep := &Report{}
+	if len(raw) != 0 && raw[0] == '[' {
+		err = json.Unmarshal(raw, &rep.Rows)
+		if err == nil && len(rep.Rows) != 0 {
+			rep.RunID, rep.Tag = rep.Rows[0].RunID, rep.Rows[0].Tag
+		}
+	} else {
+		err = json.Unmarshal(raw, rep)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rep, nil
+}
+
+// AddTotals returns the instance rows followed by an aggregated row for
+// each app, space, org and the installation, in key order. Totals take the
+// Tag of the instances, which are all from the same run, and the sum of
+// their Metrics.
+func AddTotals(runID string, instances []*Row) []*Row {
+	rows := instances
+	totals := make(map[string]*Row)
+	var totalKeys []string
+	for _, info := range instances {
+		bits := strings.Split(info.Key, "/")
+		for i := range bits {
+			key := strings.Join(bits[:i], "/")
+			total, ok := totals[key]
+			if !ok {
+				total = &Row{RunID: runID, Tag: info.Tag, Key: key}
+				totals[key] = total
+				totalKeys = append(totalKeys, key)
+			}
+			total.MemoryUsage += info.MemoryUsage
+			total.MemoryQuota += info.MemoryQuota
+			total.DiskUsage += info.DiskUsage
+			total.DiskQuota += info.DiskQuota
+			if !info.Running() {
+				total.NotRunning++
+			}
+			for name, v := range info.Metrics {
+				if total.Metrics == nil {
+					total.Metrics = make(map[string]float64)
+				}
+				total.Metrics[name] += v
+			}
+		}
+	}
+	sort.Strings(totalKeys)
+	for _, key := range totalKeys {
+		rows = append(rows, totals[key])
+	}
+	return rows
+}
+
+// Row returns the row with key, or nil if there isn't one
+func (r *Report) Row(key string) *Row {
+	for _, row := range r.Rows {
+		if row.Key == key {
+			return row
+		}
+	}
+	return nil
+}
+
+// Total returns the installation total
+func (r *Report) Total() *Row {
+	return r.node("").Total()
+}
+
+// Orgs returns every org in the report, by name
+func (r *Report) Orgs() []*Node {
+	return r.node("").Children()
+}
+
+// Org returns the org with name. If there is no such org, its Total is nil.
+func (r *Report) Org(name string) *Node {
+	return r.node(name)
+}
+
+func (r *Report) node(key string) *Node {
+	return &Node{report: r, key: key}
+}
+
+// Filter returns a report with only the instances for which keep returns
+// true, and totals recalculated to match
+func (r *Report) Filter(keep func(instance *Row) bool) *Report {
+	var instances []*Row
+	for _, row := range r.Rows {
+		if row.Level() == 4 && keep(row) {
+			instances = append(instances, row)
+		}
+	}
+	return r.withInstances(instances)
+}
+
+// withInstances returns a copy of the report with instances in place of its
+// rows, and totals recalculated for them
+func (r *Report) withInstances(instances []*Row) *Report {
+	return &Report{
+		RunID:    r.RunID,
+		Tag:      r.Tag,
+		Time:     r.Time,
+		Skipped:  r.Skipped,
+		Errors:   r.Errors,
+		Vanished: r.Vanished,
+		Appeared: r.Appeared,
+		Partial:  r.Partial,
+		Shard:    r.Shard,
+
+		OrgMemoryLimits:   r.OrgMemoryLimits,
+		SpaceMemoryLimits: r.SpaceMemoryLimits,
+
+		FreshOrg:    r.FreshOrg,
+		CachedRunID: r.CachedRunID,
+		CachedTime:  r.CachedTime,
+
+		Rows: AddTotals(r.RunID, instances),
+	}
+}
+
+// Diff compares the apps in r with those in other, an earlier report
+func (r *Report) Diff(other *Report) *Diff {
+	apps := func(rep *Report) map[string]*Row {
+		rv := make(map[string]*Row)
+		for _, row := range rep.Rows {
+			if row.Level() == 3 {
+				rv[row.Key] = row
+			}
+		}
+		return rv
+	}
+
+	d := &Diff{}
+	before, after := apps(other), apps(r)
+	for k, row := range after {
+		if prev, ok := before[k]; ok {
+			d.Changed = append(d.Changed, &AppChange{Key: k, Before: prev, After: row})
+		} else {
+			d.Added = append(d.Added, &AppChange{Key: k, After: row})
+		}
+	}
+	for k, row := range before {
+		if _, ok := after[k]; !ok {
+			d.Removed = append(d.Removed, &AppChange{Key: k, Before: row})
+		}
+	}
+	for _, acs := range [][]*AppChange{d.Changed, d.Added, d.Removed} {
+		sort.Slice(acs, func(i, j int) bool {
+			return acs[i].Key < acs[j].Key
+		})
+	}
+	return d
+}
+
+// Node is an org, space or app within a report
+type Node struct {
+	report *Report
+	key    string
+}
+
+// Key returns the key of the node, ie "org/space"
+func (n *Node) Key() string {
+	return n.key
+}
+
+// Name returns the last part of the key, ie the space name
+func (n *Node) Name() string {
+	return n.key[strings.LastIndex(n.key, "/")+1:]
+}
+
+// Total returns the aggregate row for the node, or nil if it isn't in the report
+func (n *Node) Total() *Row {
+	return n.report.Row(n.key)
+}
+
+// Space returns the space with name within an org
+func (n *Node) Space(name string) *Node {
+	return n.child(name)
+}
+
+// App returns the app with name within a space
+func (n *Node) App(name string) *Node {
+	return n.child(name)
+}
+
+func (n *Node) child(name string) *Node {
+	if n.key == "" {
+		return n.report.node(name)
+	}
+	return n.report.node(n.key + "/" + name)
+}
+
+// Children returns the spaces of an org, apps of a space, or orgs of the
+// installation, sorted by key
+func (n *Node) Children() []*Node {
+	var rv []*Node
+	for _, row := range n.descendants(1) {
+		rv = append(rv, n.report.node(row.Key))
+	}
+	return rv
+}
+
+// Instances returns the instance rows of an app, space or org, sorted by key
+func (n *Node) Instances() []*Row {
+	return n.descendants(4 - n.level())
+}
+
+func (n *Node) level() int {
+	return (&Row{Key: n.key}).Level()
+}
+
+// descendants returns rows depth levels below the node, sorted by key
+func (n *Node) descendants(depth int) []*Row {
+	prefix := n.key + "/"
+	if n.key == "" {
+		prefix = ""
+	}
+	var rv []*Row
+	for _, row := range n.report.Rows {
+		if row.Level() == n.level()+depth && strings.HasPrefix(row.Key, prefix) {
+			rv = append(rv, row)
+		}
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		return rv[i].Key < rv[j].Key
+	})
+	return rv
+}
+
+// Diff is how the apps in a report changed since an earlier report
+type Diff struct {
+	Changed []*AppChange // in both reports
+	Added   []*AppChange // only in the later report
+	Removed []*AppChange // only in the earlier report
+}
+
+// AppChange is an app-level row before and after. Before is nil for apps
+// that were added, and After is nil for apps that were removed.
+type AppChange struct {
+	Key    string
+	Before *Row
+	After  *Row
+}
+
+// MemoryUsageChange returns how much more memory is used after than before
+func (ac *AppChange) MemoryUsageChange() int {
+	return ac.after().MemoryUsage - ac.before().MemoryUsage
+}
+
+// MemoryQuotaChange returns how much more memory is reserved after than before
+func (ac *AppChange) MemoryQuotaChange() int {
+	return ac.after().MemoryQuota - ac.before().MemoryQuota
+}
+
+func (ac *AppChange) before() *Row {
+	if ac.Before == nil {
+		return &Row{}
+	}
+	return ac.Before
+}
+
+func (ac *AppChange) after() *Row {
+	if ac.After == nil {
+		return &Row{}
+	}
+	return ac.After
+}
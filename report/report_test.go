@@ -0,0 +1,142 @@
+package report
+
+import (
+	"strings"
+	"testing"
+)
+
+// instances returns instance rows of 100 bytes used of a 256 byte quota,
+// and 10 of 1024 disk, with keys
+func instances(keys ...string) []*Row {
+	var rv []*Row
+	for _, k := range keys {
+		rv = append(rv, &Row{RunID: "run", Tag: "tag", Key: k, MemoryUsage: 100, MemoryQuota: 256, DiskUsage: 10, DiskQuota: 1024, State: "RUNNING"})
+	}
+	return rv
+}
+
+func TestAddTotals(t *testing.T) {
+	in := instances("o1/s1/a/0", "o1/s1/a/1", "o1/s2/b/0", "o2/s1/c/0")
+	in[1].State = "CRASHED"
+	in[1].MemoryUsage = 0
+	rows := AddTotals("run", in)
+
+	// memory usage, memory quota, instances not running and instances
+	want := map[string][4]int{
+		"":        {300, 1024, 1, 4},
+		"o1":      {200, 768, 1, 3},
+		"o1/s1":   {100, 512, 1, 2},
+		"o1/s1/a": {100, 512, 1, 2},
+		"o1/s2":   {100, 256, 0, 1},
+		"o1/s2/b": {100, 256, 0, 1},
+		"o2":      {100, 256, 0, 1},
+		"o2/s1":   {100, 256, 0, 1},
+		"o2/s1/c": {100, 256, 0, 1},
+	}
+	if len(rows) != len(in)+len(want) {
+		t.Fatalf("got %d rows, want %d", len(rows), len(in)+len(want))
+	}
+	var keys []string
+	for i, row := range rows {
+		keys = append(keys, "/"+row.Key)
+		if i < len(in) {
+			if row != in[i] {
+				t.Errorf("row %d: instances aren't first, in order", i)
+			}
+			continue
+		}
+		w := want[row.Key]
+		if row.MemoryUsage != w[0] || row.MemoryQuota != w[1] || row.NotRunning != w[2] {
+			t.Errorf("/%s: got %d/%d, %d not running, want %d/%d, %d", row.Key, row.MemoryUsage, row.MemoryQuota, row.NotRunning, w[0], w[1], w[2])
+		}
+		if row.DiskUsage != 10*w[3] || row.DiskQuota != 1024*w[3] {
+			t.Errorf("/%s: got disk %d/%d, want %d/%d", row.Key, row.DiskUsage, row.DiskQuota, 10*w[3], 1024*w[3])
+		}
+		if row.RunID != "run" || row.Tag != "tag" {
+			t.Errorf("/%s: got run %q tag %q, want those of the instances", row.Key, row.RunID, row.Tag)
+		}
+	}
+	if got, want := strings.Join(keys[len(in):], " "), "/ /o1 /o1/s1 /o1/s1/a /o1/s2 /o1/s2/b /o2 /o2/s1 /o2/s1/c"; got != want {
+		t.Errorf("got totals %s, want %s", got, want)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	rep := &Report{RunID: "run", Rows: AddTotals("run", instances("o1/s1/a/0", "o1/s1/a/1", "o2/s1/c/0"))}
+	o1 := rep.Filter(func(instance *Row) bool {
+		return strings.HasPrefix(instance.Key, "o1/")
+	})
+	if total := o1.Total(); total.MemoryUsage != 200 || total.MemoryQuota != 512 {
+		t.Errorf("got a total of %d/%d, want 200/512", total.MemoryUsage, total.MemoryQuota)
+	}
+	if o1.Org("o2").Total() != nil {
+		t.Error("o2 was kept")
+	}
+	if total := rep.Total(); total.MemoryUsage != 300 {
+		t.Errorf("filtering changed the original's total to %d", total.MemoryUsage)
+	}
+}
+
+func TestNodes(t *testing.T) {
+	rep := &Report{Rows: AddTotals("run", instances("o1/s1/a/0", "o1/s1/a/1", "o1/s2/b/0", "o2/s1/c/0"))}
+	o1 := rep.Org("o1")
+	if o1.Total().MemoryUsage != 300 {
+		t.Errorf("got o1 using %d, want 300", o1.Total().MemoryUsage)
+	}
+	var spaces []string
+	for _, n := range o1.Children() {
+		spaces = append(spaces, n.Name())
+	}
+	if strings.Join(spaces, ",") != "s1,s2" {
+		t.Errorf("got spaces %v, want s1,s2", spaces)
+	}
+	if n := len(o1.Space("s1").App("a").Instances()); n != 2 {
+		t.Errorf("got %d instances of a, want 2", n)
+	}
+	if n := len(o1.Instances()); n != 3 {
+		t.Errorf("got %d instances in o1, want 3", n)
+	}
+}
+
+func TestRead(t *testing.T) {
+	rows, err := Read(strings.NewReader(`[{"RunID": "run", "Tag": "tag", "Key": "o/s/a/0", "MemoryUsage": 1}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows.RunID != "run" || rows.Tag != "tag" || len(rows.Rows) != 1 {
+		t.Errorf("got %+v from --output-json", rows)
+	}
+
+	sample, err := Read(strings.NewReader(`{"RunID": "run", "Skipped": ["o/s/b"], "Rows": [{"RunID": "run", "Key": "o/s/a/0"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sample.RunID != "run" || !sample.Incomplete() || len(sample.Rows) != 1 {
+		t.Errorf("got %+v from a history sample", sample)
+	}
+}
+
+func TestWithMetrics(t *testing.T) {
+	rep := &Report{RunID: "run", Rows: AddTotals("run", instances("o1/s1/a/0", "o1/s1/a/1", "o1/s2/b/0", "o2/s1/c/0"))}
+	cost := MetricFunc("cost", func(instance *Row) float64 {
+		return float64(instance.MemoryQuota) / 256 * 1.5
+	})
+	costed := rep.WithMetrics(cost)
+	for key, want := range map[string]float64{"": 6, "o1": 4.5, "o1/s1": 3, "o1/s1/a": 3, "o1/s1/a/0": 1.5, "o2": 1.5} {
+		if got := costed.Row(key).Metrics["cost"]; got != want {
+			t.Errorf("/%s: got cost %f, want %f", key, got, want)
+		}
+	}
+	if rep.Row("").Metrics != nil || rep.Row("o1/s1/a/0").Metrics != nil {
+		t.Error("original report changed")
+	}
+
+	// metrics are kept when adding others, and as totals are recalculated
+	both := costed.WithMetrics(MetricFunc("instances", func(*Row) float64 { return 1 }))
+	o1 := both.Filter(func(instance *Row) bool {
+		return strings.HasPrefix(instance.Key, "o1/")
+	}).Total()
+	if o1.Metrics["cost"] != 4.5 || o1.Metrics["instances"] != 3 {
+		t.Errorf("got metrics %v, want cost 4.5 and 3 instances", o1.Metrics)
+	}
+}
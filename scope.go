@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+
+	"code.cloudfoundry.org/cli/plugin"
+
+	"github.com/govau/cf-report-memory-usage/internal/cfclient"
+)
+
+// reportScope limits a crawl to a single org, or a single space within it.
+// The zero value covers the whole installation.
+type reportScope struct {
+	OrgGUID   string
+	OrgName   string
+	SpaceGUID string
+	SpaceName string
+}
+
+func (rs reportScope) String() string {
+	switch {
+	case rs.SpaceGUID != "":
+		return "space " + rs.OrgName + "/" + rs.SpaceName
+	case rs.OrgGUID != "":
+		return "org " + rs.OrgName
+	default:
+		return "all orgs"
+	}
+}
+
+// within returns the part of rep with keys that keep returns true for, with
+// totals recalculated, and only the errors, skipped and vanished apps and
+// quotas of the keys kept. As it leaves out the rest of the installation,
+// the report is Partial.
+func within(rep *usageReport, keep func(key string) bool) *usageReport {
+	scoped := rep.Filter(func(row *appUsageInfo) bool {
+		return keep(row.Key)
+	})
+	scoped.Skipped, scoped.Errors, scoped.Vanished, scoped.Appeared = nil, nil, nil, nil
+	scoped.Partial = true
+	for _, k := range rep.Skipped {
+		if keep(k) {
+			scoped.Skipped = append(scoped.Skipped, k)
+		}
+	}
+	for _, k := range rep.Vanished {
+		if keep(k) {
+			scoped.Vanished = append(scoped.Vanished, k)
+		}
+	}
+	for _, k := range rep.Appeared {
+		if keep(k) {
+			scoped.Appeared = append(scoped.Appeared, k)
+		}
+	}
+	for _, e := range rep.Errors {
+		if keep(e.Key) {
+			scoped.Errors = append(scoped.Errors, e)
+		}
+	}
+	scoped.OrgMemoryLimits, scoped.SpaceMemoryLimits = nil, nil
+	for k, limit := range rep.OrgMemoryLimits {
+		if keep(k) {
+			if scoped.OrgMemoryLimits == nil {
+				scoped.OrgMemoryLimits = make(map[string]int)
+			}
+			scoped.OrgMemoryLimits[k] = limit
+		}
+	}
+	for k, limit := range rep.SpaceMemoryLimits {
+		if keep(k) {
+			if scoped.SpaceMemoryLimits == nil {
+				scoped.SpaceMemoryLimits = make(map[string]int)
+			}
+			scoped.SpaceMemoryLimits[k] = limit
+		}
+	}
+	return scoped
+}
+
+// targetedScope returns the org and space currently targeted by the cf CLI
+func targetedScope(cliConnection plugin.CliConnection) (reportScope, error) {
+	org, err := cliConnection.GetCurrentOrg()
+	if err != nil {
+		return reportScope{}, err
+	}
+	if org.Guid == "" {
+		return reportScope{}, errors.New("no org targeted, use `cf target -o ORG [-s SPACE]` first")
+	}
+	space, err := cliConnection.GetCurrentSpace()
+	if err != nil {
+		return reportScope{}, err
+	}
+	return reportScope{
+		OrgGUID:   org.Guid,
+		OrgName:   org.Name,
+		SpaceGUID: space.Guid,
+		SpaceName: space.Name,
+	}, nil
+}
+
+// namedScope returns the scope for an org and optionally a space within it,
+// by name. If org is empty the targeted org is used.
+func namedScope(cliConnection plugin.CliConnection, org, space string) (reportScope, error) {
+	if org == "" {
+		current, err := cliConnection.GetCurrentOrg()
+		if err != nil {
+			return reportScope{}, err
+		}
+		if current.Name == "" {
+			return reportScope{}, errors.New("no org targeted, use --org ORG or `cf target -o ORG` first")
+		}
+		org = current.Name
+	}
+	o, err := cliConnection.GetOrg(org)
+	if err != nil {
+		return reportScope{}, fmt.Errorf("org %s: %s", org, err)
+	}
+	if o.Guid == "" {
+		return reportScope{}, fmt.Errorf("org %s not found", org)
+	}
+	rs := reportScope{OrgGUID: o.Guid, OrgName: o.Name}
+	if space == "" {
+		return rs, nil
+	}
+	for _, s := range o.Spaces {
+		if s.Name == space {
+			rs.SpaceGUID, rs.SpaceName = s.Guid, s.Name
+			return rs, nil
+		}
+	}
+	return reportScope{}, fmt.Errorf("space %s not found in org %s", space, o.Name)
+}
+
+// apiScope is as namedScope, but looks the org and space up with the v3
+// API rather than the cf CLI, for when not logged in with it. org must be
+// set, as there is no targeted org.
+func apiScope(client cfclient.API, org, space string) (reportScope, error) {
+	if org == "" {
+		return reportScope{}, errors.New("--org is needed with --space when not logged in with the cf CLI")
+	}
+	type named struct {
+		Resources []struct {
+			GUID string `json:"guid"`
+			Name string `json:"name"`
+		} `json:"resources"`
+	}
+	var orgs, spaces named
+	err := client.Get("/v3/organizations?names="+url.QueryEscape(org), &orgs)
+	if err != nil {
+		return reportScope{}, fmt.Errorf("org %s: %s", org, err)
+	}
+	if len(orgs.Resources) == 0 {
+		return reportScope{}, fmt.Errorf("org %s not found", org)
+	}
+	rs := reportScope{OrgGUID: orgs.Resources[0].GUID, OrgName: orgs.Resources[0].Name}
+	if space == "" {
+		return rs, nil
+	}
+	err = client.Get("/v3/spaces?names="+url.QueryEscape(space)+"&organization_guids="+rs.OrgGUID, &spaces)
+	if err != nil {
+		return reportScope{}, fmt.Errorf("space %s: %s", space, err)
+	}
+	if len(spaces.Resources) == 0 {
+		return reportScope{}, fmt.Errorf("space %s not found in org %s", space, rs.OrgName)
+	}
+	rs.SpaceGUID, rs.SpaceName = spaces.Resources[0].GUID, spaces.Resources[0].Name
+	return rs, nil
+}
+
+// canSeeAllOrgs returns true if the scopes allow reading the whole installation
+func canSeeAllOrgs(scopes []string) bool {
+	return hasScope(scopes, scopeAdmin) || hasScope(scopes, scopeAdminReadOnly) || hasScope(scopes, scopeGlobalAuditor)
+}
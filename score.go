@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// wastefulAppPercent is the percentage of its quota under which an app's
+// quota counts as wasted when scoring
+const wastefulAppPercent = 25
+
+// The parts of an org's efficiency score
+const (
+	scoreUtilization = "utilization"
+	scoreWaste       = "waste"
+	scoreCrashes     = "crashes"
+	scoreStale       = "stale"
+)
+
+// scoreParts are the parts of the score, in the order they are shown
+var scoreParts = []string{scoreUtilization, scoreWaste, scoreCrashes, scoreStale}
+
+// scoreWeights are how much each part counts towards the score, given to
+// --score-weights as ie "utilization=40,waste=30,crashes=20,stale=10".
+// Parts that aren't given keep their default weight.
+type scoreWeights map[string]float64
+
+// defaultScoreWeights favour using what is allocated
+var defaultScoreWeights = scoreWeights{
+	scoreUtilization: 40,
+	scoreWaste:       30,
+	scoreCrashes:     20,
+	scoreStale:       10,
+}
+
+func (sw *scoreWeights) String() string {
+	var parts []string
+	for _, part := range scoreParts {
+		if w, ok := (*sw)[part]; ok {
+			parts = append(parts, part+"="+strconv.FormatFloat(w, 'f', -1, 64))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func (sw *scoreWeights) Set(s string) error {
+	weights := make(scoreWeights)
+	for part, w := range defaultScoreWeights {
+		weights[part] = w
+	}
+	for _, kv := range strings.Split(s, ",") {
+		bits := strings.SplitN(kv, "=", 2)
+		if _, ok := defaultScoreWeights[bits[0]]; !ok || len(bits) != 2 {
+			return fmt.Errorf("expected %s=WEIGHT: %s", strings.Join(scoreParts, "|"), kv)
+		}
+		w, err := strconv.ParseFloat(bits[1], 64)
+		if err != nil || w < 0 {
+			return fmt.Errorf("invalid weight, expected a number of at least 0: %s", kv)
+		}
+		weights[bits[0]] = w
+	}
+	total := 0.0
+	for _, w := range weights {
+		total += w
+	}
+	if total == 0 {
+		return fmt.Errorf("at least one weight must be more than 0: %s", s)
+	}
+	*sw = weights
+	return nil
+}
+
+// orgScore is the efficiency of an org, out of 100, and the parts it is
+// made of, each from 0 (worst) to 1 (best)
+type orgScore struct {
+	Org   string
+	Score float64
+
+	// Utilization is how much of their quota the org's instances use
+	Utilization float64
+
+	// Waste is how much of the org's quota is not in apps using under
+	// wastefulAppPercent of theirs
+	Waste float64
+
+	// Crashes is how many of the org's instances are running
+	Crashes float64
+
+	// Stale is how many of the org's instances aren't on a stale buildpack
+	Stale float64
+
+	Instances int
+}
+
+// orgScores is every org in a report, most efficient first
+type orgScores struct {
+	Weights scoreWeights
+	Orgs    []*orgScore
+}
+
+// scoreOrgs scores each org in rep, weighting the parts as per weights.
+// Instances whose buildpack, or any of their buildpacks, matches stale are
+// on a stale buildpack. Service instances have no quota of their own, so
+// are left out.
+func scoreOrgs(rep *usageReport, weights scoreWeights, stale namePatterns) *orgScores {
+	if weights == nil {
+		weights = defaultScoreWeights
+	}
+	type totals struct {
+		instances, running, onStale int
+		usage, quota, wasted        int
+	}
+	byOrg := make(map[string]*totals)
+	var orgs []string
+	for _, row := range rep.Rows {
+		if row.Level() != 3 {
+			continue
+		}
+		bits := strings.Split(row.Key, "/")
+		if strings.HasPrefix(bits[2], servicePrefix) {
+			continue
+		}
+		t, ok := byOrg[bits[0]]
+		if !ok {
+			t = &totals{}
+			byOrg[bits[0]] = t
+			orgs = append(orgs, bits[0])
+		}
+		t.usage += row.MemoryUsage
+		t.quota += row.MemoryQuota
+		if row.MemoryQuota != 0 && row.MemoryUsage*100 < row.MemoryQuota*wastefulAppPercent {
+			t.wasted += row.MemoryQuota
+		}
+	}
+	for _, row := range rep.Rows {
+		if row.Level() != 4 {
+			continue
+		}
+		t, ok := byOrg[row.Key[:strings.Index(row.Key, "/")]]
+		if !ok {
+			continue
+		}
+		t.instances++
+		if row.Running() {
+			t.running++
+		}
+		if row.Buildpack != "" && stale.match(strings.Split(row.Buildpack, "+")...) {
+			t.onStale++
+		}
+	}
+
+	ratio := func(n, d int) float64 {
+		if d == 0 {
+			return 1
+		}
+		return float64(n) / float64(d)
+	}
+	total := 0.0
+	for _, w := range weights {
+		total += w
+	}
+	scores := &orgScores{Weights: weights}
+	for _, org := range orgs {
+		t := byOrg[org]
+		sc := &orgScore{
+			Org:         org,
+			Utilization: ratio(t.usage, t.quota),
+			Waste:       1 - ratio(t.wasted, t.quota),
+			Crashes:     ratio(t.running, t.instances),
+			Stale:       1 - ratio(t.onStale, t.instances),
+			Instances:   t.instances,
+		}
+		if t.quota == 0 {
+			sc.Waste = 1
+		}
+		if t.instances == 0 {
+			sc.Stale = 1
+		}
+		if sc.Utilization > 1 {
+			sc.Utilization = 1
+		}
+		sc.Score = 100 * (weights[scoreUtilization]*sc.Utilization +
+			weights[scoreWaste]*sc.Waste +
+			weights[scoreCrashes]*sc.Crashes +
+			weights[scoreStale]*sc.Stale) / total
+		scores.Orgs = append(scores.Orgs, sc)
+	}
+	sort.SliceStable(scores.Orgs, func(i, j int) bool {
+		if scores.Orgs[i].Score != scores.Orgs[j].Score {
+			return scores.Orgs[i].Score > scores.Orgs[j].Score
+		}
+		return scores.Orgs[i].Org < scores.Orgs[j].Org
+	})
+	return scores
+}
+
+// renderScores writes the scores as a table, ranked, or JSON. Tables follow
+// the alignment and plainness of opts.
+func renderScores(out io.Writer, rep *usageReport, scores *orgScores, opts renderOptions) error {
+	switch opts.Format {
+	case formatJSON:
+		return json.NewEncoder(out).Encode(scores)
+	case formatTable:
+		// handled below
+	default:
+		return fmt.Errorf("scores can't be shown in the %s format", opts.Format)
+	}
+
+	percent := func(f float64) string {
+		return fmt.Sprintf("%.0f%%", f*100)
+	}
+	var buf bytes.Buffer
+	table := newTable(&buf, []string{"Org", "Rank", "Score", "Utilization", "Not Wasted", "Running", "Current Buildpacks"}, opts)
+	for i, sc := range scores.Orgs {
+		table.Append([]string{
+			sc.Org,
+			strconv.Itoa(i + 1),
+			fmt.Sprintf("%.0f", sc.Score),
+			percent(sc.Utilization),
+			percent(sc.Waste),
+			percent(sc.Crashes),
+			percent(sc.Stale),
+		})
+	}
+	table.Render()
+	rendered := buf.String()
+	if opts.Plain {
+		rendered = trimLines(rendered)
+	}
+
+	_, err := fmt.Fprintf(out, "%sscored out of 100, weighted %s, run ID: %s\n", rendered, scores.Weights.String(), describeRun(rep))
+	if err != nil {
+		return err
+	}
+	return writeErrors(out, rep.Errors)
+}
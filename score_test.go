@@ -0,0 +1,51 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/govau/cf-report-memory-usage/report"
+)
+
+func TestScoreOrgs(t *testing.T) {
+	rep := &usageReport{RunID: "run", Rows: report.AddTotals("run", []*appUsageInfo{
+		// o1 uses all of its quota, but is on a stale buildpack
+		{Key: "o1/s/a/0", MemoryUsage: 100, MemoryQuota: 100, State: "RUNNING", Buildpack: "java_buildpack-v3.1"},
+		// o2 has a wasteful app b, and a crashed instance of c
+		{Key: "o2/s/b/0", MemoryUsage: 10, MemoryQuota: 100, State: "RUNNING", Buildpack: "go_buildpack"},
+		{Key: "o2/s/c/0", MemoryUsage: 50, MemoryQuota: 100, State: "RUNNING", Buildpack: "go_buildpack"},
+		{Key: "o2/s/c/1", MemoryUsage: 0, MemoryQuota: 100, State: "CRASHED", Buildpack: "go_buildpack"},
+	})}
+	var stale namePatterns
+	stale.Set("java_buildpack-v3.*")
+	var weights scoreWeights
+	err := weights.Set("stale=100")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scores := scoreOrgs(rep, weights, stale)
+	if len(scores.Orgs) != 2 || scores.Orgs[0].Org != "o2" {
+		t.Fatalf("got %+v, want o2 first with stale weighted heavily", scores.Orgs)
+	}
+	o1, o2 := scores.Orgs[1], scores.Orgs[0]
+	if o1.Utilization != 1 || o1.Waste != 1 || o1.Crashes != 1 || o1.Stale != 0 {
+		t.Errorf("got o1 %+v", o1)
+	}
+	near := func(a, b float64) bool {
+		return math.Abs(a-b) < 0.001
+	}
+	if !near(o2.Utilization, 0.2) || !near(o2.Waste, 2.0/3) || !near(o2.Crashes, 2.0/3) || o2.Stale != 1 {
+		t.Errorf("got o2 %+v", o2)
+	}
+	// (40*0.2 + 30*2/3 + 20*2/3 + 100*1) / 190
+	if want := 100 * (8 + 20 + 40.0/3 + 100) / 190; !near(o2.Score, want) {
+		t.Errorf("got o2 scoring %f, want %f", o2.Score, want)
+	}
+
+	for _, s := range []string{"speed=1", "waste", "waste=-1", "utilization=0,waste=0,crashes=0,stale=0"} {
+		if weights.Set(s) == nil {
+			t.Errorf("%s: accepted", s)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// reportServer re-crawls the installation every Interval, serving the most
+// recent report over HTTP along with metrics about the crawls themselves
+type reportServer struct {
+	Collector *collector
+
+	// Interval is how long to wait between the start of each crawl
+	Interval time.Duration
+
+	// Sinks, if any, are written to after each successful crawl
+	Sinks []sink
+
+	// Lease, if set, is held by whichever of several instances crawls. The
+	// others serve the latest report from History, written by the leader.
+	Lease   *leaderLease
+	History *historyStore
+
+	// TenantKeys, if set, are needed to read reports, each seeing only its
+	// own orgs, and /metrics is only served to keys for every org
+	TenantKeys *tenantKeys
+
+	mu           sync.Mutex
+	last         *usageReport
+	telemetry    crawlTelemetry
+	lastErr      error
+	lastDuration time.Duration
+}
+
+// crawlTelemetry is what we know about the reporter's own health
+type crawlTelemetry struct {
+	Crawls      int
+	Failures    int
+	LastSuccess time.Time
+}
+
+// serve crawls straight away and then every Interval, while serving on addr
+func (rs *reportServer) serve(addr string) error {
+	if rs.Interval <= 0 {
+		return fmt.Errorf("interval must be positive: %s", rs.Interval)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", rs.serveMetrics)
+	mux.HandleFunc("/report", rs.serveReport)
+	mux.HandleFunc(openAPIPath, serveOpenAPI)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- http.ListenAndServe(addr, mux)
+	}()
+	log.Printf("serving reports on %s, crawling every %s", addr, rs.Interval)
+
+	next := time.Now()
+	for {
+		select {
+		case err := <-errs:
+			return err
+		case <-time.After(time.Until(next)):
+		}
+		next = time.Now().Add(rs.Interval)
+		if rs.Lease == nil {
+			rs.crawl()
+			continue
+		}
+
+		leader, err := rs.Lease.acquire(time.Now())
+		if err != nil {
+			log.Printf("error: unable to check leader lease: %s", err)
+		}
+		if !leader {
+			rs.follow()
+			continue
+		}
+		stop := make(chan struct{})
+		go rs.Lease.hold(stop)
+		rs.crawl()
+		close(stop)
+	}
+}
+
+// follow loads the latest report written to the history by the leader
+func (rs *reportServer) follow() {
+	rep, err := rs.History.latest()
+	if err != nil {
+		log.Printf("error: unable to read the latest report from %s: %s", rs.History, err)
+		return
+	}
+	if rep == nil {
+		return
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.last = rep
+}
+
+// crawl collects a report and keeps it to serve. Failures are logged and
+// counted, and if the crawl itself failed the previous report is still served.
+func (rs *reportServer) crawl() {
+	started := time.Now()
+	rep, err := rs.Collector.collect()
+	if err == nil && len(rs.Sinks) != 0 {
+		err = writeSinks(rs.Sinks, rep)
+	}
+	if err != nil {
+		log.Printf("error: crawl failed: %s", err)
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.telemetry.Crawls++
+	rs.lastErr = err
+	rs.lastDuration = time.Since(started)
+	// a report that failed to reach some sinks is still worth serving
+	if rep != nil {
+		rs.last = rep
+	}
+	if err != nil {
+		rs.telemetry.Failures++
+		return
+	}
+	rs.telemetry.LastSuccess = time.Now()
+}
+
+// report returns the most recent report, if any
+func (rs *reportServer) report() *usageReport {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.last
+}
+
+// serveReport serves the latest report, as JSON unless a format is given,
+// ie /report?format=csv&sort=percent
+func (rs *reportServer) serveReport(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := rs.authorize(w, r)
+	if !ok {
+		return
+	}
+	rep := rs.report()
+	if rep == nil {
+		http.Error(w, "no report yet, the first crawl is in progress", http.StatusServiceUnavailable)
+		return
+	}
+	if tenant != nil {
+		rep = tenant.scope(rep)
+	}
+	opts := renderOptions{
+		Format: r.URL.Query().Get("format"),
+		Metric: r.URL.Query().Get("metric"),
+		Unit:   r.URL.Query().Get("unit"),
+	}
+	if opts.Format == "" {
+		opts.Format = formatJSON
+	}
+	if s := r.URL.Query().Get("sort"); s != "" {
+		err := opts.Sort.Set(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	err := opts.validate()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch opts.Format {
+	case formatJSON:
+		w.Header().Set("Content-Type", "application/json")
+	case formatCSV:
+		w.Header().Set("Content-Type", "text/csv")
+	case formatHTML:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	err = renderReport(w, rep, opts)
+	if err != nil {
+		log.Printf("error: rendering report: %s", err)
+	}
+}
+
+// serveMetrics serves the latest report in the Prometheus text format,
+// followed by metrics about the reporter itself
+func (rs *reportServer) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := rs.authorize(w, r)
+	if !ok {
+		return
+	}
+	if tenant != nil && !tenant.all() {
+		http.Error(w, "metrics cover every org, so need a key for all orgs", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	rep := rs.report()
+	if rep != nil {
+		err := writePrometheus(w, rep)
+		if err != nil {
+			log.Printf("error: writing metrics: %s", err)
+			return
+		}
+	}
+	err := rs.writeTelemetry(w)
+	if err != nil {
+		log.Printf("error: writing metrics: %s", err)
+	}
+}
+
+// authorize returns the tenant making the request, or nil if there are no
+// tenant keys. If the request has no valid key, an error is sent and false
+// is returned.
+func (rs *reportServer) authorize(w http.ResponseWriter, r *http.Request) (*tenantKey, bool) {
+	if rs.TenantKeys == nil {
+		return nil, true
+	}
+	tenant, err := rs.TenantKeys.authenticate(r)
+	if err != nil {
+		log.Printf("error: reading tenant keys: %s", err)
+		http.Error(w, "unable to check keys", http.StatusInternalServerError)
+		return nil, false
+	}
+	if tenant == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="cf-report-memory-usage"`)
+		http.Error(w, "a tenant key is needed, as \"Authorization: Bearer KEY\"", http.StatusUnauthorized)
+		return nil, false
+	}
+	return tenant, true
+}
+
+// writeTelemetry writes metrics about crawls and API requests, so that the
+// reporter breaking can be alerted on
+func (rs *reportServer) writeTelemetry(out io.Writer) error {
+	rs.mu.Lock()
+	t := rs.telemetry
+	lastErr, lastDuration := rs.lastErr, rs.lastDuration
+	skipped, errs := 0, 0
+	if rs.last != nil {
+		skipped, errs = len(rs.last.Skipped), len(rs.last.Errors)
+	}
+	rs.mu.Unlock()
+
+	lastFailed := 0
+	if lastErr != nil {
+		lastFailed = 1
+	}
+	lastSuccess := 0.0
+	if !t.LastSuccess.IsZero() {
+		lastSuccess = float64(t.LastSuccess.UnixNano()) / 1e9
+	}
+	leader := 1
+	if rs.Lease != nil && !rs.Lease.isLeader() {
+		leader = 0
+	}
+	client := rs.Collector.client
+
+	for _, m := range []struct {
+		Name, Help, Type string
+		Value            float64
+	}{
+		{"cf_report_memory_usage_crawls_total", "Crawls of the installation started", "counter", float64(t.Crawls)},
+		{"cf_report_memory_usage_crawl_failures_total", "Crawls that failed", "counter", float64(t.Failures)},
+		{"cf_report_memory_usage_last_crawl_failed", "1 if the most recent crawl failed", "gauge", float64(lastFailed)},
+		{"cf_report_memory_usage_last_crawl_duration_seconds", "How long the most recent crawl took", "gauge", lastDuration.Seconds()},
+		{"cf_report_memory_usage_last_success_timestamp_seconds", "When the most recent successful crawl finished", "gauge", lastSuccess},
+		{"cf_report_memory_usage_leader", "1 if this instance is crawling, 0 if it is serving reports from another", "gauge", float64(leader)},
+		{"cf_report_memory_usage_skipped_apps", "Apps left out of the most recent report due to errors", "gauge", float64(skipped)},
+		{"cf_report_memory_usage_errors", "Orgs, spaces and apps left out of, or incomplete in, the most recent report due to errors", "gauge", float64(errs)},
+		{"cf_report_memory_usage_api_requests_total", "Requests made to the cloud controller and log-cache", "counter", float64(client.Requests())},
+		{"cf_report_memory_usage_api_request_failures_total", "Requests that failed or had a bad status code", "counter", float64(client.Failures())},
+	} {
+		_, err := fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", m.Name, m.Help, m.Name, m.Type, m.Name, m.Value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// serviceUsageAnnotation and serviceQuotaAnnotation are the annotations
+	// a broker, or an operator, sets on a service instance to have its
+	// memory attributed to the space it is in, ie "512M" or "1073741824"
+	serviceUsageAnnotation = "report-memory-usage/memory-usage"
+	serviceQuotaAnnotation = "report-memory-usage/memory-quota"
+
+	// servicePrefix is put before service instance names in keys, so that
+	// they can't be confused with apps, ie "org/space/service:redis/0"
+	servicePrefix = "service:"
+)
+
+// errServicesNeedV3 is returned if services are included with the v2 API
+var errServicesNeedV3 = errors.New("including services needs the v3 API, as service instances have no annotations in v2")
+
+// serviceRows returns a row for each service instance in space that has
+// its memory usage annotated, in name order. Instances with invalid
+// annotations are skipped with a warning rather than failing the crawl.
+func (col *collector) serviceRows(runID string, org *cfOrg, space *cfSpace) ([]*appUsageInfo, error) {
+	var rows []*appUsageInfo
+	sampled := time.Now()
+	err := col.api.ServiceInstances(space, func(si *cfServiceInstance) error {
+		usage, quota, ok, err := serviceMemory(si.Annotations)
+		if err != nil {
+			log.Printf("warning: ignoring memory of service instance %s in %s/%s: %s", si.Name, org.Name, space.Name, err)
+			return nil
+		}
+		if !ok {
+			return nil
+		}
+		rows = append(rows, &appUsageInfo{
+			RunID: runID,
+			Key: fmt.Sprintf("%s/%s/%s%s/0",
+				noSlash(org.Name),
+				noSlash(space.Name),
+				servicePrefix,
+				noSlash(si.Name),
+			),
+			MemoryUsage: usage,
+			MemoryQuota: quota,
+			SampledAt:   &sampled,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].Key < rows[j].Key
+	})
+	return rows, nil
+}
+
+// serviceMemory reads the memory usage and quota annotations. ok is false
+// if the instance has neither. The quota defaults to the usage.
+func serviceMemory(annotations map[string]string) (usage, quota int, ok bool, err error) {
+	u, uok := annotations[serviceUsageAnnotation]
+	q, qok := annotations[serviceQuotaAnnotation]
+	if !uok && !qok {
+		return 0, 0, false, nil
+	}
+	if uok {
+		usage, err = parseByteSize(u)
+		if err != nil {
+			return 0, 0, false, fmt.Errorf("%s: %s", serviceUsageAnnotation, err)
+		}
+	}
+	quota = usage
+	if qok {
+		quota, err = parseByteSize(q)
+		if err != nil {
+			return 0, 0, false, fmt.Errorf("%s: %s", serviceQuotaAnnotation, err)
+		}
+	}
+	return usage, quota, true, nil
+}
+
+// parseByteSize parses a whole number of bytes, optionally followed by a
+// binary unit as in a manifest, ie "512M", "1G" or "1.5GB"
+func parseByteSize(s string) (int, error) {
+	upper := strings.ToUpper(strings.TrimSpace(s))
+	trimmed := strings.TrimSuffix(strings.TrimSuffix(upper, "B"), "I")
+	multiplier := 1.0
+	for i, u := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(trimmed, u) {
+			trimmed = strings.TrimSuffix(trimmed, u)
+			for j := 0; j <= i; j++ {
+				multiplier *= 1024
+			}
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(trimmed), 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size, expected bytes or a size such as 512M: %s", s)
+	}
+	return int(v * multiplier), nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// exitDiscrepancies is the exit status when --shadow-compare finds the v2
+// and v3 reports disagree, as diff(1) does
+const exitDiscrepancies = 1
+
+// shadowDiscrepancy is something about an app that the v2 and v3 reports
+// disagree on
+type shadowDiscrepancy struct {
+	Key string
+
+	// Field is what differs, ie "MemoryQuota", or "App" if the app is only
+	// in one of the reports
+	Field string
+
+	V2, V3 string
+}
+
+// shadowComparison is the result of crawling with both APIs
+type shadowComparison struct {
+	V2RunID, V3RunID string
+
+	// Apps is how many apps were compared, ie were in either report, and
+	// weren't left out of the other due to errors
+	Apps int
+
+	Discrepancies []*shadowDiscrepancy
+}
+
+// shadowCompare crawls the installation with the v2 API and then the v3
+// API, comparing the apps each finds. Usage isn't compared, as it changes
+// between the crawls, but instance counts, quotas, states and buildpacks
+// should be the same.
+func shadowCompare(client *simpleClient, opts collectorOptions, summary *runSummary) (*shadowComparison, error) {
+	if opts.IncludeServices || len(opts.Labels) != 0 {
+		return nil, fmt.Errorf("--shadow-compare can't be used with --include-services or --group-by-label, as they need the v3 API")
+	}
+	reps := make(map[string]*usageReport)
+	for _, version := range []string{apiVersionV2, apiVersionV3} {
+		opts.APIVersion = version
+		col, err := newCollector(client, opts)
+		if err != nil {
+			return nil, err
+		}
+		col.summary = summary
+		rep, err := col.collect()
+		if err != nil {
+			return nil, fmt.Errorf("crawling with the %s API: %s", version, err)
+		}
+		reps[version] = rep
+	}
+	return compareShadow(reps[apiVersionV2], reps[apiVersionV3]), nil
+}
+
+// shadowApp is what is compared about each app
+type shadowApp struct {
+	row       *appUsageInfo
+	instances []string
+	buildpack string
+}
+
+// shadowApps returns the apps in rep, by key
+func shadowApps(rep *usageReport) map[string]*shadowApp {
+	apps := make(map[string]*shadowApp)
+	for _, row := range rep.Rows {
+		switch row.Level() {
+		case 3:
+			if apps[row.Key] == nil {
+				apps[row.Key] = &shadowApp{}
+			}
+			apps[row.Key].row = row
+		case 4:
+			i := strings.LastIndex(row.Key, "/")
+			app := apps[row.Key[:i]]
+			if app == nil {
+				app = &shadowApp{}
+				apps[row.Key[:i]] = app
+			}
+			app.instances = append(app.instances, row.Key[i+1:])
+			if row.Buildpack != "" {
+				app.buildpack = row.Buildpack
+			}
+		}
+	}
+	return apps
+}
+
+// leftOut returns true if key is, or is within, something left out of rep
+// due to errors, so can't be compared
+func leftOut(rep *usageReport, key string) bool {
+	for _, e := range rep.Errors {
+		if e.Key == "" || key == e.Key || strings.HasPrefix(key, e.Key+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// compareShadow compares the apps in a v2 and a v3 report
+func compareShadow(v2, v3 *usageReport) *shadowComparison {
+	sc := &shadowComparison{V2RunID: v2.RunID, V3RunID: v3.RunID}
+	v2Apps, v3Apps := shadowApps(v2), shadowApps(v3)
+	keys := make(map[string]bool)
+	for k := range v2Apps {
+		keys[k] = true
+	}
+	for k := range v3Apps {
+		keys[k] = true
+	}
+
+	differ := func(key, field, a, b string) {
+		if a != b {
+			sc.Discrepancies = append(sc.Discrepancies, &shadowDiscrepancy{Key: key, Field: field, V2: a, V3: b})
+		}
+	}
+	for k := range keys {
+		if leftOut(v2, k) || leftOut(v3, k) {
+			continue
+		}
+		sc.Apps++
+		a, b := v2Apps[k], v3Apps[k]
+		if a == nil || b == nil {
+			present := map[bool]string{true: "present", false: "missing"}
+			differ(k, "App", present[a != nil], present[b != nil])
+			continue
+		}
+		sort.Strings(a.instances)
+		sort.Strings(b.instances)
+		differ(k, "Instances", strings.Join(a.instances, ","), strings.Join(b.instances, ","))
+		differ(k, "MemoryQuota", strconv.Itoa(a.row.MemoryQuota), strconv.Itoa(b.row.MemoryQuota))
+		differ(k, "DiskQuota", strconv.Itoa(a.row.DiskQuota), strconv.Itoa(b.row.DiskQuota))
+		differ(k, "NotRunning", strconv.Itoa(a.row.NotRunning), strconv.Itoa(b.row.NotRunning))
+		// v3 only knows the buildpacks of apps pushed without one with
+		// --buildpacks
+		if a.buildpack != "" && b.buildpack != "" {
+			differ(k, "Buildpack", a.buildpack, b.buildpack)
+		}
+	}
+	sort.Slice(sc.Discrepancies, func(i, j int) bool {
+		if sc.Discrepancies[i].Key != sc.Discrepancies[j].Key {
+			return sc.Discrepancies[i].Key < sc.Discrepancies[j].Key
+		}
+		return sc.Discrepancies[i].Field < sc.Discrepancies[j].Field
+	})
+	if len(sc.Discrepancies) != 0 {
+		log.Printf("warning: the v2 and v3 reports disagree about %d things, of %d apps", len(sc.Discrepancies), sc.Apps)
+	}
+	return sc
+}
+
+// renderShadow writes the comparison as a table or JSON
+func renderShadow(out io.Writer, sc *shadowComparison, format string) error {
+	switch format {
+	case formatJSON:
+		return json.NewEncoder(out).Encode(sc)
+	case formatTable:
+		// handled below
+	default:
+		return fmt.Errorf("unknown format: %s", format)
+	}
+
+	if len(sc.Discrepancies) != 0 {
+		table := tablewriter.NewWriter(out)
+		table.SetHeader([]string{"Key", "Field", "v2", "v3"})
+		for _, d := range sc.Discrepancies {
+			table.Append([]string{"/" + d.Key, d.Field, d.V2, d.V3})
+		}
+		table.Render()
+	}
+	_, err := fmt.Fprintf(out, "%d discrepancies in %d apps, v2 run ID: %s, v3 run ID: %s\n", len(sc.Discrepancies), sc.Apps, sc.V2RunID, sc.V3RunID)
+	return err
+}
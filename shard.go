@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/govau/cf-report-memory-usage/report"
+)
+
+// reportShard is a deterministic share of the orgs in an installation, so
+// that several workers can each crawl part and their reports be merged. The
+// zero value is every org.
+type reportShard struct {
+	// Index is 1 based, ie "2/5" is the second of five
+	Index int
+	Count int
+}
+
+func (rs *reportShard) String() string {
+	if rs.Count == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d/%d", rs.Index, rs.Count)
+}
+
+// Set parses a shard such as "2/5"
+func (rs *reportShard) Set(s string) error {
+	bits := strings.SplitN(s, "/", 2)
+	if len(bits) != 2 {
+		return fmt.Errorf("invalid shard, expected INDEX/COUNT, ie 2/5: %s", s)
+	}
+	idx, err := strconv.Atoi(bits[0])
+	if err != nil {
+		return fmt.Errorf("invalid shard index: %s", s)
+	}
+	count, err := strconv.Atoi(bits[1])
+	if err != nil {
+		return fmt.Errorf("invalid shard count: %s", s)
+	}
+	if count < 1 || idx < 1 || idx > count {
+		return fmt.Errorf("invalid shard, index must be between 1 and count: %s", s)
+	}
+	rs.Index, rs.Count = idx, count
+	return nil
+}
+
+// contains returns true if org is in the shard. Orgs are assigned by a hash
+// of their GUID, so each worker gets the same orgs on every run.
+func (rs reportShard) contains(org *cfOrg) bool {
+	if rs.Count <= 1 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(org.GUID))
+	return int(h.Sum32()%uint32(rs.Count)) == rs.Index-1
+}
+
+// mergeReports combines the reports of several shards into one report for
+// the whole installation, with a new run ID and recalculated totals
+func mergeReports(reps []*usageReport) (*usageReport, error) {
+	if len(reps) == 0 {
+		return nil, errors.New("no reports to merge")
+	}
+	runID, err := newRunID()
+	if err != nil {
+		return nil, err
+	}
+
+	merged := &usageReport{RunID: runID}
+	seen := make(map[string]string)
+	// shards are the indexes merged of the shard count, which is 0 if a
+	// report wasn't of a shard
+	shards := make(map[int]bool)
+	shardCount := 0
+	var instances []*appUsageInfo
+	for i, rep := range reps {
+		if i == 0 {
+			merged.Tag = rep.Tag
+		} else if rep.Tag != merged.Tag {
+			return nil, fmt.Errorf("runs %s and %s have different tags, are they shards of the same crawl?", reps[0].RunID, rep.RunID)
+		}
+		// the crawl started when the first shard did
+		if !rep.Time.IsZero() && (merged.Time.IsZero() || rep.Time.Before(merged.Time)) {
+			merged.Time = rep.Time
+		}
+		merged.Skipped = append(merged.Skipped, rep.Skipped...)
+		merged.Errors = append(merged.Errors, rep.Errors...)
+		merged.Vanished = append(merged.Vanished, rep.Vanished...)
+		merged.Appeared = append(merged.Appeared, rep.Appeared...)
+		merged.Partial = merged.Partial || rep.Partial
+		var shard reportShard
+		if rep.Shard != "" && shard.Set(rep.Shard) == nil {
+			shards[shard.Index] = true
+		}
+		if i == 0 {
+			shardCount = shard.Count
+		} else if shard.Count != shardCount {
+			shardCount = -1
+		}
+		for org, limit := range rep.OrgMemoryLimits {
+			if merged.OrgMemoryLimits == nil {
+				merged.OrgMemoryLimits = make(map[string]int)
+			}
+			merged.OrgMemoryLimits[org] = limit
+		}
+		for space, limit := range rep.SpaceMemoryLimits {
+			if merged.SpaceMemoryLimits == nil {
+				merged.SpaceMemoryLimits = make(map[string]int)
+			}
+			merged.SpaceMemoryLimits[space] = limit
+		}
+		for _, row := range rep.Rows {
+			if strings.Count(row.Key, "/") != 3 {
+				continue
+			}
+			if other, ok := seen[row.Key]; ok {
+				return nil, fmt.Errorf("/%s is in runs %s and %s, are the shards overlapping?", row.Key, other, rep.RunID)
+			}
+			seen[row.Key] = rep.RunID
+			instance := *row
+			instance.RunID = runID
+			instances = append(instances, &instance)
+		}
+	}
+	if merged.Time.IsZero() {
+		merged.Time = time.Now()
+	}
+	if shardCount != 0 && len(shards) != shardCount {
+		// only some of the shards, so only some of the orgs
+		merged.Partial = true
+	}
+	sort.SliceStable(merged.Errors, func(i, j int) bool {
+		return merged.Errors[i].Key < merged.Errors[j].Key
+	})
+	merged.Rows = report.AddTotals(runID, instances)
+	return merged, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// checksumSuffix and signatureSuffix are appended to the path of a
+	// signed artifact to name its checksum and detached signature files
+	checksumSuffix  = ".sha256"
+	signatureSuffix = ".sig"
+)
+
+// artifactSigner writes a SHA-256 checksum and a detached signature next to
+// each report file, so that tampering can be detected later. Signatures
+// are compatible with openssl: Ed25519 keys sign the file itself, and RSA
+// (PKCS #1 v1.5) and ECDSA keys sign its SHA-256 digest.
+type artifactSigner struct {
+	Key   crypto.Signer
+	Quiet bool
+}
+
+// loadSigner reads a PEM encoded Ed25519, ECDSA or RSA private key
+func loadSigner(path string) (*artifactSigner, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM encoded key found", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported key type: %s", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: key can't be used for signing", path)
+	}
+	return &artifactSigner{Key: signer}, nil
+}
+
+// sign writes PATH.sha256, in the format of sha256sum, and PATH.sig for
+// the file at path
+func (as *artifactSigner) sign(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	err = writeFile(path+checksumSuffix, []byte(fmt.Sprintf("%x  %s\n", sum, filepath.Base(path))))
+	if err != nil {
+		return err
+	}
+
+	var sig []byte
+	if _, ok := as.Key.(ed25519.PrivateKey); ok {
+		sig, err = as.Key.Sign(rand.Reader, data, crypto.Hash(0))
+	} else {
+		sig, err = as.Key.Sign(rand.Reader, sum[:], crypto.SHA256)
+	}
+	if err != nil {
+		return err
+	}
+	err = writeFile(path+signatureSuffix, sig)
+	if err != nil {
+		return err
+	}
+
+	if !as.Quiet {
+		log.Printf("signed %s, sha256 %x", path, sum)
+	}
+	return nil
+}
+
+// loadPublicKey reads a PEM encoded public key, as written by
+// openssl pkey -pubout
+func loadPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("%s: no PEM encoded public key found", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return key, nil
+}
+
+// verifyArtifact checks the file at path against its checksum, if there is
+// one, and its detached signature
+func verifyArtifact(path string, key crypto.PublicKey) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+
+	checksum, err := ioutil.ReadFile(path + checksumSuffix)
+	switch {
+	case err == nil:
+		fields := strings.Fields(string(checksum))
+		if len(fields) == 0 || fields[0] != hex.EncodeToString(sum[:]) {
+			return fmt.Errorf("%s: does not match %s%s", path, path, checksumSuffix)
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	sig, err := ioutil.ReadFile(path + signatureSuffix)
+	if err != nil {
+		return err
+	}
+	ok := false
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(k, data, sig)
+	case *ecdsa.PublicKey:
+		ok = ecdsa.VerifyASN1(k, sum[:], sig)
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], sig) == nil
+	default:
+		return errors.New("unsupported public key type")
+	}
+	if !ok {
+		return fmt.Errorf("%s: signature is not valid", path)
+	}
+	return nil
+}
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sink is a destination for a completed report. A single crawl can be
+// written to any number of sinks.
+//
+// Deliveries may be retried, so sinks that append rather than replace must
+// be idempotent on (RunID, Key).
+type sink interface {
+	// Write delivers the report to the sink
+	Write(rep *usageReport) error
+
+	// String describes the sink for progress and error messages
+	String() string
+}
+
+// sinkKind is a kind of sink that can be given to --sink
+type sinkKind struct {
+	Name string
+
+	// Target describes what follows "kind:", ie "DIR", or is empty if the
+	// kind takes no target
+	Target string
+
+	// Help is a one line description, for "help SINKS"
+	Help string
+
+	// plaintext is set if what the sink sends must be readable by its
+	// receiver, so can't be encrypted with --encrypt-recipient
+	plaintext bool
+
+	create func(target string, opts sinkOptions) sink
+}
+
+// sinkKinds are every kind of sink, in the order they are listed in help
+var sinkKinds = []*sinkKind{
+	{
+		Name: "stdout",
+		Help: "rendered as a table, or as JSON, CSV, Prometheus metrics or HTML with --output-json, --output-csv, --output-prometheus or --output-html",
+		create: func(target string, opts sinkOptions) sink {
+			return &writerSink{Name: "stdout", Out: os.Stdout, Render: opts.Render}
+		},
+	},
+	{
+		Name:   "file",
+		Target: "PATH",
+		Help:   "rendered as for stdout, replacing the file",
+		create: func(target string, opts sinkOptions) sink {
+			return &fileSink{Path: target, Render: opts.Render, Quiet: opts.Quiet, Signer: opts.Signer, Encrypter: opts.Encrypter, Compressor: opts.Compressor}
+		},
+	},
+	{
+		Name:   "webhook",
+		Target: "URL",
+		Help:   "POSTs the JSON report",
+		create: func(target string, opts sinkOptions) sink {
+			return &webhookSink{URL: target, Client: http.DefaultClient, Encrypter: opts.Encrypter, Compressor: opts.Compressor}
+		},
+	},
+	{
+		Name:      "pushgateway",
+		Target:    "URL",
+		Help:      "PUTs per-instance metrics in Prometheus text format",
+		plaintext: true,
+		create: func(target string, opts sinkOptions) sink {
+			return &pushgatewaySink{URL: strings.TrimSuffix(target, "/"), Client: http.DefaultClient}
+		},
+	},
+	{
+		Name:   "s3",
+		Target: "URL",
+		Help:   "PUTs each JSON report as its own object to an S3-compatible bucket, ie https://s3.REGION.amazonaws.com/BUCKET/PREFIX, with AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_REGION",
+		create: func(target string, opts sinkOptions) sink {
+			return &s3Sink{URL: target, Client: http.DefaultClient, Encrypter: opts.Encrypter, Compressor: opts.Compressor}
+		},
+	},
+	{
+		Name:   "audit",
+		Target: "URL",
+		Help:   "PUTs the instance rows of each run as JSON lines to a new object, partitioned by date, ie BUCKET/PREFIX/2024/01/01/, in an S3-compatible bucket, never replacing objects, as for s3",
+		create: func(target string, opts sinkOptions) sink {
+			return &auditSink{URL: target, Client: http.DefaultClient, Encrypter: opts.Encrypter, Compressor: opts.Compressor}
+		},
+	},
+	{
+		Name:      "influxdb",
+		Target:    "URL",
+		Help:      "POSTs per-instance points in line protocol to a write URL, ie http://influxdb:8086/api/v2/write?org=ORG&bucket=BUCKET, with INFLUX_TOKEN",
+		plaintext: true,
+		create: func(target string, opts sinkOptions) sink {
+			return &influxSink{URL: target, Client: http.DefaultClient}
+		},
+	},
+	{
+		Name:   "history",
+		Target: "DIR",
+		Help:   "keeps every run in a directory for later comparison, compacted and expired as per --compact-after and --retain",
+		create: func(target string, opts sinkOptions) sink {
+			return &historyStore{
+				Dir:          target,
+				Retain:       opts.Retain,
+				CompactAfter: opts.CompactAfter,
+				Quiet:        opts.Quiet,
+			}
+		},
+	},
+	{
+		Name:   "snapshot",
+		Target: "DIR",
+		Help:   "writes every run to its own timestamped JSON file in a directory, never expired",
+		create: func(target string, opts sinkOptions) sink {
+			return &snapshotSink{Dir: target, Quiet: opts.Quiet, Signer: opts.Signer, Encrypter: opts.Encrypter, Compressor: opts.Compressor}
+		},
+	},
+}
+
+// parseSink creates a sink from a spec of the form "kind:target", ie:
+//
+//	stdout
+//	file:/path/to/report.json
+//	webhook:https://example.com/hook
+//	pushgateway:http://pushgateway:9091
+//	s3:https://s3.ap-southeast-2.amazonaws.com/bucket/prefix
+//	audit:https://s3.ap-southeast-2.amazonaws.com/bucket/prefix
+//	influxdb:http://influxdb:8086/api/v2/write?org=org&bucket=bucket
+//	history:/path/to/history
+//	snapshot:/path/to/snapshots
+func parseSink(spec string, opts sinkOptions) (sink, error) {
+	if spec == "-" {
+		spec = "stdout"
+	}
+
+	bits := strings.SplitN(spec, ":", 2)
+	for _, sk := range sinkKinds {
+		if sk.Name != bits[0] {
+			continue
+		}
+		target := ""
+		if len(bits) == 2 {
+			target = bits[1]
+		}
+		if sk.Target == "" && len(bits) == 2 {
+			return nil, fmt.Errorf("invalid sink, %s takes no target: %s", sk.Name, spec)
+		}
+		if sk.Target != "" && target == "" {
+			return nil, fmt.Errorf("invalid sink, expected %s:%s: %s", sk.Name, sk.Target, spec)
+		}
+		if sk.plaintext && opts.Encrypter != nil {
+			return nil, fmt.Errorf("%s sinks can't be encrypted, so would send the report in the clear despite --encrypt-recipient: %s", sk.Name, spec)
+		}
+		return sk.create(target, opts), nil
+	}
+	if len(bits) != 2 || bits[1] == "" {
+		return nil, fmt.Errorf("invalid sink, expected kind:target: %s", spec)
+	}
+	return nil, fmt.Errorf("unknown sink kind: %s", bits[0])
+}
+
+// parseSinks parses each spec, as per parseSink
+func parseSinks(specs []string, opts sinkOptions) ([]sink, error) {
+	var sinks []sink
+	for _, spec := range specs {
+		s, err := parseSink(spec, opts)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	return sinks, nil
+}
+
+// sinkOptions are settings used when creating sinks from specs
+type sinkOptions struct {
+	// Render is used by sinks that have no fixed format of their own (stdout and file)
+	Render renderOptions
+
+	// Quiet suppresses progress messages
+	Quiet bool
+
+	// Retain is how long history is kept for, or 0 for forever
+	Retain time.Duration
+
+	// CompactAfter is the age at which history samples are downsampled
+	CompactAfter time.Duration
+
+	// Signer, if set, signs the files written by file and snapshot sinks
+	Signer *artifactSigner
+
+	// Encrypter, if set, encrypts the files written by file and snapshot
+	// sinks, and what webhook, s3 and audit sinks send
+	Encrypter *reportEncrypter
+
+	// Compressor, if set, compresses the files written by file and snapshot
+	// sinks, and what webhook, s3 and audit sinks send, before any encryption
+	Compressor *reportCompressor
+}
+
+// upload is the body of a request sent by a sink, compressed and encrypted
+// as a file would be
+type upload struct {
+	Data []byte
+
+	// Suffix is appended to the name of the object, if named
+	Suffix string
+
+	// ContentType and Encoding are sent as the Content-Type and
+	// Content-Encoding. Encrypted data is opaque to the receiver, so is sent
+	// as application/octet-stream, with no encoding, whether compressed
+	// within or not.
+	ContentType string
+	Encoding    string
+}
+
+// encodeUpload compresses, then encrypts, data of contentType, as per
+// compressor and encrypter, either of which may be nil
+func encodeUpload(data []byte, contentType string, compressor *reportCompressor, encrypter *reportEncrypter) (*upload, error) {
+	up := &upload{Data: data, ContentType: contentType}
+	var err error
+	if compressor != nil {
+		up.Data, err = compressor.compress(up.Data)
+		if err != nil {
+			return nil, err
+		}
+		up.Suffix += compressor.suffix()
+		up.Encoding = compressor.Algorithm
+	}
+	if encrypter != nil {
+		up.Data, err = encrypter.encrypt(up.Data, false)
+		if err != nil {
+			return nil, err
+		}
+		up.Suffix += encrypter.suffix()
+		up.ContentType, up.Encoding = "application/octet-stream", ""
+	}
+	return up, nil
+}
+
+// writeSinks writes the rows to every sink, continuing past failures so that
+// one broken destination doesn't starve the others
+func writeSinks(sinks []sink, rep *usageReport) error {
+	var failed []string
+	for _, s := range sinks {
+		err := s.Write(rep)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", s, err))
+		}
+	}
+	if len(failed) != 0 {
+		return fmt.Errorf("error writing to sinks: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// sinkFlags collects repeated --sink flags
+type sinkFlags []string
+
+func (sf *sinkFlags) String() string {
+	return strings.Join(*sf, ",")
+}
+
+func (sf *sinkFlags) Set(s string) error {
+	*sf = append(*sf, s)
+	return nil
+}
+
+// writerSink renders the report to an io.Writer
+type writerSink struct {
+	Name   string
+	Out    io.Writer
+	Render renderOptions
+
+	// Clear, if set, clears the terminal before each report, for --watch
+	Clear bool
+}
+
+func (ws *writerSink) Write(rep *usageReport) error {
+	if ws.Clear {
+		_, err := io.WriteString(ws.Out, "\033[H\033[2J")
+		if err != nil {
+			return err
+		}
+	}
+	return renderReport(ws.Out, rep, ws.Render)
+}
+
+func (ws *writerSink) String() string {
+	return ws.Name
+}
+
+// fileSink renders the report to a file, replacing any previous contents.
+// The path is used as given, even if the file is compressed or encrypted.
+type fileSink struct {
+	Path       string
+	Render     renderOptions
+	Quiet      bool
+	Signer     *artifactSigner
+	Encrypter  *reportEncrypter
+	Compressor *reportCompressor
+}
+
+func (fs *fileSink) Write(rep *usageReport) error {
+	buf := &bytes.Buffer{}
+	err := renderReport(buf, rep, fs.Render)
+	if err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	if fs.Compressor != nil {
+		data, err = fs.Compressor.compress(data)
+		if err != nil {
+			return err
+		}
+	}
+	if fs.Encrypter != nil {
+		data, err = fs.Encrypter.encrypt(data, false)
+		if err != nil {
+			return err
+		}
+	}
+	err = writeFile(fs.Path, data)
+	if err != nil {
+		return err
+	}
+
+	if !fs.Quiet {
+		log.Printf("report written to %s", fs.Path)
+	}
+	if fs.Signer != nil {
+		return fs.Signer.sign(fs.Path)
+	}
+	return nil
+}
+
+func (fs *fileSink) String() string {
+	return "file:" + fs.Path
+}
+
+// snapshotSink keeps each run as a timestamped JSON file in a directory, for
+// comparing with --diff. Unlike a history sink nothing is compacted or
+// expired, so every snapshot remains comparable.
+type snapshotSink struct {
+	Dir        string
+	Quiet      bool
+	Signer     *artifactSigner
+	Encrypter  *reportEncrypter
+	Compressor *reportCompressor
+}
+
+func (ss *snapshotSink) Write(rep *usageReport) error {
+	err := os.MkdirAll(ss.Dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	// named as history samples are, so that files sort by time
+	path := filepath.Join(ss.Dir, rep.Time.UTC().Format(sampleTimeFormat)+"-"+rep.RunID+".json")
+	if ss.Compressor != nil {
+		path += ss.Compressor.suffix()
+	}
+	if ss.Encrypter != nil {
+		path += ss.Encrypter.suffix()
+	}
+	if ss.Compressor != nil || ss.Encrypter != nil {
+		err = ss.writeEncoded(path, rep)
+	} else {
+		err = writeJSONFile(path, rep)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !ss.Quiet {
+		log.Printf("snapshot written to %s", path)
+	}
+	if ss.Signer != nil {
+		return ss.Signer.sign(path)
+	}
+	return nil
+}
+
+// writeEncoded writes the report as compressed and/or encrypted JSON. As
+// encrypted files can no longer be read by --diff, they are named so as not
+// to be listed by paths, while compressed ones are read as they are.
+func (ss *snapshotSink) writeEncoded(path string, rep *usageReport) error {
+	data, err := json.Marshal(rep)
+	if err != nil {
+		return err
+	}
+	if ss.Compressor != nil {
+		data, err = ss.Compressor.compress(data)
+		if err != nil {
+			return err
+		}
+	}
+	if ss.Encrypter != nil {
+		data, err = ss.Encrypter.encrypt(data, false)
+		if err != nil {
+			return err
+		}
+	}
+	return writeFile(path, data)
+}
+
+func (ss *snapshotSink) String() string {
+	return "snapshot:" + ss.Dir
+}
+
+// paths returns the paths of all snapshots, compressed or not, oldest first
+func (ss *snapshotSink) paths() ([]string, error) {
+	var paths []string
+	for _, suffix := range []string{"", compressionSuffixes[compressGzip], compressionSuffixes[compressZstd]} {
+		matches, err := filepath.Glob(filepath.Join(ss.Dir, "*.json"+suffix))
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, matches...)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// webhookSink POSTs the report as JSON, with a Content-Encoding if
+// compressed, or encrypted, as per encodeUpload
+type webhookSink struct {
+	URL        string
+	Client     *http.Client
+	Encrypter  *reportEncrypter
+	Compressor *reportCompressor
+}
+
+func (ws *webhookSink) Write(rep *usageReport) error {
+	data, err := json.Marshal(rep.Rows)
+	if err != nil {
+		return err
+	}
+	up, err := encodeUpload(data, "application/json", ws.Compressor, ws.Encrypter)
+	if err != nil {
+		return err
+	}
+	return doSinkRequest(ws.Client, http.MethodPost, ws.URL, up.ContentType, up.Encoding, rep.RunID, bytes.NewReader(up.Data))
+}
+
+func (ws *webhookSink) String() string {
+	return "webhook:" + ws.URL
+}
+
+// pushgatewaySink pushes per-instance metrics to a Prometheus Pushgateway.
+// It uses PUT so that instances that no longer exist are removed.
+type pushgatewaySink struct {
+	URL    string
+	Client *http.Client
+}
+
+func (ps *pushgatewaySink) Write(rep *usageReport) error {
+	body := &bytes.Buffer{}
+	err := writePrometheus(body, rep)
+	if err != nil {
+		return err
+	}
+	return doSinkRequest(ps.Client, http.MethodPut, ps.URL+"/metrics/job/report_memory_usage", "text/plain; version=0.0.4", "", rep.RunID, body)
+}
+
+func (ps *pushgatewaySink) String() string {
+	return "pushgateway:" + ps.URL
+}
+
+// doSinkRequest sends body to url, as per newSinkRequest
+func doSinkRequest(client *http.Client, method, url, contentType, encoding, runID string, body io.Reader) error {
+	req, err := newSinkRequest(method, url, contentType, encoding, runID, body)
+	if err != nil {
+		return err
+	}
+	return sendSinkRequest(client, req)
+}
+
+// newSinkRequest returns a request sending body to url, with a
+// Content-Encoding if encoding is set. The run ID is sent as the
+// Idempotency-Key so that receivers can discard duplicate deliveries.
+func newSinkRequest(method, url, contentType, encoding, runID string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	req.Header.Set("Idempotency-Key", runID)
+	return req, nil
+}
+
+// sendSinkRequest sends req, failing unless the status is 2xx
+func sendSinkRequest(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("bad status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// promLabelEscaper escapes label values per the exposition format
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writePrometheus writes per-instance usage and quota in the Prometheus
+// text exposition format. Aggregate rows are left out as they can be
+// derived with sum() and would otherwise be double counted. If the run is
+// tagged, every series has a tag label.
+func writePrometheus(out io.Writer, rep *usageReport) error {
+	tagLabel := ""
+	if rep.Tag != "" {
+		tagLabel = ",tag=\"" + promLabelEscaper.Replace(rep.Tag) + "\""
+	}
+	_, err := fmt.Fprintf(out, "# HELP cf_report_memory_usage_run_info Identifies the run that produced these metrics\n# TYPE cf_report_memory_usage_run_info gauge\ncf_report_memory_usage_run_info{run_id=\"%s\"%s} 1\n", rep.RunID, tagLabel)
+	if err != nil {
+		return err
+	}
+
+	var instances []*appUsageInfo
+	for _, info := range rep.Rows {
+		if strings.Count(info.Key, "/") == 3 {
+			instances = append(instances, info)
+		}
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].Key < instances[j].Key
+	})
+
+	for _, m := range []struct {
+		Name, Help string
+		Value      func(*appUsageInfo) int
+	}{
+		{"cf_app_instance_memory_usage_bytes", "Memory used by the app instance", func(i *appUsageInfo) int { return i.MemoryUsage }},
+		{"cf_app_instance_memory_quota_bytes", "Memory quota of the app instance", func(i *appUsageInfo) int { return i.MemoryQuota }},
+		{"cf_app_instance_disk_usage_bytes", "Disk used by the app instance", func(i *appUsageInfo) int { return i.DiskUsage }},
+		{"cf_app_instance_disk_quota_bytes", "Disk quota of the app instance", func(i *appUsageInfo) int { return i.DiskQuota }},
+	} {
+		_, err = fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s gauge\n", m.Name, m.Help, m.Name)
+		if err != nil {
+			return err
+		}
+		for _, info := range instances {
+			bits := strings.Split(info.Key, "/")
+			_, err = fmt.Fprintf(out, "%s{org=\"%s\",space=\"%s\",app=\"%s\",instance=\"%s\"%s} %d\n", m.Name,
+				promLabelEscaper.Replace(bits[0]),
+				promLabelEscaper.Replace(bits[1]),
+				promLabelEscaper.Replace(bits[2]),
+				promLabelEscaper.Replace(bits[3]),
+				tagLabel,
+				m.Value(info))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// quotas are only present if collected, and unlimited quotas are left out
+	for _, m := range []struct {
+		Name, Help string
+		Limits     map[string]int
+	}{
+		{"cf_org_memory_limit_bytes", "Memory limit of the org's quota", rep.OrgMemoryLimits},
+		{"cf_space_memory_limit_bytes", "Memory limit of the space's own quota", rep.SpaceMemoryLimits},
+	} {
+		if len(m.Limits) == 0 {
+			continue
+		}
+		_, err = fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s gauge\n", m.Name, m.Help, m.Name)
+		if err != nil {
+			return err
+		}
+		var keys []string
+		for key := range m.Limits {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if m.Limits[key] < 0 {
+				continue
+			}
+			bits := strings.Split(key, "/")
+			labels := fmt.Sprintf("org=\"%s\"", promLabelEscaper.Replace(bits[0]))
+			if len(bits) == 2 {
+				labels += fmt.Sprintf(",space=\"%s\"", promLabelEscaper.Replace(bits[1]))
+			}
+			labels += tagLabel
+			_, err = fmt.Fprintf(out, "%s{%s} %d\n", m.Name, labels, m.Limits[key])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSinkRefusesPlaintextWhenEncrypting(t *testing.T) {
+	opts := sinkOptions{Encrypter: &reportEncrypter{Recipients: []string{"ops@example.com"}}}
+	for _, spec := range []string{"pushgateway:http://pushgateway:9091", "influxdb:http://influxdb:8086/write?db=cf"} {
+		_, err := parseSink(spec, opts)
+		if err == nil || !strings.Contains(err.Error(), "in the clear") {
+			t.Errorf("%s: got %v, want it refused", spec, err)
+		}
+	}
+	for _, spec := range []string{"webhook:https://example.com/hook", "s3:https://s3.amazonaws.com/bucket", "audit:https://s3.amazonaws.com/bucket"} {
+		_, err := parseSink(spec, opts)
+		if err != nil {
+			t.Errorf("%s: got %v, want it encrypted", spec, err)
+		}
+	}
+}
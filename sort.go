@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	sortUsage   = "usage"
+	sortQuota   = "quota"
+	sortPercent = "percent"
+	sortKey     = "key"
+)
+
+// rowSort is the order to show rows in, parsed from "FIELD[:asc|desc]". The
+// zero value leaves rows in report order, except in tables, which are
+// sorted by quota, largest first.
+type rowSort struct {
+	Field string
+	Desc  bool
+}
+
+func (rs *rowSort) String() string {
+	if rs.Field == "" {
+		return ""
+	}
+	if rs.Desc {
+		return rs.Field + ":desc"
+	}
+	return rs.Field + ":asc"
+}
+
+// Set parses a sort such as "percent" or "key:desc". Keys are ascending by
+// default, and sizes descending.
+func (rs *rowSort) Set(s string) error {
+	bits := strings.SplitN(s, ":", 2)
+	switch bits[0] {
+	case sortUsage, sortQuota, sortPercent:
+		rs.Desc = true
+	case sortKey:
+		rs.Desc = false
+	default:
+		return fmt.Errorf("unknown sort, expected usage, quota, percent or key: %s", s)
+	}
+	rs.Field = bits[0]
+	if len(bits) == 2 {
+		switch bits[1] {
+		case "asc":
+			rs.Desc = false
+		case "desc":
+			rs.Desc = true
+		default:
+			return fmt.Errorf("unknown sort direction, expected asc or desc: %s", s)
+		}
+	}
+	return nil
+}
+
+// UnmarshalJSON parses a sort string
+func (rs *rowSort) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+	return rs.Set(s)
+}
+
+// apply sorts rows in place. Sizes are memory, or disk if metric is "disk".
+// Ties are broken by key, so the order is the same on every run.
+func (rs rowSort) apply(rows []*groupedRow, metric string) {
+	usage := func(row *groupedRow) (int, int) {
+		if metric == metricDisk {
+			return row.DiskUsage, row.DiskQuota
+		}
+		return row.MemoryUsage, row.MemoryQuota
+	}
+	compare := func(a, b *groupedRow) int {
+		ua, qa := usage(a)
+		ub, qb := usage(b)
+		switch rs.Field {
+		case sortUsage:
+			return ua - ub
+		case sortQuota:
+			return qa - qb
+		case sortPercent:
+			// without a quota there is no percentage, so sort those first
+			pa, pb := -1.0, -1.0
+			if qa != 0 {
+				pa = float64(ua) / float64(qa)
+			}
+			if qb != 0 {
+				pb = float64(ub) / float64(qb)
+			}
+			switch {
+			case pa < pb:
+				return -1
+			case pa > pb:
+				return 1
+			}
+		}
+		return 0
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		c := compare(rows[i], rows[j])
+		if c == 0 {
+			c = strings.Compare(rows[i].Key, rows[j].Key)
+			if rs.Field != sortKey {
+				// ties are always by key ascending
+				return c < 0
+			}
+		}
+		if rs.Desc {
+			return c > 0
+		}
+		return c < 0
+	})
+}
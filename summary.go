@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// runSummary collects what happened during a run, so that it can end with
+// a single line on stderr that is easy to find and parse in cron logs, ie:
+//
+//	summary: status=0 duration=12.3s reports=1 rows=1210 instances=1000 apps=150 skipped=0 vanished=0 appeared=0 memory_usage=1073741824 memory_quota=2147483648 warnings=1 errors=0 tag=loadtest
+//
+// Sizes are in bytes, and describe the last report collected, and tag is
+// only there if the report has one. It is used as the log output, to count
+// the warnings and errors logged.
+type runSummary struct {
+	started time.Time
+
+	mu       sync.Mutex
+	reports  int
+	last     *usageReport
+	warnings int
+	errors   int
+}
+
+// newRunSummary starts summarising a run, logging through it
+func newRunSummary() *runSummary {
+	rs := &runSummary{started: time.Now()}
+	log.SetOutput(rs)
+	return rs
+}
+
+// Write passes log output to stderr, counting warnings and errors: entries
+// whose message, after the timestamp, starts with "warning: " or "error: ".
+// Each call is a single log entry.
+func (rs *runSummary) Write(p []byte) (int, error) {
+	msg := logMessage(p)
+	rs.mu.Lock()
+	if bytes.HasPrefix(msg, []byte("warning: ")) {
+		rs.warnings++
+	}
+	if bytes.HasPrefix(msg, []byte("error: ")) {
+		rs.errors++
+	}
+	rs.mu.Unlock()
+	return os.Stderr.Write(p)
+}
+
+// logMessage returns the message of a log entry, without the date and time
+// the standard logger starts it with
+func logMessage(p []byte) []byte {
+	fields := 0
+	if log.Flags()&log.Ldate != 0 {
+		fields++
+	}
+	if log.Flags()&(log.Ltime|log.Lmicroseconds) != 0 {
+		fields++
+	}
+	bits := bytes.SplitN(p, []byte(" "), fields+1)
+	return bits[len(bits)-1]
+}
+
+// record notes a report that was collected or merged. It does nothing if
+// rs is nil, so that collectors needn't have a summary.
+func (rs *runSummary) record(rep *usageReport) {
+	if rs == nil {
+		return
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.reports++
+	rs.last = rep
+}
+
+// line returns the summary of the run, ending with status
+func (rs *runSummary) line(status int) string {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	var rows, instances, apps, skipped, vanished, appeared, usage, quota int
+	tag := ""
+	if rs.last != nil {
+		if rs.last.Tag != "" {
+			tag = " tag=" + rs.last.Tag
+		}
+		rows = len(rs.last.Rows)
+		skipped = len(rs.last.Skipped)
+		vanished = len(rs.last.Vanished)
+		appeared = len(rs.last.Appeared)
+		for _, row := range rs.last.Rows {
+			switch row.Level() {
+			case 0:
+				usage, quota = row.MemoryUsage, row.MemoryQuota
+			case 3:
+				apps++
+			case 4:
+				instances++
+			}
+		}
+	}
+	return fmt.Sprintf("summary: status=%d duration=%s reports=%d rows=%d instances=%d apps=%d skipped=%d vanished=%d appeared=%d memory_usage=%d memory_quota=%d warnings=%d errors=%d%s",
+		status, time.Since(rs.started).Round(time.Millisecond), rs.reports, rows, instances, apps, skipped, vanished, appeared, usage, quota, rs.warnings, rs.errors, tag)
+}
+
+// exit logs the summary and exits with status
+func (rs *runSummary) exit(status int) {
+	log.Print(rs.line(status))
+	os.Exit(status)
+}
+
+// exitIfIncomplete exits with exitPartialData if rep is incomplete, so
+// that modes which render the crawl their own way fail as a report would
+func (rs *runSummary) exitIfIncomplete(rep *usageReport) {
+	if rep.Incomplete() {
+		rs.exit(exitPartialData)
+	}
+}
+
+// fatal logs v as log.Print does, as an error, then exits with status 1
+func (rs *runSummary) fatal(v ...interface{}) {
+	log.Print("error: " + fmt.Sprint(v...))
+	rs.exit(1)
+}
+
+// fatalf logs as log.Printf does, as an error, then exits with status 1
+func (rs *runSummary) fatalf(format string, v ...interface{}) {
+	log.Printf("error: "+format, v...)
+	rs.exit(1)
+}
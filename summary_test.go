@@ -0,0 +1,24 @@
+package main
+
+import (
+	"log"
+	"testing"
+)
+
+func TestRunSummaryCountsByPrefix(t *testing.T) {
+	if log.Flags() != log.LstdFlags {
+		t.Fatalf("got log flags %d, want the standard ones", log.Flags())
+	}
+	rs := &runSummary{}
+	// the retry wraps a body mentioning an error, but is only a warning
+	for _, entry := range []string{
+		"2018/06/01 02:00:14 warning: GET /v3/apps: 502 Bad Gateway: error: upstream failed, retrying in 1s\n",
+		"2018/06/01 02:00:15 error: crawl failed: 401 Unauthorized\n",
+		"2018/06/01 02:00:16 fetched the stats of 2 apps, no error: none\n",
+	} {
+		rs.Write([]byte(entry))
+	}
+	if rs.warnings != 1 || rs.errors != 1 {
+		t.Errorf("got %d warnings and %d errors, want 1 of each", rs.warnings, rs.errors)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// allOrgs in a tenant's orgs gives it the whole report, and /metrics
+const allOrgs = "*"
+
+// tenantKeyPrefix starts every issued key, so that leaked keys are easy to
+// recognise, ie by secret scanners
+const tenantKeyPrefix = "crmu_"
+
+// tenantKey lets the holder of a key read the part of the report covering
+// some orgs. Only the key's hash is kept.
+type tenantKey struct {
+	Name      string    `json:"name"`
+	Orgs      []string  `json:"orgs"`
+	KeySHA256 string    `json:"key_sha256"`
+	Issued    time.Time `json:"issued"`
+}
+
+// tenantKeysFile is the file of keys given with --tenant-keys
+type tenantKeysFile struct {
+	Tenants []*tenantKey `json:"tenants"`
+}
+
+// tenantKeys authenticates requests to the server against the keys in
+// Path, which is re-read whenever it changes, so that keys can be issued
+// and revoked without a restart
+type tenantKeys struct {
+	Path string
+
+	mu      sync.Mutex
+	keys    []*tenantKey
+	modTime time.Time
+}
+
+// load re-reads the keys if the file has changed
+func (tk *tenantKeys) load() ([]*tenantKey, error) {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+	fi, err := os.Stat(tk.Path)
+	if err != nil {
+		return nil, err
+	}
+	if tk.keys != nil && fi.ModTime().Equal(tk.modTime) {
+		return tk.keys, nil
+	}
+	var f tenantKeysFile
+	err = readJSONFile(tk.Path, &f)
+	if err != nil {
+		return nil, err
+	}
+	tk.keys, tk.modTime = f.Tenants, fi.ModTime()
+	if tk.keys == nil {
+		tk.keys = []*tenantKey{}
+	}
+	return tk.keys, nil
+}
+
+// authenticate returns the tenant whose key the request has as a bearer
+// token, or nil if it has none or an unknown one
+func (tk *tenantKeys) authenticate(r *http.Request) (*tenantKey, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, nil
+	}
+	keys, err := tk.load()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(strings.TrimPrefix(auth, "Bearer ")))
+	presented := []byte(hex.EncodeToString(sum[:]))
+	for _, key := range keys {
+		if subtle.ConstantTimeCompare(presented, []byte(key.KeySHA256)) == 1 {
+			return key, nil
+		}
+	}
+	return nil, nil
+}
+
+// all returns true if the tenant can read every org
+func (key *tenantKey) all() bool {
+	for _, org := range key.Orgs {
+		if org == allOrgs {
+			return true
+		}
+	}
+	return false
+}
+
+// scope returns the part of rep covering the tenant's orgs, with totals
+// recalculated, and without the errors, skipped apps and quotas of other
+// orgs, so that a tenant can't learn what other orgs there are
+func (key *tenantKey) scope(rep *usageReport) *usageReport {
+	if key.all() {
+		return rep
+	}
+	orgs := make(map[string]bool)
+	for _, org := range key.Orgs {
+		orgs[noSlash(org)] = true
+	}
+	inOrgs := func(k string) bool {
+		return orgs[strings.SplitN(k, "/", 2)[0]]
+	}
+	return within(rep, inOrgs)
+}
+
+// issueTenantKey adds a new key for orgs to the file at path, creating it
+// if need be, and returns the key, which isn't stored so can't be shown again
+func issueTenantKey(path, name string, orgs []string) (string, error) {
+	if len(orgs) == 0 {
+		return "", errors.New("a tenant key needs at least one org, or * for all of them")
+	}
+	var f tenantKeysFile
+	err := readJSONFile(path, &f)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if name == "" {
+		name = strings.Join(orgs, ",")
+	}
+	for _, key := range f.Tenants {
+		if key.Name == name {
+			return "", fmt.Errorf("%s: there is already a tenant called %s, revoke its key by removing it first", path, name)
+		}
+	}
+
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	secret := tenantKeyPrefix + hex.EncodeToString(b)
+	sum := sha256.Sum256([]byte(secret))
+	f.Tenants = append(f.Tenants, &tenantKey{
+		Name:      name,
+		Orgs:      orgs,
+		KeySHA256: hex.EncodeToString(sum[:]),
+		Issued:    time.Now().UTC(),
+	})
+	err = writeJSONFile(path, &f)
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}